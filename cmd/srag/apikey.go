@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var apikeyCmd = &cli.Command{
+	Name:  "apikey",
+	Usage: "Manage the API keys accepted by the server",
+	Commands: []*cli.Command{
+		apikeyCreateCmd,
+		apikeyListCmd,
+		apikeyRevokeCmd,
+	},
+}
+
+var apikeyCreateCmd = &cli.Command{
+	Name:  "create",
+	Usage: "Create an API key and print it once",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "name", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.IntFlag{
+			Name:  "rate-limit",
+			Usage: "requests per minute allowed with the key, 0 is unlimited",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		key, secret, err := r.CreateAPIKey(ctx, command.StringArg("name"), command.Int("rate-limit"))
+		if err != nil {
+			return err
+		}
+		log.Info().Uint64("id", key.ID).Str("name", key.Name).Msg("Created API key, store it now, it is not shown again")
+		fmt.Println(secret)
+		return nil
+	},
+}
+
+var apikeyListCmd = &cli.Command{
+	Name:  "list",
+	Usage: "List API keys",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		keys, err := r.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"ID", "Name", "Prefix", "Rate limit", "Created at", "Last used at", "Status"})
+		for _, key := range keys {
+			rateLimit := "unlimited"
+			if key.RateLimit > 0 {
+				rateLimit = fmt.Sprintf("%d/min", key.RateLimit)
+			}
+			lastUsed := "never"
+			if key.LastUsedAt != nil {
+				lastUsed = key.LastUsedAt.Format(time.DateTime)
+			}
+			state := "active"
+			if key.RevokedAt != nil {
+				state = "revoked " + key.RevokedAt.Format(time.DateTime)
+			}
+			tw.AppendRow(table.Row{key.ID, key.Name, key.Prefix + "...", rateLimit,
+				key.CreatedAt.Format(time.DateTime), lastUsed, state})
+		}
+		return printOutput(command.String("output"), tw, keys)
+	},
+}
+
+var apikeyRevokeCmd = &cli.Command{
+	Name:  "revoke",
+	Usage: "Reject further requests with an API key",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "id", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		id, err := strconv.ParseUint(command.StringArg("id"), 10, 64)
+		if err != nil {
+			return errors.Newf("invalid API key ID '%s'", command.StringArg("id"))
+		}
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		err = r.RevokeAPIKey(ctx, id)
+		if err != nil {
+			return err
+		}
+		log.Info().Uint64("id", id).Msg("Revoked API key")
+		return nil
+	},
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+func isArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".zip")
+}
+
+// walkArchive calls fn with the name, modification time and content of every regular file in a
+// .tar.gz or .zip archive, telling them apart by their first bytes.
+func walkArchive(data []byte, fn func(name string, modTime time.Time, data []byte)) error {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return walkTarGz(bytes.NewReader(data), fn)
+	case bytes.HasPrefix(data, zipMagic):
+		return walkZip(bytes.NewReader(data), int64(len(data)), fn)
+	default:
+		return errors.New("not a .tar.gz or .zip archive")
+	}
+}
+
+func walkTarGz(r io.Reader, fn func(name string, modTime time.Time, data []byte)) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = gz.Close() }()
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %s", h.Name)
+		}
+		fn(h.Name, h.ModTime, data)
+	}
+}
+
+func walkZip(r io.ReaderAt, size int64, fn func(name string, modTime time.Time, data []byte)) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open %s", f.Name)
+		}
+		data, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %s", f.Name)
+		}
+		fn(f.Name, f.Modified, data)
+	}
+	return nil
+}
@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/goccy/go-json"
 	"github.com/jedib0t/go-pretty/v6/table"
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
 	"golang.org/x/sync/errgroup"
 
@@ -25,15 +25,30 @@ var askCmd = &cli.Command{
 	},
 	Flags: []cli.Flag{
 		flagDSN,
+		flagServer,
+		flagAPIKey,
+		flagCollection,
+		flagFilter,
 		flagEmbeddingBaseURL,
 		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
 		flagRerankerBaseURL,
 		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
 		flagAssistantBaseURL,
 		flagAssistantModel,
 		&cli.IntFlag{Name: "limit", Value: 40},
 		&cli.IntFlag{Name: "top-n", Value: 10},
 		&cli.IntFlag{Name: "jobs", Value: 4},
+		flagNeighbors,
+		flagParentSection,
+		flagCompress,
+		flagRecencyHalfLife,
+		flagGraph,
+		flagSummaries,
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		query, err := getArgumentQuery(command)
@@ -42,31 +57,70 @@ var askCmd = &cli.Command{
 		}
 
 		dsn := command.String("dsn")
-		embeddingBaseURL := command.String("embedding-base-url")
-		embeddingModel := command.String("embedding-model")
-		rerankerBaseURL := command.String("reranker-base-url")
 		rerankerModel := command.String("reranker-model")
-		assistantBaseURL := command.String("assistant-base-url")
 		assistantModel := command.String("assistant-model")
-		limit := command.Int("limit")
-		topN := command.Int("top-n")
 		jobs := command.Int("jobs")
-
-		db, err := rag.OpenDB(dsn)
+		filter, err := parseFilter(command)
+		if err != nil {
+			return err
+		}
+		halfLife, err := rag.ParseHalfLife(command.String("recency-half-life"))
 		if err != nil {
 			return err
 		}
+		opts := &askOptions{
+			collection:    command.String("collection"),
+			filter:        filter,
+			limit:         command.Int("limit"),
+			topN:          command.Int("top-n"),
+			neighbors:     command.Int("neighbors"),
+			parentSection: command.Bool("parent-section"),
+			compress:      command.Bool("compress"),
+			halfLife:      halfLife,
+			graph:         command.Bool("graph"),
+			summaries:     command.Bool("summaries"),
+		}
 
-		embeddingClient := openai.NewClient(option.WithBaseURL(embeddingBaseURL))
-		assistantClient := openai.NewClient(option.WithBaseURL(assistantBaseURL))
-		r := rag.RAG{
-			DB:              db,
-			EmbeddingClient: &embeddingClient,
-			EmbeddingModel:  embeddingModel,
-			RerankerClient:  rag.NewInfinityClient(rerankerBaseURL),
-			RerankerModel:   rerankerModel,
-			AssistantClient: &assistantClient,
-			AssistantModel:  assistantModel,
+		var run func(ctx context.Context, query string) error
+		if client := newRemoteClient(command); client != nil {
+			defer func() { _ = client.Close() }()
+			run = func(ctx context.Context, query string) error {
+				return askRemote(ctx, client, query, opts)
+			}
+		} else {
+			db, err := rag.OpenDB(dsn)
+			if err != nil {
+				return err
+			}
+
+			embedder, err := newEmbedder(command, defaultEmbeddingRetries)
+			if err != nil {
+				return err
+			}
+			reranker, err := newReranker(command)
+			if err != nil {
+				return err
+			}
+			if reranker != nil {
+				defer func() { _ = reranker.Close() }()
+			}
+			assistantClient := newAssistantClient(command)
+			r := &rag.RAG{
+				DB:              db,
+				Embedder:        embedder,
+				Reranker:        reranker,
+				RerankerModel:   rerankerModel,
+				AssistantClient: &assistantClient,
+				AssistantModel:  assistantModel,
+			}
+			config, err := r.CurrentConfig(ctx)
+			if err != nil {
+				return err
+			}
+			r = r.WithConfig(config)
+			run = func(ctx context.Context, query string) error {
+				return ask(ctx, r, query, opts)
+			}
 		}
 
 		if strings.HasSuffix(query, ".ndjson") {
@@ -88,13 +142,13 @@ var askCmd = &cli.Command{
 					if err != nil {
 						return err
 					}
-					return ask(ctx, &r, item.Query, limit, topN)
+					return run(ctx, item.Query)
 				})
 			}
 			return g.Wait()
 		}
 
-		return ask(ctx, &r, query, limit, topN)
+		return run(ctx, query)
 	},
 }
 
@@ -102,30 +156,109 @@ type queryItem struct {
 	Query string `json:"query"`
 }
 
-func ask(ctx context.Context, r *rag.RAG, query string, limit int, topN int) error {
-	chunks, err := r.QueryDocumentChunks(ctx, query, limit)
+type askOptions struct {
+	collection    string
+	filter        *rag.Filter
+	limit         int
+	topN          int
+	neighbors     int
+	parentSection bool
+	compress      bool
+	halfLife      time.Duration
+	graph         bool
+	summaries     bool
+}
+
+func ask(ctx context.Context, r *rag.RAG, query string, opts *askOptions) error {
+	chunks, err := r.Search(ctx, &rag.SearchOptions{
+		Query:         query,
+		Collection:    opts.collection,
+		Filter:        opts.filter,
+		Limit:         opts.topN,
+		Mode:          rag.SearchModeDense,
+		Rerank:        true,
+		Candidates:    opts.limit,
+		Neighbors:     opts.neighbors,
+		ParentSection: opts.parentSection,
+		Compress:      opts.compress,
+
+		RecencyHalfLife: opts.halfLife,
+		Graph:           opts.graph,
+		Summaries:       opts.summaries,
+	})
 	if err != nil {
 		return err
 	}
 
-	chunks, err = r.Rerank(query, chunks, topN)
+	answer, err := r.Ask(ctx, query, chunks)
 	if err != nil {
 		return err
 	}
 
-	tw := table.NewWriter()
-	tw.AppendHeader(table.Row{"Chunk ID", "Document"})
-	for _, chunk := range chunks {
-		tw.AppendRow(table.Row{chunk.ID, chunk.Document})
-	}
-	fmt.Println(tw.Render())
+	printAnswer(answer, answer.Chunks)
+	return nil
+}
 
-	answer, err := r.Ask(ctx, query, chunks)
+func askRemote(ctx context.Context, client *rag.RemoteClient, query string, opts *askOptions) error {
+	rerank := true
+	p := &rag.ChatParam{SearchParam: rag.SearchParam{
+		Query:         query,
+		Mode:          string(rag.SearchModeDense),
+		Limit:         opts.topN,
+		Rerank:        &rerank,
+		Candidates:    opts.limit,
+		Neighbors:     opts.neighbors,
+		ParentSection: opts.parentSection,
+		Compress:      opts.compress,
+		Graph:         opts.graph,
+		Summaries:     opts.summaries,
+	}}
+	if opts.halfLife > 0 {
+		p.RecencyHalfLife = opts.halfLife.String()
+	}
+	if opts.filter != nil {
+		p.Filter = opts.filter.String()
+	}
+	result, err := client.Chat(ctx, opts.collection, p, nil)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("The answer is:")
-	fmt.Println(answer)
+	chunks := make([]rag.DocumentChunk, len(result.Sources))
+	for i, source := range result.Sources {
+		chunks[i] = rag.DocumentChunk{ID: source.ChunkID, Document: source.Document, RawDocument: source.RawDocument}
+	}
+	printAnswer(&rag.Answer{
+		Text:          result.Answer,
+		Citations:     result.Citations,
+		ConfigVersion: result.ConfigVersion,
+		Usage:         result.Usage,
+	}, chunks)
 	return nil
 }
+
+func printAnswer(answer *rag.Answer, chunks []rag.DocumentChunk) {
+	fmt.Println(answer.Text)
+	fmt.Println()
+	log.Info().Int64("config_version", answer.ConfigVersion).Int("prompt_tokens", answer.Usage.PromptTokens).
+		Int("context_tokens", answer.Usage.ContextTokens).Int("completion_tokens", answer.Usage.CompletionTokens).
+		Msg("Answered")
+	printSources(answer, chunks)
+}
+
+// printSources lists the citations of answer, or the chunks it was given
+// when it cites none.
+func printSources(answer *rag.Answer, chunks []rag.DocumentChunk) {
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"#", "Source", "Chunk ID"})
+	if len(answer.Citations) > 0 {
+		for _, c := range answer.Citations {
+			tw.AppendRow(table.Row{c.Index, c.RawDocument, c.ChunkID})
+		}
+	} else {
+		for i, chunk := range chunks {
+			tw.AppendRow(table.Row{i + 1, chunk.RawDocument, chunk.ID})
+		}
+	}
+	fmt.Println(tw.Render())
+}
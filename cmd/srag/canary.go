@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var canaryCmd = &cli.Command{
+	Name:  "canary",
+	Usage: "Serve a configuration version to part of the traffic and compare it with the current one",
+	Commands: []*cli.Command{
+		canaryStartCmd,
+		canaryStatusCmd,
+		canaryPromoteCmd,
+		canaryStopCmd,
+	},
+}
+
+var canaryStartCmd = &cli.Command{
+	Name:  "start",
+	Usage: "Start serving a configuration version to a percentage of search and chat requests",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "version", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.IntFlag{
+			Name:  "percent",
+			Usage: "share of requests served by the canary",
+			Value: 10,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		version, err := parseConfigVersion(command.StringArg("version"))
+		if err != nil {
+			return err
+		}
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		c, err := r.StartCanary(ctx, version, command.Int("percent"))
+		if err != nil {
+			return err
+		}
+		log.Info().Int64("version", c.Version).Int("percent", c.Percent).Msg("Started canary")
+		return nil
+	},
+}
+
+var canaryStatusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "Compare quality and latency of the control and canary arms",
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		report, err := r.ReportCanary(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Canary version %d serving %d%% since %s\n", report.Canary.Version, report.Canary.Percent,
+			report.Canary.StartedAt.Format(time.DateTime))
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Arm", "Version", "Requests", "Errors", "p50 ms", "p95 ms",
+			"Avg results", "Empty", "Avg citations", "Feedback", "Helpful"})
+		for _, a := range report.Arms {
+			tw.AppendRow(table.Row{
+				a.Arm, a.ConfigVersion, a.Requests, percent(a.ErrorRate),
+				fmt.Sprintf("%.1f", a.P50LatencyMS), fmt.Sprintf("%.1f", a.P95LatencyMS),
+				fmt.Sprintf("%.2f", a.AvgResults), percent(a.EmptyRate),
+				fmt.Sprintf("%.2f", a.AvgCitations), a.Feedback, percent(a.HelpfulRate),
+			})
+		}
+		fmt.Println(tw.Render())
+		return nil
+	},
+}
+
+func percent(v float64) string {
+	return fmt.Sprintf("%.1f%%", v*100)
+}
+
+var canaryPromoteCmd = &cli.Command{
+	Name:  "promote",
+	Usage: "Make the canary's configuration current for all traffic",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagAuthor,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		v, err := r.PromoteCanary(ctx, command.String("author"))
+		if err != nil {
+			return err
+		}
+		log.Info().Int64("version", v.Version).Msg("Promoted canary")
+		return nil
+	},
+}
+
+var canaryStopCmd = &cli.Command{
+	Name:  "stop",
+	Usage: "Stop the canary, serving the current configuration to all traffic",
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		return r.StopCanary(ctx)
+	},
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var collectionCmd = &cli.Command{
+	Name:  "collection",
+	Usage: "Manage collections of documents",
+	Commands: []*cli.Command{
+		collectionListCmd,
+		collectionSetCmd,
+	},
+}
+
+var collectionListCmd = &cli.Command{
+	Name:  "list",
+	Usage: "List collections with their document and chunk counts",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		collections, err := r.ListCollections(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Name", "Analyzer", "Distance", "Documents", "Chunks", "Created at"})
+		for _, c := range collections {
+			tw.AppendRow(table.Row{c.Name, c.TextSearchConfig, c.Distance, c.Documents, c.Chunks,
+				c.CreatedAt.Format(time.DateTime)})
+		}
+		return printOutput(command.String("output"), tw, collections)
+	},
+}
+
+var collectionSetCmd = &cli.Command{
+	Name:  "set",
+	Usage: "Create a collection or change its settings",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "name", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.StringFlag{
+			Name:  "analyzer",
+			Usage: "Postgres text search configuration for lexical search",
+		},
+		&cli.StringFlag{
+			Name:      "distance",
+			Usage:     "metric of dense search: l2, cosine or ip (inner product), drop the collection's vector index first",
+			Validator: func(s string) error { _, err := rag.ParseDistance(s); return err },
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		name := command.StringArg("name")
+		if name == "" {
+			return errors.New("collection name is required")
+		}
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := &rag.RAG{DB: db}
+		analyzer := command.String("analyzer")
+		if analyzer != "" {
+			err = r.ValidateTextSearchConfig(analyzer)
+			if err != nil {
+				return err
+			}
+		}
+		c, err := r.EnsureCollection(ctx, name, analyzer)
+		if err != nil {
+			return err
+		}
+		if command.IsSet("distance") {
+			c.Distance = command.String("distance")
+			err = r.SetCollectionDistance(ctx, name, c.Distance)
+			if err != nil {
+				return err
+			}
+		}
+		log.Info().Str("collection", c.Name).Str("analyzer", c.TextSearchConfig).Str("distance", c.Distance).
+			Msg("Collection updated")
+		return nil
+	},
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"context"
 
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 	"github.com/urfave/cli/v3"
 
 	"github.com/fanyang89/rag/v1"
@@ -17,35 +15,76 @@ var computeCmd = &cli.Command{
 		flagDSN,
 		flagEmbeddingBaseURL,
 		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "only compute embeddings for this collection, empty computes all",
+		},
 		&cli.BoolFlag{
 			Name:  "force",
 			Value: false,
 		},
 		&cli.IntFlag{
-			Name:    "workers",
-			Aliases: []string{"j"},
+			Name:    "concurrency",
+			Aliases: []string{"workers", "j"},
+			Usage:   "number of embedding requests in flight",
 			Value:   3,
 		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "number of chunks per embedding request",
+			Value: 32,
+		},
+		&cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "retries with exponential backoff on 429 and 5xx responses",
+			Value: 5,
+		},
+		&cli.StringFlag{
+			Name:      "quantize",
+			Usage:     "also store embeddings quantized to int8, which dense search scans and re-scores by the originals",
+			Validator: func(s string) error { _, err := rag.ParseQuantize(s); return err },
+		},
+		&cli.BoolFlag{
+			Name:  "keep-original",
+			Usage: "keep the halfvec embeddings next to quantized ones for exact re-scoring and the vector index",
+			Value: true,
+		},
+		flagWebhook,
+		flagWebhookSecret,
+		flagWebhookEvent,
+		flagWebhookTimeout,
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		dsn := command.String("dsn")
-		baseURL := command.String("embedding-base-url")
-		embeddingModel := command.String("embedding-model")
 		force := command.Bool("force")
-		workers := command.Int("workers")
 
 		db, err := rag.OpenDB(dsn)
 		if err != nil {
 			return err
 		}
 
-		embeddingClient := openai.NewClient(option.WithBaseURL(baseURL))
-		r := rag.RAG{
-			DB:              db,
-			EmbeddingClient: &embeddingClient,
-			EmbeddingModel:  embeddingModel,
+		embedder, err := newEmbedder(command, command.Int("max-retries"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db, Embedder: embedder}
+		r.Webhooks, err = newWebhooks(command)
+		if err != nil {
+			return err
+		}
+		if r.Webhooks != nil {
+			defer func() { _ = r.Webhooks.Close() }()
 		}
 
-		return r.ComputeEmbeddings(ctx, !force, workers)
+		return r.ComputeEmbeddings(ctx, &rag.ComputeOptions{
+			OnlyEmpty:    !force,
+			Collection:   command.String("collection"),
+			Concurrency:  command.Int("concurrency"),
+			BatchSize:    command.Int("batch-size"),
+			Quantize:     command.String("quantize"),
+			DropOriginal: !command.Bool("keep-original"),
+		})
 	},
 }
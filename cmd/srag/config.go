@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var flagAuthor = &cli.StringFlag{
+	Name:    "author",
+	Usage:   "who made the change, recorded in the history",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_AUTHOR"), cli.EnvVar("USER")),
+}
+
+var configCmd = &cli.Command{
+	Name:  "config",
+	Usage: "Manage versioned prompts and retrieval defaults",
+	Commands: []*cli.Command{
+		configShowCmd,
+		configSetCmd,
+		configHistoryCmd,
+		configDiffCmd,
+		configRollbackCmd,
+	},
+}
+
+func parseConfigVersion(s string) (int64, error) {
+	version, err := strconv.ParseInt(strings.TrimPrefix(s, "v"), 10, 64)
+	if err != nil || version < 0 {
+		return 0, errors.Newf("invalid configuration version: '%s'", s)
+	}
+	return version, nil
+}
+
+var configShowCmd = &cli.Command{
+	Name:  "show",
+	Usage: "Print a configuration version as JSON, the current one by default",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "version", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		var v *rag.ConfigVersion
+		if s := command.StringArg("version"); s != "" {
+			version, err := parseConfigVersion(s)
+			if err != nil {
+				return err
+			}
+			v, err = r.GetConfigVersion(ctx, version)
+			if err != nil {
+				return err
+			}
+		} else {
+			v, err = r.CurrentConfig(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		buf, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	},
+}
+
+var configSetCmd = &cli.Command{
+	Name:  "set",
+	Usage: "Change the configuration, saving it as a new version",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagAuthor,
+		&cli.StringFlag{
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "why the configuration changed",
+		},
+		&cli.StringFlag{
+			Name:  "system-prompt-file",
+			Usage: "file holding the system prompt",
+		},
+		&cli.StringFlag{
+			Name:  "answer-prompt",
+			Usage: "instruction preceding the knowledge chunks in the user message",
+		},
+		&cli.StringFlag{
+			Name:  "mode",
+			Usage: "default search mode: dense, keyword or hybrid",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "default number of results",
+		},
+		&cli.IntFlag{
+			Name:  "candidates-per-result",
+			Usage: "candidates retrieved per result when reranking",
+		},
+		&cli.StringFlag{
+			Name:  "reranker-model",
+			Usage: "reranker model overriding the server's, empty uses the server's",
+		},
+		&cli.IntFlag{
+			Name:  "context-tokens",
+			Usage: "most tokens of the prompt sent to the assistant, fitting the retrieved chunks in; 0 doesn't limit it",
+		},
+		&cli.IntFlag{
+			Name:  "fusion-k",
+			Usage: "reciprocal rank fusion constant of hybrid search",
+		},
+		&cli.Float64Flag{
+			Name:  "dense-weight",
+			Usage: "weight of dense results in hybrid search",
+		},
+		&cli.Float64Flag{
+			Name:  "keyword-weight",
+			Usage: "weight of keyword results in hybrid search",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		current, err := r.CurrentConfig(ctx)
+		if err != nil {
+			return err
+		}
+
+		cfg := current.Config
+		if path := command.String("system-prompt-file"); path != "" {
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			cfg.SystemPrompt = strings.TrimSpace(string(buf))
+		}
+		if command.IsSet("answer-prompt") {
+			cfg.AnswerPrompt = command.String("answer-prompt")
+		}
+		if command.IsSet("mode") {
+			cfg.Mode, err = rag.ParseSearchMode(command.String("mode"))
+			if err != nil {
+				return err
+			}
+		}
+		if command.IsSet("limit") {
+			cfg.Limit = command.Int("limit")
+		}
+		if command.IsSet("candidates-per-result") {
+			cfg.CandidatesPerResult = command.Int("candidates-per-result")
+		}
+		if command.IsSet("reranker-model") {
+			cfg.RerankerModel = command.String("reranker-model")
+		}
+		if command.IsSet("context-tokens") {
+			cfg.ContextTokens = command.Int("context-tokens")
+		}
+		if command.IsSet("fusion-k") {
+			cfg.Fusion.K = command.Int("fusion-k")
+		}
+		if command.IsSet("dense-weight") {
+			cfg.Fusion.DenseWeight = command.Float64("dense-weight")
+		}
+		if command.IsSet("keyword-weight") {
+			cfg.Fusion.KeywordWeight = command.Float64("keyword-weight")
+		}
+
+		v, err := r.SetConfig(ctx, &cfg, command.String("author"), command.String("message"))
+		if err != nil {
+			return err
+		}
+		if v.Version == current.Version {
+			log.Info().Int64("version", v.Version).Msg("Configuration unchanged")
+			return nil
+		}
+		printConfigChanges(rag.DiffConfig(&current.Config, &v.Config))
+		log.Info().Int64("version", v.Version).Msg("Saved configuration")
+		return nil
+	},
+}
+
+var configHistoryCmd = &cli.Command{
+	Name:  "history",
+	Usage: "List configuration versions with who changed what and when",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		versions, err := r.ConfigHistory(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Version", "Author", "Created at", "Message", "Changed"})
+		tw.SetColumnConfigs([]table.ColumnConfig{{Name: "Changed", WidthMax: 60}})
+		for i, v := range versions {
+			previous := rag.DefaultConfig()
+			if i+1 < len(versions) {
+				previous = versions[i+1].Config
+			}
+			fields := make([]string, 0)
+			for _, change := range rag.DiffConfig(&previous, &v.Config) {
+				fields = append(fields, change.Field)
+			}
+			tw.AppendRow(table.Row{v.Version, v.Author, v.CreatedAt.Format(time.DateTime), v.Message, strings.Join(fields, ", ")})
+		}
+		tw.AppendRow(table.Row{0, "built-in", "", "Defaults", ""})
+		return printOutput(command.String("output"), tw, versions)
+	},
+}
+
+var configDiffCmd = &cli.Command{
+	Name:  "diff",
+	Usage: "Show the differences between two configuration versions",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "from", Config: trimSpace},
+		&cli.StringArg{Name: "to", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		from, err := parseConfigVersion(command.StringArg("from"))
+		if err != nil {
+			return err
+		}
+		a, err := r.GetConfigVersion(ctx, from)
+		if err != nil {
+			return err
+		}
+		b, err := r.CurrentConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if s := command.StringArg("to"); s != "" {
+			to, err := parseConfigVersion(s)
+			if err != nil {
+				return err
+			}
+			b, err = r.GetConfigVersion(ctx, to)
+			if err != nil {
+				return err
+			}
+		}
+		printConfigChanges(rag.DiffConfig(&a.Config, &b.Config))
+		return nil
+	},
+}
+
+var configRollbackCmd = &cli.Command{
+	Name:  "rollback",
+	Usage: "Restore an earlier configuration version, recorded as a new version",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "version", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagAuthor,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		version, err := parseConfigVersion(command.StringArg("version"))
+		if err != nil {
+			return err
+		}
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		current, err := r.CurrentConfig(ctx)
+		if err != nil {
+			return err
+		}
+
+		v, err := r.RollbackConfig(ctx, version, command.String("author"))
+		if err != nil {
+			return err
+		}
+		if v.Version == current.Version {
+			log.Info().Int64("version", v.Version).Msg("Configuration already matches")
+			return nil
+		}
+		printConfigChanges(rag.DiffConfig(&current.Config, &v.Config))
+		log.Info().Int64("version", v.Version).Int64("restored", version).Msg("Rolled back configuration")
+		return nil
+	},
+}
+
+func printConfigChanges(changes []rag.ConfigChange) {
+	if len(changes) == 0 {
+		fmt.Println("No differences")
+		return
+	}
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"Field", "Old", "New"})
+	tw.SetColumnConfigs([]table.ColumnConfig{
+		{Name: "Old", WidthMax: 60},
+		{Name: "New", WidthMax: 60},
+	})
+	for _, c := range changes {
+		tw.AppendRow(table.Row{c.Field, c.Old, c.New})
+	}
+	fmt.Println(tw.Render())
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are looked up in the working directory, then in the rag
+// directory of the user configuration directory, without --config.
+var configFileNames = []string{"rag.yaml", "rag.yml", "rag.toml"}
+
+var flagConfigFile = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "config file setting flags by name, rag.yaml or rag.toml in the working or user config directory by default",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_CONFIG")),
+}
+
+var flagProfile = &cli.StringFlag{
+	Name:    "profile",
+	Usage:   "profile of the config file overriding its top-level settings, defaults to the file's profile key",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_PROFILE")),
+}
+
+// configFile holds the flag values of the config file for the selected
+// profile. A nil configFile sets nothing.
+type configFile struct {
+	path   string
+	values map[string]string
+}
+
+// loadedConfig is read before the command line is parsed, and again on reload.
+var loadedConfig *configFile
+
+// findConfigFile returns the first config file found in the default places, empty if none.
+func findConfigFile() string {
+	dirs := []string{"."}
+	if userConfigDir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(userConfigDir, "rag"))
+	}
+	for _, dir := range dirs {
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// loadConfigFile reads the config file given by --config, RAG_CONFIG or found
+// in the default places, with the profile given by --profile, RAG_PROFILE or
+// the file's profile key. Top-level keys apply to every profile.
+func loadConfigFile(args []string) (*configFile, error) {
+	path, explicit := argValue(args, flagConfigFile)
+	if !explicit {
+		path = findConfigFile()
+	}
+	profile, _ := argValue(args, flagProfile)
+	if path == "" {
+		if profile != "" {
+			return nil, errors.Newf("profile '%s' requires a config file", profile)
+		}
+		return nil, nil
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read config file")
+	}
+	doc := make(map[string]any)
+	if strings.HasSuffix(path, ".toml") {
+		err = toml.Unmarshal(buf, &doc)
+	} else {
+		err = yaml.Unmarshal(buf, &doc)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse %s", path)
+	}
+
+	profiles, ok := doc["profiles"].(map[string]any)
+	if !ok && doc["profiles"] != nil {
+		return nil, errors.Newf("profiles of %s must be a map of profile names to settings", path)
+	}
+	if profile == "" {
+		profile, _ = doc["profile"].(string)
+	}
+	delete(doc, "profiles")
+	delete(doc, "profile")
+	settings := []map[string]any{doc}
+	if profile != "" {
+		p, ok := profiles[profile].(map[string]any)
+		if !ok {
+			return nil, errors.Newf("profile '%s' is not defined in %s", profile, path)
+		}
+		settings = append(settings, p)
+	}
+
+	c := &configFile{path: path, values: make(map[string]string)}
+	for _, s := range settings {
+		for key, value := range s {
+			c.values[key], err = configValue(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %s in %s", key, path)
+			}
+		}
+	}
+	log.Debug().Str("path", path).Str("profile", profile).Msg("Loaded config file")
+	return c, nil
+}
+
+// configValue formats a setting as it would be given on the command line,
+// lists are comma separated as slice flags expect.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case []any:
+		values := make([]string, len(v))
+		for i, x := range v {
+			s, err := configValue(x)
+			if err != nil {
+				return "", err
+			}
+			values[i] = s
+		}
+		return strings.Join(values, ","), nil
+	case map[string]any:
+		return "", errors.New("expected a value or a list")
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// argValue returns the value of f given on the command line or by its
+// environment variables, which decide the config file before flags are parsed.
+func argValue(args []string, f *cli.StringFlag) (string, bool) {
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !slices.Contains(f.Names(), name) {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		return value, true
+	}
+	return f.Sources.Lookup()
+}
+
+// configSource looks a flag up in the loaded config file, after the flag's
+// environment variables so flags > env > config file.
+type configSource struct {
+	key string
+}
+
+func (s *configSource) Lookup() (string, bool) {
+	if loadedConfig == nil {
+		return "", false
+	}
+	value, ok := loadedConfig.values[s.key]
+	return value, ok
+}
+
+func (s *configSource) String() string {
+	return fmt.Sprintf("config key %q", s.key)
+}
+
+func (s *configSource) GoString() string {
+	return fmt.Sprintf("&configSource{key:%q}", s.key)
+}
+
+// addConfigSources lets the config file set every flag of the commands by its
+// name, and warns about keys that are not the name of any flag.
+func addConfigSources(commands []*cli.Command) {
+	names := make(map[string]bool)
+	seen := make(map[cli.Flag]bool)
+	var walk func(commands []*cli.Command)
+	walk = func(commands []*cli.Command) {
+		for _, command := range commands {
+			for _, f := range command.Flags {
+				if seen[f] || f == flagConfigFile || f == flagProfile {
+					continue
+				}
+				seen[f] = true
+				name := f.Names()[0]
+				names[name] = true
+				src := cli.NewValueSourceChain(&configSource{key: name})
+				switch f := f.(type) {
+				case *cli.StringFlag:
+					f.Sources.Append(src)
+				case *cli.StringSliceFlag:
+					f.Sources.Append(src)
+				case *cli.IntFlag:
+					f.Sources.Append(src)
+				case *cli.IntSliceFlag:
+					f.Sources.Append(src)
+				case *cli.FloatFlag:
+					f.Sources.Append(src)
+				case *cli.BoolFlag:
+					f.Sources.Append(src)
+				case *cli.DurationFlag:
+					f.Sources.Append(src)
+				}
+			}
+			walk(command.Commands)
+		}
+	}
+	walk(commands)
+
+	if loadedConfig == nil {
+		return
+	}
+	for key := range loadedConfig.values {
+		if !names[key] {
+			log.Warn().Str("path", loadedConfig.path).Str("key", key).Msg("Config file sets an unknown flag")
+		}
+	}
+}
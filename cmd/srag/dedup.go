@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var dedupCmd = &cli.Command{
+	Name:  "dedup",
+	Usage: "Find duplicate chunks by text or embedding similarity and optionally collapse them",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		&cli.FloatFlag{
+			Name:  "threshold",
+			Usage: "cosine similarity of embeddings at or above which chunks are near duplicates, 0 compares text only",
+			Value: 0.95,
+		},
+		&cli.IntFlag{
+			Name:  "neighbors",
+			Usage: "nearest chunks compared with every chunk on Postgres",
+			Value: rag.DefaultDedupNeighbors,
+		},
+		&cli.BoolFlag{
+			Name:  "collapse",
+			Usage: "hide the newer chunk of every pair from search, listing its document among the results' duplicates",
+		},
+		&cli.BoolFlag{
+			Name:  "reset",
+			Usage: "make the collapsed chunks of the collection searchable again",
+		},
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		collection := command.String("collection")
+
+		if command.Bool("reset") {
+			n, err := r.ResetDuplicates(ctx, collection)
+			if err != nil {
+				return err
+			}
+			log.Info().Str("collection", collection).Int64("count", n).Msg("Reset collapsed chunks")
+			return nil
+		}
+
+		pairs, err := r.FindDuplicates(ctx, &rag.DedupOptions{
+			Collection: collection,
+			Threshold:  command.Float("threshold"),
+			Neighbors:  command.Int("neighbors"),
+		})
+		if err != nil {
+			return err
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Similarity", "Kept", "Duplicate", "Kept chunk", "Duplicate chunk"})
+		for _, p := range pairs {
+			similarity := fmt.Sprintf("%.4f", p.Similarity)
+			if p.Exact {
+				similarity = "exact"
+			}
+			tw.AppendRow(table.Row{similarity, p.Kept.RawDocument, p.Duplicate.RawDocument,
+				p.Kept.ChunkID, p.Duplicate.ChunkID})
+		}
+		err = printOutput(command.String("output"), tw, pairs)
+		if err != nil {
+			return err
+		}
+
+		if command.Bool("collapse") && len(pairs) > 0 {
+			n, err := r.CollapseDuplicates(ctx, pairs)
+			if err != nil {
+				return err
+			}
+			log.Info().Str("collection", collection).Int64("count", n).Msg("Collapsed duplicate chunks")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var deleteCmd = &cli.Command{
+	Name:  "delete",
+	Usage: "Delete documents and their chunks by document ID or path, globs are supported",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "path", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		&cli.BoolFlag{Name: "dry-run"},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		pattern, err := getArgumentPath(command)
+		if err != nil {
+			return err
+		}
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		dryRun := command.Bool("dry-run")
+		documents, chunks, err := r.DeleteDocuments(ctx, command.String("collection"), pattern, dryRun)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			fmt.Println(document)
+		}
+		log.Info().Int("documents", len(documents)).Int64("chunks", chunks).Bool("dry_run", dryRun).
+			Msg("Deleted documents")
+		return nil
+	},
+}
+
+var pruneCmd = &cli.Command{
+	Name:  "prune",
+	Usage: "Delete documents whose source files or objects no longer exist",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		&cli.BoolFlag{Name: "dry-run"},
+		flagOSSEndpoint,
+		flagOSSAccessKey,
+		flagOSSSecretAccessKey,
+		flagOSSSecure,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		oss, err := newOSS(command)
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db, OSS: oss}
+
+		dryRun := command.Bool("dry-run")
+		documents, chunks, err := r.PruneDocuments(ctx, command.String("collection"), dryRun)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			fmt.Println(document)
+		}
+		log.Info().Int("documents", len(documents)).Int64("chunks", chunks).Bool("dry_run", dryRun).
+			Msg("Pruned documents")
+		return nil
+	},
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var exportCmd = &cli.Command{
+	Name:  "export",
+	Usage: "Dump documents, chunks, metadata and embeddings to a portable zstd-compressed file",
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.StringFlag{
+			Name:    "out",
+			Aliases: []string{"o"},
+			Usage:   "output file, - writes to stdout",
+			Value:   "index.jsonl.zst",
+			Config:  trimSpace,
+		},
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "only export this collection, empty exports all",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		var w io.Writer
+		outputPath := command.String("out")
+		if outputPath == "-" {
+			w = os.Stdout
+		} else {
+			f, err := os.Create(outputPath)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			w = f
+		}
+
+		stats, err := r.ExportIndex(ctx, w, &rag.ExportIndexOptions{Collection: command.String("collection")})
+		if err != nil {
+			return err
+		}
+		log.Info().Int("models", stats.Models).Int("collections", stats.Collections).
+			Int("source_files", stats.SourceFiles).Int("chunks", stats.Chunks).Int("embeddings", stats.Embeddings).
+			Int("quantized", stats.Quantized).Int("chunk_embeddings", stats.ChunkEmbeddings).Msg("Index exported")
+		return nil
+	},
+}
+
+var importCmd = &cli.Command{
+	Name:  "import",
+	Usage: "Restore a dump created by export, overwriting rows with the same keys",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "path", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		path, err := getArgumentPath(command)
+		if err != nil {
+			return err
+		}
+
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		var rd io.Reader
+		if path == "-" {
+			rd = os.Stdin
+		} else {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			rd = f
+		}
+
+		stats, err := r.ImportIndex(ctx, rd)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("models", stats.Models).Int("collections", stats.Collections).
+			Int("source_files", stats.SourceFiles).Int("chunks", stats.Chunks).Int("embeddings", stats.Embeddings).
+			Int("quantized", stats.Quantized).Int("chunk_embeddings", stats.ChunkEmbeddings).Msg("Index imported")
+		return nil
+	},
+}
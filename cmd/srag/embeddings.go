@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var embeddingsCmd = &cli.Command{
+	Name:  "embeddings",
+	Usage: "Bulk export and import precomputed embeddings",
+	Commands: []*cli.Command{
+		exportEmbeddingsCmd,
+		importEmbeddingsCmd,
+	},
+}
+
+var exportEmbeddingsCmd = &cli.Command{
+	Name:  "export",
+	Usage: "Export embeddings as a zstd-compressed float16 dump",
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "-",
+			Config:  trimSpace,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		var w io.Writer
+		outputPath := command.String("output")
+		if outputPath == "-" {
+			w = os.Stdout
+		} else {
+			f, err := os.Create(outputPath)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			w = f
+		}
+
+		count, err := r.ExportEmbeddings(ctx, w)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("count", count).Msg("Embeddings exported")
+		return nil
+	},
+}
+
+var importEmbeddingsCmd = &cli.Command{
+	Name:  "import",
+	Usage: "Import embeddings from a dump created by export",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "path", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		path, err := getArgumentPath(command)
+		if err != nil {
+			return err
+		}
+
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		var rd io.Reader
+		if path == "-" {
+			rd = os.Stdin
+		} else {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			rd = f
+		}
+
+		result, err := r.ImportEmbeddings(ctx, rd)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("imported", result.Imported).Int("missing", result.Missing).Msg("Embeddings imported")
+		return nil
+	},
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var evalCmd = &cli.Command{
+	Name:  "eval",
+	Usage: "Measure recall@k, MRR and nDCG of retrieval on a JSONL file of questions and expected results",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "path", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		flagFilter,
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagRerankerBaseURL,
+		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
+		&cli.IntFlag{
+			Name:  "k",
+			Usage: "number of results scored per question",
+			Value: 10,
+		},
+		&cli.StringSliceFlag{
+			Name:  "config-version",
+			Usage: "configuration versions to compare, defaults to the current one",
+		},
+		&cli.StringFlag{
+			Name:  "rerank",
+			Usage: "off, on or both to compare retrieval with and without the reranker",
+			Value: "off",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the results as JSON, including the missed questions",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		path, err := getArgumentPath(command)
+		if err != nil {
+			return err
+		}
+		var reranks []bool
+		switch command.String("rerank") {
+		case "off":
+			reranks = []bool{false}
+		case "on":
+			reranks = []bool{true}
+		case "both":
+			reranks = []bool{false, true}
+		default:
+			return errors.Newf("invalid rerank '%s', expected off, on or both", command.String("rerank"))
+		}
+		filter, err := parseFilter(command)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		cases, err := rag.ReadEvalCases(f)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %s", path)
+		}
+
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		embedder, err := newEmbedder(command, defaultEmbeddingRetries)
+		if err != nil {
+			return err
+		}
+		r := &rag.RAG{
+			DB:            db,
+			Embedder:      embedder,
+			RerankerModel: command.String("reranker-model"),
+		}
+		if reranks[len(reranks)-1] {
+			r.Reranker, err = newReranker(command)
+			if err != nil {
+				return err
+			}
+			if r.Reranker != nil {
+				defer func() { _ = r.Reranker.Close() }()
+			}
+		}
+
+		var configs []*rag.ConfigVersion
+		for _, s := range command.StringSlice("config-version") {
+			version, err := parseConfigVersion(s)
+			if err != nil {
+				return err
+			}
+			v, err := r.GetConfigVersion(ctx, version)
+			if err != nil {
+				return err
+			}
+			configs = append(configs, v)
+		}
+		if len(configs) == 0 {
+			v, err := r.CurrentConfig(ctx)
+			if err != nil {
+				return err
+			}
+			configs = append(configs, v)
+		}
+
+		results := make([]*rag.EvalResult, 0, len(configs)*len(reranks))
+		for _, config := range configs {
+			for _, rerank := range reranks {
+				name := fmt.Sprintf("v%d", config.Version)
+				if rerank {
+					name += "+rerank"
+				}
+				result, err := r.WithConfig(config).Evaluate(ctx, cases, &rag.EvalOptions{
+					Name:       name,
+					K:          command.Int("k"),
+					Collection: command.String("collection"),
+					Filter:     filter,
+					Rerank:     rerank,
+				})
+				if err != nil {
+					return err
+				}
+				results = append(results, result)
+			}
+		}
+
+		if command.Bool("json") {
+			buf, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(buf))
+			return nil
+		}
+
+		k := command.Int("k")
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Variant", "Cases", fmt.Sprintf("Recall@%d", k), "MRR", fmt.Sprintf("nDCG@%d", k),
+			"Misses", "P50 ms", "P95 ms"})
+		for _, result := range results {
+			tw.AppendRow(table.Row{
+				result.Name,
+				result.Cases,
+				fmt.Sprintf("%.3f", result.Recall),
+				fmt.Sprintf("%.3f", result.MRR),
+				fmt.Sprintf("%.3f", result.NDCG),
+				len(result.Misses),
+				fmt.Sprintf("%.1f", result.P50LatencyMS),
+				fmt.Sprintf("%.1f", result.P95LatencyMS),
+			})
+		}
+		fmt.Println(tw.Render())
+		return nil
+	},
+}
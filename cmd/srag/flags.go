@@ -2,26 +2,139 @@ package main
 
 import (
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
 	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
 )
 
 var flagDSN = &cli.StringFlag{
 	Name:    "dsn",
+	Usage:   "postgres DSN, or sqlite://path for a local index",
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_DSN")),
 }
 
+var flagServer = &cli.StringFlag{
+	Name:    "server",
+	Usage:   "URL of a rag server to query instead of the database, e.g. http://localhost:5000",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_SERVER")),
+}
+
+var flagAPIKey = &cli.StringFlag{
+	Name:    "api-key",
+	Usage:   "API key sent to the rag server",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_API_KEY")),
+}
+
+// newRemoteClient returns nil if no --server is configured.
+func newRemoteClient(command *cli.Command) *rag.RemoteClient {
+	server := command.String("server")
+	if server == "" {
+		return nil
+	}
+	return rag.NewRemoteClient(server, command.String("api-key"))
+}
+
+var flagCollection = &cli.StringFlag{
+	Name:    "collection",
+	Usage:   "collection the documents belong to",
+	Value:   rag.DefaultCollection,
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_COLLECTION")),
+}
+
+var flagFilter = &cli.StringFlag{
+	Name:  "filter",
+	Usage: `metadata filter, e.g. 'tag=finance AND path~"reports/2024/*"', fields are tag, path, document, section, page, created and updated`,
+}
+
+// parseFilter returns the --filter expression, nil when unset.
+func parseFilter(command *cli.Command) (*rag.Filter, error) {
+	if s := command.String("filter"); s != "" {
+		return rag.ParseFilter(s)
+	}
+	return nil, nil
+}
+
 var flagEmbeddingBaseURL = &cli.StringFlag{
 	Name:    "embedding-base-url",
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_EMBEDDING_BASE_URL")),
 }
 
+var flagNeighbors = &cli.IntFlag{
+	Name:  "neighbors",
+	Usage: "widen every result to this many chunks before and after it, merging overlapping results",
+}
+
+var flagParentSection = &cli.BoolFlag{
+	Name:  "parent-section",
+	Usage: "widen every result to the section it is in",
+}
+
+var flagCompress = &cli.BoolFlag{
+	Name:  "compress",
+	Usage: "keep only the sentences of every result the assistant finds relevant to the query",
+}
+
+var flagChunkTokens = &cli.IntFlag{
+	Name:  "chunk-tokens",
+	Usage: "maximum tokens per chunk as counted for the embedding model, 0 only limits runes",
+}
+
+// newParagraphChunker limits chunks to --chunk-size runes and --chunk-tokens
+// tokens, counted with the tokenizer of --embedding-model.
+func newParagraphChunker(command *cli.Command) (*rag.ParagraphChunker, error) {
+	c := &rag.ParagraphChunker{MaxRunes: command.Int("chunk-size"), MaxTokens: command.Int("chunk-tokens")}
+	if c.MaxTokens > 0 {
+		var err error
+		c.Tokenizer, err = rag.NewTokenizer(command.String("embedding-model"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+var flagRecencyHalfLife = &cli.StringFlag{
+	Name:      "recency-half-life",
+	Usage:     "rank newer documents higher, halving scores for every half-life a document is older, e.g. 90d",
+	Validator: func(s string) error { _, err := rag.ParseHalfLife(s); return err },
+}
+
+var flagGraph = &cli.BoolFlag{
+	Name:  "graph",
+	Usage: "add the chunks related to the results in the knowledge graph built by graph",
+}
+
+var flagSummaries = &cli.BoolFlag{
+	Name:  "summaries",
+	Usage: "search the section and document summaries built by summarize as well, followed by their chunks",
+}
+
 var flagEmbeddingModel = &cli.StringFlag{
 	Name:    "embedding-model",
+	Usage:   "embedding model, search queries the embeddings of this model",
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_EMBEDDING_MODEL")),
 }
 
+var flagEmbeddingProvider = &cli.StringFlag{
+	Name:    "embedding-provider",
+	Usage:   "embedding API flavor: openai, ollama, infinity or cohere",
+	Value:   rag.EmbeddingProviderOpenAI,
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_EMBEDDING_PROVIDER")),
+}
+
+var flagEmbeddingAPIKey = &cli.StringFlag{
+	Name:    "embedding-api-key",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_EMBEDDING_API_KEY")),
+}
+
 var flagRerankerBaseURL = &cli.StringFlag{
 	Name:    "reranker-base-url",
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_RERANKER_BASE_URL")),
@@ -32,6 +145,25 @@ var flagRerankerModel = &cli.StringFlag{
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_RERANKER_MODEL")),
 }
 
+var flagRerankerProvider = &cli.StringFlag{
+	Name:    "reranker-provider",
+	Usage:   "reranker API flavor: infinity, cohere, jina or openai (an OpenAI-compatible /score endpoint)",
+	Value:   rag.RerankerProviderInfinity,
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_RERANKER_PROVIDER")),
+}
+
+var flagRerankerAPIKey = &cli.StringFlag{
+	Name:    "reranker-api-key",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_RERANKER_API_KEY")),
+}
+
+var flagRerankerTimeout = &cli.DurationFlag{
+	Name:    "reranker-timeout",
+	Usage:   "timeout of every rerank request, retries included",
+	Value:   30 * time.Second,
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_RERANKER_TIMEOUT")),
+}
+
 var flagAssistantBaseURL = &cli.StringFlag{
 	Name:    "assistant-base-url",
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_ASSISTANT_BASE_URL")),
@@ -42,6 +174,169 @@ var flagAssistantModel = &cli.StringFlag{
 	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_ASSISTANT_MODEL")),
 }
 
+var flagOSSEndpoint = &cli.StringFlag{
+	Name:    "oss-endpoint",
+	Usage:   "S3-compatible object storage endpoint",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("OSS_ENDPOINT")),
+}
+
+var flagOSSAccessKey = &cli.StringFlag{
+	Name:    "oss-access-key",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("OSS_ACCESS_KEY")),
+}
+
+var flagOSSSecretAccessKey = &cli.StringFlag{
+	Name:    "oss-secret-access-key",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("OSS_SECRET_ACCESS_KEY")),
+}
+
+var flagOSSSecure = &cli.BoolFlag{
+	Name:    "oss-secure",
+	Usage:   "use TLS for object storage",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("OSS_SECURE")),
+}
+
+// newOSS returns nil if no object storage endpoint is configured.
+func newOSS(command *cli.Command) (*minio.Client, error) {
+	endpoint := command.String("oss-endpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+	return minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(command.String("oss-access-key"), command.String("oss-secret-access-key"), ""),
+		Secure: command.Bool("oss-secure"),
+	})
+}
+
+// defaultEmbeddingRetries matches the OpenAI client's default for commands
+// that embed a handful of queries rather than a whole corpus.
+const defaultEmbeddingRetries = 2
+
+func newEmbedder(command *cli.Command, maxRetries int) (rag.Embedder, error) {
+	return rag.NewEmbedder(&rag.EmbedderOptions{
+		Provider:  command.String("embedding-provider"),
+		BaseURL:   command.String("embedding-base-url"),
+		Model:     command.String("embedding-model"),
+		APIKey:    command.String("embedding-api-key"),
+		Transport: newModelTransport(command, maxRetries),
+	})
+}
+
+// defaultRerankerRetries matches defaultEmbeddingRetries, every search with rerank waits for it.
+const defaultRerankerRetries = 2
+
+// newReranker returns nil if neither --reranker-base-url nor --reranker-api-key
+// is configured, hosted providers only need the latter.
+func newReranker(command *cli.Command) (rag.Reranker, error) {
+	baseURL := command.String("reranker-base-url")
+	apiKey := command.String("reranker-api-key")
+	if baseURL == "" && apiKey == "" {
+		return nil, nil
+	}
+	return rag.NewReranker(&rag.RerankerOptions{
+		Provider:  command.String("reranker-provider"),
+		BaseURL:   baseURL,
+		APIKey:    apiKey,
+		Timeout:   command.Duration("reranker-timeout"),
+		Transport: newModelTransport(command, defaultRerankerRetries),
+	})
+}
+
+// defaultAssistantRetries matches the OpenAI client's default.
+const defaultAssistantRetries = 2
+
+// newAssistantClient returns a client of --assistant-base-url calling through
+// the model transport, which retries instead of the client.
+func newAssistantClient(command *cli.Command) openai.Client {
+	return openai.NewClient(
+		option.WithBaseURL(command.String("assistant-base-url")),
+		option.WithHTTPClient(newModelTransport(command, defaultAssistantRetries).Client()),
+		option.WithMaxRetries(0),
+	)
+}
+
+var flagLLMTimeout = &cli.DurationFlag{
+	Name:    "llm-timeout",
+	Usage:   "timeout of every embedding, rerank and assistant call until it answers, and of every wait for more of a streamed answer, 0 waits forever",
+	Value:   rag.DefaultTransportOptions().Timeout,
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_LLM_TIMEOUT")),
+}
+
+var flagLLMMaxRetries = &cli.IntFlag{
+	Name:    "llm-max-retries",
+	Usage:   "retries of model calls with jittered backoff on errors, timeouts, 429 and 5xx responses, overriding the command's default",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_LLM_MAX_RETRIES")),
+}
+
+var flagLLMMaxInflight = &cli.IntFlag{
+	Name:    "llm-max-inflight",
+	Usage:   "model calls in flight at once across the embedding, reranker and assistant, 0 doesn't limit them",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_LLM_MAX_INFLIGHT")),
+}
+
+// modelTransport is shared by the model clients of the process, so its limit
+// of calls in flight and circuits hold across them, and across reloads.
+var (
+	modelTransportOnce sync.Once
+	modelTransport     *rag.Transport
+)
+
+// newModelTransport returns the model transport retrying maxRetries times,
+// or --llm-max-retries times if set.
+func newModelTransport(command *cli.Command, maxRetries int) *rag.Transport {
+	modelTransportOnce.Do(func() {
+		opts := rag.DefaultTransportOptions()
+		opts.Timeout = command.Duration("llm-timeout")
+		opts.MaxInflight = command.Int("llm-max-inflight")
+		modelTransport = rag.NewTransport(opts)
+	})
+	if command.IsSet("llm-max-retries") {
+		maxRetries = command.Int("llm-max-retries")
+	}
+	return modelTransport.WithMaxRetries(maxRetries)
+}
+
+var flagWebhook = &cli.StringSliceFlag{
+	Name:    "webhook",
+	Usage:   "URL notified of ingested documents, computed embeddings and failed ingest jobs",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_WEBHOOKS")),
+}
+
+var flagWebhookSecret = &cli.StringFlag{
+	Name:    "webhook-secret",
+	Usage:   "secret signing webhook payloads with HMAC-SHA256 in the X-RAG-Signature header",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_WEBHOOK_SECRET")),
+}
+
+var flagWebhookEvent = &cli.StringSliceFlag{
+	Name:    "webhook-event",
+	Usage:   "event posted to webhooks: document.ingested, embeddings.computed or job.failed, all by default",
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_WEBHOOK_EVENTS")),
+}
+
+var flagWebhookTimeout = &cli.DurationFlag{
+	Name:  "webhook-timeout",
+	Usage: "timeout of every attempt to post to a webhook",
+	Value: 10 * time.Second,
+}
+
+const webhookRetries = 3
+
+// newWebhooks returns nil without --webhook.
+func newWebhooks(command *cli.Command) (*rag.Webhooks, error) {
+	urls := command.StringSlice("webhook")
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	return rag.NewWebhooks(&rag.WebhookOptions{
+		URLs:       urls,
+		Secret:     command.String("webhook-secret"),
+		Events:     command.StringSlice("webhook-event"),
+		Timeout:    command.Duration("webhook-timeout"),
+		MaxRetries: webhookRetries,
+	})
+}
+
 func getArgumentQuery(command *cli.Command) (string, error) {
 	query := command.StringArg("query")
 	if query == "" {
@@ -86,10 +86,7 @@ var generateCmd = &cli.Command{
 			if d.IsDir() {
 				return nil
 			}
-			if !strings.HasSuffix(path, ".pdf") ||
-				strings.HasSuffix(path, "_layout.pdf") ||
-				strings.HasSuffix(path, "_origin.pdf") ||
-				strings.HasSuffix(path, "_span.pdf") {
+			if !isSourcePDF(path) {
 				return nil
 			}
 
@@ -143,3 +140,11 @@ var generateCmd = &cli.Command{
 		})
 	},
 }
+
+// isSourcePDF skips the _layout, _origin and _span PDFs mineru writes next to its output.
+func isSourcePDF(path string) bool {
+	return strings.HasSuffix(path, ".pdf") &&
+		!strings.HasSuffix(path, "_layout.pdf") &&
+		!strings.HasSuffix(path, "_origin.pdf") &&
+		!strings.HasSuffix(path, "_span.pdf")
+}
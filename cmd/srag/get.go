@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/urfave/cli/v3"
 
 	"github.com/fanyang89/rag/v1"
@@ -18,12 +19,37 @@ var getChunkCmd = &cli.Command{
 	},
 	Flags: []cli.Flag{
 		flagDSN,
+		flagServer,
+		flagAPIKey,
+		flagCollection,
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: text, table, markdown, csv, json or yaml",
+			Value: outputText,
+			Validator: func(format string) error {
+				if format == outputText {
+					return nil
+				}
+				return validateOutput(format)
+			},
+		},
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		id := command.StringArg("id")
 		if id == "" {
 			return errors.New("id is required")
 		}
+
+		if client := newRemoteClient(command); client != nil {
+			defer func() { _ = client.Close() }()
+			// the server only returns chunks of the collection it is asked about
+			cc, err := client.GetChunkContext(ctx, command.String("collection"), id, 0, 0)
+			if err != nil {
+				return err
+			}
+			return printChunk(command.String("output"), &cc.Chunk)
+		}
+
 		dsn := command.String("dsn")
 		db, err := rag.OpenDB(dsn)
 		if err != nil {
@@ -35,8 +61,19 @@ var getChunkCmd = &cli.Command{
 		if err != nil {
 			return err
 		}
+		return printChunk(command.String("output"), c)
+	},
+}
+
+func printChunk(format string, c *rag.DocumentChunk) error {
+	if format == outputText {
 		fmt.Printf("id=%v document='%s' raw_document='%s'\n", c.ID, c.Document, c.RawDocument)
 		fmt.Println(c.Text)
 		return nil
-	},
+	}
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"Chunk ID", "Document", "Raw document", "Text"})
+	tw.SetColumnConfigs([]table.ColumnConfig{{Name: "Text", WidthMax: 80}})
+	tw.AppendRow(table.Row{c.ID, c.Document, c.RawDocument, c.Text})
+	return printOutput(format, tw, newChunkRecord(c, 0))
 }
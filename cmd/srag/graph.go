@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var graphCmd = &cli.Command{
+	Name:  "graph",
+	Usage: "Extract the entities and relations of chunks into a knowledge graph searched with --graph",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagAssistantBaseURL,
+		flagAssistantModel,
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "only extract chunks of this collection, empty extracts all",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "extract chunks extracted before again",
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Aliases: []string{"workers", "j"},
+			Usage:   "number of completions in flight",
+			Value:   3,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		assistantClient := newAssistantClient(command)
+		r := rag.RAG{
+			DB:              db,
+			AssistantClient: &assistantClient,
+			AssistantModel:  command.String("assistant-model"),
+		}
+
+		collection := command.String("collection")
+		err = r.ExtractGraph(ctx, &rag.GraphOptions{
+			Collection:  collection,
+			Force:       command.Bool("force"),
+			Concurrency: command.Int("concurrency"),
+		})
+		if err != nil {
+			return err
+		}
+		stats, err := r.Stats(ctx, collection)
+		if err != nil {
+			return err
+		}
+		log.Info().Int64("entities", stats.Entities).Int64("relations", stats.Relations).Msg("Graph extracted")
+		return nil
+	},
+}
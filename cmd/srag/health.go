@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
 	"github.com/urfave/cli/v3"
@@ -12,101 +13,83 @@ import (
 	"github.com/fanyang89/rag/v1"
 )
 
+var flagHealthRequire = &cli.StringSliceFlag{
+	Name:    "require",
+	Usage:   "components that must be configured and working: database, embedding, reranker, assistant",
+	Value:   rag.DefaultHealthOptions().Required,
+	Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_HEALTH_REQUIRE")),
+}
+
 var healthCmd = &cli.Command{
 	Name:  "health",
-	Usage: "Retrieve service health status",
+	Usage: "Probe the configured components and print a JSON report",
 	Flags: []cli.Flag{
 		flagDSN,
 		flagEmbeddingBaseURL,
 		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
 		flagRerankerBaseURL,
 		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
 		flagAssistantBaseURL,
 		flagAssistantModel,
+		flagHealthRequire,
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "timeout of every probe",
+			Value: rag.DefaultHealthOptions().Timeout,
+		},
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
-		dsn := command.String("dsn")
-		if dsn == "" {
-			return errors.New("dsn is required")
-		}
-		db, err := rag.OpenDB(dsn)
-		if err != nil {
-			return err
-		}
-		rawDB, err := db.DB()
-		if err != nil {
-			return err
+		opts := &rag.HealthOptions{
+			Required: command.StringSlice("require"),
+			Timeout:  command.Duration("timeout"),
 		}
-		err = rawDB.Ping()
+		err := opts.Validate()
 		if err != nil {
 			return err
 		}
 
-		embeddingBaseURL := command.String("embedding-base-url")
-		if embeddingBaseURL == "" {
-			return errors.New("embedding-base-url is required")
+		// components without flags are reported as not configured
+		r := &rag.RAG{}
+		if dsn := command.String("dsn"); dsn != "" {
+			r.DB, err = rag.OpenDB(dsn)
+			if err != nil {
+				return err
+			}
 		}
-		embeddingModel := command.String("embedding-model")
-		if embeddingModel == "" {
-			return errors.New("embedding-model is required")
+		if command.String("embedding-model") != "" {
+			r.Embedder, err = newEmbedder(command, 0)
+			if err != nil {
+				return err
+			}
 		}
-		embeddingClient := openai.NewClient(option.WithBaseURL(embeddingBaseURL))
-		embeddingResponse, err := embeddingClient.Embeddings.New(ctx, openai.EmbeddingNewParams{
-			Input: openai.EmbeddingNewParamsInputUnion{
-				OfString: openai.String("Hello world"),
-			},
-			Model:          embeddingModel,
-			EncodingFormat: openai.EmbeddingNewParamsEncodingFormatBase64,
-		})
+		r.Reranker, err = newReranker(command)
 		if err != nil {
 			return err
 		}
-		if len(embeddingResponse.Data) == 0 || len(embeddingResponse.Data[0].Embedding) == 0 {
-			return errors.New("empty response")
+		if r.Reranker != nil {
+			r.RerankerModel = command.String("reranker-model")
+			defer func() { _ = r.Reranker.Close() }()
 		}
-
-		rerankerBaseURL := command.String("reranker-base-url")
-		if rerankerBaseURL == "" {
-			return errors.New("reranker-base-url is required")
-		}
-		rerankerModel := command.String("reranker-model")
-		if rerankerModel == "" {
-			return errors.New("reranker-model is required")
-		}
-		rerankerClient := rag.NewInfinityClient(rerankerBaseURL)
-		_, err = rerankerClient.Rerank(&rag.RerankRequest{
-			Model:     rerankerModel,
-			Query:     "Where is Munich?",
-			Documents: []string{"Munich is in Germany.", "The sky is blue."},
-			TopN:      3,
-		})
-		if err != nil {
-			return err
+		if assistantBaseURL := command.String("assistant-base-url"); assistantBaseURL != "" {
+			assistantClient := openai.NewClient(option.WithBaseURL(assistantBaseURL), option.WithRequestTimeout(opts.Timeout))
+			r.AssistantClient = &assistantClient
+			r.AssistantModel = command.String("assistant-model")
 		}
 
-		assistantBaseURL := command.String("assistant-base-url")
-		if assistantBaseURL == "" {
-			return errors.New("assistant-base-url is required")
-		}
-		assistantModel := command.String("assistant-model")
-		if assistantModel == "" {
-			return errors.New("assistant-model is required")
-		}
-		assistantClient := openai.NewClient(option.WithBaseURL(assistantBaseURL))
-		assistantResponse, err := assistantClient.Completions.New(ctx, openai.CompletionNewParams{
-			Model: openai.CompletionNewParamsModel(assistantModel),
-			Prompt: openai.CompletionNewParamsPromptUnion{
-				OfString: openai.String("Hello world"),
-			},
-		})
+		report := r.CheckHealth(ctx, opts)
+		buf, err := json.MarshalIndent(report, "", "  ")
 		if err != nil {
 			return err
 		}
-		if len(assistantResponse.Choices) == 0 || len(assistantResponse.Choices[0].Text) == 0 {
-			return errors.New("empty response")
+		fmt.Println(string(buf))
+		if !report.Healthy {
+			return errors.New("required components are unhealthy")
 		}
-
-		fmt.Println("OK, database/embedding/reranker/assistant are operational")
 		return nil
 	},
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var indexCmd = &cli.Command{
+	Name:  "index",
+	Usage: "Manage the vector index",
+	Commands: []*cli.Command{
+		indexCreateCmd,
+		indexDropCmd,
+		indexStatusCmd,
+		indexTuneCmd,
+	},
+}
+
+var flagIndexCollection = &cli.StringFlag{
+	Name:   "collection",
+	Usage:  "index of this collection, built for its distance metric, the shared L2 index on all chunks by default",
+	Config: trimSpace,
+}
+
+var indexCreateCmd = &cli.Command{
+	Name:  "create",
+	Usage: "Build an HNSW or IVFFlat index on the embeddings without blocking writes",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagIndexCollection,
+		&cli.StringFlag{
+			Name:      "method",
+			Usage:     "hnsw or ivfflat",
+			Value:     rag.IndexMethodHNSW,
+			Validator: func(s string) error { _, err := rag.ParseIndexMethod(s); return err },
+		},
+		&cli.IntFlag{
+			Name:  "m",
+			Usage: "hnsw: max connections per node, higher improves recall at the cost of size and build time",
+		},
+		&cli.IntFlag{
+			Name:  "ef-construction",
+			Usage: "hnsw: candidate list size while building, higher improves recall at the cost of build time",
+		},
+		&cli.IntFlag{
+			Name:  "lists",
+			Usage: "ivfflat: number of clusters, defaults to chunks/1000 or sqrt(chunks) above 1M chunks",
+		},
+		&cli.StringFlag{
+			Name:  "maintenance-work-mem",
+			Usage: "memory for the build, e.g. 2GB, see index tune for a recommendation",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		index, err := r.CreateVectorIndex(ctx, &rag.VectorIndexOptions{
+			Collection:         command.String("collection"),
+			Method:             command.String("method"),
+			M:                  command.Int("m"),
+			EfConstruction:     command.Int("ef-construction"),
+			Lists:              command.Int("lists"),
+			MaintenanceWorkMem: command.String("maintenance-work-mem"),
+		})
+		if err != nil {
+			return err
+		}
+		log.Info().Str("index", index.Name).Str("method", index.Method).Int64("size_mb", index.Bytes>>20).
+			Msg("Vector index created")
+		return nil
+	},
+}
+
+var indexDropCmd = &cli.Command{
+	Name:  "drop",
+	Usage: "Drop the vector index, searches fall back to exact scans",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagIndexCollection,
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "do not ask for confirmation",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		if !command.Bool("yes") && !confirm("Drop the vector index?") {
+			return nil
+		}
+		r := rag.RAG{DB: db}
+		index, err := r.DropVectorIndex(ctx, command.String("collection"))
+		if err != nil {
+			return err
+		}
+		log.Info().Str("index", index.Name).Str("method", index.Method).Msg("Vector index dropped")
+		return nil
+	},
+}
+
+var indexStatusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "Show the vector index, its search settings and the progress of a build",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagIndexCollection,
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		s, err := r.VectorIndexStatus(ctx, command.String("collection"))
+		if err != nil {
+			return err
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Setting", "Value"})
+		if s.Index == nil {
+			tw.AppendRow(table.Row{"index", "none, searches use exact scans"})
+		} else {
+			tw.AppendRows([]table.Row{
+				{"index", s.Index.Name},
+				{"method", s.Index.Method},
+				{"definition", s.Index.Definition},
+				{"valid", s.Index.Valid},
+				{"size", fmt.Sprintf("%dMB", s.Index.Bytes>>20)},
+			})
+		}
+		tw.AppendRows([]table.Row{
+			{"embedded chunks", s.Chunks},
+			{"hnsw.ef_search", s.EfSearch},
+			{"ivfflat.probes", s.Probes},
+			{"maintenance_work_mem", s.MaintenanceWorkMem},
+		})
+		if s.Phase != "" {
+			tw.AppendRow(table.Row{"build", fmt.Sprintf("%s (%d/%d tuples)", s.Phase, s.TuplesDone, s.TuplesTotal)})
+		}
+		tw.SetColumnConfigs([]table.ColumnConfig{{Name: "Value", WidthMax: 80}})
+		return printOutput(command.String("output"), tw, s)
+	},
+}
+
+var indexTuneCmd = &cli.Command{
+	Name:  "tune",
+	Usage: "Measure recall and latency and recommend index search settings",
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.IntFlag{
+			Name:  "queries",
+			Usage: "number of sampled chunks used as queries",
+			Value: 50,
+		},
+		&cli.IntFlag{
+			Name:  "k",
+			Usage: "number of neighbors compared against exact search",
+			Value: 10,
+		},
+		&cli.FloatFlag{
+			Name:  "target-recall",
+			Usage: "minimum recall the recommended setting must reach",
+			Value: 0.95,
+		},
+		&cli.IntSliceFlag{
+			Name:  "value",
+			Usage: "ef_search or probes values to try, defaults depend on the index type",
+		},
+		&cli.BoolFlag{
+			Name:  "apply",
+			Usage: "apply the recommended settings as database defaults",
+		},
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "do not ask for confirmation with --apply",
+		},
+		&cli.BoolFlag{
+			Name:  "history",
+			Usage: "show previously recorded samples instead of running a new measurement",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		if command.Bool("history") {
+			samples, err := r.IndexTuneHistory(ctx, 100)
+			if err != nil {
+				return err
+			}
+			fmt.Println(renderTuneSamples(samples, true))
+			return nil
+		}
+
+		report, err := r.TuneIndex(ctx, &rag.IndexTuneOptions{
+			Queries:      command.Int("queries"),
+			K:            command.Int("k"),
+			TargetRecall: command.Float("target-recall"),
+			Values:       command.IntSlice("value"),
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("chunks=%d\n", report.Chunks)
+		if report.Index != nil {
+			fmt.Printf("index=%s method=%s size=%dMB\n", report.Index.Name, report.Index.Method, report.Index.Bytes>>20)
+		}
+		if len(report.Samples) > 0 {
+			fmt.Println(renderTuneSamples(report.Samples, false))
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Setting", "Current", "Recommended"})
+		if report.Param != "" {
+			tw.AppendRow(table.Row{report.Param, report.Current, report.Recommended})
+		}
+		tw.AppendRow(table.Row{"maintenance_work_mem", report.CurrentMaintenanceWorkMem, report.RecommendedMaintenanceWorkMem})
+		fmt.Println(tw.Render())
+		for _, note := range report.Notes {
+			fmt.Println("note:", note)
+		}
+
+		if !command.Bool("apply") {
+			return nil
+		}
+		if !command.Bool("yes") && !confirm("Apply recommended settings to the database?") {
+			return nil
+		}
+		err = r.ApplyIndexTuning(ctx, report)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Applied, new connections will use the recommended settings")
+		return nil
+	},
+}
+
+func renderTuneSamples(samples []rag.IndexTuneSample, history bool) string {
+	tw := table.NewWriter()
+	header := table.Row{"Param", "Value", "Recall", "P50 (ms)", "P95 (ms)"}
+	if history {
+		header = append(table.Row{"Time", "Chunks"}, header...)
+	}
+	tw.AppendHeader(header)
+	for _, s := range samples {
+		row := table.Row{s.Param, s.Value, fmt.Sprintf("%.3f", s.Recall), fmt.Sprintf("%.2f", s.P50Ms), fmt.Sprintf("%.2f", s.P95Ms)}
+		if history {
+			row = append(table.Row{s.CreatedAt.Format("2006-01-02 15:04"), s.Chunks}, row...)
+		}
+		tw.AppendRow(row)
+	}
+	return tw.Render()
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
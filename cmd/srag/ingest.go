@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/schollz/progressbar/v3"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var ingestCmd = &cli.Command{
+	Name:  "ingest",
+	Usage: "Convert PDFs to Markdown, chunk, upsert and embed them in one pass",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "path", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		&cli.StringFlag{
+			Name:  "extractor",
+			Usage: "command converting a PDF to Markdown, writing into {output} or printing to stdout",
+			Value: "mineru -p {input} -o {output}",
+		},
+		&cli.IntFlag{
+			Name:    "jobs",
+			Aliases: []string{"j"},
+			Usage:   "number of PDFs converted concurrently",
+			Value:   2,
+		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Usage: "maximum runes per chunk",
+			Value: 1000,
+		},
+		flagChunkTokens,
+		&cli.StringFlag{
+			Name:  "analyzer",
+			Usage: "Postgres text search configuration for lexical search, remembered per collection",
+		},
+		&cli.BoolFlag{
+			Name:    "force",
+			Aliases: []string{"f"},
+			Usage:   "ingest PDFs even if their content hash is unchanged",
+		},
+		&cli.BoolFlag{
+			Name:  "compute",
+			Usage: "compute embeddings for the new chunks",
+			Value: true,
+		},
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagWebhook,
+		flagWebhookSecret,
+		flagWebhookEvent,
+		flagWebhookTimeout,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		path, err := getArgumentPath(command)
+		if err != nil {
+			return err
+		}
+		extractor := strings.Fields(command.String("extractor"))
+		if len(extractor) == 0 {
+			return errors.New("extractor is required")
+		}
+
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := &rag.RAG{DB: db}
+		r.Webhooks, err = newWebhooks(command)
+		if err != nil {
+			return err
+		}
+		if r.Webhooks != nil {
+			defer func() { _ = r.Webhooks.Close() }()
+		}
+		analyzer := command.String("analyzer")
+		if analyzer != "" {
+			err = r.ValidateTextSearchConfig(analyzer)
+			if err != nil {
+				return err
+			}
+		}
+		collection, err := r.EnsureCollection(ctx, command.String("collection"), analyzer)
+		if err != nil {
+			return err
+		}
+		if command.Bool("compute") {
+			r.Embedder, err = newEmbedder(command, defaultEmbeddingRetries)
+			if err != nil {
+				return err
+			}
+		}
+
+		ing := rag.NewIngestor()
+		ing.Converters[rag.ContentTypePDF] = &rag.CommandConverter{Command: extractor, Markdown: true}
+		ing.Chunker, err = newParagraphChunker(command)
+		if err != nil {
+			return err
+		}
+
+		paths := make([]string, 0)
+		err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && isSourcePDF(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		p := &pdfIngester{
+			root:       path,
+			r:          r,
+			ing:        ing,
+			collection: collection,
+			force:      command.Bool("force"),
+			bar:        progressbar.New(len(paths)),
+		}
+		p.bar.Describe("Ingesting PDFs")
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(max(command.Int("jobs"), 1))
+		for _, path := range paths {
+			g.Go(func() error {
+				p.ingest(gctx, path)
+				return nil
+			})
+		}
+		_ = g.Wait()
+		_ = p.bar.Finish()
+		log.Info().Int("files", len(paths)).Int("ingested", p.ingested).Int("unchanged", p.unchanged).
+			Int("chunks", p.chunks).Int("failed", len(p.failures)).Msg("Ingested")
+
+		if command.Bool("compute") && p.ingested > 0 {
+			err = r.ComputeEmbeddings(ctx, &rag.ComputeOptions{
+				OnlyEmpty:   true,
+				Collection:  collection.Name,
+				Concurrency: 3,
+				BatchSize:   32,
+			})
+			if err != nil {
+				return errors.Wrap(err, "Failed to compute embeddings")
+			}
+		}
+
+		if len(p.failures) == 0 {
+			return nil
+		}
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"File", "Error"})
+		tw.SetColumnConfigs([]table.ColumnConfig{{Name: "Error", WidthMax: 100}})
+		for _, f := range p.failures {
+			tw.AppendRow(table.Row{f.path, f.err})
+		}
+		fmt.Println(tw.Render())
+		return errors.Newf("%d of %d files failed", len(p.failures), len(paths))
+	},
+}
+
+type ingestFailure struct {
+	path string
+	err  error
+}
+
+// pdfIngester converts and upserts PDFs concurrently. A failing file is
+// recorded and doesn't stop the others.
+type pdfIngester struct {
+	root       string
+	r          *rag.RAG
+	ing        *rag.Ingestor
+	collection *rag.Collection
+	force      bool
+	bar        *progressbar.ProgressBar
+
+	mu        sync.Mutex
+	ingested  int
+	unchanged int
+	chunks    int
+	failures  []ingestFailure
+}
+
+func (p *pdfIngester) ingest(ctx context.Context, path string) {
+	defer func() { _ = p.bar.Add(1) }()
+	unchanged, chunks, err := p.ingestFile(ctx, path)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case err != nil:
+		log.Error().Err(err).Str("path", path).Msg("Ingest")
+		p.failures = append(p.failures, ingestFailure{path: path, err: err})
+	case unchanged:
+		p.unchanged++
+	default:
+		p.ingested++
+		p.chunks += chunks
+	}
+}
+
+func (p *pdfIngester) ingestFile(ctx context.Context, path string) (bool, int, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return false, 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, 0, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, 0, err
+	}
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+	if !p.force {
+		unchanged, err := p.r.SourceFileUnchanged(ctx, p.collection.Name, absPath, hash)
+		if err != nil || unchanged {
+			return unchanged, 0, err
+		}
+	}
+
+	// documents are named by their path below the root, so equal file names in different directories don't collide
+	name, err := filepath.Rel(p.root, path)
+	if err != nil || name == "." {
+		name = filepath.Base(path)
+	}
+	document, _, err := p.ing.Load(ctx, filepath.ToSlash(name), buf)
+	if err != nil {
+		return false, 0, err
+	}
+	if len(document.Chunks) == 0 {
+		return false, 0, errors.New("no text extracted")
+	}
+	document.Collection = p.collection.Name
+	document.TextSearchConfig = p.collection.TextSearchConfig
+	document.SourcePath = absPath
+	document.SourceHash = hash
+	modTime := info.ModTime()
+	document.Timestamp = &modTime
+	document.Fix()
+	err = p.r.UpsertDocumentChunks(document)
+	if err != nil {
+		return false, 0, err
+	}
+	return false, len(document.Chunks), nil
+}
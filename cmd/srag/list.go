@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var listCmd = &cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "List documents with their chunk counts and embedding coverage, globs on the path are supported",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "pattern", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagServer,
+		flagAPIKey,
+		&cli.StringFlag{
+			Name:   "collection",
+			Usage:  "list only the documents of this collection, all collections by default",
+			Config: trimSpace,
+		},
+		&cli.IntFlag{Name: "limit", Value: 100, Usage: "maximum number of documents listed, 0 lists all"},
+		&cli.IntFlag{Name: "offset", Usage: "number of documents skipped"},
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		opts := &rag.ListDocumentsOptions{
+			Collection: command.String("collection"),
+			Pattern:    command.StringArg("pattern"),
+			Limit:      command.Int("limit"),
+			Offset:     command.Int("offset"),
+		}
+		var documents []rag.DocumentInfo
+		if client := newRemoteClient(command); client != nil {
+			defer func() { _ = client.Close() }()
+			var err error
+			documents, err = client.ListDocuments(ctx, opts)
+			if err != nil {
+				return err
+			}
+		} else {
+			db, err := rag.OpenDB(command.String("dsn"))
+			if err != nil {
+				return err
+			}
+			r := rag.RAG{DB: db}
+			documents, err = r.ListDocuments(ctx, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Collection", "Document", "Chunks", "Embedded", "Updated at"})
+		for _, d := range documents {
+			tw.AppendRow(table.Row{d.Collection, d.RawDocument, d.Chunks, formatCoverage(d.Embedded, d.Chunks),
+				d.UpdatedAt.Format(time.DateTime)})
+		}
+		return printOutput(command.String("output"), tw, documents)
+	},
+}
+
+var statsCmd = &cli.Command{
+	Name:  "stats",
+	Usage: "Summarize the index: chunks, embedding coverage, storage size and vectors per model",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagServer,
+		flagAPIKey,
+		&cli.StringFlag{
+			Name:   "collection",
+			Usage:  "summarize only this collection, all collections by default",
+			Config: trimSpace,
+		},
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		var stats *rag.IndexStats
+		if client := newRemoteClient(command); client != nil {
+			defer func() { _ = client.Close() }()
+			var err error
+			stats, err = client.Stats(ctx, command.String("collection"))
+			if err != nil {
+				return err
+			}
+		} else {
+			db, err := rag.OpenDB(command.String("dsn"))
+			if err != nil {
+				return err
+			}
+			r := rag.RAG{DB: db}
+			stats, err = r.Stats(ctx, command.String("collection"))
+			if err != nil {
+				return err
+			}
+		}
+
+		tw := table.NewWriter()
+		tw.AppendRows([]table.Row{
+			{"Collections", stats.Collections},
+			{"Documents", stats.Documents},
+			{"Chunks", stats.Chunks},
+			{"Embedded", formatCoverage(stats.Embedded, stats.Chunks)},
+			{"Pending", stats.Pending},
+			{"Quantized", formatCoverage(stats.Quantized, stats.Chunks)},
+			{"Summaries", stats.Summaries},
+			{"Graph entities", stats.Entities},
+			{"Graph relations", stats.Relations},
+			{"Storage", formatBytes(stats.StorageBytes)},
+		})
+		for _, m := range stats.Models {
+			name := m.Model
+			if name == "" {
+				name = "(unnamed)"
+			}
+			state := "secondary"
+			if m.Active {
+				state = "active"
+			}
+			tw.AppendRow(table.Row{fmt.Sprintf("Vectors of %s (%s)", name, state), m.Vectors})
+		}
+		return printOutput(command.String("output"), tw, stats)
+	},
+}
+
+func formatCoverage(embedded int64, chunks int64) string {
+	if chunks == 0 {
+		return "0/0"
+	}
+	return fmt.Sprintf("%d/%d (%.0f%%)", embedded, chunks, float64(embedded)*100/float64(chunks))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
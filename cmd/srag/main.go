@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/joho/godotenv"
@@ -17,30 +18,98 @@ import (
 var cmd = &cli.Command{
 	Name:  "SlimRAG",
 	Usage: "RAG for minimalists",
+	Flags: []cli.Flag{
+		flagConfigFile,
+		flagProfile,
+		flagLLMTimeout,
+		flagLLMMaxRetries,
+		flagLLMMaxInflight,
+	},
 	Commands: []*cli.Command{
 		generateCmd,
+		ingestCmd,
 		scanCmd,
+		collectionCmd,
+		listCmd,
+		statsCmd,
+		dedupCmd,
+		graphCmd,
+		summarizeCmd,
 		computeCmd,
+		reindexCmd,
+		embeddingsCmd,
+		exportCmd,
+		importCmd,
 		cleanupCmd,
+		deleteCmd,
+		pruneCmd,
+		retentionCmd,
+		configCmd,
+		canaryCmd,
 		serveCmd,
+		apikeyCmd,
+		mcpCmd,
+		searchCmd,
 		askCmd,
+		replCmd,
+		evalCmd,
 		getChunkCmd,
+		reportCmd,
+		indexCmd,
+		migrateCmd,
 		healthCmd,
 	},
 }
 
 var trimSpace = cli.StringConfig{TrimSpace: true}
 
+// inheritedEnv holds the variables set before .env was read, which take
+// precedence over it. dotEnv holds those set from .env.
+var (
+	inheritedEnv = make(map[string]bool)
+	dotEnv       = make(map[string]bool)
+)
+
+// loadDotEnv sets the variables of .env that are not inherited, and unsets
+// those set by a previous load that are gone from it.
+func loadDotEnv() {
+	env, _ := godotenv.Read(".env")
+	for key := range dotEnv {
+		if _, ok := env[key]; !ok {
+			_ = os.Unsetenv(key)
+			delete(dotEnv, key)
+		}
+	}
+	for key, value := range env {
+		if !inheritedEnv[key] {
+			_ = os.Setenv(key, value)
+			dotEnv[key] = true
+		}
+	}
+}
+
 func main() {
-	_ = godotenv.Load(".env")
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		inheritedEnv[key] = true
+	}
+	loadDotEnv()
 
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	log.Logger = zerolog.New(pzlog.NewPtermWriter()).With().Timestamp().Caller().Stack().Logger()
 
+	var err error
+	loadedConfig, err = loadConfigFile(os.Args)
+	if err != nil {
+		log.Error().Err(err).Msg("Load config file")
+		return
+	}
+	addConfigSources([]*cli.Command{cmd})
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	err := cmd.Run(ctx, os.Args)
+	err = cmd.Run(ctx, os.Args)
 	if err != nil {
 		log.Error().Err(err).Msg("Unexpected error")
 	}
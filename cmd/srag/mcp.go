@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var mcpCmd = &cli.Command{
+	Name:  "mcp",
+	Usage: "Run a Model Context Protocol server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "transport",
+			Usage: "stdio or sse",
+			Value: "stdio",
+		},
+		&cli.StringFlag{
+			Name:    "bind",
+			Aliases: []string{"a", "l"},
+			Usage:   "listen address of the sse transport",
+			Value:   ":5001",
+		},
+		&cli.StringFlag{
+			Name:  "base-url",
+			Usage: "public base URL of the sse transport",
+		},
+		flagDSN,
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagRerankerBaseURL,
+		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		transport := command.String("transport")
+		if transport == "stdio" {
+			// stdout carries the protocol
+			log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+		}
+
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+
+		embedder, err := newEmbedder(command, defaultEmbeddingRetries)
+		if err != nil {
+			return err
+		}
+		r := &rag.RAG{DB: db, Embedder: embedder}
+		r.Reranker, err = newReranker(command)
+		if err != nil {
+			return err
+		}
+		if r.Reranker != nil {
+			r.RerankerModel = command.String("reranker-model")
+			defer func() { _ = r.Reranker.Close() }()
+		}
+
+		s := rag.NewMCPServer(r)
+		switch transport {
+		case "stdio":
+			return server.NewStdioServer(s).Listen(ctx, os.Stdin, os.Stdout)
+		case "sse":
+			var opts []server.SSEOption
+			if baseURL := command.String("base-url"); baseURL != "" {
+				opts = append(opts, server.WithBaseURL(baseURL))
+			}
+			sse := server.NewSSEServer(s, opts...)
+			go func() {
+				<-ctx.Done()
+				closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				_ = sse.Shutdown(closeCtx)
+			}()
+			err = sse.Start(command.String("bind"))
+			if err == nil || errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		default:
+			return errors.Newf("unknown transport: '%s'", transport)
+		}
+	},
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var migrateCmd = &cli.Command{
+	Name:  "migrate",
+	Usage: "Manage the versioned database schema",
+	Commands: []*cli.Command{
+		migrateUpCmd,
+		migrateDownCmd,
+		migrateStatusCmd,
+	},
+}
+
+var migrateUpCmd = &cli.Command{
+	Name:  "up",
+	Usage: "Apply the pending migrations, safe to run from several instances at once",
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.ConnectDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		applied, err := (&rag.RAG{DB: db}).MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("applied", len(applied)).Int("version", rag.LatestSchemaVersion()).Msg("Schema is up to date")
+		return nil
+	},
+}
+
+var migrateDownCmd = &cli.Command{
+	Name:  "down",
+	Usage: "Revert migrations, the latest one unless --to is given",
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.IntFlag{
+			Name:  "to",
+			Usage: "version to revert to, 0 drops all tables",
+			Value: -1,
+		},
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "do not ask for confirmation",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.ConnectDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := &rag.RAG{DB: db}
+		to := command.Int("to")
+		if to < 0 {
+			statuses, err := r.MigrationStatus(ctx)
+			if err != nil {
+				return err
+			}
+			for _, s := range statuses {
+				if s.AppliedAt != nil && !s.Unknown {
+					to = s.Version - 1
+				}
+			}
+			if to < 0 {
+				log.Info().Msg("No migration to revert")
+				return nil
+			}
+		}
+
+		prompt := "Revert the schema to version " + strconv.Itoa(to) + "? Data in reverted tables and columns is lost."
+		if to == 0 {
+			prompt = "Revert the baseline? All tables and their data are dropped."
+		}
+		if !command.Bool("yes") && !confirm(prompt) {
+			return nil
+		}
+		reverted, err := r.MigrateDown(ctx, to)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("reverted", len(reverted)).Int("version", to).Msg("Schema reverted")
+		return nil
+	},
+}
+
+var migrateStatusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "Show the migrations of this binary and when they were applied",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.ConnectDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		statuses, err := (&rag.RAG{DB: db}).MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Version", "Name", "State", "Applied at"})
+		for _, s := range statuses {
+			state, appliedAt := "pending", ""
+			if s.AppliedAt != nil {
+				state, appliedAt = "applied", s.AppliedAt.Format(time.DateTime)
+			}
+			if s.Unknown {
+				state = "unknown, applied by a newer binary"
+			}
+			tw.AppendRow(table.Row{s.Version, s.Name, state, appliedAt})
+		}
+		return printOutput(command.String("output"), tw, statuses)
+	},
+}
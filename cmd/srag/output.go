@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+const (
+	outputTable    = "table"
+	outputMarkdown = "markdown"
+	outputCSV      = "csv"
+	outputJSON     = "json"
+	outputYAML     = "yaml"
+	// outputText prints chunks as plain text, only offered by get.
+	outputText = "text"
+)
+
+func validateOutput(format string) error {
+	switch format {
+	case outputTable, outputMarkdown, outputCSV, outputJSON, outputYAML:
+		return nil
+	default:
+		return errors.Newf("unknown output format: '%s', expected table, markdown, csv, json or yaml", format)
+	}
+}
+
+var flagOutput = &cli.StringFlag{
+	Name:      "output",
+	Usage:     "output format: table, markdown, csv, json or yaml",
+	Value:     outputTable,
+	Validator: validateOutput,
+}
+
+// chunkRecord is the machine readable form of a search result or chunk.
+// Field names are part of the CLI's interface, don't rename them.
+type chunkRecord struct {
+	Rank        int     `json:"rank,omitempty"`
+	Score       float64 `json:"score"`
+	ID          string  `json:"id"`
+	Collection  string  `json:"collection"`
+	Document    string  `json:"document"`
+	RawDocument string  `json:"raw_document"`
+	Index       int     `json:"index"`
+	SourcePath  string  `json:"source_path"`
+	Page        int     `json:"page"`
+	Section     string  `json:"section"`
+	// PageEnd, Headings and the offsets locate the chunk in its source, for
+	// deep links; the offsets are runes into the extracted text.
+	PageEnd     int      `json:"page_end"`
+	Headings    []string `json:"headings"`
+	StartOffset int      `json:"start_offset"`
+	EndOffset   int      `json:"end_offset"`
+	Tags        []string `json:"tags"`
+	// Level is 1 for section and 2 for document summaries, see --summaries.
+	Level int `json:"level,omitempty"`
+	// DocumentTime is when the document was written, ranked by --recency-half-life.
+	DocumentTime *time.Time `json:"document_time,omitempty"`
+	MoreMatches  int        `json:"more_matches"`
+	Text         string     `json:"text"`
+	// Span is set for results widened with --neighbors or --parent-section.
+	Span *rag.ChunkSpan `json:"span,omitempty"`
+	// Duplicates lists the chunks of other documents collapsed by dedup.
+	Duplicates []rag.DuplicateSource `json:"duplicates,omitempty"`
+}
+
+// newChunkRecord returns the record of c, rank is its 1-based position in
+// the results or 0 outside of a result list.
+func newChunkRecord(c *rag.DocumentChunk, rank int) chunkRecord {
+	tags := c.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	headings := c.Headings
+	if headings == nil {
+		headings = []string{}
+	}
+	return chunkRecord{
+		Rank:         rank,
+		Score:        c.Score,
+		ID:           c.ID,
+		Collection:   c.Collection,
+		Document:     c.Document,
+		RawDocument:  c.RawDocument,
+		Index:        c.Index,
+		SourcePath:   c.SourcePath,
+		Page:         c.Page,
+		Section:      c.Section,
+		PageEnd:      c.PageEnd,
+		Headings:     headings,
+		StartOffset:  c.StartOffset,
+		EndOffset:    c.EndOffset,
+		Tags:         tags,
+		Level:        c.Level,
+		DocumentTime: c.DocumentTime,
+		MoreMatches:  c.Collapsed,
+		Text:         c.Text,
+		Span:         c.Span,
+		Duplicates:   c.Duplicates,
+	}
+}
+
+// documentCell lists the document of a result with the documents of the
+// duplicates collapsed into it.
+func documentCell(c *rag.DocumentChunk) string {
+	cell := c.Document
+	for _, d := range c.Duplicates {
+		cell += "\n= " + d.Document
+	}
+	return cell
+}
+
+// formatScore keeps the digits that tell results apart, RRF scores are around 0.01.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', 4, 64)
+}
+
+// printOutput prints tw for the table and markdown formats, and records, a
+// slice or a single record, with the field names of their JSON tags for the others.
+func printOutput(format string, tw table.Writer, records any) error {
+	switch format {
+	case outputTable:
+		fmt.Println(tw.Render())
+		return nil
+	case outputMarkdown:
+		fmt.Println(tw.RenderMarkdown())
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode output")
+	}
+	switch format {
+	case outputJSON:
+		fmt.Println(string(buf))
+		return nil
+	case outputYAML, outputCSV:
+		// decoding JSON as YAML keeps the field names and their order
+		var doc yaml.Node
+		err = yaml.Unmarshal(buf, &doc)
+		if err != nil {
+			return errors.Wrap(err, "Failed to encode output")
+		}
+		if format == outputCSV {
+			return writeCSV(&doc)
+		}
+		resetYAMLStyle(&doc)
+		buf, err = yaml.Marshal(&doc)
+		if err != nil {
+			return errors.Wrap(err, "Failed to encode output")
+		}
+		fmt.Print(string(buf))
+		return nil
+	default:
+		return validateOutput(format)
+	}
+}
+
+// resetYAMLStyle turns the flow style of decoded JSON into block style.
+func resetYAMLStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		resetYAMLStyle(c)
+	}
+}
+
+// writeCSV writes a mapping or a sequence of mappings as CSV, with a column for
+// every key in the order first seen. Lists are joined with commas, nested objects are JSON.
+func writeCSV(doc *yaml.Node) error {
+	var rows []*yaml.Node
+	if len(doc.Content) > 0 {
+		rows = doc.Content[0].Content
+		if doc.Content[0].Kind == yaml.MappingNode {
+			rows = doc.Content[:1]
+		}
+	}
+	columns := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		for i := 0; i+1 < len(row.Content); i += 2 {
+			key := row.Content[i].Value
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	err := w.Write(columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := make(map[string]string, len(row.Content)/2)
+		for i := 0; i+1 < len(row.Content); i += 2 {
+			values[row.Content[i].Value], err = csvValue(row.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = values[column]
+		}
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func csvValue(n *yaml.Node) (string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return "", nil
+		}
+		return n.Value, nil
+	case yaml.SequenceNode:
+		values := make([]string, len(n.Content))
+		for i, c := range n.Content {
+			v, err := csvValue(c)
+			if err != nil {
+				return "", err
+			}
+			values[i] = v
+		}
+		return strings.Join(values, ","), nil
+	default:
+		var v any
+		err := n.Decode(&v)
+		if err != nil {
+			return "", err
+		}
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	}
+}
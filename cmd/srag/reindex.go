@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var reindexCmd = &cli.Command{
+	Name:  "reindex",
+	Usage: "Recompute all embeddings with another model and switch over when complete",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagEmbeddingBaseURL,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagOutput,
+		&cli.StringFlag{
+			Name:  "model",
+			Usage: "embedding model to switch to, run again with the same model to resume",
+		},
+		&cli.BoolFlag{
+			Name:  "no-switch",
+			Usage: "keep the embeddings side by side with the active model's, search them with --embedding-model",
+		},
+		&cli.BoolFlag{
+			Name:  "status",
+			Usage: "show the embedding models and the progress of reindexing instead",
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Aliases: []string{"workers", "j"},
+			Usage:   "number of embedding requests in flight",
+			Value:   3,
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "number of chunks per embedding request",
+			Value: 32,
+		},
+		&cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "retries with exponential backoff on 429 and 5xx responses",
+			Value: 5,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+
+		if command.Bool("status") {
+			r := rag.RAG{DB: db}
+			models, err := r.EmbeddingModels(ctx)
+			if err != nil {
+				return err
+			}
+			tw := table.NewWriter()
+			tw.AppendHeader(table.Row{"Model", "Dims", "State", "Embedded", "Updated at"})
+			for _, m := range models {
+				state := "secondary"
+				switch {
+				case m.Active:
+					state = "active"
+				case m.Embedded < m.Chunks:
+					state = "reindexing"
+				}
+				tw.AppendRow(table.Row{m.Name, m.Dims, state, fmt.Sprintf("%d/%d", m.Embedded, m.Chunks),
+					m.UpdatedAt.Format(time.DateTime)})
+			}
+			return printOutput(command.String("output"), tw, models)
+		}
+
+		model := command.String("model")
+		if model == "" {
+			return errors.New("model is required")
+		}
+		embedder, err := rag.NewEmbedder(&rag.EmbedderOptions{
+			Provider:  command.String("embedding-provider"),
+			BaseURL:   command.String("embedding-base-url"),
+			Model:     model,
+			APIKey:    command.String("embedding-api-key"),
+			Transport: newModelTransport(command, command.Int("max-retries")),
+		})
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db, Embedder: embedder}
+		report, err := r.Reindex(ctx, &rag.ReindexOptions{
+			Concurrency: command.Int("concurrency"),
+			BatchSize:   command.Int("batch-size"),
+			NoSwitch:    command.Bool("no-switch"),
+		})
+		if err != nil {
+			return err
+		}
+		if command.Bool("no-switch") {
+			log.Info().Str("model", report.Model).Int("dims", report.Dims).
+				Int64("computed", report.Computed).Int64("resumed", report.Resumed).
+				Msg("Embedded side by side")
+			return nil
+		}
+		log.Info().Str("model", report.Model).Int("dims", report.Dims).
+			Int64("computed", report.Computed).Int64("resumed", report.Resumed).
+			Msg("Switched embedding model")
+		if report.Cleared > 0 {
+			log.Warn().Int64("chunks", report.Cleared).
+				Msg("Chunks were added while switching over, run compute to embed them")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/urfave/cli/v3"
+)
+
+// onCommandLine reports whether f was given as an argument rather than by
+// the environment or its default.
+func onCommandLine(f cli.Flag) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if slices.Contains(f.Names(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadFlags reads .env and the config file again and sets the flags not given
+// on the command line to their environment variables or config keys, or their
+// defaults once both are gone, keeping the precedence of startup. Every value
+// is validated before any flag is set, so an invalid one leaves all of them
+// as they were. The returned func sets them back, e.g. when the reloaded
+// values fail to configure the models.
+func reloadFlags(command *cli.Command, flags ...cli.Flag) (func(), error) {
+	loadDotEnv()
+	config, err := loadConfigFile(os.Args)
+	if err != nil {
+		return nil, err
+	}
+	previousConfig := loadedConfig
+	loadedConfig = config
+
+	type reload struct{ name, value, previous string }
+	var reloads []reload
+	for _, f := range flags {
+		if onCommandLine(f) {
+			continue
+		}
+		r := reload{name: f.Names()[0]}
+		var ok bool
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			r.value, ok = f.Sources.Lookup()
+			if !ok {
+				r.value = f.Value
+			}
+			r.value = strings.TrimSpace(r.value)
+			if f.Validator != nil {
+				err = f.Validator(r.value)
+			}
+			r.previous = command.String(r.name)
+		case *cli.DurationFlag:
+			r.value, ok = f.Sources.Lookup()
+			if !ok {
+				r.value = f.Value.String()
+			}
+			r.value = strings.TrimSpace(r.value)
+			var d time.Duration
+			d, err = time.ParseDuration(r.value)
+			if err == nil && f.Validator != nil {
+				err = f.Validator(d)
+			}
+			r.previous = command.Duration(r.name).String()
+		default:
+			err = errors.Newf("flag '%s' cannot be reloaded", r.name)
+		}
+		if err != nil {
+			loadedConfig = previousConfig
+			return nil, errors.Wrapf(err, "Failed to reload %s", r.name)
+		}
+		reloads = append(reloads, r)
+	}
+
+	restore := func() {
+		loadedConfig = previousConfig
+		for _, r := range reloads {
+			_ = command.Set(r.name, r.previous)
+		}
+	}
+	for _, r := range reloads {
+		err = command.Set(r.name, r.value)
+		if err != nil {
+			restore()
+			return nil, errors.Wrapf(err, "Failed to reload %s", r.name)
+		}
+	}
+	return restore, nil
+}
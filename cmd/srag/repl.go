@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/cockroachdb/errors"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+const replHelp = `<query>              search, with the settings below
+/ask <question>      search and answer the question with the assistant
+/get <id or #>       print a chunk by ID, or the #-th result of the last search
+/set <key> <value>   change a setting: collection, filter, mode, limit, rerank, recency-half-life, graph
+                     or summaries
+/show                print the settings
+/help                print this help
+/quit                exit, as does Ctrl-D`
+
+var replCmd = &cli.Command{
+	Name:  "repl",
+	Usage: "Search and ask interactively, keeping the database and model clients open",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		flagFilter,
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagRerankerBaseURL,
+		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
+		flagAssistantBaseURL,
+		flagAssistantModel,
+		flagRecencyHalfLife,
+		flagGraph,
+		flagSummaries,
+		&cli.StringFlag{
+			Name:  "history",
+			Usage: "file the entered lines are kept in, empty to keep none",
+			Value: defaultReplHistory(),
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		embedder, err := newEmbedder(command, defaultEmbeddingRetries)
+		if err != nil {
+			return err
+		}
+		reranker, err := newReranker(command)
+		if err != nil {
+			return err
+		}
+		if reranker != nil {
+			defer func() { _ = reranker.Close() }()
+		}
+		assistantClient := newAssistantClient(command)
+		r := &rag.RAG{
+			DB:              db,
+			Embedder:        embedder,
+			Reranker:        reranker,
+			RerankerModel:   command.String("reranker-model"),
+			AssistantClient: &assistantClient,
+			AssistantModel:  command.String("assistant-model"),
+		}
+		config, err := r.CurrentConfig(ctx)
+		if err != nil {
+			return err
+		}
+
+		s := &replSession{
+			r:          r.WithConfig(config),
+			collection: command.String("collection"),
+			mode:       config.Config.Mode,
+			limit:      config.Config.Limit,
+			rerank:     reranker != nil,
+			graph:      command.Bool("graph"),
+			summaries:  command.Bool("summaries"),
+		}
+		for _, kv := range [][2]string{
+			{"filter", command.String("filter")},
+			{"recency-half-life", command.String("recency-half-life")},
+		} {
+			if err = s.set(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+
+		rl, err := readline.NewEx(&readline.Config{
+			Prompt:          "srag> ",
+			HistoryFile:     command.String("history"),
+			InterruptPrompt: "^C",
+			EOFPrompt:       "/quit",
+		})
+		if err != nil {
+			return errors.Wrap(err, "Failed to open terminal")
+		}
+		defer func() { _ = rl.Close() }()
+
+		fmt.Println("Type /help for commands.")
+		for {
+			line, err := rl.Readline()
+			if errors.Is(err, readline.ErrInterrupt) {
+				if line == "" {
+					return nil
+				}
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if line == "/quit" || line == "/exit" {
+				return nil
+			}
+			// Ctrl-C cancels the running command rather than the session
+			cmdCtx, stop := signal.NotifyContext(context.WithoutCancel(ctx), os.Interrupt)
+			err = s.run(cmdCtx, line)
+			stop()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			}
+		}
+	},
+}
+
+func defaultReplHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".srag_history")
+}
+
+// replSession is the state of a repl: the open clients, the settings every
+// search takes, and the last results, which /get can refer to by rank.
+type replSession struct {
+	r          *rag.RAG
+	collection string
+	filter     *rag.Filter
+	mode       rag.SearchMode
+	limit      int
+	rerank     bool
+	halfLife   time.Duration
+	graph      bool
+	summaries  bool
+	last       []rag.DocumentChunk
+}
+
+func (s *replSession) run(ctx context.Context, line string) error {
+	if !strings.HasPrefix(line, "/") {
+		return s.search(ctx, line)
+	}
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/ask":
+		if arg == "" {
+			return errors.New("question is required")
+		}
+		return s.ask(ctx, arg)
+	case "/get":
+		if arg == "" {
+			return errors.New("id is required")
+		}
+		return s.get(arg)
+	case "/set":
+		key, value, _ := strings.Cut(arg, " ")
+		return s.set(key, strings.TrimSpace(value))
+	case "/show":
+		s.show()
+		return nil
+	case "/help":
+		fmt.Println(replHelp)
+		return nil
+	default:
+		return errors.Newf("unknown command '%s', type /help for commands", name)
+	}
+}
+
+func (s *replSession) searchOptions(query string) *rag.SearchOptions {
+	cfg := &s.r.Config.Config
+	return &rag.SearchOptions{
+		Query:      query,
+		Collection: s.collection,
+		Filter:     s.filter,
+		Limit:      s.limit,
+		Mode:       s.mode,
+		Rerank:     s.rerank,
+		Candidates: s.limit * cfg.CandidatesPerResult,
+		Fusion:     cfg.Fusion,
+
+		RecencyHalfLife: s.halfLife,
+		Graph:           s.graph,
+		Summaries:       s.summaries,
+	}
+}
+
+func (s *replSession) search(ctx context.Context, query string) error {
+	chunks, err := s.r.Search(ctx, s.searchOptions(query))
+	if err != nil {
+		return err
+	}
+	s.last = chunks
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"#", "Chunk ID", "Document", "Score", "Text"})
+	tw.SetColumnConfigs([]table.ColumnConfig{{Name: "Text", WidthMax: 80}})
+	for i, chunk := range chunks {
+		tw.AppendRow(table.Row{i + 1, chunk.ID, documentCell(&chunk), formatScore(chunk.Score), chunk.Text})
+	}
+	fmt.Println(tw.Render())
+	return nil
+}
+
+// ask streams the answer to question as the assistant writes it.
+func (s *replSession) ask(ctx context.Context, question string) error {
+	chunks, err := s.r.Search(ctx, s.searchOptions(question))
+	if err != nil {
+		return err
+	}
+	s.last = chunks
+	answer, err := s.r.AskStream(ctx, question, chunks, func(token string) error {
+		fmt.Print(token)
+		return nil
+	})
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	printSources(answer, answer.Chunks)
+	return nil
+}
+
+// get prints the chunk of an ID, or of a rank of the last results.
+func (s *replSession) get(id string) error {
+	if rank, err := strconv.Atoi(id); err == nil && rank >= 1 && rank <= len(s.last) {
+		return printChunk(outputText, &s.last[rank-1])
+	}
+	c, err := s.r.GetDocumentChunk(id)
+	if err != nil {
+		return err
+	}
+	return printChunk(outputText, c)
+}
+
+func (s *replSession) set(key, value string) error {
+	switch key {
+	case "collection":
+		s.collection = value
+	case "filter":
+		if value == "" {
+			s.filter = nil
+			return nil
+		}
+		filter, err := rag.ParseFilter(value)
+		if err != nil {
+			return err
+		}
+		s.filter = filter
+	case "mode":
+		mode, err := rag.ParseSearchMode(value)
+		if err != nil {
+			return err
+		}
+		s.mode = mode
+	case "limit":
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return errors.Newf("invalid limit '%s', expected a positive number", value)
+		}
+		s.limit = limit
+	case "rerank":
+		rerank, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Newf("invalid rerank '%s', expected true or false", value)
+		}
+		if rerank && s.r.Reranker == nil {
+			return errors.New("no reranker is configured, set --reranker-base-url or --reranker-api-key")
+		}
+		s.rerank = rerank
+	case "recency-half-life":
+		halfLife, err := rag.ParseHalfLife(value)
+		if err != nil {
+			return err
+		}
+		s.halfLife = halfLife
+	case "graph":
+		graph, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Newf("invalid graph '%s', expected true or false", value)
+		}
+		s.graph = graph
+	case "summaries":
+		summaries, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Newf("invalid summaries '%s', expected true or false", value)
+		}
+		s.summaries = summaries
+	default:
+		return errors.Newf("unknown setting '%s', expected collection, filter, mode, limit, rerank, "+
+			"recency-half-life, graph or summaries", key)
+	}
+	return nil
+}
+
+func (s *replSession) show() {
+	filter := ""
+	if s.filter != nil {
+		filter = s.filter.String()
+	}
+	halfLife := ""
+	if s.halfLife > 0 {
+		halfLife = s.halfLife.String()
+	}
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"Setting", "Value"})
+	tw.AppendRows([]table.Row{
+		{"collection", s.collection},
+		{"filter", filter},
+		{"mode", s.mode},
+		{"limit", s.limit},
+		{"rerank", s.rerank},
+		{"recency-half-life", halfLife},
+		{"graph", s.graph},
+		{"summaries", s.summaries},
+	})
+	fmt.Println(tw.Render())
+}
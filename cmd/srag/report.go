@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var reportCmd = &cli.Command{
+	Name:  "report",
+	Usage: "Generate reports about the index",
+	Commands: []*cli.Command{
+		corpusHealthCmd,
+	},
+}
+
+var corpusHealthCmd = &cli.Command{
+	Name:  "corpus-health",
+	Usage: "Report embedding and chunk statistics and flag anomalies",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagCollection,
+		&cli.IntFlag{
+			Name:  "sample",
+			Usage: "number of chunks sampled for nearest-neighbor distances",
+			Value: 500,
+		},
+		&cli.FloatFlag{
+			Name:  "z-threshold",
+			Usage: "z-score above which values are flagged",
+			Value: 3,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+
+		report, err := r.CorpusHealth(ctx, &rag.CorpusHealthOptions{
+			Collection: command.String("collection"),
+			SampleSize: command.Int("sample"),
+			ZThreshold: command.Float("z-threshold"),
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("collection=%s model=%s chunks=%d embedded=%d quantized=%d\n",
+			report.Collection, report.Model, report.Chunks, report.Embedded, report.Quantized)
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Metric", "Count", "Min", "Mean", "StdDev", "P50", "P95", "Max"})
+		for _, m := range []struct {
+			name string
+			d    rag.Distribution
+		}{
+			{"Embedding norm", report.Norms},
+			{"Neighbor distance", report.NeighborDistances},
+			{"Text length", report.TextLengths},
+		} {
+			tw.AppendRow(table.Row{m.name, m.d.Count, m.d.Min, m.d.Mean, m.d.StdDev, m.d.P50, m.d.P95, m.d.Max})
+		}
+		for _, m := range report.Models {
+			d := m.Norms
+			tw.AppendRow(table.Row{"Embedding norm (" + m.Model + ")", d.Count, d.Min, d.Mean, d.StdDev, d.P50, d.P95, d.Max})
+		}
+		fmt.Println(tw.Render())
+
+		tw = table.NewWriter()
+		tw.AppendHeader(table.Row{"Text length", "Chunks"})
+		for _, b := range report.LengthHistogram {
+			if b.Upper < 0 {
+				tw.AppendRow(table.Row{fmt.Sprintf(">= %d", b.Lower), b.Count})
+			} else {
+				tw.AppendRow(table.Row{fmt.Sprintf("%d - %d", b.Lower, b.Upper), b.Count})
+			}
+		}
+		fmt.Println(tw.Render())
+
+		if len(report.Outliers) > 0 {
+			tw = table.NewWriter()
+			tw.AppendHeader(table.Row{"Outlier chunk", "Document", "Neighbor distance"})
+			for _, o := range report.Outliers {
+				tw.AppendRow(table.Row{o.ID, o.Document, o.Distance})
+			}
+			fmt.Println(tw.Render())
+		}
+
+		if len(report.Anomalies) > 0 {
+			tw = table.NewWriter()
+			tw.AppendHeader(table.Row{"Document", "Chunks", "Value", "Anomaly"})
+			for _, a := range report.Anomalies {
+				tw.AppendRow(table.Row{a.Document, a.Chunks, a.Value, a.Reason})
+			}
+			fmt.Println(tw.Render())
+		} else {
+			fmt.Println("No anomalies found")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var retentionCmd = &cli.Command{
+	Name:  "retention",
+	Usage: "Manage retention policies for documents and their superseded versions",
+	Commands: []*cli.Command{
+		retentionSetCmd,
+		retentionListCmd,
+		retentionRemoveCmd,
+		retentionPreviewCmd,
+		retentionRunCmd,
+	},
+}
+
+var retentionSetCmd = &cli.Command{
+	Name:  "set",
+	Usage: "Create or replace a retention policy",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "name", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "only apply the policy to this collection, empty applies to all",
+		},
+		&cli.StringFlag{
+			Name:     "pattern",
+			Usage:    "glob matched against document IDs and paths",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "keep-versions",
+			Usage: "number of superseded versions kept per document",
+		},
+		&cli.DurationFlag{
+			Name:  "expire-after",
+			Usage: "remove documents and versions not updated for this long, 0 never expires",
+		},
+		&cli.StringFlag{
+			Name:  "archive-bucket",
+			Usage: "object storage bucket receiving removed chunks before deletion",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		return r.SetRetentionPolicy(ctx, &rag.RetentionPolicy{
+			Name:          command.StringArg("name"),
+			Collection:    command.String("collection"),
+			Pattern:       command.String("pattern"),
+			KeepVersions:  command.Int("keep-versions"),
+			ExpireAfter:   command.Duration("expire-after"),
+			ArchiveBucket: command.String("archive-bucket"),
+		})
+	},
+}
+
+var retentionListCmd = &cli.Command{
+	Name:  "list",
+	Usage: "List retention policies in the order they are matched",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagOutput,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		policies, err := r.ListRetentionPolicies(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := table.NewWriter()
+		tw.AppendHeader(table.Row{"Name", "Collection", "Pattern", "Keep versions", "Expire after", "Archive bucket"})
+		for _, p := range policies {
+			expireAfter := "never"
+			if p.ExpireAfter > 0 {
+				expireAfter = p.ExpireAfter.String()
+			}
+			tw.AppendRow(table.Row{p.Name, p.Collection, p.Pattern, p.KeepVersions, expireAfter, p.ArchiveBucket})
+		}
+		return printOutput(command.String("output"), tw, policies)
+	},
+}
+
+var retentionRemoveCmd = &cli.Command{
+	Name:  "remove",
+	Usage: "Remove a retention policy",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "name", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		return r.DeleteRetentionPolicy(ctx, command.StringArg("name"))
+	},
+}
+
+var retentionPreviewCmd = &cli.Command{
+	Name:  "preview",
+	Usage: "Show what the next retention run would remove",
+	Flags: []cli.Flag{
+		flagDSN,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db}
+		items, err := r.PlanRetention(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		printRetentionItems(items)
+		return nil
+	},
+}
+
+var retentionRunCmd = &cli.Command{
+	Name:  "run",
+	Usage: "Apply retention policies now",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagOSSEndpoint,
+		flagOSSAccessKey,
+		flagOSSSecretAccessKey,
+		flagOSSSecure,
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		oss, err := newOSS(command)
+		if err != nil {
+			return err
+		}
+		r := rag.RAG{DB: db, OSS: oss}
+		items, err := r.PlanRetention(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		err = r.ApplyRetention(ctx, items)
+		if err != nil {
+			return err
+		}
+		printRetentionItems(items)
+		log.Info().Int("items", len(items)).Msg("Applied retention policies")
+		return nil
+	},
+}
+
+func printRetentionItems(items []rag.RetentionItem) {
+	if len(items) == 0 {
+		fmt.Println("Nothing to remove")
+		return
+	}
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"Collection", "Document", "Reason", "Version", "Chunks", "Updated at", "Policy"})
+	for _, item := range items {
+		version := "current"
+		if item.SupersededAt != nil {
+			version = item.SupersededAt.Format(time.DateTime)
+		}
+		tw.AppendRow(table.Row{item.Collection, item.Document, item.Reason, version, item.Chunks, item.UpdatedAt.Format(time.DateTime), item.Policy})
+	}
+	fmt.Println(tw.Render())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog/log"
+	"github.com/schollz/progressbar/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+// scanS3 upserts the objects below prefix whose names match, and the members
+// of archives among them. Objects are named by their key below prefix.
+func (s *scanner) scanS3(ctx context.Context, client *minio.Client, bucket string, prefix string,
+	match func(name string) bool,
+) error {
+	objects := make([]minio.ObjectInfo, 0)
+	for object := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return errors.Wrapf(object.Err, "Failed to list s3://%s/%s", bucket, prefix)
+		}
+		if !strings.HasSuffix(object.Key, "/") && match(path.Base(object.Key)) {
+			objects = append(objects, object)
+		}
+	}
+
+	bar := progressbar.New(len(objects))
+	bar.Describe("Uploading chunks")
+	for _, object := range objects {
+		_ = bar.Add(1)
+		s.scanObject(ctx, client, bucket, prefix, object.Key, object.LastModified)
+	}
+	_ = bar.Finish()
+	log.Info().Int("objects", len(objects)).Int("unchanged", s.unchanged).Msg("Scanned")
+	return nil
+}
+
+func (s *scanner) scanObject(ctx context.Context, client *minio.Client, bucket string, prefix string, key string,
+	modTime time.Time,
+) {
+	sourcePath := rag.S3Scheme + bucket + "/" + key
+	obj, err := client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		log.Error().Err(err).Str("path", sourcePath).Msg("Get object")
+		return
+	}
+	defer func() { _ = obj.Close() }()
+	buf, err := io.ReadAll(obj)
+	if err != nil {
+		log.Error().Err(err).Str("path", sourcePath).Msg("Read object")
+		return
+	}
+
+	if isArchive(key) {
+		err = s.scanArchive(ctx, sourcePath, buf)
+		if err != nil {
+			log.Error().Err(err).Str("path", sourcePath).Msg("Read archive")
+		}
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+	if name == "" {
+		name = path.Base(key)
+	}
+	s.scanSource(ctx, name, sourcePath, modTime, buf)
+}
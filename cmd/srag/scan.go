@@ -3,10 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/gobwas/glob"
 	"github.com/goccy/go-json"
 	"github.com/rs/zerolog/log"
@@ -18,20 +24,62 @@ import (
 
 var scanCmd = &cli.Command{
 	Name:  "scan",
-	Usage: "Scan directories for files and upsert them into the database",
+	Usage: "Scan directories, archives, object storage or stdin for files and upsert them into the database",
 	Arguments: []cli.Argument{
-		&cli.StringArg{Name: "path"},
+		&cli.StringArg{Name: "path", UsageText: "directory, .tar.gz or .zip archive, s3://bucket/prefix, or - for stdin"},
 	},
 	Flags: []cli.Flag{
 		flagDSN,
+		flagCollection,
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "chunks for pre-chunked JSON, or txt, md, html or docx to chunk raw files",
+			Value: "chunks",
+		},
 		&cli.StringFlag{
 			Name:    "glob",
 			Aliases: []string{"g"},
-			Value:   "*.md.chunks.json",
+			Usage:   "file name pattern, defaults to the extension of the format, e.g. *.md.chunks.json",
 		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Usage: "maximum runes per chunk of raw files",
+			Value: 1000,
+		},
+		flagChunkTokens,
 		&cli.BoolFlag{
 			Name: "dry-run",
 		},
+		&cli.StringFlag{
+			Name:  "analyzer",
+			Usage: "Postgres text search configuration for lexical search, e.g. english or a zhparser configuration, remembered per collection",
+		},
+		&cli.BoolFlag{
+			Name:    "force",
+			Aliases: []string{"f"},
+			Usage:   "upsert files even if their content hash is unchanged",
+		},
+		&cli.BoolFlag{
+			Name:    "watch",
+			Aliases: []string{"w"},
+			Usage:   "keep watching the directory and upsert new or modified files",
+		},
+		&cli.BoolFlag{
+			Name:  "compute",
+			Usage: "compute embeddings for new chunks after upserting",
+		},
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagOSSEndpoint,
+		flagOSSAccessKey,
+		flagOSSSecretAccessKey,
+		flagOSSSecure,
+		flagWebhook,
+		flagWebhookSecret,
+		flagWebhookEvent,
+		flagWebhookTimeout,
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		path, err := getArgumentPath(command)
@@ -39,8 +87,14 @@ var scanCmd = &cli.Command{
 			return err
 		}
 		dsn := command.String("dsn")
-		dryRun := command.Bool("dry-run")
+		format, ok := scanFormats[command.String("format")]
+		if !ok {
+			return errors.Newf("unknown format '%s', expected chunks, txt, md, html or docx", command.String("format"))
+		}
 		globStr := command.String("glob")
+		if globStr == "" {
+			globStr = format.glob
+		}
 
 		g, err := glob.Compile(globStr)
 		if err != nil {
@@ -52,53 +106,310 @@ var scanCmd = &cli.Command{
 			return err
 		}
 
-		r := rag.RAG{DB: db}
+		s := &scanner{
+			root:        path,
+			glob:        g,
+			contentType: format.contentType,
+			r:           &rag.RAG{DB: db},
+			collection:  command.String("collection"),
+			analyzer:    command.String("analyzer"),
+			dryRun:      command.Bool("dry-run"),
+			compute:     command.Bool("compute"),
+			force:       command.Bool("force"),
+		}
+		s.r.Webhooks, err = newWebhooks(command)
+		if err != nil {
+			return err
+		}
+		if s.r.Webhooks != nil {
+			defer func() { _ = s.r.Webhooks.Close() }()
+		}
+		if s.contentType != rag.ContentTypeChunks {
+			s.ing = rag.NewIngestor()
+			s.ing.Chunker, err = newParagraphChunker(command)
+			if err != nil {
+				return err
+			}
+		}
+		if s.analyzer != "" {
+			err = s.r.ValidateTextSearchConfig(s.analyzer)
+			if err != nil {
+				return err
+			}
+		}
+		if !s.dryRun {
+			c, err := s.r.EnsureCollection(ctx, command.String("collection"), s.analyzer)
+			if err != nil {
+				return err
+			}
+			s.analyzer = c.TextSearchConfig
+		}
+		if s.compute {
+			s.r.Embedder, err = newEmbedder(command, 5)
+			if err != nil {
+				return err
+			}
+		}
+
+		if path == "-" {
+			if command.Bool("watch") {
+				return errors.New("stdin can't be watched")
+			}
+			err = s.scanStdin(ctx, os.Stdin)
+			if err != nil {
+				return err
+			}
+			s.computeEmbeddings(ctx)
+			return nil
+		}
+
+		match := func(name string) bool { return g.Match(name) || isArchive(name) }
+		if bucket, prefix, ok := rag.ParseS3URL(path); ok {
+			if command.Bool("watch") {
+				return errors.New("object storage can't be watched")
+			}
+			client, err := newOSS(command)
+			if err != nil {
+				return err
+			}
+			if client == nil {
+				return errors.New("s3:// paths require --oss-endpoint")
+			}
+			err = s.scanS3(ctx, client, bucket, prefix, match)
+			if err != nil {
+				return err
+			}
+			s.computeEmbeddings(ctx)
+			return nil
+		}
 
 		pathList := make([]string, 0)
 		err = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
-			if !d.IsDir() && g.Match(d.Name()) {
+			if !d.IsDir() && match(d.Name()) {
 				pathList = append(pathList, path)
 			}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 
 		bar := progressbar.New(len(pathList))
 		bar.Describe("Uploading chunks")
-		defer func() { _ = bar.Finish() }()
-
 		for _, path := range pathList {
 			_ = bar.Add(1)
+			s.scanFile(ctx, path)
+		}
+		_ = bar.Finish()
+		log.Info().Int("files", len(pathList)).Int("unchanged", s.unchanged).Msg("Scanned")
+		s.computeEmbeddings(ctx)
 
-			buf, err := os.ReadFile(path)
-			if err != nil {
-				log.Error().Err(err).Stack().Str("path", path).Msg("Read file")
-				continue
+		if !command.Bool("watch") {
+			return nil
+		}
+		log.Info().Str("path", path).Msg("Watching for changes")
+		return watch(ctx, path, match, func(paths []string) {
+			for _, path := range paths {
+				log.Info().Str("path", path).Msg("Changed")
+				s.scanFile(ctx, path)
 			}
+			s.computeEmbeddings(ctx)
+		})
+	},
+}
 
-			decoder := json.NewDecoder(bytes.NewReader(buf))
-			decoder.DisallowUnknownFields()
-			var chunks rag.Document
-			err = decoder.Decode(&chunks)
-			if err != nil {
-				log.Error().Err(err).Stack().Str("path", path).Msg("Decode")
-				continue
-			}
-			chunks.Fix()
+// scanFormat is a file format scan understands and the files it matches by default.
+type scanFormat struct {
+	contentType string
+	glob        string
+}
 
-			if dryRun {
-				log.Info().Str("path", path).Msg("Skipped chunks uploading due to dry-run")
-				continue
-			}
+var scanFormats = map[string]scanFormat{
+	"chunks": {rag.ContentTypeChunks, "*.md.chunks.json"},
+	"txt":    {rag.ContentTypeText, "*.txt"},
+	"md":     {rag.ContentTypeMarkdown, "*.md"},
+	"html":   {rag.ContentTypeHTML, "*.{html,htm}"},
+	"docx":   {rag.ContentTypeDOCX, "*.docx"},
+}
 
-			err = r.UpsertDocumentChunks(&chunks)
-			if err != nil {
-				log.Error().Err(err).Stack().Str("path", path).Msg("Upsert chunks")
-			}
+type scanner struct {
+	root        string
+	glob        glob.Glob
+	contentType string
+	// ing loads raw files, nil for pre-chunked JSON.
+	ing        *rag.Ingestor
+	r          *rag.RAG
+	collection string
+	analyzer   string
+	dryRun     bool
+	compute    bool
+	force      bool
+
+	unchanged int
+}
+
+func (s *scanner) scanFile(ctx context.Context, path string) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		log.Error().Err(err).Stack().Str("path", path).Msg("Read file")
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Stat file")
+		return
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Resolve path")
+		return
+	}
+	if isArchive(path) {
+		err = s.scanArchive(ctx, absPath, buf)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Read archive")
 		}
+		return
+	}
 
-		return nil
-	},
+	name, err := filepath.Rel(s.root, path)
+	if err != nil || name == "." {
+		name = filepath.Base(path)
+	}
+	s.scanSource(ctx, filepath.ToSlash(name), absPath, info.ModTime(), buf)
+}
+
+// scanArchive upserts the members of an archive matching the glob. Their
+// source paths join the archive's and theirs by rag.ArchiveSeparator, empty
+// archivePath leaves them without one.
+func (s *scanner) scanArchive(ctx context.Context, archivePath string, buf []byte) error {
+	return walkArchive(buf, func(name string, modTime time.Time, data []byte) {
+		name = path.Clean(name)
+		if !s.glob.Match(path.Base(name)) {
+			return
+		}
+		sourcePath := ""
+		if archivePath != "" {
+			sourcePath = archivePath + rag.ArchiveSeparator + name
+		}
+		s.scanSource(ctx, name, sourcePath, modTime, data)
+	})
+}
+
+// scanStdin upserts a chunks document, a stream of them or an archive read from r.
+func (s *scanner) scanStdin(ctx context.Context, r io.Reader) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read stdin")
+	}
+	if bytes.HasPrefix(buf, gzipMagic) || bytes.HasPrefix(buf, zipMagic) {
+		return s.scanArchive(ctx, "", buf)
+	}
+	if s.ing != nil {
+		return errors.New("stdin takes chunks documents or a .tar.gz or .zip archive")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	for n := 1; ; n++ {
+		var document rag.Document
+		err = decoder.Decode(&document)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to decode document %d from stdin", n)
+		}
+		s.upsert(document.FileName, &document, "", "", time.Time{})
+	}
+}
+
+// scanSource upserts the file name read from sourcePath unless its content is
+// unchanged since the last scan. Files without a source path are always upserted.
+// modTime dates documents without a timestamp of their own.
+func (s *scanner) scanSource(ctx context.Context, name string, sourcePath string, modTime time.Time, buf []byte) {
+	hash := ""
+	if sourcePath != "" {
+		sum := sha256.Sum256(buf)
+		hash = hex.EncodeToString(sum[:])
+	}
+	if !s.force && sourcePath != "" {
+		unchanged, err := s.r.SourceFileUnchanged(ctx, s.collection, sourcePath, hash)
+		if err != nil {
+			log.Error().Err(err).Str("path", name).Msg("Check source file")
+			return
+		}
+		if unchanged {
+			s.unchanged++
+			log.Debug().Str("path", name).Msg("Skipped unchanged file")
+			return
+		}
+	}
+
+	chunks, err := s.load(ctx, name, buf)
+	if err != nil {
+		log.Error().Err(err).Stack().Str("path", name).Msg("Decode")
+		return
+	}
+	s.upsert(name, chunks, sourcePath, hash, modTime)
+}
+
+func (s *scanner) upsert(name string, chunks *rag.Document, sourcePath string, hash string, modTime time.Time) {
+	if s.analyzer != "" {
+		chunks.TextSearchConfig = s.analyzer
+	}
+	if chunks.Timestamp == nil && !modTime.IsZero() {
+		chunks.Timestamp = &modTime
+	}
+	chunks.Collection = s.collection
+	chunks.SourcePath = sourcePath
+	chunks.SourceHash = hash
+	chunks.Fix()
+
+	if s.dryRun {
+		log.Info().Str("path", name).Msg("Skipped chunks uploading due to dry-run")
+		return
+	}
+
+	err := s.r.UpsertDocumentChunks(chunks)
+	if err != nil {
+		log.Error().Err(err).Stack().Str("path", name).Msg("Upsert chunks")
+	}
+}
+
+// load decodes pre-chunked JSON, or converts and chunks a raw file named by
+// its path below the scanned directory or in its archive.
+func (s *scanner) load(ctx context.Context, name string, buf []byte) (*rag.Document, error) {
+	if s.ing == nil {
+		decoder := json.NewDecoder(bytes.NewReader(buf))
+		decoder.DisallowUnknownFields()
+		var chunks rag.Document
+		err := decoder.Decode(&chunks)
+		if err != nil {
+			return nil, err
+		}
+		return &chunks, nil
+	}
+
+	document, _, err := s.ing.LoadAs(ctx, name, s.contentType, buf)
+	return document, err
+}
+
+func (s *scanner) computeEmbeddings(ctx context.Context) {
+	if !s.compute || s.dryRun {
+		return
+	}
+	err := s.r.ComputeEmbeddings(ctx, &rag.ComputeOptions{
+		OnlyEmpty:   true,
+		Collection:  s.collection,
+		Concurrency: 3,
+		BatchSize:   32,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Compute embeddings")
+	}
 }
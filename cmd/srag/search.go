@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var searchCmd = &cli.Command{
+	Name:  "search",
+	Usage: "Search document chunks",
+	Arguments: []cli.Argument{
+		&cli.StringArg{Name: "query", Config: trimSpace},
+	},
+	Flags: []cli.Flag{
+		flagDSN,
+		flagServer,
+		flagAPIKey,
+		flagCollection,
+		flagFilter,
+		flagEmbeddingBaseURL,
+		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
+		flagRerankerBaseURL,
+		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
+		flagAssistantBaseURL,
+		flagAssistantModel,
+		flagOutput,
+		flagNeighbors,
+		flagParentSection,
+		flagCompress,
+		flagRecencyHalfLife,
+		flagGraph,
+		flagSummaries,
+		&cli.BoolFlag{
+			Name:  "mmr",
+			Usage: "diversify the results by maximal marginal relevance among the candidates",
+		},
+		&cli.FloatFlag{
+			Name:      "lambda",
+			Usage:     "MMR trade-off, 1 ranks by relevance alone and 0 by diversity alone",
+			Value:     rag.DefaultMMRLambda,
+			Validator: rag.ValidateMMRLambda,
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "number of results, defaults to the configured limit",
+		},
+		&cli.StringFlag{
+			Name:  "mode",
+			Usage: "dense, keyword or hybrid, defaults to the configured mode",
+		},
+		&cli.StringSliceFlag{
+			Name:  "boost",
+			Usage: "boost rule as field=value:factor, e.g. tag=official:1.3 or path=**/archive/**:0.5",
+		},
+		&cli.BoolFlag{
+			Name:  "rerank",
+			Usage: "rerank the retrieved candidates with the reranker model",
+		},
+		&cli.IntFlag{
+			Name:  "candidates",
+			Usage: "number of candidates retrieved before reranking, defaults to the configured ratio",
+		},
+		&cli.StringFlag{
+			Name:  "collapse",
+			Usage: "set to document to return only the best chunk per document",
+		},
+		&cli.StringFlag{
+			Name:  "expand",
+			Usage: "hyde or multi to also retrieve with a hypothetical answer or paraphrases written by the assistant",
+		},
+		&cli.IntFlag{
+			Name:  "expansions",
+			Usage: "number of hypothetical answers or paraphrases, defaults to 1 for hyde and 3 for multi",
+		},
+		&cli.FloatFlag{
+			Name:  "min-score",
+			Usage: "drop results scoring lower, e.g. 0.5 for a cosine similarity of dense search",
+		},
+		&cli.IntFlag{
+			Name:  "ef-search",
+			Usage: "hnsw.ef_search for this query, higher trades latency for recall, defaults to the database setting",
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		query, err := getArgumentQuery(command)
+		if err != nil {
+			return err
+		}
+
+		collapse, err := rag.ParseCollapse(command.String("collapse"))
+		if err != nil {
+			return err
+		}
+		filter, err := parseFilter(command)
+		if err != nil {
+			return err
+		}
+		expand, err := rag.ParseExpand(command.String("expand"))
+		if err != nil {
+			return err
+		}
+		halfLife, err := rag.ParseHalfLife(command.String("recency-half-life"))
+		if err != nil {
+			return err
+		}
+
+		boosts := make([]rag.BoostRule, 0)
+		for _, s := range command.StringSlice("boost") {
+			b, err := rag.ParseBoostRule(s)
+			if err != nil {
+				return err
+			}
+			boosts = append(boosts, b)
+		}
+
+		if client := newRemoteClient(command); client != nil {
+			defer func() { _ = client.Close() }()
+			rerank := command.Bool("rerank")
+			lambda := command.Float("lambda")
+			chunks, err := client.Search(ctx, command.String("collection"), &rag.SearchParam{
+				Query:         query,
+				Mode:          command.String("mode"),
+				Boosts:        boosts,
+				Limit:         command.Int("limit"),
+				Rerank:        &rerank,
+				Candidates:    command.Int("candidates"),
+				Collapse:      collapse,
+				Filter:        command.String("filter"),
+				Expand:        expand,
+				Expansions:    command.Int("expansions"),
+				MinScore:      command.Float("min-score"),
+				EfSearch:      command.Int("ef-search"),
+				Neighbors:     command.Int("neighbors"),
+				ParentSection: command.Bool("parent-section"),
+				MMR:           command.Bool("mmr"),
+				Lambda:        &lambda,
+				Compress:      command.Bool("compress"),
+
+				RecencyHalfLife: command.String("recency-half-life"),
+				Graph:           command.Bool("graph"),
+				Summaries:       command.Bool("summaries"),
+			})
+			if err != nil {
+				return err
+			}
+			return printChunks(command.String("output"), chunks, collapse)
+		}
+
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		config, err := (&rag.RAG{DB: db}).CurrentConfig(ctx)
+		if err != nil {
+			return err
+		}
+		cfg := &config.Config
+
+		mode := cfg.Mode
+		if command.IsSet("mode") {
+			mode, err = rag.ParseSearchMode(command.String("mode"))
+			if err != nil {
+				return err
+			}
+		}
+		limit := cfg.Limit
+		if command.IsSet("limit") {
+			limit = command.Int("limit")
+		}
+		candidates := limit * cfg.CandidatesPerResult
+		if command.IsSet("candidates") {
+			candidates = command.Int("candidates")
+		}
+
+		embedder, err := newEmbedder(command, defaultEmbeddingRetries)
+		if err != nil {
+			return err
+		}
+		r := (&rag.RAG{
+			DB:            db,
+			Embedder:      embedder,
+			RerankerModel: command.String("reranker-model"),
+		}).WithConfig(config)
+		rerank := command.Bool("rerank")
+		if rerank {
+			r.Reranker, err = newReranker(command)
+			if err != nil {
+				return err
+			}
+			if r.Reranker != nil {
+				defer func() { _ = r.Reranker.Close() }()
+			}
+		}
+		if expand != "" || command.Bool("compress") {
+			assistantClient := newAssistantClient(command)
+			r.AssistantClient = &assistantClient
+			r.AssistantModel = command.String("assistant-model")
+		}
+
+		chunks, err := r.Search(ctx, &rag.SearchOptions{
+			Query:         query,
+			Collection:    command.String("collection"),
+			Filter:        filter,
+			Limit:         limit,
+			Mode:          mode,
+			Boosts:        boosts,
+			Rerank:        rerank,
+			Candidates:    candidates,
+			Collapse:      collapse,
+			Fusion:        cfg.Fusion,
+			Expand:        expand,
+			Expansions:    command.Int("expansions"),
+			MinScore:      command.Float("min-score"),
+			EfSearch:      command.Int("ef-search"),
+			Neighbors:     command.Int("neighbors"),
+			ParentSection: command.Bool("parent-section"),
+			MMR:           command.Bool("mmr"),
+			Lambda:        command.Float("lambda"),
+			Compress:      command.Bool("compress"),
+
+			RecencyHalfLife: halfLife,
+			Graph:           command.Bool("graph"),
+			Summaries:       command.Bool("summaries"),
+		})
+		if err != nil {
+			return err
+		}
+
+		return printChunks(command.String("output"), chunks, collapse)
+	},
+}
+
+func printChunks(format string, chunks []rag.DocumentChunk, collapse string) error {
+	tw := table.NewWriter()
+	if collapse == "" {
+		tw.AppendHeader(table.Row{"Chunk ID", "Document", "Score", "Text"})
+	} else {
+		tw.AppendHeader(table.Row{"Chunk ID", "Document", "Score", "Text", "More matches"})
+	}
+	tw.SetColumnConfigs([]table.ColumnConfig{{Name: "Text", WidthMax: 80}})
+	records := make([]chunkRecord, len(chunks))
+	for i, chunk := range chunks {
+		if collapse == "" {
+			tw.AppendRow(table.Row{chunk.ID, documentCell(&chunk), formatScore(chunk.Score), chunk.Text})
+		} else {
+			tw.AppendRow(table.Row{chunk.ID, documentCell(&chunk), formatScore(chunk.Score), chunk.Text, chunk.Collapsed})
+		}
+		records[i] = newChunkRecord(&chunk, i+1)
+	}
+	return printOutput(format, tw, records)
+}
@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cockroachdb/errors"
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
+	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/fanyang89/rag/v1"
 )
@@ -22,41 +29,437 @@ var serveCmd = &cli.Command{
 			Aliases: []string{"a", "l"},
 			Value:   ":5000",
 		},
+		&cli.StringFlag{
+			Name:  "grpc-bind",
+			Usage: "address to serve the gRPC API on, e.g. :5001, empty disables it",
+		},
+		&cli.StringFlag{
+			Name:    "tls-cert",
+			Usage:   "certificate file to serve HTTPS and gRPC over TLS with, read again on SIGHUP",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_TLS_CERT")),
+		},
+		&cli.StringFlag{
+			Name:    "tls-key",
+			Usage:   "key file of --tls-cert",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_TLS_KEY")),
+		},
+		&cli.StringSliceFlag{
+			Name:    "acme-domain",
+			Usage:   "domain to obtain certificates for from Let's Encrypt, the server must be reachable on it at port 443",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_ACME_DOMAIN")),
+		},
+		&cli.StringFlag{
+			Name:  "acme-email",
+			Usage: "contact address for the ACME account",
+		},
+		&cli.StringFlag{
+			Name:  "acme-cache",
+			Usage: "directory the ACME account and certificates are kept in, defaults to the user cache directory",
+		},
+		&cli.DurationFlag{
+			Name:  "drain-timeout",
+			Usage: "how long to wait for in-flight requests and streams on shutdown",
+			Value: 30 * time.Second,
+		},
+		&cli.StringSliceFlag{
+			Name:  "hook",
+			Usage: "retrieval plugin as stage=url, stage is pre-query, post-candidates or post-rerank",
+		},
+		&cli.StringSliceFlag{
+			Name:  "hook-header",
+			Usage: "request header forwarded to retrieval plugins",
+			Value: []string{"Authorization"},
+		},
+		&cli.DurationFlag{
+			Name:  "hook-timeout",
+			Value: 5 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "pdf-converter",
+			Usage: "command converting uploaded PDFs to text on stdout, e.g. 'pdftotext -layout {input} -'",
+		},
+		&cli.StringFlag{
+			Name:  "standby-of",
+			Usage: "DSN of a primary to replicate from, serving read-only search",
+		},
+		&cli.DurationFlag{
+			Name:  "replication-interval",
+			Value: 5 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "ingest-workers",
+			Usage: "number of documents submitted to /v1/documents ingested concurrently, 0 leaves them to other servers",
+			Value: 2,
+		},
+		&cli.DurationFlag{
+			Name:  "retention-interval",
+			Usage: "how often to apply retention policies, 0 disables the janitor",
+		},
+		&cli.StringSliceFlag{
+			Name:    "health-require",
+			Usage:   "components /health/deep and /readyz require: database, embedding, reranker, assistant",
+			Value:   rag.DefaultHealthOptions().Required,
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_HEALTH_REQUIRE")),
+		},
+		&cli.DurationFlag{
+			Name:  "health-timeout",
+			Usage: "timeout of every /health/deep and /readyz probe",
+			Value: 5 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "health-cache-ttl",
+			Usage: "how long /readyz answers with its last report before probing again, 0 probes every time",
+			Value: rag.DefaultHealthOptions().CacheTTL,
+		},
+		&cli.StringFlag{
+			Name:    "auth",
+			Usage:   "apikey requires a key created by 'srag apikey create' on every request, none disables auth for local use",
+			Value:   "apikey",
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_AUTH")),
+		},
+		&cli.IntFlag{
+			Name:  "cache-size",
+			Usage: "number of query embeddings and result sets cached in memory, 0 disables the cache",
+		},
+		&cli.DurationFlag{
+			Name:  "cache-ttl",
+			Usage: "how long cached results are served, bounding how stale they get after ingestion",
+			Value: 5 * time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "cache-match",
+			Usage: "exact serves cached results for the same normalized query, approximate for similar ones too",
+			Value: rag.CacheMatchExact,
+		},
+		&cli.FloatFlag{
+			Name:  "cache-similarity",
+			Usage: "minimum cosine similarity of query embeddings for an approximate cache hit",
+			Value: 0.97,
+		},
+		&cli.BoolFlag{
+			Name:  "cache-db",
+			Usage: "persist cached result sets in the database, shared by servers and kept across restarts",
+		},
+		&cli.BoolFlag{
+			Name:  "metrics",
+			Usage: "serve Prometheus metrics on /metrics",
+			Value: true,
+		},
 		flagDSN,
+		&cli.StringFlag{
+			Name:    "collection",
+			Usage:   "collection served by the unscoped /v1 routes",
+			Value:   rag.DefaultCollection,
+			Sources: cli.NewValueSourceChain(cli.EnvVar("RAG_COLLECTION")),
+		},
+		flagOSSEndpoint,
+		flagOSSAccessKey,
+		flagOSSSecretAccessKey,
+		flagOSSSecure,
 		flagEmbeddingBaseURL,
 		flagEmbeddingModel,
+		flagEmbeddingProvider,
+		flagEmbeddingAPIKey,
 		flagRerankerBaseURL,
 		flagRerankerModel,
+		flagRerankerProvider,
+		flagRerankerAPIKey,
+		flagRerankerTimeout,
 		flagAssistantBaseURL,
 		flagAssistantModel,
+		flagWebhook,
+		flagWebhookSecret,
+		flagWebhookEvent,
+		flagWebhookTimeout,
 	},
 	Action: func(ctx context.Context, command *cli.Command) error {
 		dsn := command.String("dsn")
-		embeddingBaseURL := command.String("embedding-base-url")
-		embeddingModel := command.String("embedding-model")
 		bind := command.String("bind")
+		drainTimeout := command.Duration("drain-timeout")
 
 		db, err := rag.OpenDB(dsn)
 		if err != nil {
 			return err
 		}
 
-		client := openai.NewClient(option.WithBaseURL(embeddingBaseURL))
-		r := &rag.RAG{DB: db, EmbeddingClient: &client, EmbeddingModel: embeddingModel}
+		oss, err := newOSS(command)
+		if err != nil {
+			return err
+		}
+		r := &rag.RAG{DB: db, OSS: oss}
+		err = configureModels(command, r)
+		if err != nil {
+			return err
+		}
+		// reloads keep the webhooks, payloads being posted finish before exiting
+		r.Webhooks, err = newWebhooks(command)
+		if err != nil {
+			return err
+		}
+		if r.Webhooks != nil {
+			defer func() { _ = r.Webhooks.Close() }()
+		}
+		tlsConfig, reloadCert, err := newTLSConfig(command)
+		if err != nil {
+			return err
+		}
 
-		s := rag.NewServer(r)
-		go func() {
-			select {
-			case <-ctx.Done():
-				closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				defer cancel()
-				_ = s.Shutdown(closeCtx)
+		opts := &rag.ServerOptions{
+			TLS:        tlsConfig,
+			Ingestor:   rag.NewIngestor(),
+			Collection: command.String("collection"),
+			Health: &rag.HealthOptions{
+				Required: command.StringSlice("health-require"),
+				Timeout:  command.Duration("health-timeout"),
+				CacheTTL: command.Duration("health-cache-ttl"),
+			},
+		}
+		err = opts.Health.Validate()
+		if err != nil {
+			return err
+		}
+		switch command.String("auth") {
+		case "apikey":
+			opts.Auth = rag.NewAuthenticator(r)
+			keys, err := r.ListAPIKeys(ctx)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				log.Warn().Msg("No API keys exist, create one with 'srag apikey create' or pass --auth=none")
+			}
+		case "none":
+			log.Warn().Msg("Authentication is disabled, every client has full access")
+		default:
+			return errors.Newf("invalid auth '%s', expected apikey or none", command.String("auth"))
+		}
+		if size := command.Int("cache-size"); size > 0 {
+			cacheOpts := &rag.QueryCacheOptions{
+				Size:       size,
+				TTL:        command.Duration("cache-ttl"),
+				Match:      command.String("cache-match"),
+				Similarity: command.Float("cache-similarity"),
+			}
+			if command.Bool("cache-db") {
+				cacheOpts.DB = db
+			}
+			r.Cache, err = rag.NewQueryCache(cacheOpts)
+			if err != nil {
+				return err
+			}
+		}
+		if command.Bool("metrics") {
+			opts.Metrics = rag.NewMetrics()
+			r.Metrics = opts.Metrics
+			err = opts.Metrics.InstrumentDB(db)
+			if err != nil {
+				return err
+			}
+		}
+		if pdfConverter := strings.Fields(command.String("pdf-converter")); len(pdfConverter) > 0 {
+			opts.Ingestor.Converters[rag.ContentTypePDF] = &rag.CommandConverter{Command: pdfConverter}
+		}
+		if hooks := command.StringSlice("hook"); len(hooks) > 0 {
+			opts.Hooks, err = rag.NewHTTPHooks(hooks, command.StringSlice("hook-header"), command.Duration("hook-timeout"))
+			if err != nil {
+				return err
 			}
+			defer func() { _ = opts.Hooks.Close() }()
+		}
+
+		if primaryDSN := command.String("standby-of"); primaryDSN != "" {
+			primary, err := rag.OpenDB(primaryDSN)
+			if err != nil {
+				return errors.Wrap(err, "Failed to open primary")
+			}
+			opts.Replicator = &rag.Replicator{
+				Primary:   primary,
+				Standby:   db,
+				Interval:  command.Duration("replication-interval"),
+				BatchSize: 500,
+			}
+			go opts.Replicator.Run(ctx)
+		} else if interval := command.Duration("retention-interval"); interval > 0 {
+			go r.RunRetentionJanitor(ctx, interval)
+		}
+
+		s := rag.NewServer(r, opts)
+		if workers := command.Int("ingest-workers"); workers > 0 && opts.Replicator == nil {
+			jobsDone := make(chan struct{})
+			go func() {
+				s.RunIngestJobs(ctx, workers)
+				close(jobsDone)
+			}()
+			// interrupted jobs are queued again before exiting
+			s.OnShutdown(func(ctx context.Context) error {
+				select {
+				case <-jobsDone:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}
+		if grpcBind := command.String("grpc-bind"); grpcBind != "" {
+			lis, err := net.Listen("tcp", grpcBind)
+			if err != nil {
+				return errors.Wrap(err, "Failed to listen for gRPC")
+			}
+			go func() {
+				if err := s.ServeGRPC(lis); err != nil {
+					log.Error().Err(err).Msg("gRPC server stopped")
+				}
+			}()
+		}
+		// reloading stops once the server drained, closing the last reranker
+		reloadCtx, stopReload := context.WithCancel(context.WithoutCancel(ctx))
+		defer stopReload()
+		go reloadOnHangup(reloadCtx, command, s, r, reloadCert)
+		shutdownErr := make(chan error, 1)
+		go func() {
+			<-ctx.Done()
+			closeCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			shutdownErr <- s.Shutdown(closeCtx)
 		}()
 		err = s.Start(bind)
 		if err == nil || errors.Is(err, http.ErrServerClosed) {
-			return nil
+			return <-shutdownErr
 		}
 		return err
 	},
 }
+
+// reloadableFlags are the flags of serve a SIGHUP reloads from .env and the environment.
+var reloadableFlags = []cli.Flag{
+	flagEmbeddingBaseURL,
+	flagEmbeddingModel,
+	flagEmbeddingProvider,
+	flagEmbeddingAPIKey,
+	flagRerankerBaseURL,
+	flagRerankerModel,
+	flagRerankerProvider,
+	flagRerankerAPIKey,
+	flagRerankerTimeout,
+	flagAssistantBaseURL,
+	flagAssistantModel,
+}
+
+// configureModels sets the embedder, reranker and assistant of r from the flags.
+func configureModels(command *cli.Command, r *rag.RAG) error {
+	var err error
+	r.Embedder, err = newEmbedder(command, defaultEmbeddingRetries)
+	if err != nil {
+		return err
+	}
+	r.Reranker, err = newReranker(command)
+	if err != nil {
+		return err
+	}
+	r.RerankerModel = ""
+	if r.Reranker != nil {
+		r.RerankerModel = command.String("reranker-model")
+	}
+	r.AssistantClient, r.AssistantModel = nil, ""
+	if command.String("assistant-base-url") != "" {
+		assistantClient := newAssistantClient(command)
+		r.AssistantClient = &assistantClient
+		r.AssistantModel = command.String("assistant-model")
+	}
+	return nil
+}
+
+// newTLSConfig returns nil without --tls-cert and --acme-domain. reloadCert
+// reads the certificate files again, it is nil for ACME, which renews on its own.
+func newTLSConfig(command *cli.Command) (config *tls.Config, reloadCert func() error, err error) {
+	certFile := command.String("tls-cert")
+	keyFile := command.String("tls-key")
+	domains := command.StringSlice("acme-domain")
+	switch {
+	case (certFile != "" || keyFile != "") && len(domains) > 0:
+		return nil, nil, errors.New("--tls-cert and --acme-domain are mutually exclusive")
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, nil, errors.New("--tls-cert and --tls-key are required together")
+		}
+		certs, err := rag.NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return certs.TLSConfig(), certs.Reload, nil
+	case len(domains) > 0:
+		cacheDir := command.String("acme-cache")
+		if cacheDir == "" {
+			userCacheDir, err := os.UserCacheDir()
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "Failed to locate the ACME cache, set --acme-cache")
+			}
+			cacheDir = filepath.Join(userCacheDir, "srag", "acme")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      command.String("acme-email"),
+		}
+		return m.TLSConfig(), nil, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// reloadOnHangup reloads the certificate and the reloadable flags on every
+// SIGHUP until ctx is done. New requests use the new model clients, those of
+// the previous configuration are closed once no in-flight request uses them.
+func reloadOnHangup(ctx context.Context, command *cli.Command, s *rag.Server, r *rag.RAG,
+	reloadCert func() error,
+) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	defer func() {
+		if r.Reranker != nil {
+			_ = r.Reranker.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		if reloadCert != nil {
+			err := reloadCert()
+			if err != nil {
+				log.Error().Err(err).Msg("Reload certificate, keeping the previous one")
+			} else {
+				log.Info().Msg("Reloaded certificate")
+			}
+		}
+
+		next := *r
+		restore, err := reloadFlags(command, reloadableFlags...)
+		if err == nil {
+			err = configureModels(command, &next)
+			if err != nil {
+				restore()
+			}
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Reload configuration, keeping the previous one")
+			continue
+		}
+		retired := s.Reload(&next)
+		if previous := r.Reranker; previous != nil {
+			go func() {
+				<-retired
+				_ = previous.Close()
+			}()
+		}
+		r = &next
+		log.Info().Str("embedding_model", command.String("embedding-model")).Str("reranker_model", r.RerankerModel).
+			Str("assistant_model", r.AssistantModel).Msg("Reloaded configuration")
+	}
+}
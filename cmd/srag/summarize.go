@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.com/fanyang89/rag/v1"
+)
+
+var summarizeCmd = &cli.Command{
+	Name:  "summarize",
+	Usage: "Summarize sections and documents with the assistant into summaries searched with --summaries",
+	Flags: []cli.Flag{
+		flagDSN,
+		flagAssistantBaseURL,
+		flagAssistantModel,
+		&cli.StringFlag{
+			Name:  "collection",
+			Usage: "only summarize documents of this collection, empty summarizes all",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "summarize documents summarized before again",
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Aliases: []string{"workers", "j"},
+			Usage:   "number of completions in flight",
+			Value:   3,
+		},
+	},
+	Action: func(ctx context.Context, command *cli.Command) error {
+		db, err := rag.OpenDB(command.String("dsn"))
+		if err != nil {
+			return err
+		}
+		assistantClient := newAssistantClient(command)
+		r := rag.RAG{
+			DB:              db,
+			AssistantClient: &assistantClient,
+			AssistantModel:  command.String("assistant-model"),
+		}
+
+		collection := command.String("collection")
+		err = r.Summarize(ctx, &rag.SummarizeOptions{
+			Collection:  collection,
+			Force:       command.Bool("force"),
+			Concurrency: command.Int("concurrency"),
+		})
+		if err != nil {
+			return err
+		}
+		stats, err := r.Stats(ctx, collection)
+		if err != nil {
+			return err
+		}
+		// summaries are embedded like chunks, by compute
+		log.Info().Int64("summaries", stats.Summaries).Int64("pending", stats.Pending).
+			Msg("Documents summarized, run compute to embed the summaries")
+		return nil
+	},
+}
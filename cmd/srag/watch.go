@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+const watchDebounce = time.Second
+
+// watch calls onChange with files whose names match that were created or
+// modified under root, once they have been quiet for watchDebounce.
+func watch(ctx context.Context, root string, match func(name string) bool, onChange func(paths []string)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+
+	pending := make(map[string]struct{})
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	// Files inside directories moved into the tree don't produce events of their own.
+	addDirs := func(dir string, enqueue bool) error {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return w.Add(path)
+			}
+			if enqueue && match(d.Name()) {
+				pending[path] = struct{}{}
+				timer.Reset(watchDebounce)
+			}
+			return nil
+		})
+	}
+	err = addDirs(root, false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) && !event.Has(fsnotify.Rename) {
+				continue
+			}
+			info, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				if event.Has(fsnotify.Create) {
+					err = addDirs(event.Name, true)
+					if err != nil {
+						log.Error().Err(err).Str("path", event.Name).Msg("Watch directory")
+					}
+				}
+				continue
+			}
+			if match(filepath.Base(event.Name)) {
+				pending[event.Name] = struct{}{}
+				timer.Reset(watchDebounce)
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error().Err(err).Msg("Watch")
+
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			clear(pending)
+			onChange(paths)
+		}
+	}
+}
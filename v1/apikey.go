@@ -0,0 +1,221 @@
+package rag
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+const (
+	// HeaderAPIKey is accepted in place of an "Authorization: Bearer" header.
+	HeaderAPIKey = "X-Api-Key"
+
+	apiKeyPrefix = "rag_"
+	// apiKeyTouchInterval limits how often last_used_at is written per key.
+	apiKeyTouchInterval = time.Minute
+)
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey grants access to the server. Only the SHA-256 of the key is stored,
+// the key itself is shown once when it is created.
+type APIKey struct {
+	ID     uint64 `gorm:"primaryKey" json:"id"`
+	Name   string `gorm:"not null" json:"name"`
+	Prefix string `gorm:"not null" json:"prefix"`
+	Hash   string `gorm:"not null;uniqueIndex" json:"-"`
+	// RateLimit is the number of requests allowed per minute, 0 is unlimited.
+	RateLimit  int        `gorm:"not null;default:0" json:"rate_limit"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey stores a new key and returns it with its secret, which can't be recovered later.
+func (r *RAG) CreateAPIKey(ctx context.Context, name string, rateLimit int) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("API key name is required")
+	}
+	if rateLimit < 0 {
+		return nil, "", errors.New("rate limit must not be negative")
+	}
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(buf)
+	key := &APIKey{
+		Name:      name,
+		Prefix:    secret[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(secret),
+		RateLimit: rateLimit,
+	}
+	err = r.DB.WithContext(ctx).Create(key).Error
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Failed to create API key")
+	}
+	return key, secret, nil
+}
+
+// ListAPIKeys returns all keys including revoked ones, oldest first.
+func (r *RAG) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	err := r.DB.WithContext(ctx).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// RevokeAPIKey rejects further requests with the key.
+func (r *RAG) RevokeAPIKey(ctx context.Context, id uint64) error {
+	res := r.DB.WithContext(ctx).Model(&APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.Wrapf(gorm.ErrRecordNotFound, "active API key %d", id)
+	}
+	return nil
+}
+
+// RateLimitError rejects a request of a key that exceeded its rate limit.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded, retry after " + e.RetryAfter.Round(time.Second).String()
+}
+
+// Authenticator checks API keys of HTTP and gRPC requests against the
+// database and applies their rate limits.
+type Authenticator struct {
+	r *RAG
+
+	mu       sync.Mutex
+	limiters map[uint64]*rate.Limiter
+}
+
+func NewAuthenticator(r *RAG) *Authenticator {
+	return &Authenticator{r: r, limiters: make(map[uint64]*rate.Limiter)}
+}
+
+// Authenticate returns the active key matching secret, or ErrInvalidAPIKey,
+// or a *RateLimitError if the key made too many requests.
+func (a *Authenticator) Authenticate(ctx context.Context, secret string) (*APIKey, error) {
+	if secret == "" {
+		return nil, ErrInvalidAPIKey
+	}
+	var key APIKey
+	err := a.r.DB.WithContext(ctx).
+		Where("hash = ? AND revoked_at IS NULL", hashAPIKey(secret)).
+		Take(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		err = a.r.DB.WithContext(ctx).Model(&key).Update("last_used_at", now).Error
+		if err != nil {
+			log.Warn().Err(err).Uint64("key", key.ID).Msg("Failed to record API key usage")
+		}
+	}
+
+	if key.RateLimit > 0 {
+		reservation := a.limiter(&key).ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			return nil, &RateLimitError{RetryAfter: delay}
+		}
+	}
+	return &key, nil
+}
+
+// limiter returns the token bucket of key, replaced when its rate limit changed.
+func (a *Authenticator) limiter(key *APIKey) *rate.Limiter {
+	limit := rate.Every(time.Minute / time.Duration(key.RateLimit))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, ok := a.limiters[key.ID]
+	if !ok || l.Burst() != key.RateLimit {
+		l = rate.NewLimiter(limit, key.RateLimit)
+		a.limiters[key.ID] = l
+	}
+	return l
+}
+
+// bearerToken extracts the key from an "Authorization: Bearer" or X-Api-Key header.
+func bearerToken(authorization string, apiKey string) string {
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(apiKey)
+}
+
+func (a *Authenticator) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header
+		_, err := a.Authenticate(c.Request().Context(), bearerToken(header.Get(echo.HeaderAuthorization), header.Get(HeaderAPIKey)))
+		var limitErr *RateLimitError
+		switch {
+		case err == nil:
+			return next(c)
+		case errors.Is(err, ErrInvalidAPIKey):
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		case errors.As(err, &limitErr):
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(limitErr.RetryAfter.Seconds())+1))
+			return echo.NewHTTPError(http.StatusTooManyRequests, err.Error())
+		default:
+			return err
+		}
+	}
+}
+
+func (a *Authenticator) unaryInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(k string) string {
+		if v := md.Get(k); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	_, err := a.Authenticate(ctx, bearerToken(first("authorization"), first(HeaderAPIKey)))
+	var limitErr *RateLimitError
+	switch {
+	case err == nil:
+		return handler(ctx, req)
+	case errors.Is(err, ErrInvalidAPIKey):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errors.As(err, &limitErr):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return nil, grpcError(err)
+	}
+}
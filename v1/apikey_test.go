@@ -0,0 +1,56 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	ctx := context.Background()
+
+	key, secret, err := r.CreateAPIKey(ctx, "ci", 2)
+	require.NoError(t, err)
+	require.Equal(t, secret[:len(key.Prefix)], key.Prefix)
+	_, unlimited, err := r.CreateAPIKey(ctx, "ops", 0)
+	require.NoError(t, err)
+
+	s := NewServer(r, &ServerOptions{Auth: NewAuthenticator(r)})
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/collections", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+	require.Equal(t, http.StatusUnauthorized, get("Authorization", "Bearer rag_wrong").Code)
+
+	require.Equal(t, http.StatusOK, get("Authorization", "Bearer "+secret).Code)
+	require.Equal(t, http.StatusOK, get(HeaderAPIKey, secret).Code)
+	rec = get("Authorization", "Bearer "+secret)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("Retry-After"))
+	for range 5 {
+		require.Equal(t, http.StatusOK, get("Authorization", "Bearer "+unlimited).Code)
+	}
+
+	keys, err := r.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.NotNil(t, keys[0].LastUsedAt)
+
+	require.NoError(t, r.RevokeAPIKey(ctx, keys[1].ID))
+	require.Error(t, r.RevokeAPIKey(ctx, keys[1].ID))
+	require.Equal(t, http.StatusUnauthorized, get("Authorization", "Bearer "+unlimited).Code)
+}
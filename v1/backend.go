@@ -0,0 +1,51 @@
+package rag
+
+import (
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+)
+
+// backend holds the schema and queries that differ between storage engines.
+// Everything else goes through gorm and works on both.
+type backend interface {
+	// migrate creates the baseline schema, dropSchema drops it again.
+	migrate(db *gorm.DB) error
+	dropSchema(tx *gorm.DB) error
+	// lockSchema serializes migrations across processes until tx ends,
+	// creating schema_version if needed.
+	lockSchema(tx *gorm.DB) error
+	validateTextSearchConfig(db *gorm.DB, name string) error
+	// queryDense searches the chunks' embeddings, or with space set the
+	// embeddings of that model in chunk_embeddings, ranked by distance.
+	queryDense(db *gorm.DB, queryEmbedding pgvector.Vector, space string, distance string, opts *SearchOptions) ([]DocumentChunk, error)
+	// queryKeyword searches the chunks' text with the collection's analyzer.
+	queryKeyword(db *gorm.DB, analyzer string, opts *SearchOptions) ([]DocumentChunk, error)
+	// nearDuplicates returns the pairs of embedded chunks of a collection at
+	// least threshold cosine similar, comparing every chunk with its nearest
+	// neighbors by the collection's distance.
+	nearDuplicates(db *gorm.DB, collection string, distance string, threshold float64, neighbors int) ([]nearPair, error)
+	// invalidChunks calls fn with the chunks without an embedding or text, or
+	// embedded as the zero vector.
+	invalidChunks(db *gorm.DB, fn func(chunk *DocumentChunk) error) error
+	// chunkStats returns the text length and embedding norm of the leaf
+	// chunks of a collection.
+	chunkStats(db *gorm.DB, collection string) ([]chunkStat, error)
+	// modelNorms returns the norms of the embeddings in chunk_embeddings of
+	// the leaf chunks of a collection.
+	modelNorms(db *gorm.DB, collection string) ([]modelNorm, error)
+	// nearestNeighbors returns the L2 distance of up to sampleSize random
+	// embedded leaf chunks of a collection to their nearest neighbor.
+	nearestNeighbors(db *gorm.DB, collection string, sampleSize int) ([]chunkNeighbor, error)
+	// storageSize returns the size of the database on disk in bytes.
+	storageSize(db *gorm.DB) (int64, error)
+}
+
+// postgresBackend uses pgvector for dense search and tsvector for keyword search.
+type postgresBackend struct{}
+
+func backendOf(db *gorm.DB) backend {
+	if db.Dialector.Name() == sqliteDialect {
+		return sqliteBackend{}
+	}
+	return postgresBackend{}
+}
@@ -0,0 +1,200 @@
+package rag
+
+import (
+	"time"
+
+	"github.com/pgvector/pgvector-go"
+)
+
+// The baseline, schema version 1, is frozen as copies of the models as they
+// were when versioned migrations were introduced. Changes to the live models
+// go into numbered migrations, so migrating from version 1 up creates the
+// same schema as databases created before migrations existed.
+
+type baselineCollection struct {
+	Name             string `gorm:"primaryKey"`
+	TextSearchConfig string `gorm:"not null;default:'simple'"`
+	CreatedAt        time.Time
+}
+
+func (baselineCollection) TableName() string { return "collections" }
+
+type baselineChunk struct {
+	ID               string               `gorm:"primaryKey"`
+	Collection       string               `gorm:"not null;default:'default';index"`
+	Document         string               `gorm:"not null;index"`
+	RawDocument      string               `gorm:"not null"`
+	Text             string               `gorm:"not null"`
+	Embedding        *pgvector.HalfVector `gorm:"type:halfvec(2560)"`
+	Index            int                  `gorm:"column:chunk_index;not null;default:0"`
+	Tags             string               `gorm:"type:jsonb;default:'[]'"`
+	TextSearchConfig string               `gorm:"type:regconfig;not null;default:'simple'"`
+	SourcePath       string               `gorm:"index"`
+	Page             int                  `gorm:"not null;default:0"`
+	Section          string               `gorm:"not null;default:''"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	EmbeddingModel   string `gorm:"not null;default:''"`
+	EmbeddingDims    int    `gorm:"not null;default:0"`
+}
+
+func (baselineChunk) TableName() string { return "document_chunks" }
+
+type baselineSourceFile struct {
+	Path       string `gorm:"primaryKey"`
+	SHA256     string `gorm:"column:sha256;not null"`
+	Collection string `gorm:"not null;default:'default'"`
+	Document   string `gorm:"not null;index"`
+	UpdatedAt  time.Time
+}
+
+func (baselineSourceFile) TableName() string { return "source_files" }
+
+type baselineIndexTuneSample struct {
+	ID        uint      `gorm:"primaryKey"`
+	Index     string    `gorm:"not null"`
+	Method    string    `gorm:"not null"`
+	Chunks    int64     `gorm:"not null"`
+	Param     string    `gorm:"not null"`
+	Value     int       `gorm:"not null"`
+	K         int       `gorm:"not null"`
+	Queries   int       `gorm:"not null"`
+	Recall    float64   `gorm:"not null"`
+	P50Ms     float64   `gorm:"column:p50_ms;not null"`
+	P95Ms     float64   `gorm:"column:p95_ms;not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func (baselineIndexTuneSample) TableName() string { return "index_tune_samples" }
+
+type baselineRetentionPolicy struct {
+	Name          string `gorm:"primaryKey"`
+	Collection    string
+	Pattern       string `gorm:"not null"`
+	KeepVersions  int    `gorm:"not null;default:0"`
+	ExpireAfter   int64  `gorm:"not null;default:0"`
+	ArchiveBucket string
+	UpdatedAt     time.Time
+}
+
+func (baselineRetentionPolicy) TableName() string { return "retention_policies" }
+
+type baselineChunkVersion struct {
+	VersionID    uint   `gorm:"primaryKey"`
+	ChunkID      string `gorm:"not null"`
+	Collection   string `gorm:"not null;default:'default'"`
+	Document     string `gorm:"not null;index"`
+	RawDocument  string
+	Text         string
+	Embedding    *pgvector.HalfVector `gorm:"type:halfvec(2560)"`
+	Index        int                  `gorm:"column:chunk_index;not null;default:0"`
+	Tags         string               `gorm:"type:jsonb;default:'[]'"`
+	UpdatedAt    time.Time
+	SupersededAt time.Time `gorm:"not null;index"`
+}
+
+func (baselineChunkVersion) TableName() string { return "chunk_versions" }
+
+type baselineConfigVersion struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement"`
+	Config    string `gorm:"type:text;not null"`
+	Author    string `gorm:"not null"`
+	Message   string
+	CreatedAt time.Time
+}
+
+func (baselineConfigVersion) TableName() string { return "config_versions" }
+
+type baselineCanary struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Percent   int       `gorm:"not null"`
+	StartedAt time.Time `gorm:"not null"`
+}
+
+func (baselineCanary) TableName() string { return "canaries" }
+
+type baselineCanaryMetric struct {
+	ID            uint64  `gorm:"primaryKey"`
+	Canary        int64   `gorm:"not null;index"`
+	Arm           string  `gorm:"not null"`
+	ConfigVersion int64   `gorm:"not null"`
+	Endpoint      string  `gorm:"not null"`
+	Status        int     `gorm:"not null"`
+	LatencyMS     float64 `gorm:"not null"`
+	Results       int
+	Citations     int
+	Helpful       *bool
+	CreatedAt     time.Time
+}
+
+func (baselineCanaryMetric) TableName() string { return "canary_metrics" }
+
+type baselineAPIKey struct {
+	ID         uint64 `gorm:"primaryKey"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null"`
+	Hash       string `gorm:"not null;uniqueIndex"`
+	RateLimit  int    `gorm:"not null;default:0"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (baselineAPIKey) TableName() string { return "api_keys" }
+
+type baselineQueryCacheEntry struct {
+	Key         string `gorm:"column:cache_key;primaryKey"`
+	Fingerprint string `gorm:"not null;index"`
+	Query       string `gorm:"not null;index"`
+	Embedding   []byte
+	Chunks      string    `gorm:"type:jsonb"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+}
+
+func (baselineQueryCacheEntry) TableName() string { return "query_cache_entries" }
+
+type baselineEmbeddingModel struct {
+	Name      string `gorm:"primaryKey"`
+	Dims      int    `gorm:"not null;default:0"`
+	Active    bool   `gorm:"not null;default:false;index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (baselineEmbeddingModel) TableName() string { return "embedding_models" }
+
+type baselineChunkEmbedding struct {
+	ChunkID   string               `gorm:"primaryKey"`
+	Model     string               `gorm:"primaryKey"`
+	Dims      int                  `gorm:"not null"`
+	Embedding *pgvector.HalfVector `gorm:"type:halfvec(2560);not null"`
+	CreatedAt time.Time
+}
+
+func (baselineChunkEmbedding) TableName() string { return "chunk_embeddings" }
+
+// baselineModels are the tables of the baseline on every backend.
+var baselineModels = []any{
+	&baselineCollection{}, &baselineChunk{}, &baselineSourceFile{}, &baselineIndexTuneSample{},
+	&baselineRetentionPolicy{}, &baselineChunkVersion{}, &baselineConfigVersion{}, &baselineCanary{},
+	&baselineCanaryMetric{}, &baselineAPIKey{}, &baselineQueryCacheEntry{}, &baselineEmbeddingModel{},
+	&baselineChunkEmbedding{},
+}
+
+// baselineChunkChange and baselineReplicationState are the change feed of
+// the Postgres baseline, see migrateChangeFeed.
+type baselineChunkChange struct {
+	ChunkID string `gorm:"primaryKey"`
+	Seq     int64  `gorm:"not null;uniqueIndex"`
+	Deleted bool   `gorm:"not null;default:false"`
+}
+
+func (baselineChunkChange) TableName() string { return "chunk_changes" }
+
+type baselineReplicationState struct {
+	ID        uint  `gorm:"primaryKey"`
+	Seq       int64 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+func (baselineReplicationState) TableName() string { return "replication_states" }
@@ -0,0 +1,163 @@
+package rag
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+)
+
+type BoostField string
+
+const (
+	BoostFieldTag  BoostField = "tag"
+	BoostFieldPath BoostField = "path"
+	BoostFieldAge  BoostField = "age"
+)
+
+// BoostRule multiplies the relevance of chunks matching Value by Factor. For
+// tags Value is the tag name, for paths it is a glob over the raw document and
+// for age it is a duration such as "720h" matching recently updated chunks.
+type BoostRule struct {
+	Field  BoostField `json:"field"`
+	Value  string     `json:"value"`
+	Factor float64    `json:"factor"`
+}
+
+// ParseBoostRule parses rules written as "field=value:factor", e.g. "tag=official:1.3".
+func ParseBoostRule(s string) (BoostRule, error) {
+	field, rest, ok := strings.Cut(s, "=")
+	if !ok {
+		return BoostRule{}, errors.Newf("invalid boost rule: '%s'", s)
+	}
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return BoostRule{}, errors.Newf("invalid boost rule: '%s'", s)
+	}
+	factor, err := strconv.ParseFloat(rest[i+1:], 64)
+	if err != nil {
+		return BoostRule{}, errors.Wrapf(err, "invalid boost factor in '%s'", s)
+	}
+	rule := BoostRule{Field: BoostField(field), Value: rest[:i], Factor: factor}
+	return rule, rule.Validate()
+}
+
+func (b *BoostRule) Validate() error {
+	if b.Factor <= 0 {
+		return errors.Newf("boost factor must be positive, got %v", b.Factor)
+	}
+	switch b.Field {
+	case BoostFieldTag, BoostFieldPath:
+	case BoostFieldAge:
+		if _, err := time.ParseDuration(b.Value); err != nil {
+			return errors.Wrapf(err, "invalid boost age '%s'", b.Value)
+		}
+	default:
+		return errors.Newf("unknown boost field: '%s'", b.Field)
+	}
+	return nil
+}
+
+// boostExpr renders the rules into a SQL expression evaluating to the combined
+// multiplicative factor of a row.
+func boostExpr(rules []BoostRule) (string, []interface{}) {
+	if len(rules) == 0 {
+		return "1", nil
+	}
+
+	terms := make([]string, 0, len(rules))
+	vars := make([]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		factor := strconv.FormatFloat(rule.Factor, 'f', -1, 64)
+		switch rule.Field {
+		case BoostFieldTag:
+			tags, _ := json.Marshal([]string{rule.Value})
+			terms = append(terms, "(CASE WHEN tags @> ? THEN "+factor+" ELSE 1 END)")
+			vars = append(vars, string(tags))
+		case BoostFieldPath:
+			terms = append(terms, "(CASE WHEN raw_document ~ ? THEN "+factor+" ELSE 1 END)")
+			vars = append(vars, globToRegexp(rule.Value))
+		case BoostFieldAge:
+			d, _ := time.ParseDuration(rule.Value)
+			terms = append(terms, "(CASE WHEN updated_at > ? THEN "+factor+" ELSE 1 END)")
+			vars = append(vars, time.Now().Add(-d))
+		}
+	}
+	return strings.Join(terms, " * "), vars
+}
+
+func globToRegexp(glob string) string {
+	g := []rune(glob)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(g); i++ {
+		switch g[i] {
+		case '*':
+			if i+1 < len(g) && g[i+1] == '*' {
+				i++
+				if i+1 < len(g) && g[i+1] == '/' {
+					i++
+					b.WriteString("(.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(g[i])))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// boostMatcher evaluates rules in Go, for backends that rank outside SQL.
+type boostMatcher struct {
+	rules []BoostRule
+	paths []*regexp.Regexp
+	since []time.Time
+}
+
+func newBoostMatcher(rules []BoostRule) *boostMatcher {
+	m := &boostMatcher{
+		rules: rules,
+		paths: make([]*regexp.Regexp, len(rules)),
+		since: make([]time.Time, len(rules)),
+	}
+	for i, rule := range rules {
+		switch rule.Field {
+		case BoostFieldPath:
+			m.paths[i] = regexp.MustCompile(globToRegexp(rule.Value))
+		case BoostFieldAge:
+			d, _ := time.ParseDuration(rule.Value)
+			m.since[i] = time.Now().Add(-d)
+		}
+	}
+	return m
+}
+
+func (m *boostMatcher) factor(c *DocumentChunk) float64 {
+	f := 1.0
+	for i, rule := range m.rules {
+		var match bool
+		switch rule.Field {
+		case BoostFieldTag:
+			match = slices.Contains(c.Tags, rule.Value)
+		case BoostFieldPath:
+			match = m.paths[i].MatchString(c.RawDocument)
+		case BoostFieldAge:
+			match = c.UpdatedAt.After(m.since[i])
+		}
+		if match {
+			f *= rule.Factor
+		}
+	}
+	return f
+}
@@ -0,0 +1,370 @@
+package rag
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// CacheMatchExact serves cached results only for the same normalized query.
+	CacheMatchExact = "exact"
+	// CacheMatchApproximate also serves the results of a query whose embedding
+	// is at least Similarity close, e.g. "vacation policy?" for "Vacation policy".
+	CacheMatchApproximate = "approximate"
+)
+
+func ParseCacheMatch(s string) (string, error) {
+	switch s {
+	case "", CacheMatchExact:
+		return CacheMatchExact, nil
+	case CacheMatchApproximate:
+		return s, nil
+	default:
+		return "", errors.Newf("unknown cache match: '%s', expected exact or approximate", s)
+	}
+}
+
+type QueryCacheOptions struct {
+	// Size bounds the query embeddings and the result sets kept in memory each.
+	Size int
+	// TTL is how long results are served from the cache, so documents ingested
+	// meanwhile show up after at most TTL.
+	TTL time.Duration
+	// Match is CacheMatchExact or CacheMatchApproximate.
+	Match string
+	// Similarity is the minimum cosine similarity of approximate matches.
+	Similarity float64
+	// DB, if set, keeps result sets in the query_cache_entries table as well,
+	// so they survive restarts and are shared by servers using the same database.
+	DB *gorm.DB
+}
+
+// QueryCache keeps query embeddings and final result sets of searches, keyed
+// by the normalized query text and all other search options.
+type QueryCache struct {
+	opts QueryCacheOptions
+
+	mu         sync.Mutex
+	embeddings *lruCache[[]float32]
+	results    *lruCache[*cachedResult]
+}
+
+type cachedResult struct {
+	fingerprint string
+	embedding   []float32
+	chunks      []DocumentChunk
+}
+
+// QueryCacheEntry is a result set persisted by a QueryCache with a DB.
+type QueryCacheEntry struct {
+	Key         string          `gorm:"column:cache_key;primaryKey"`
+	Fingerprint string          `gorm:"not null;index"`
+	Query       string          `gorm:"not null;index"`
+	Embedding   []byte          // float16, little endian
+	Chunks      []DocumentChunk `gorm:"type:jsonb;serializer:json"`
+	ExpiresAt   time.Time       `gorm:"not null;index"`
+}
+
+func NewQueryCache(opts *QueryCacheOptions) (*QueryCache, error) {
+	if opts.Size <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+	if opts.TTL <= 0 {
+		return nil, errors.New("cache TTL must be positive")
+	}
+	match, err := ParseCacheMatch(opts.Match)
+	if err != nil {
+		return nil, err
+	}
+	if match == CacheMatchApproximate && (opts.Similarity <= 0 || opts.Similarity > 1) {
+		return nil, errors.Newf("cache similarity must be in (0, 1], got %g", opts.Similarity)
+	}
+	c := &QueryCache{
+		opts:       *opts,
+		embeddings: newLRUCache[[]float32](opts.Size),
+		results:    newLRUCache[*cachedResult](opts.Size),
+	}
+	c.opts.Match = match
+	return c, nil
+}
+
+// normalizeQuery folds case and whitespace, which don't change what users look for.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// cacheQuery is the normalized query qualified by the embedding model, whose
+// embeddings are not interchangeable with those of other models.
+func (r *RAG) cacheQuery(query string) string {
+	key := normalizeQuery(query)
+	if model := embedderModel(r.Embedder); model != "" {
+		key = model + "\x00" + key
+	}
+	return key
+}
+
+// searchFingerprint identifies everything but the query that decides the results.
+func (r *RAG) searchFingerprint(opts *SearchOptions) string {
+	config := r.config()
+	filter := ""
+	if opts.Filter != nil {
+		filter = opts.Filter.String()
+	}
+	b, _ := json.Marshal([]any{
+		config.Version, embedderModel(r.Embedder), r.RerankerModel, opts.collection(), opts.Mode, opts.Limit,
+		opts.Boosts, filter, opts.Rerank, opts.Candidates, opts.Collapse, opts.Fusion, opts.Expand, opts.Expansions,
+		opts.MinScore, opts.EfSearch, opts.Neighbors, opts.ParentSection, opts.MMR, opts.Lambda,
+		opts.Compress, opts.RecencyHalfLife, opts.Graph, opts.Summaries,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheKey(fingerprint string, query string) string {
+	sum := sha256.Sum256([]byte(fingerprint + "\x00" + query))
+	return hex.EncodeToString(sum[:])
+}
+
+func cosineSimilarity(a []float32, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// cloneChunks copies a result set without embeddings, so cached results
+// neither share memory with callers nor carry vectors nobody reads.
+func cloneChunks(chunks []DocumentChunk) []DocumentChunk {
+	cloned := make([]DocumentChunk, len(chunks))
+	copy(cloned, chunks)
+	for i := range cloned {
+		cloned[i].Embedding = nil
+	}
+	return cloned
+}
+
+func (c *QueryCache) embedding(ctx context.Context, query string) ([]float32, bool) {
+	c.mu.Lock()
+	v, ok := c.embeddings.get(query, time.Now())
+	c.mu.Unlock()
+	if ok || c.opts.DB == nil {
+		return v, ok
+	}
+
+	var entry QueryCacheEntry
+	err := c.opts.DB.WithContext(ctx).Select("embedding").
+		Where("query = ? AND embedding IS NOT NULL AND expires_at > ?", query, time.Now()).
+		Take(&entry).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Warn().Err(err).Msg("Failed to read query cache")
+		}
+		return nil, false
+	}
+	v = decodeHalfVector(entry.Embedding)
+	c.putEmbedding(query, v)
+	return v, true
+}
+
+func (c *QueryCache) putEmbedding(query string, embedding []float32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.embeddings.add(query, embedding, time.Now().Add(c.opts.TTL))
+}
+
+// get returns the cached results of the query, or with approximate matching
+// of the closest query with the same fingerprint if embedding is not nil.
+func (c *QueryCache) get(ctx context.Context, fingerprint string, query string, embedding []float32) ([]DocumentChunk, bool) {
+	now := time.Now()
+	key := cacheKey(fingerprint, query)
+	approximate := c.opts.Match == CacheMatchApproximate && embedding != nil
+
+	c.mu.Lock()
+	result, ok := c.results.get(key, now)
+	if !ok && approximate {
+		best := c.opts.Similarity
+		c.results.each(now, func(_ string, r *cachedResult) {
+			if r.fingerprint != fingerprint || r.embedding == nil {
+				return
+			}
+			if s := cosineSimilarity(embedding, r.embedding); s >= best {
+				best, result, ok = s, r, true
+			}
+		})
+	}
+	c.mu.Unlock()
+	if ok {
+		return cloneChunks(result.chunks), true
+	}
+	if c.opts.DB == nil {
+		return nil, false
+	}
+
+	db := c.opts.DB.WithContext(ctx)
+	var entry QueryCacheEntry
+	err := db.Where("cache_key = ? AND expires_at > ?", key, now).Take(&entry).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) && approximate {
+		var entries []QueryCacheEntry
+		err = db.Where("fingerprint = ? AND embedding IS NOT NULL AND expires_at > ?", fingerprint, now).
+			Find(&entries).Error
+		best := c.opts.Similarity
+		for _, e := range entries {
+			if s := cosineSimilarity(embedding, decodeHalfVector(e.Embedding)); s >= best {
+				best, entry, ok = s, e, true
+			}
+		}
+		if err == nil && !ok {
+			err = gorm.ErrRecordNotFound
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Warn().Err(err).Msg("Failed to read query cache")
+		}
+		return nil, false
+	}
+	c.mu.Lock()
+	c.results.add(key, &cachedResult{fingerprint: fingerprint, embedding: embedding, chunks: entry.Chunks}, entry.ExpiresAt)
+	c.mu.Unlock()
+	return cloneChunks(entry.Chunks), true
+}
+
+func (c *QueryCache) put(ctx context.Context, fingerprint string, query string, embedding []float32, chunks []DocumentChunk) {
+	expires := time.Now().Add(c.opts.TTL)
+	key := cacheKey(fingerprint, query)
+	chunks = cloneChunks(chunks)
+
+	c.mu.Lock()
+	c.results.add(key, &cachedResult{fingerprint: fingerprint, embedding: embedding, chunks: chunks}, expires)
+	c.mu.Unlock()
+	if c.opts.DB == nil {
+		return
+	}
+
+	entry := &QueryCacheEntry{Key: key, Fingerprint: fingerprint, Query: query, Chunks: chunks, ExpiresAt: expires}
+	if embedding != nil {
+		entry.Embedding = encodeHalfVector(embedding)
+	}
+	err := c.opts.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("expires_at <= ?", time.Now()).Delete(&QueryCacheEntry{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(entry).Error
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to write query cache")
+	}
+}
+
+// cachedSearch serves searches from r.Cache. Searches with hooks bypass the
+// cache, since plugins may change the results per request.
+func (r *RAG) cachedSearch(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	c := r.Cache
+	if c == nil || opts.Hooks != nil {
+		return r.search(ctx, opts)
+	}
+
+	fingerprint := r.searchFingerprint(opts)
+	query := r.cacheQuery(opts.Query)
+	var embedding []float32
+	if opts.Mode != SearchModeKeyword {
+		v, err := r.embedQuery(ctx, opts.Query)
+		if err != nil {
+			return nil, err
+		}
+		embedding = v.Slice()
+	}
+
+	chunks, ok := c.get(ctx, fingerprint, query, embedding)
+	r.Metrics.observeCache("results", ok)
+	if ok {
+		return chunks, nil
+	}
+	chunks, err := r.search(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.put(ctx, fingerprint, query, embedding, chunks)
+	return chunks, nil
+}
+
+// lruCache evicts the least recently used entry beyond size and ignores
+// expired entries. It is not safe for concurrent use.
+type lruCache[V any] struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruItem[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache[V]) get(key string, now time.Time) (V, bool) {
+	var zero V
+	e, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	item := e.Value.(*lruItem[V])
+	if !now.Before(item.expires) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return zero, false
+	}
+	c.ll.MoveToFront(e)
+	return item.value, true
+}
+
+func (c *lruCache[V]) add(key string, value V, expires time.Time) {
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*lruItem[V])
+		item.value, item.expires = value, expires
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruItem[V]{key: key, value: value, expires: expires})
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*lruItem[V]).key)
+	}
+}
+
+// each calls fn for every entry not expired at now.
+func (c *lruCache[V]) each(now time.Time, fn func(key string, value V)) {
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		item := e.Value.(*lruItem[V])
+		if now.Before(item.expires) {
+			fn(item.key, item.value)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package rag
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type countingEmbedder struct {
+	wordEmbedder
+	calls atomic.Int32
+}
+
+func (e *countingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.calls.Add(1)
+	return e.wordEmbedder.Embed(ctx, texts)
+}
+
+func TestQueryCache(t *testing.T) {
+	db := newTestDB(t)
+	embedder := &countingEmbedder{}
+	r := &RAG{DB: db, Embedder: embedder, Metrics: NewMetrics()}
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true})
+	embedder.calls.Store(0)
+
+	hits := func() float64 {
+		return testutil.ToFloat64(r.Metrics.cacheRequests.WithLabelValues("results", "hit"))
+	}
+
+	cache, err := NewQueryCache(&QueryCacheOptions{Size: 8, TTL: time.Minute, DB: db})
+	require.NoError(t, err)
+	r.Cache = cache
+	first, err := r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	cached, err := r.Search(ctx, &SearchOptions{Query: "  Yellow BANANAS ", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, first[0].ID, cached[0].ID)
+	require.Nil(t, cached[0].Embedding)
+	require.EqualValues(t, 1, embedder.calls.Load())
+	require.EqualValues(t, 1, hits())
+
+	// other options don't share results
+	_, err = r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 2})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, hits())
+
+	// a new process reads the embedding and the results from the database
+	r.Cache, err = NewQueryCache(&QueryCacheOptions{Size: 8, TTL: time.Minute, DB: db})
+	require.NoError(t, err)
+	cached, err = r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, first[0].ID, cached[0].ID)
+	require.EqualValues(t, 1, embedder.calls.Load())
+	require.EqualValues(t, 2, hits())
+
+	r.Cache, err = NewQueryCache(&QueryCacheOptions{Size: 8, TTL: time.Minute, Match: CacheMatchApproximate, Similarity: 0.9})
+	require.NoError(t, err)
+	_, err = r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 1})
+	require.NoError(t, err)
+	cached, err = r.Search(ctx, &SearchOptions{Query: "bananas yellow", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, first[0].ID, cached[0].ID)
+	require.EqualValues(t, 3, hits())
+	_, err = r.Search(ctx, &SearchOptions{Query: "red apples", Limit: 1})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, hits())
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Now()
+	c := newLRUCache[int](2)
+	c.add("a", 1, now.Add(time.Minute))
+	c.add("b", 2, now.Add(time.Minute))
+	_, ok := c.get("a", now)
+	require.True(t, ok)
+	c.add("c", 3, now.Add(time.Second))
+	_, ok = c.get("b", now)
+	require.False(t, ok)
+	v, ok := c.get("c", now)
+	require.True(t, ok)
+	require.Equal(t, 3, v)
+	_, ok = c.get("c", now.Add(time.Second))
+	require.False(t, ok)
+}
@@ -0,0 +1,292 @@
+package rag
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	ArmControl = "control"
+	ArmCanary  = "canary"
+)
+
+// Canary serves a configuration version to a percentage of search and ask
+// traffic while the rest keeps the current configuration. At most one canary
+// runs at a time.
+type Canary struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Percent   int       `gorm:"not null" json:"percent"`
+	StartedAt time.Time `gorm:"not null" json:"started_at"`
+}
+
+// CanaryMetric is logged for every request served while a canary runs.
+type CanaryMetric struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	Canary        int64     `gorm:"not null;index" json:"canary"`
+	Arm           string    `gorm:"not null" json:"arm"`
+	ConfigVersion int64     `gorm:"not null" json:"config_version"`
+	Endpoint      string    `gorm:"not null" json:"endpoint"`
+	Status        int       `gorm:"not null" json:"status"`
+	LatencyMS     float64   `gorm:"not null" json:"latency_ms"`
+	Results       int       `json:"results"`
+	Citations     int       `json:"citations"`
+	Helpful       *bool     `json:"helpful,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// StartCanary replaces any running canary with one serving version to percent of traffic.
+func (r *RAG) StartCanary(ctx context.Context, version int64, percent int) (*Canary, error) {
+	if percent < 1 || percent > 99 {
+		return nil, errors.Newf("canary percent must be between 1 and 99, got %d", percent)
+	}
+	v, err := r.GetConfigVersion(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	current, err := r.CurrentConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(current.Config, v.Config) {
+		return nil, errors.Newf("configuration version %d matches the current configuration", version)
+	}
+
+	c := &Canary{Version: version, Percent: percent, StartedAt: time.Now()}
+	err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("1 = 1").Delete(&Canary{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(c).Error
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to start canary")
+	}
+	return c, nil
+}
+
+// StopCanary stops the running canary, all traffic gets the current configuration again.
+func (r *RAG) StopCanary(ctx context.Context) error {
+	return r.DB.WithContext(ctx).Where("1 = 1").Delete(&Canary{}).Error
+}
+
+// ActiveCanary returns the running canary or nil.
+func (r *RAG) ActiveCanary(ctx context.Context) (*Canary, error) {
+	var c Canary
+	err := r.DB.WithContext(ctx).Take(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// PromoteCanary makes the canary's configuration current and stops the canary.
+func (r *RAG) PromoteCanary(ctx context.Context, author string) (*ConfigVersion, error) {
+	c, err := r.ActiveCanary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("no canary is running")
+	}
+	v, err := r.RollbackConfig(ctx, c.Version, author)
+	if err != nil {
+		return nil, err
+	}
+	return v, r.StopCanary(ctx)
+}
+
+// canaryArm assigns a request to an arm. Requests with the same key, e.g. a
+// session ID, always get the same arm; requests without one are assigned at random.
+func canaryArm(key string, percent int) string {
+	var n int
+	if key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		n = int(h.Sum32() % 100)
+	} else {
+		n = rand.IntN(100)
+	}
+	if n < percent {
+		return ArmCanary
+	}
+	return ArmControl
+}
+
+func (r *RAG) RecordCanaryMetric(ctx context.Context, m *CanaryMetric) error {
+	return r.DB.WithContext(ctx).Create(m).Error
+}
+
+// RecordCanaryFeedback marks the answer of a logged request as helpful or not.
+func (r *RAG) RecordCanaryFeedback(ctx context.Context, id uint64, helpful bool) error {
+	res := r.DB.WithContext(ctx).Model(&CanaryMetric{}).Where("id = ?", id).Update("helpful", helpful)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.Wrapf(gorm.ErrRecordNotFound, "request %d", id)
+	}
+	return nil
+}
+
+type CanaryArmReport struct {
+	Arm           string  `json:"arm"`
+	ConfigVersion int64   `json:"config_version"`
+	Requests      int     `json:"requests"`
+	ErrorRate     float64 `json:"error_rate"`
+	P50LatencyMS  float64 `json:"p50_latency_ms"`
+	P95LatencyMS  float64 `json:"p95_latency_ms"`
+	AvgResults    float64 `json:"avg_results"`
+	EmptyRate     float64 `json:"empty_rate"`
+	AvgCitations  float64 `json:"avg_citations"`
+	Feedback      int     `json:"feedback"`
+	HelpfulRate   float64 `json:"helpful_rate"`
+}
+
+type CanaryReport struct {
+	Canary *Canary           `json:"canary"`
+	Arms   []CanaryArmReport `json:"arms"`
+}
+
+// ReportCanary compares the metrics logged for both arms of the running canary.
+func (r *RAG) ReportCanary(ctx context.Context) (*CanaryReport, error) {
+	c, err := r.ActiveCanary(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("no canary is running")
+	}
+
+	var metrics []CanaryMetric
+	err = r.DB.WithContext(ctx).Where("canary = ? AND created_at >= ?", c.Version, c.StartedAt).
+		Find(&metrics).Error
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CanaryReport{Canary: c}
+	for _, arm := range []string{ArmControl, ArmCanary} {
+		a := CanaryArmReport{Arm: arm}
+		latencies := make([]float64, 0)
+		var errs, empty, results, citations, helpful int
+		for _, m := range metrics {
+			if m.Arm != arm {
+				continue
+			}
+			a.ConfigVersion = m.ConfigVersion
+			latencies = append(latencies, m.LatencyMS)
+			if m.Status >= 400 {
+				errs++
+				continue
+			}
+			results += m.Results
+			citations += m.Citations
+			if m.Results == 0 {
+				empty++
+			}
+			if m.Helpful != nil {
+				a.Feedback++
+				if *m.Helpful {
+					helpful++
+				}
+			}
+		}
+		a.Requests = len(latencies)
+		if a.Requests > 0 {
+			latency := newDistribution(latencies)
+			a.P50LatencyMS = latency.P50
+			a.P95LatencyMS = latency.P95
+			a.ErrorRate = float64(errs) / float64(a.Requests)
+		}
+		if ok := a.Requests - errs; ok > 0 {
+			a.AvgResults = float64(results) / float64(ok)
+			a.AvgCitations = float64(citations) / float64(ok)
+			a.EmptyRate = float64(empty) / float64(ok)
+		}
+		if a.Feedback > 0 {
+			a.HelpfulRate = float64(helpful) / float64(a.Feedback)
+		}
+		report.Arms = append(report.Arms, a)
+	}
+	return report, nil
+}
+
+const canaryMetricKey = "canary_metric"
+
+// canaryMetric returns the metric logged for the request, nil without a canary.
+func canaryMetric(c echo.Context) *CanaryMetric {
+	m, _ := c.Get(canaryMetricKey).(*CanaryMetric)
+	return m
+}
+
+// canaryMiddleware completes the metric logged by configure once the handler returns.
+func (s *Server) canaryMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		m := canaryMetric(c)
+		if m == nil {
+			return err
+		}
+
+		if m.Status == 0 {
+			m.Status = c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				m.Status = httpErr.Code
+			} else if err != nil {
+				m.Status = http.StatusInternalServerError
+			}
+		}
+		s.ragOf(c).finishCanaryMetric(c.Request().Context(), m, start)
+		return err
+	}
+}
+
+// finishCanaryMetric records the latency of a request started at start with
+// the status and results set on m.
+func (r *RAG) finishCanaryMetric(ctx context.Context, m *CanaryMetric, start time.Time) {
+	m.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	err := r.DB.WithContext(context.WithoutCancel(ctx)).Model(m).
+		Select("status", "latency_ms", "results", "citations").Updates(m).Error
+	if err != nil {
+		log.Error().Err(err).Uint64("id", m.ID).Msg("Record canary metric")
+	}
+}
+
+type FeedbackParam struct {
+	RequestID uint64 `json:"request_id"`
+	Helpful   bool   `json:"helpful"`
+}
+
+func (s *Server) feedbackHandler(c echo.Context) error {
+	var p FeedbackParam
+	err := c.Bind(&p)
+	if err != nil {
+		return err
+	}
+	if p.RequestID == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "request_id is required")
+	}
+	err = s.ragOf(c).RecordCanaryFeedback(c.Request().Context(), p.RequestID, p.Helpful)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
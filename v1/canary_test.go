@@ -0,0 +1,75 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanaryArm(t *testing.T) {
+	require.Equal(t, canaryArm("session-1", 50), canaryArm("session-1", 50))
+
+	canary := 0
+	for i := 0; i < 1000; i++ {
+		if canaryArm("", 20) == ArmCanary {
+			canary++
+		}
+	}
+	require.InDelta(t, 200, canary, 60)
+}
+
+func TestCanaryTrafficSplit(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	cfg := DefaultConfig()
+	cfg.Limit = 1
+	v, err := r.SetConfig(ctx, &cfg, "alice", "")
+	require.NoError(t, err)
+	_, err = r.StartCanary(ctx, v.Version, 50)
+	require.Error(t, err)
+	control, err := r.RollbackConfig(ctx, 0, "alice")
+	require.NoError(t, err)
+	_, err = r.StartCanary(ctx, v.Version, 50)
+	require.NoError(t, err)
+
+	s := NewServer(r, &ServerOptions{})
+	versions := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/search", strings.NewReader(`{"query":"apples"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderSession, "session-"+strconv.Itoa(i))
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		versions[rec.Header().Get(HeaderConfigVersion)]++
+	}
+	require.Len(t, versions, 2)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/feedback", strings.NewReader(`{"request_id":1,"helpful":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	report, err := r.ReportCanary(ctx)
+	require.NoError(t, err)
+	require.Len(t, report.Arms, 2)
+	require.Equal(t, 40, report.Arms[0].Requests+report.Arms[1].Requests)
+	require.Equal(t, control.Version, report.Arms[0].ConfigVersion)
+	require.Equal(t, v.Version, report.Arms[1].ConfigVersion)
+	require.Equal(t, 1, report.Arms[0].Feedback+report.Arms[1].Feedback)
+
+	promoted, err := r.PromoteCanary(ctx, "alice")
+	require.NoError(t, err)
+	require.Equal(t, cfg, promoted.Config)
+	canary, err := r.ActiveCanary(ctx)
+	require.NoError(t, err)
+	require.Nil(t, canary)
+}
@@ -0,0 +1,107 @@
+package rag
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+type ChatParam struct {
+	SearchParam
+}
+
+type ChatSource struct {
+	Index       int    `json:"index"`
+	ChunkID     string `json:"chunk_id"`
+	Document    string `json:"document"`
+	RawDocument string `json:"raw_document"`
+}
+
+// ChatResult is the final event of a chat stream.
+type ChatResult struct {
+	Answer        string       `json:"answer"`
+	Citations     []Citation   `json:"citations"`
+	Sources       []ChatSource `json:"sources"`
+	ConfigVersion int64        `json:"config_version"`
+	Usage         TokenUsage   `json:"usage"`
+}
+
+func writeEvent(c echo.Context, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", event, b)
+	if err != nil {
+		return err
+	}
+	c.Response().Flush()
+	return nil
+}
+
+func (s *Server) chatHandler(c echo.Context) error {
+	var p ChatParam
+	err := c.Bind(&p)
+	if err != nil {
+		return err
+	}
+	r, err := s.configure(c)
+	if err != nil {
+		return err
+	}
+	opts, err := s.searchOptions(c, r, &p.SearchParam)
+	if err != nil {
+		return err
+	}
+
+	done := s.trackStream()
+	defer done()
+
+	ctx := c.Request().Context()
+	chunks, err := r.Search(ctx, opts)
+	if err != nil {
+		return err
+	}
+	m := canaryMetric(c)
+	if m != nil {
+		m.Results = len(chunks)
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	answer, err := r.AskStream(ctx, p.Query, chunks, func(token string) error {
+		return writeEvent(c, "token", echo.Map{"content": token})
+	})
+	if err != nil {
+		if m != nil {
+			m.Status = http.StatusBadGateway
+		}
+		return writeEvent(c, "error", echo.Map{"error": err.Error()})
+	}
+	if m != nil {
+		m.Citations = len(answer.Citations)
+	}
+
+	sources := make([]ChatSource, len(answer.Chunks))
+	for i, chunk := range answer.Chunks {
+		sources[i] = ChatSource{
+			Index:       i + 1,
+			ChunkID:     chunk.ID,
+			Document:    chunk.Document,
+			RawDocument: chunk.RawDocument,
+		}
+	}
+	return writeEvent(c, "done", &ChatResult{
+		Answer:        answer.Text,
+		Citations:     answer.Citations,
+		Sources:       sources,
+		ConfigVersion: answer.ConfigVersion,
+		Usage:         answer.Usage,
+	})
+}
@@ -1,12 +1,14 @@
 package rag
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/cockroachdb/errors"
 	"resty.dev/v3"
 )
 
+// InfinityClient calls an Infinity server, which embeds and reranks.
 type InfinityClient struct {
 	client *resty.Client
 }
@@ -28,9 +30,9 @@ type HealthResponse struct {
 	Unix float64 `json:"unix"`
 }
 
-func (c *InfinityClient) GetHealth() (*HealthResponse, error) {
+func (c *InfinityClient) GetHealth(ctx context.Context) (*HealthResponse, error) {
 	var response HealthResponse
-	rsp, err := c.client.R().SetResult(&response).Get("/health")
+	rsp, err := c.client.R().SetContext(ctx).SetResult(&response).Get("/health")
 	if err != nil {
 		return nil, err
 	}
@@ -45,8 +47,8 @@ type RerankRequest struct {
 	Query           string   `json:"query"`
 	Documents       []string `json:"documents"`
 	TopN            int      `json:"top_n"`
-	ReturnDocuments bool     `json:"return_documents"`
-	RawScores       bool     `json:"raw_scores"`
+	ReturnDocuments bool     `json:"return_documents,omitempty"`
+	RawScores       bool     `json:"raw_scores,omitempty"`
 }
 
 type RerankResponse struct {
@@ -67,14 +69,11 @@ type RerankResponse struct {
 	} `json:"results"`
 }
 
-func (c *InfinityClient) Rerank(req *RerankRequest) (*RerankResponse, error) {
-	var response RerankResponse
-	rsp, err := c.client.R().SetBody(req).SetResult(&response).Post("/rerank")
-	if err != nil {
-		return nil, err
-	}
-	if code := rsp.StatusCode(); code != http.StatusOK {
-		return nil, errors.Newf("status code: %d, response: '%s'", code, rsp.String())
-	}
-	return &response, nil
+func (c *InfinityClient) Rerank(ctx context.Context, model string, query string, documents []string, topN int) ([]RerankResult, error) {
+	return rerankAPI(ctx, c.client, "/rerank", &RerankRequest{
+		Model:     model,
+		Query:     query,
+		Documents: documents,
+		TopN:      topN,
+	})
 }
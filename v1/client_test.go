@@ -1,6 +1,7 @@
 package rag
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -12,15 +13,11 @@ func TestInfinityClient_Rerank(t *testing.T) {
 	client := NewInfinityClient(os.Getenv("RERANKER_BASE_URL"))
 	defer func() { _ = client.Close() }()
 
-	_, err := client.GetHealth()
+	_, err := client.GetHealth(context.Background())
 	require.NoError(t, err)
 
-	rsp, err := client.Rerank(&RerankRequest{
-		Model:     os.Getenv("RERANKER_MODEL"),
-		Query:     "query",
-		Documents: []string{"doc1", "doc2", "doc3"},
-		TopN:      3,
-	})
+	rsp, err := client.Rerank(context.Background(), os.Getenv("RERANKER_MODEL"), "query",
+		[]string{"doc1", "doc2", "doc3"}, 3)
 	require.NoError(t, err)
 	fmt.Printf("%+v\n", rsp)
 }
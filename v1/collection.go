@@ -0,0 +1,134 @@
+package rag
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"gorm.io/gorm"
+)
+
+const DefaultCollection = "default"
+
+var collectionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Collection is a corpus indexed alongside others in the same database.
+// Searches are always scoped to one collection.
+type Collection struct {
+	Name string `gorm:"primaryKey" json:"name"`
+	// TextSearchConfig is the analyzer used for documents scanned into the
+	// collection unless overridden.
+	TextSearchConfig string `gorm:"not null;default:'simple'" json:"text_search_config"`
+	// Distance is the metric dense search ranks the collection's chunks by,
+	// see ParseDistance.
+	Distance  string    `gorm:"not null;default:'l2'" json:"distance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CollectionInfo struct {
+	Collection
+	Documents int64 `json:"documents"`
+	Chunks    int64 `json:"chunks"`
+}
+
+func ValidateCollectionName(name string) error {
+	if !collectionNameRegexp.MatchString(name) {
+		return errors.Newf("invalid collection name: '%s'", name)
+	}
+	return nil
+}
+
+// EnsureCollection creates the collection if needed. A non-empty analyzer
+// replaces the collection's text search configuration, and that of its
+// chunks, whose tsv is generated from it.
+func (r *RAG) EnsureCollection(ctx context.Context, name string, analyzer string) (*Collection, error) {
+	if err := ValidateCollectionName(name); err != nil {
+		return nil, err
+	}
+	c := Collection{Name: name, TextSearchConfig: defaultTextSearchConfig, Distance: DefaultDistance}
+	if analyzer != "" {
+		c.TextSearchConfig = analyzer
+	}
+	err := r.DB.WithContext(ctx).Where("name = ?", name).FirstOrCreate(&c).Error
+	if err != nil {
+		return nil, err
+	}
+	if analyzer != "" && c.TextSearchConfig != analyzer {
+		err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&c).Update("text_search_config", analyzer).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&DocumentChunk{}).Where("collection = ? AND text_search_config <> ?", name, analyzer).
+				Update("text_search_config", analyzer).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// SetCollectionDistance changes the metric of a collection. Its vector
+// index is built for the previous metric, so it must be dropped first.
+func (r *RAG) SetCollectionDistance(ctx context.Context, name string, distance string) error {
+	distance, err := ParseDistance(distance)
+	if err != nil {
+		return err
+	}
+	if r.DB.Dialector.Name() != sqliteDialect {
+		index, err := r.vectorIndex(ctx, name)
+		if err != nil {
+			return errors.Wrap(err, "Failed to find vector index")
+		}
+		if index != nil {
+			return errors.Newf("collection '%s' has vector index %s, drop it first", name, index.Name)
+		}
+	}
+	result := r.DB.WithContext(ctx).Model(&Collection{}).Where("name = ?", name).Update("distance", distance)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.Newf("collection '%s' does not exist", name)
+	}
+	return nil
+}
+
+// collectionDistance returns the metric of a collection, the default for
+// collections not created yet.
+func (r *RAG) collectionDistance(ctx context.Context, name string) (string, error) {
+	var distances []string
+	err := r.DB.WithContext(ctx).Model(&Collection{}).Where("name = ?", name).Pluck("distance", &distances).Error
+	if err != nil {
+		return "", err
+	}
+	if len(distances) == 0 || distances[0] == "" {
+		return DefaultDistance, nil
+	}
+	return distances[0], nil
+}
+
+// collectionAnalyzer returns the text search configuration of a collection,
+// the default for collections not created yet.
+func (r *RAG) collectionAnalyzer(ctx context.Context, name string) (string, error) {
+	var analyzers []string
+	err := r.DB.WithContext(ctx).Model(&Collection{}).Where("name = ?", name).Pluck("text_search_config", &analyzers).Error
+	if err != nil {
+		return "", err
+	}
+	if len(analyzers) == 0 || analyzers[0] == "" {
+		return defaultTextSearchConfig, nil
+	}
+	return analyzers[0], nil
+}
+
+func (r *RAG) ListCollections(ctx context.Context) ([]CollectionInfo, error) {
+	var collections []CollectionInfo
+	err := r.DB.WithContext(ctx).Raw(`SELECT c.name, c.text_search_config, c.distance, c.created_at,
+  COUNT(DISTINCT d.document) AS documents, COUNT(d.id) AS chunks
+FROM collections c LEFT JOIN document_chunks d ON d.collection = c.name
+GROUP BY c.name, c.text_search_config, c.distance, c.created_at ORDER BY c.name`).Scan(&collections).Error
+	return collections, err
+}
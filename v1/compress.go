@@ -0,0 +1,73 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const compressPrompt = "下面是一段检索到的文档和一个问题。请从文档中原样摘录与问题相关的句子，每行一句，不要改写，不要解释。" +
+	"如果没有相关的句子，只输出 NONE。\n问题：%s\n文档：\n%s"
+
+// compressNone is the assistant's reply for chunks without relevant sentences.
+const compressNone = "NONE"
+
+// compressConcurrency bounds the completions running at once for one search.
+const compressConcurrency = 8
+
+// compressChunk returns the sentences of text relevant to query, empty if
+// none are. Sentences the assistant didn't copy verbatim are dropped, and if
+// none is left the whole text is kept rather than trusting a rewrite.
+func (r *RAG) compressChunk(ctx context.Context, query string, text string) (string, error) {
+	reply, err := r.complete(ctx, "contextual compression", fmt.Sprintf(compressPrompt, query, text))
+	if err != nil {
+		return "", err
+	}
+	if reply == compressNone {
+		return "", nil
+	}
+	sentences := make([]string, 0)
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimSpace(listMarker.ReplaceAllString(line, ""))
+		if line != "" && line != compressNone && strings.Contains(text, line) {
+			sentences = append(sentences, line)
+		}
+	}
+	if len(sentences) == 0 {
+		return text, nil
+	}
+	return strings.Join(sentences, "\n"), nil
+}
+
+// compress replaces the text of every chunk with the sentences relevant to
+// the query and drops the chunks without any.
+func (r *RAG) compress(ctx context.Context, query string, chunks []DocumentChunk) (_ []DocumentChunk, err error) {
+	start := time.Now()
+	defer func() { r.Metrics.observeCompression(start, err) }()
+
+	texts := make([]string, len(chunks))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(compressConcurrency)
+	for i, c := range chunks {
+		g.Go(func() error {
+			var err error
+			texts[i], err = r.compressChunk(ctx, query, c.Text)
+			return err
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		return nil, err
+	}
+	compressed := make([]DocumentChunk, 0, len(chunks))
+	for i, c := range chunks {
+		if texts[i] != "" {
+			c.Text = texts[i]
+			compressed = append(compressed, c)
+		}
+	}
+	return compressed, nil
+}
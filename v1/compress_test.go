@@ -0,0 +1,56 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchCompress(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "Apples are red. They grow in cold climates.\nPears are green."},
+		{Text: "Bananas are yellow."},
+	}}
+	d.Fix()
+	require.NoError(t, newTestRAG(db).UpsertDocumentChunks(d))
+
+	for _, tt := range []struct {
+		reply string
+		texts []string
+	}{
+		{"- Apples are red.\nPears are green.", []string{"Apples are red.\nPears are green."}},
+		// sentences not copied verbatim are dropped
+		{"Apples are red.\nApples are tasty.", []string{"Apples are red."}},
+		// a rewrite keeps the whole chunk
+		{"Apples are usually red.", []string{d.Chunks[0].Text}},
+		{"NONE", []string{}},
+	} {
+		r := &RAG{DB: db, Embedder: wordEmbedder{}, AssistantClient: fakeAssistant(t, tt.reply)}
+		chunks, err := r.Search(ctx, &SearchOptions{Query: "apples", Mode: SearchModeKeyword, Limit: 5, Compress: true})
+		require.NoError(t, err)
+		texts := make([]string, len(chunks))
+		for i, c := range chunks {
+			texts[i] = c.Text
+		}
+		require.Equal(t, tt.texts, texts, tt.reply)
+	}
+
+	r := newTestRAG(db)
+	_, err := r.Search(ctx, &SearchOptions{Query: "apples", Mode: SearchModeKeyword, Limit: 5, Compress: true})
+	require.ErrorContains(t, err, "requires the assistant")
+
+	s := NewServer(r, &ServerOptions{})
+	req := httptest.NewRequest(http.MethodPost, "/v1/search", strings.NewReader(`{"query":"apples","compress":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "requires the assistant")
+}
@@ -0,0 +1,223 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+// Config holds the prompts and retrieval defaults that affect answer quality.
+// Every change is stored as a new ConfigVersion so it can be traced and reverted.
+type Config struct {
+	SystemPrompt string `json:"system_prompt"`
+	// AnswerPrompt introduces the knowledge chunks in the user message.
+	AnswerPrompt string `json:"answer_prompt"`
+
+	Mode  SearchMode `json:"mode"`
+	Limit int        `json:"limit"`
+	// CandidatesPerResult is how many candidates are retrieved per result when reranking.
+	CandidatesPerResult int `json:"candidates_per_result"`
+	// RerankerModel overrides the reranker model the server was started with.
+	RerankerModel string `json:"reranker_model,omitempty"`
+	// ContextTokens caps the prompt sent to the assistant: the retrieved
+	// chunks that don't fit are dropped, the last one truncated. Set it to
+	// the model's context window less the tokens its answers take. Zero
+	// doesn't limit the prompt.
+	ContextTokens int `json:"context_tokens,omitempty"`
+
+	Fusion Fusion `json:"fusion"`
+}
+
+// Fusion weighs dense and keyword results in hybrid search.
+type Fusion struct {
+	K             int     `json:"k"`
+	DenseWeight   float64 `json:"dense_weight"`
+	KeywordWeight float64 `json:"keyword_weight"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		SystemPrompt:        systemPrompt,
+		AnswerPrompt:        answerPrompt,
+		Mode:                SearchModeDense,
+		Limit:               10,
+		CandidatesPerResult: 4,
+		Fusion:              Fusion{K: rrfK, DenseWeight: 1, KeywordWeight: 1},
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.SystemPrompt == "" {
+		return errors.New("system prompt is required")
+	}
+	if _, err := ParseSearchMode(string(c.Mode)); err != nil {
+		return err
+	}
+	if c.Limit <= 0 {
+		return errors.Newf("limit must be positive, got %d", c.Limit)
+	}
+	if c.CandidatesPerResult < 1 {
+		return errors.Newf("candidates per result must be at least 1, got %d", c.CandidatesPerResult)
+	}
+	if c.ContextTokens < 0 {
+		return errors.Newf("context tokens must not be negative, got %d", c.ContextTokens)
+	}
+	if c.Fusion.K <= 0 {
+		return errors.Newf("fusion k must be positive, got %d", c.Fusion.K)
+	}
+	if c.Fusion.DenseWeight < 0 || c.Fusion.KeywordWeight < 0 ||
+		c.Fusion.DenseWeight+c.Fusion.KeywordWeight == 0 {
+		return errors.New("fusion weights must be non-negative and not both zero")
+	}
+	return nil
+}
+
+// ConfigVersion is one saved configuration. Version 0 is the built-in default
+// and is never stored.
+type ConfigVersion struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement" json:"version"`
+	Config    Config    `gorm:"type:text;not null;serializer:json" json:"config"`
+	Author    string    `gorm:"not null" json:"author"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func defaultConfigVersion() *ConfigVersion {
+	return &ConfigVersion{Config: DefaultConfig(), Author: "built-in"}
+}
+
+// WithConfig returns a copy of the RAG bound to the configuration version.
+func (r *RAG) WithConfig(v *ConfigVersion) *RAG {
+	bound := *r
+	bound.Config = v
+	if v.Config.RerankerModel != "" {
+		bound.RerankerModel = v.Config.RerankerModel
+	}
+	return &bound
+}
+
+// config returns the configuration the RAG was bound to, or the defaults.
+func (r *RAG) config() *ConfigVersion {
+	if r.Config == nil {
+		return defaultConfigVersion()
+	}
+	return r.Config
+}
+
+// CurrentConfig returns the latest configuration version.
+func (r *RAG) CurrentConfig(ctx context.Context) (*ConfigVersion, error) {
+	var v ConfigVersion
+	err := r.DB.WithContext(ctx).Order("version DESC").Take(&v).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return defaultConfigVersion(), nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load configuration")
+	}
+	return &v, nil
+}
+
+func (r *RAG) GetConfigVersion(ctx context.Context, version int64) (*ConfigVersion, error) {
+	if version == 0 {
+		return defaultConfigVersion(), nil
+	}
+	var v ConfigVersion
+	err := r.DB.WithContext(ctx).Take(&v, version).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errors.Newf("configuration version %d not found", version)
+	}
+	return &v, err
+}
+
+// ConfigHistory returns all saved versions, newest first.
+func (r *RAG) ConfigHistory(ctx context.Context) ([]ConfigVersion, error) {
+	var versions []ConfigVersion
+	err := r.DB.WithContext(ctx).Order("version DESC").Find(&versions).Error
+	return versions, err
+}
+
+// SetConfig saves cfg as a new version. Nothing is saved if it equals the
+// current configuration, in which case the current version is returned.
+func (r *RAG) SetConfig(ctx context.Context, cfg *Config, author string, message string) (*ConfigVersion, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if author == "" {
+		return nil, errors.New("author is required")
+	}
+
+	current, err := r.CurrentConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(current.Config, *cfg) {
+		return current, nil
+	}
+
+	v := &ConfigVersion{Config: *cfg, Author: author, Message: message}
+	err = r.DB.WithContext(ctx).Create(v).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save configuration")
+	}
+	return v, nil
+}
+
+// RollbackConfig saves the configuration of an earlier version as a new version,
+// so the history keeps the rollback itself.
+func (r *RAG) RollbackConfig(ctx context.Context, version int64, author string) (*ConfigVersion, error) {
+	v, err := r.GetConfigVersion(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return r.SetConfig(ctx, &v.Config, author, fmt.Sprintf("Rollback to version %d", version))
+}
+
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+// DiffConfig lists the fields that differ between two configurations,
+// named by their JSON path, e.g. fusion.k.
+func DiffConfig(old *Config, new *Config) []ConfigChange {
+	a, b := flattenConfig(old), flattenConfig(new)
+	changes := make([]ConfigChange, 0)
+	for field, v := range b {
+		if !reflect.DeepEqual(a[field], v) {
+			changes = append(changes, ConfigChange{Field: field, Old: a[field], New: v})
+		}
+	}
+	for field, v := range a {
+		if _, ok := b[field]; !ok {
+			changes = append(changes, ConfigChange{Field: field, Old: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func flattenConfig(c *Config) map[string]any {
+	buf, _ := json.Marshal(c)
+	var m map[string]any
+	_ = json.Unmarshal(buf, &m)
+	flat := make(map[string]any)
+	var walk func(prefix string, m map[string]any)
+	walk = func(prefix string, m map[string]any) {
+		for k, v := range m {
+			if nested, ok := v.(map[string]any); ok {
+				walk(prefix+k+".", nested)
+			} else {
+				flat[prefix+k] = v
+			}
+		}
+	}
+	walk("", m)
+	return flat
+}
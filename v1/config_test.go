@@ -0,0 +1,51 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRollback(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	ctx := context.Background()
+
+	current, err := r.CurrentConfig(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, current.Version)
+	require.Equal(t, DefaultConfig(), current.Config)
+
+	cfg := DefaultConfig()
+	cfg.Mode = SearchModeHybrid
+	cfg.Fusion.KeywordWeight = 0.5
+	v1, err := r.SetConfig(ctx, &cfg, "alice", "prefer dense matches")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v1.Version)
+
+	// saving the same configuration again doesn't create a version
+	same, err := r.SetConfig(ctx, &cfg, "bob", "")
+	require.NoError(t, err)
+	require.Equal(t, v1.Version, same.Version)
+
+	cfg.Fusion.K = 0
+	_, err = r.SetConfig(ctx, &cfg, "bob", "")
+	require.Error(t, err)
+
+	v2, err := r.RollbackConfig(ctx, 0, "bob")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, v2.Version)
+	require.Equal(t, DefaultConfig(), v2.Config)
+
+	require.Equal(t, []ConfigChange{
+		{Field: "fusion.keyword_weight", Old: 0.5, New: 1.0},
+		{Field: "mode", Old: "hybrid", New: "dense"},
+	}, DiffConfig(&v1.Config, &v2.Config))
+
+	history, err := r.ConfigHistory(ctx)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, "Rollback to version 0", history[0].Message)
+	require.Equal(t, "alice", history[1].Author)
+}
@@ -0,0 +1,285 @@
+package rag
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultDedupNeighbors is how many nearest chunks every chunk is compared
+// with on Postgres, where near duplicates are found through the vector index.
+const DefaultDedupNeighbors = 5
+
+// DuplicateSource is a chunk of a duplicate pair, or a duplicate collapsed
+// into a search result, keeping the document it came from.
+type DuplicateSource struct {
+	ChunkID     string `json:"chunk_id"`
+	Document    string `json:"document"`
+	RawDocument string `json:"raw_document"`
+}
+
+// DuplicatePair is a chunk duplicating an older one, which is kept when
+// duplicates are collapsed.
+type DuplicatePair struct {
+	Kept      DuplicateSource `json:"kept"`
+	Duplicate DuplicateSource `json:"duplicate"`
+	// Similarity is the cosine similarity of the embeddings, 1 for exact pairs.
+	Similarity float64 `json:"similarity"`
+	// Exact pairs have the same text after normalizing case and whitespace.
+	Exact bool `json:"exact"`
+}
+
+type DedupOptions struct {
+	Collection string
+	// Threshold is the cosine similarity of embeddings at or above which
+	// chunks are near duplicates. Zero only finds chunks with the same text.
+	Threshold float64
+	// Neighbors is how many nearest chunks every chunk is compared with on
+	// Postgres, zero uses DefaultDedupNeighbors. SQLite compares all pairs.
+	Neighbors int
+}
+
+// dedupChunk is a chunk as compared by FindDuplicates.
+type dedupChunk struct {
+	ID          string
+	Document    string
+	RawDocument string
+	CreatedAt   time.Time
+}
+
+func (c *dedupChunk) source() DuplicateSource {
+	return DuplicateSource{ChunkID: c.ID, Document: c.Document, RawDocument: c.RawDocument}
+}
+
+// olderThan orders chunks by ingestion, so the first ingested copy is kept.
+func (c *dedupChunk) olderThan(o *dedupChunk) bool {
+	if !c.CreatedAt.Equal(o.CreatedAt) {
+		return c.CreatedAt.Before(o.CreatedAt)
+	}
+	return c.ID < o.ID
+}
+
+// nearPair is two chunks whose embeddings are at least as similar as the threshold.
+type nearPair struct {
+	A          dedupChunk `gorm:"embedded;embeddedPrefix:a_"`
+	B          dedupChunk `gorm:"embedded;embeddedPrefix:b_"`
+	Similarity float64
+}
+
+// notDuplicate matches the chunks of table that are not collapsed into
+// another chunk. Duplicates of a deleted chunk are searched again.
+func notDuplicate(table string) string {
+	return "(" + table + ".duplicate_of = '' OR NOT EXISTS " +
+		"(SELECT 1 FROM document_chunks canonical WHERE canonical.id = " + table + ".duplicate_of))"
+}
+
+// normalizeText folds case and whitespace, so copies of a text that differ
+// only in line wrapping or capitalization compare equal.
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// FindDuplicates returns the pairs of chunks of a collection with the same
+// normalized text, or with embeddings at least opts.Threshold similar, most
+// similar first. Chunks already collapsed are skipped.
+func (r *RAG) FindDuplicates(ctx context.Context, opts *DedupOptions) ([]DuplicatePair, error) {
+	collection := opts.Collection
+	if collection == "" {
+		collection = DefaultCollection
+	}
+	db := r.DB.WithContext(ctx)
+
+	rows, err := db.Model(&DocumentChunk{}).Select("id", "document", "raw_document", "text", "created_at").
+		Where("collection = ?", collection).Where(notDuplicate("document_chunks")).Where(leafChunks("document_chunks")).
+		Order("created_at, id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	pairs := make([]DuplicatePair, 0)
+	seen := make(map[[2]string]bool)
+	first := make(map[string]dedupChunk)
+	for rows.Next() {
+		var c DocumentChunk
+		err = db.ScanRows(rows, &c)
+		if err != nil {
+			return nil, err
+		}
+		chunk := dedupChunk{ID: c.ID, Document: c.Document, RawDocument: c.RawDocument, CreatedAt: c.CreatedAt}
+		key := hashString(normalizeText(c.Text))
+		kept, ok := first[key]
+		if !ok {
+			first[key] = chunk
+			continue
+		}
+		pairs = append(pairs, DuplicatePair{Kept: kept.source(), Duplicate: chunk.source(), Similarity: 1, Exact: true})
+		seen[[2]string{kept.ID, chunk.ID}] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if opts.Threshold > 0 {
+		neighbors := opts.Neighbors
+		if neighbors <= 0 {
+			neighbors = DefaultDedupNeighbors
+		}
+		distance, err := r.collectionDistance(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		near, err := backendOf(db).nearDuplicates(db, collection, distance, opts.Threshold, neighbors)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range near {
+			kept, duplicate := p.A, p.B
+			if duplicate.olderThan(&kept) {
+				kept, duplicate = duplicate, kept
+			}
+			key := [2]string{kept.ID, duplicate.ID}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			pairs = append(pairs, DuplicatePair{
+				Kept:       kept.source(),
+				Duplicate:  duplicate.source(),
+				Similarity: min(p.Similarity, 1),
+			})
+		}
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Similarity > pairs[j].Similarity })
+	return pairs, nil
+}
+
+func (postgresBackend) nearDuplicates(db *gorm.DB, collection string, distance string, threshold float64, neighbors int) ([]nearPair, error) {
+	var pairs []nearPair
+	// the nearest chunks are ordered by the distance the collection's vector index serves
+	err := db.Raw(`SELECT a.id AS a_id, a.document AS a_document, a.raw_document AS a_raw_document,
+  a.created_at AS a_created_at, b.id AS b_id, b.document AS b_document, b.raw_document AS b_raw_document,
+  b.created_at AS b_created_at, b.similarity
+FROM document_chunks a CROSS JOIN LATERAL (
+  SELECT n.id, n.document, n.raw_document, n.created_at, 1 - (n.embedding <=> a.embedding) AS similarity
+  FROM document_chunks n
+  WHERE n.collection = ? AND n.id <> a.id AND n.embedding IS NOT NULL AND `+notDuplicate("n")+` AND `+leafChunks("n")+`
+  ORDER BY n.embedding `+distanceOperator(distance)+` a.embedding LIMIT ?) b
+WHERE a.collection = ? AND a.embedding IS NOT NULL AND `+notDuplicate("a")+` AND `+leafChunks("a")+`
+  AND b.similarity >= ?`,
+		collection, neighbors, collection, threshold).Scan(&pairs).Error
+	return pairs, err
+}
+
+func (sqliteBackend) nearDuplicates(db *gorm.DB, collection string, _ string, threshold float64, _ int) ([]nearPair, error) {
+	var chunks []DocumentChunk
+	err := db.Model(&DocumentChunk{}).Select("id", "document", "raw_document", "created_at", "embedding").
+		Where("collection = ? AND embedding IS NOT NULL", collection).Where(notDuplicate("document_chunks")).
+		Where(leafChunks("document_chunks")).Find(&chunks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float32, len(chunks))
+	for i, c := range chunks {
+		embeddings[i] = c.Embedding.Slice()
+	}
+	pairs := make([]nearPair, 0)
+	for i := range chunks {
+		for j := i + 1; j < len(chunks); j++ {
+			similarity := cosineSimilarity(embeddings[i], embeddings[j])
+			if similarity < threshold {
+				continue
+			}
+			a, b := chunks[i], chunks[j]
+			pairs = append(pairs, nearPair{
+				A:          dedupChunk{ID: a.ID, Document: a.Document, RawDocument: a.RawDocument, CreatedAt: a.CreatedAt},
+				B:          dedupChunk{ID: b.ID, Document: b.Document, RawDocument: b.RawDocument, CreatedAt: b.CreatedAt},
+				Similarity: similarity,
+			})
+		}
+	}
+	return pairs, nil
+}
+
+// CollapseDuplicates hides the duplicate of every pair from search, keeping
+// it with its document so search results list it among their sources. A
+// chunk duplicating several others is collapsed into the most similar, and
+// chains are followed to the chunk kept. It returns the number collapsed.
+func (r *RAG) CollapseDuplicates(ctx context.Context, pairs []DuplicatePair) (int64, error) {
+	parent := make(map[string]string)
+	for _, p := range pairs {
+		if _, ok := parent[p.Duplicate.ChunkID]; !ok {
+			parent[p.Duplicate.ChunkID] = p.Kept.ChunkID
+		}
+	}
+	// every pair keeps the older chunk, so chains end
+	root := func(id string) string {
+		for {
+			next, ok := parent[id]
+			if !ok {
+				return id
+			}
+			id = next
+		}
+	}
+
+	byRoot := make(map[string][]string)
+	for id := range parent {
+		kept := root(id)
+		byRoot[kept] = append(byRoot[kept], id)
+	}
+	var collapsed int64
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for kept, ids := range byRoot {
+			result := tx.Model(&DocumentChunk{}).Where("id IN ?", ids).Update("duplicate_of", kept)
+			if result.Error != nil {
+				return result.Error
+			}
+			collapsed += result.RowsAffected
+		}
+		return nil
+	})
+	return collapsed, err
+}
+
+// ResetDuplicates makes the collapsed chunks of a collection searchable
+// again, all collections when collection is empty.
+func (r *RAG) ResetDuplicates(ctx context.Context, collection string) (int64, error) {
+	q := r.DB.WithContext(ctx).Model(&DocumentChunk{}).Where("duplicate_of <> ''")
+	if collection != "" {
+		q = q.Where("collection = ?", collection)
+	}
+	result := q.Update("duplicate_of", "")
+	return result.RowsAffected, result.Error
+}
+
+// attachDuplicates lists the chunks collapsed into every search result.
+func attachDuplicates(db *gorm.DB, chunks []DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	ids := make([]string, len(chunks))
+	for i, c := range chunks {
+		ids[i] = c.ID
+	}
+	var duplicates []DocumentChunk
+	err := db.Model(&DocumentChunk{}).Select("id", "document", "raw_document", "duplicate_of").
+		Where("duplicate_of IN ?", ids).Order("created_at, id").Find(&duplicates).Error
+	if err != nil {
+		return err
+	}
+	byKept := make(map[string][]DuplicateSource)
+	for _, d := range duplicates {
+		byKept[d.DuplicateOf] = append(byKept[d.DuplicateOf],
+			DuplicateSource{ChunkID: d.ID, Document: d.Document, RawDocument: d.RawDocument})
+	}
+	for i := range chunks {
+		chunks[i].Duplicates = byKept[chunks[i].ID]
+	}
+	return nil
+}
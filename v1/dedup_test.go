@@ -0,0 +1,76 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	for _, d := range []*Document{
+		{FileName: "v1.md", Chunks: []*DocumentChunk{{Text: "apples are red"}, {Text: "bananas are yellow"}}},
+		{FileName: "v2.md", Chunks: []*DocumentChunk{{Text: "Apples  are\nRED"}}},
+		{FileName: "v3.md", Chunks: []*DocumentChunk{{Text: "apples are red today"}}},
+	} {
+		upsertDocument(t, r, d)
+	}
+	embedChunks(t, r, &ComputeOptions{BatchSize: 4})
+
+	pairs, err := r.FindDuplicates(ctx, &DedupOptions{})
+	require.NoError(t, err)
+	require.Len(t, pairs, 1)
+	require.True(t, pairs[0].Exact)
+	require.Equal(t, "v1", pairs[0].Kept.Document)
+	require.Equal(t, "v2", pairs[0].Duplicate.Document)
+
+	pairs, err = r.FindDuplicates(ctx, &DedupOptions{Threshold: 0.8})
+	require.NoError(t, err)
+	require.Len(t, pairs, 3)
+	for _, p := range pairs[1:] {
+		require.False(t, p.Exact)
+		require.Equal(t, "v3", p.Duplicate.Document)
+		require.InDelta(t, 0.866, p.Similarity, 0.001)
+	}
+
+	n, err := r.CollapseDuplicates(ctx, pairs)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+
+	// the kept chunk lists the documents of its duplicates
+	search := func() []DocumentChunk {
+		chunks, err := r.Search(ctx, &SearchOptions{Query: "apples", Mode: SearchModeKeyword, Limit: 10})
+		require.NoError(t, err)
+		return chunks
+	}
+	chunks := search()
+	require.Len(t, chunks, 1)
+	require.Equal(t, "v1", chunks[0].Document)
+	require.Len(t, chunks[0].Duplicates, 2)
+	require.ElementsMatch(t, []string{"v2", "v3"},
+		[]string{chunks[0].Duplicates[0].Document, chunks[0].Duplicates[1].Document})
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "apples are red", Limit: 10})
+	require.NoError(t, err)
+	for _, c := range chunks {
+		require.NotEqual(t, "v2", c.Document)
+		require.NotEqual(t, "v3", c.Document)
+	}
+
+	pairs, err = r.FindDuplicates(ctx, &DedupOptions{Threshold: 0.8})
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+
+	// duplicates of a deleted chunk are searched again
+	_, _, err = r.DeleteDocuments(ctx, DefaultCollection, "v1", false)
+	require.NoError(t, err)
+	require.Len(t, search(), 2)
+
+	n, err = r.ResetDuplicates(ctx, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+}
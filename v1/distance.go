@@ -0,0 +1,91 @@
+package rag
+
+import (
+	"math"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Distance metrics of dense search, set per collection.
+const (
+	DistanceL2           = "l2"
+	DistanceCosine       = "cosine"
+	DistanceInnerProduct = "ip"
+
+	DefaultDistance = DistanceL2
+)
+
+func ParseDistance(s string) (string, error) {
+	switch s {
+	case DistanceL2, DistanceCosine, DistanceInnerProduct:
+		return s, nil
+	default:
+		return "", errors.Newf("unknown distance: '%s', expected l2, cosine or ip", s)
+	}
+}
+
+// distanceOperator is the pgvector operator ordering by distance, which an
+// index built with distanceOpclass serves.
+func distanceOperator(distance string) string {
+	switch distance {
+	case DistanceCosine:
+		return "<=>"
+	case DistanceInnerProduct:
+		// the negative inner product, so nearer is smaller as for the others
+		return "<#>"
+	default:
+		return "<->"
+	}
+}
+
+func distanceOpclass(distance string) string {
+	switch distance {
+	case DistanceCosine:
+		return "halfvec_cosine_ops"
+	case DistanceInnerProduct:
+		return "halfvec_ip_ops"
+	default:
+		return "halfvec_l2_ops"
+	}
+}
+
+// relevanceSQL computes the Score of a dense result: the inner product for
+// ip, the cosine similarity otherwise.
+func relevanceSQL(distance string, column string) string {
+	if distance == DistanceInnerProduct {
+		return "-(" + column + " <#> ?)"
+	}
+	return "1 - (" + column + " <=> ?)"
+}
+
+// vectorDistance computes the distance of distanceOperator and the relevance
+// of relevanceSQL in Go.
+func vectorDistance(distance string, q []float32, e []float32) (float64, float64) {
+	switch distance {
+	case DistanceCosine:
+		similarity := cosineSimilarity(q, e)
+		return 1 - similarity, similarity
+	case DistanceInnerProduct:
+		var dot float64
+		for i, v := range e {
+			dot += float64(v) * float64(q[i])
+		}
+		return -dot, dot
+	default:
+		var sum float64
+		for i, v := range e {
+			d := float64(v - q[i])
+			sum += d * d
+		}
+		return math.Sqrt(sum), cosineSimilarity(q, e)
+	}
+}
+
+// boostDistance applies a boost factor to a distance: distances are
+// divided, negative inner products multiplied, so boosts always rank higher.
+func boostDistance(distance float64, factor float64) float64 {
+	if distance < 0 {
+		return distance * factor
+	}
+	return distance / factor
+}
@@ -0,0 +1,54 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestCollectionDistance(t *testing.T) {
+	forEachBackend(t, testCollectionDistance)
+}
+
+func testCollectionDistance(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	_, err := r.EnsureCollection(ctx, "fruits", "")
+	require.NoError(t, err)
+	d := &Document{FileName: "fruits.md", Collection: "fruits", Chunks: []*DocumentChunk{
+		{Text: "apples"},
+		{Text: "apples apples apples pears"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{BatchSize: 2})
+
+	search := func() []DocumentChunk {
+		chunks, err := r.Search(ctx, &SearchOptions{Query: "apples", Collection: "fruits", Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, chunks, 2)
+		return chunks
+	}
+	for _, distance := range []string{DistanceL2, DistanceCosine} {
+		require.NoError(t, r.SetCollectionDistance(ctx, "fruits", distance))
+		chunks := search()
+		require.Equal(t, "apples", chunks[0].Text, distance)
+		require.InDelta(t, 1, chunks[0].Score, 1e-6, distance)
+	}
+
+	// the inner product favors the longer vector
+	require.NoError(t, r.SetCollectionDistance(ctx, "fruits", DistanceInnerProduct))
+	chunks := search()
+	require.Equal(t, "apples apples apples pears", chunks[0].Text)
+	require.InDelta(t, 3, chunks[0].Score, 1e-6)
+
+	collections, err := r.ListCollections(ctx)
+	require.NoError(t, err)
+	require.Equal(t, DefaultDistance, collections[0].Distance)
+	require.Equal(t, DistanceInnerProduct, collections[1].Distance)
+
+	require.Error(t, r.SetCollectionDistance(ctx, "fruits", "hamming"))
+	require.ErrorContains(t, r.SetCollectionDistance(ctx, "missing", DistanceCosine), "does not exist")
+}
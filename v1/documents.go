@@ -0,0 +1,167 @@
+package rag
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/minio/minio-go/v7"
+	"gorm.io/gorm"
+)
+
+type ListDocumentsOptions struct {
+	// Collection restricts the listing to one collection, empty lists all.
+	Collection string
+	// Pattern is a glob matched against the raw document path.
+	Pattern string
+	Limit   int
+	Offset  int
+}
+
+func (r *RAG) ListDocuments(ctx context.Context, opts *ListDocumentsOptions) ([]DocumentInfo, error) {
+	q := r.DB.WithContext(ctx).Model(&DocumentChunk{}).
+		Select("collection, document, MAX(raw_document) AS raw_document, COUNT(*) AS chunks, " + countEmbeddedSQL + " AS embedded, " +
+			"MAX(updated_at) AS updated_at").
+		Group("collection, document").
+		Order("collection, document")
+	if opts.Collection != "" {
+		q = q.Where("collection = ?", opts.Collection)
+	}
+	if opts.Pattern != "" {
+		q = q.Where("raw_document "+regexpOperator(q.Dialector.Name())+" ?", globToRegexp(opts.Pattern))
+	}
+	if opts.Limit > 0 {
+		q = q.Limit(opts.Limit)
+	}
+	if opts.Offset > 0 {
+		q = q.Offset(opts.Offset)
+	}
+
+	var documents []DocumentInfo
+	err := q.Scan(&documents).Error
+	if err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+// DeleteDocuments removes all chunks of the documents in the collection whose
+// ID or raw document path matches the glob pattern, returning the deleted document IDs.
+func (r *RAG) DeleteDocuments(ctx context.Context, collection string, pattern string, dryRun bool) ([]string, int64, error) {
+	re := globToRegexp(pattern)
+	var documents []string
+	var deleted int64
+	op := regexpOperator(r.DB.Dialector.Name())
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&DocumentChunk{}).
+			Distinct("document").
+			Where("collection = ? AND (document "+op+" ? OR raw_document "+op+" ?)", collection, re, re).
+			Order("document").
+			Pluck("document", &documents).Error
+		if err != nil || len(documents) == 0 {
+			return err
+		}
+
+		if dryRun {
+			return tx.Model(&DocumentChunk{}).Where("collection = ? AND document IN ?", collection, documents).
+				Count(&deleted).Error
+		}
+		deleted, err = deleteChunks(tx, "collection = ? AND document IN ?", collection, documents)
+		if err != nil {
+			return err
+		}
+		return tx.Where("collection = ? AND document IN ?", collection, documents).Delete(&SourceFile{}).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return documents, deleted, nil
+}
+
+// S3Scheme prefixes the source paths of objects in object storage, s3://bucket/key.
+const S3Scheme = "s3://"
+
+// ParseS3URL splits s3://bucket/key into the bucket and the key, ok is false
+// for other paths.
+func ParseS3URL(s string) (bucket string, key string, ok bool) {
+	rest, ok := strings.CutPrefix(s, S3Scheme)
+	if !ok {
+		return "", "", false
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	return bucket, key, bucket != ""
+}
+
+// ArchiveSeparator joins the path of an archive and of a member in source
+// paths, e.g. /data/docs.zip!/faq.md.chunks.json.
+const ArchiveSeparator = "!/"
+
+// sourceExists reports whether a source file or object exists. Members of
+// archives exist as long as their archive does.
+func (r *RAG) sourceExists(ctx context.Context, sourcePath string) (bool, error) {
+	path, _, _ := strings.Cut(sourcePath, ArchiveSeparator)
+	if bucket, key, ok := ParseS3URL(path); ok {
+		if r.OSS == nil {
+			return false, errors.Newf("object storage is not configured, can't check %s", path)
+		}
+		_, err := r.OSS.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PruneDocuments deletes documents of the collection whose source files or
+// objects no longer exist.
+func (r *RAG) PruneDocuments(ctx context.Context, collection string, dryRun bool) ([]string, int64, error) {
+	type source struct {
+		Document   string
+		SourcePath string
+	}
+	var sources []source
+	err := r.DB.WithContext(ctx).Model(&DocumentChunk{}).
+		Distinct("document", "source_path").
+		Where("collection = ? AND source_path <> ''", collection).
+		Find(&sources).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	orphans := make([]string, 0)
+	for _, s := range sources {
+		exists, err := r.sourceExists(ctx, s.SourcePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !exists {
+			orphans = append(orphans, s.Document)
+		}
+	}
+	if len(orphans) == 0 {
+		return orphans, 0, nil
+	}
+
+	var deleted int64
+	if dryRun {
+		err = r.DB.WithContext(ctx).Model(&DocumentChunk{}).
+			Where("collection = ? AND document IN ?", collection, orphans).
+			Count(&deleted).Error
+		return orphans, deleted, err
+	}
+	err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		deleted, err = deleteChunks(tx, "collection = ? AND document IN ?", collection, orphans)
+		if err != nil {
+			return err
+		}
+		return tx.Where("collection = ? AND document IN ?", collection, orphans).Delete(&SourceFile{}).Error
+	})
+	return orphans, deleted, err
+}
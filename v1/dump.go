@@ -0,0 +1,385 @@
+package rag
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The index dump is a zstd stream of JSON lines: a header, then the
+// embedding models, the collections, the source files, the chunks with their
+// embeddings as base64-encoded little-endian float16 vectors and their int8
+// embeddings as stored, and the embeddings of other models kept side by side.
+// Version 1 dumps lack the models, int8 and side-by-side embeddings.
+const (
+	indexDumpFormat  = "rag-index"
+	indexDumpVersion = 2
+)
+
+const (
+	dumpKindHeader         = "header"
+	dumpKindEmbeddingModel = "embedding_model"
+	dumpKindCollection     = "collection"
+	dumpKindSourceFile     = "source_file"
+	dumpKindChunk          = "chunk"
+	dumpKindChunkEmbedding = "chunk_embedding"
+)
+
+type indexDumpHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	Dims       int       `json:"dims"`
+	Collection string    `json:"collection,omitempty"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type dumpChunk struct {
+	DocumentChunk
+	Embedding     []byte `json:"embedding,omitempty"`
+	EmbeddingInt8 []byte `json:"embedding_int8,omitempty"`
+}
+
+type dumpChunkEmbedding struct {
+	ChunkID   string    `json:"chunk_id"`
+	Model     string    `json:"model"`
+	Dims      int       `json:"dims"`
+	Embedding []byte    `json:"embedding"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type dumpRecord struct {
+	Kind           string              `json:"kind"`
+	Header         *indexDumpHeader    `json:"header,omitempty"`
+	EmbeddingModel *EmbeddingModel     `json:"embedding_model,omitempty"`
+	Collection     *Collection         `json:"collection,omitempty"`
+	SourceFile     *SourceFile         `json:"source_file,omitempty"`
+	Chunk          *dumpChunk          `json:"chunk,omitempty"`
+	ChunkEmbedding *dumpChunkEmbedding `json:"chunk_embedding,omitempty"`
+}
+
+func encodeHalfVector(v []float32) []byte {
+	buf := make([]byte, 2*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint16(buf[2*i:], float32ToHalf(f))
+	}
+	return buf
+}
+
+func decodeHalfVector(buf []byte) []float32 {
+	v := make([]float32, len(buf)/2)
+	for i := range v {
+		v[i] = halfToFloat32(binary.LittleEndian.Uint16(buf[2*i:]))
+	}
+	return v
+}
+
+type ExportIndexOptions struct {
+	// Collection restricts the dump to one collection, empty exports all.
+	Collection string
+}
+
+type IndexDumpStats struct {
+	Models      int `json:"models"`
+	Collections int `json:"collections"`
+	SourceFiles int `json:"source_files"`
+	Chunks      int `json:"chunks"`
+	// Embeddings and Quantized are the chunks with an original and an int8
+	// embedding, ChunkEmbeddings the embeddings of other models.
+	Embeddings      int `json:"embeddings"`
+	Quantized       int `json:"quantized"`
+	ChunkEmbeddings int `json:"chunk_embeddings"`
+}
+
+// ExportIndex writes the documents, chunks, metadata and embeddings of the
+// index to w, so it can be restored elsewhere without recomputing embeddings.
+func (r *RAG) ExportIndex(ctx context.Context, w io.Writer, opts *ExportIndexOptions) (*IndexDumpStats, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = zw.Close() }()
+
+	enc := json.NewEncoder(zw)
+	stats := &IndexDumpStats{}
+	err = enc.Encode(&dumpRecord{Kind: dumpKindHeader, Header: &indexDumpHeader{
+		Format:     indexDumpFormat,
+		Version:    indexDumpVersion,
+		Dims:       dims,
+		Collection: opts.Collection,
+		ExportedAt: time.Now(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	db := r.DB.WithContext(ctx)
+	scoped := func(db *gorm.DB, column string) *gorm.DB {
+		if opts.Collection == "" {
+			return db
+		}
+		return db.Where(column+" = ?", opts.Collection)
+	}
+
+	// the models are global, chunks of any collection name them
+	var models []EmbeddingModel
+	err = db.Order("name").Find(&models).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to export embedding models")
+	}
+	for i := range models {
+		err = enc.Encode(&dumpRecord{Kind: dumpKindEmbeddingModel, EmbeddingModel: &models[i]})
+		if err != nil {
+			return stats, err
+		}
+		stats.Models++
+	}
+
+	var collections []Collection
+	err = scoped(db, "name").Order("name").Find(&collections).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to export collections")
+	}
+	if opts.Collection != "" && len(collections) == 0 {
+		return nil, errors.Newf("collection '%s' not found", opts.Collection)
+	}
+	for i := range collections {
+		err = enc.Encode(&dumpRecord{Kind: dumpKindCollection, Collection: &collections[i]})
+		if err != nil {
+			return stats, err
+		}
+		stats.Collections++
+	}
+
+	var sourceFiles []SourceFile
+	err = scoped(db, "collection").Order("path").Find(&sourceFiles).Error
+	if err != nil {
+		return stats, errors.Wrap(err, "Failed to export source files")
+	}
+	for i := range sourceFiles {
+		err = enc.Encode(&dumpRecord{Kind: dumpKindSourceFile, SourceFile: &sourceFiles[i]})
+		if err != nil {
+			return stats, err
+		}
+		stats.SourceFiles++
+	}
+
+	rows, err := scoped(db.Model(&DocumentChunk{}), "collection").
+		Order("collection, document, chunk_index").Rows()
+	if err != nil {
+		return stats, errors.Wrap(err, "Failed to export chunks")
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var chunk dumpChunk
+		err = r.DB.ScanRows(rows, &chunk.DocumentChunk)
+		if err != nil {
+			return stats, err
+		}
+		if chunk.DocumentChunk.Embedding != nil {
+			chunk.Embedding = encodeHalfVector(chunk.DocumentChunk.Embedding.Slice())
+			chunk.DocumentChunk.Embedding = nil
+			stats.Embeddings++
+		}
+		if len(chunk.DocumentChunk.EmbeddingInt8) > 0 {
+			chunk.EmbeddingInt8 = chunk.DocumentChunk.EmbeddingInt8
+			stats.Quantized++
+		}
+		err = enc.Encode(&dumpRecord{Kind: dumpKindChunk, Chunk: &chunk})
+		if err != nil {
+			return stats, err
+		}
+		stats.Chunks++
+	}
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	q := db.Model(&ChunkEmbedding{}).Order("chunk_id, model")
+	if opts.Collection != "" {
+		q = q.Where("chunk_id IN (?)", db.Model(&DocumentChunk{}).Select("id").Where("collection = ?", opts.Collection))
+	}
+	embeddings, err := q.Rows()
+	if err != nil {
+		return stats, errors.Wrap(err, "Failed to export chunk embeddings")
+	}
+	defer func() { _ = embeddings.Close() }()
+	for embeddings.Next() {
+		var e ChunkEmbedding
+		err = r.DB.ScanRows(embeddings, &e)
+		if err != nil {
+			return stats, err
+		}
+		err = enc.Encode(&dumpRecord{Kind: dumpKindChunkEmbedding, ChunkEmbedding: &dumpChunkEmbedding{
+			ChunkID:   e.ChunkID,
+			Model:     e.Model,
+			Dims:      e.Dims,
+			Embedding: encodeHalfVector(e.Embedding.Slice()),
+			CreatedAt: e.CreatedAt,
+		}})
+		if err != nil {
+			return stats, err
+		}
+		stats.ChunkEmbeddings++
+	}
+	if err = embeddings.Err(); err != nil {
+		return stats, err
+	}
+	return stats, zw.Close()
+}
+
+// importEmbeddingModel upserts a model of an index dump. The dump's active
+// model must be the index's, if it has one, since the chunks imported are
+// embedded with it; a model active in the index stays active.
+func (r *RAG) importEmbeddingModel(ctx context.Context, m *EmbeddingModel) error {
+	columns := []string{"dims", "updated_at"}
+	if m.Active {
+		active, err := r.ActiveEmbeddingModel(ctx)
+		if err != nil {
+			return err
+		}
+		if active != nil && active.Name != m.Name {
+			return errors.Newf("index dump is embedded with '%s', the index with '%s'", m.Name, active.Name)
+		}
+		columns = append(columns, "active")
+	}
+	return r.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).Create(m).Error
+}
+
+func decodeDumpEmbedding(id string, buf []byte) (*pgvector.HalfVector, error) {
+	if len(buf) != 2*dims {
+		return nil, errors.Newf("chunk %s: expected %d dimensions, got %d", id, dims, len(buf)/2)
+	}
+	hv := pgvector.NewHalfVector(decodeHalfVector(buf))
+	return &hv, nil
+}
+
+// ImportIndex restores a dump written by ExportIndex. Existing rows with the
+// same keys are overwritten, others are left untouched.
+func (r *RAG) ImportIndex(ctx context.Context, rd io.Reader) (*IndexDumpStats, error) {
+	zr, err := zstd.NewReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(zr)
+	var rec dumpRecord
+	err = dec.Decode(&rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read header")
+	}
+	if rec.Kind != dumpKindHeader || rec.Header == nil || rec.Header.Format != indexDumpFormat {
+		return nil, errors.New("not an index dump")
+	}
+	if rec.Header.Version < 1 || rec.Header.Version > indexDumpVersion {
+		return nil, errors.Newf("unsupported index dump version %d", rec.Header.Version)
+	}
+	if rec.Header.Dims != dims {
+		return nil, errors.Newf("index dump has %d dimensions, expected %d", rec.Header.Dims, dims)
+	}
+
+	stats := &IndexDumpStats{}
+	batch := make([]DocumentChunk, 0, importBatchSize)
+	embeddings := make([]ChunkEmbedding, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) > 0 {
+			err := r.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&batch).Error
+			if err != nil {
+				return errors.Wrap(err, "Failed to import chunks")
+			}
+			stats.Chunks += len(batch)
+			batch = batch[:0]
+		}
+		if len(embeddings) > 0 {
+			err := r.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&embeddings).Error
+			if err != nil {
+				return errors.Wrap(err, "Failed to import chunk embeddings")
+			}
+			stats.ChunkEmbeddings += len(embeddings)
+			embeddings = embeddings[:0]
+		}
+		return nil
+	}
+
+	for {
+		rec = dumpRecord{}
+		err = dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, errors.Wrap(err, "Failed to read index dump")
+		}
+
+		switch {
+		case rec.Kind == dumpKindEmbeddingModel && rec.EmbeddingModel != nil:
+			err = r.importEmbeddingModel(ctx, rec.EmbeddingModel)
+			if err != nil {
+				return stats, errors.Wrap(err, "Failed to import embedding model")
+			}
+			stats.Models++
+		case rec.Kind == dumpKindCollection && rec.Collection != nil:
+			err = r.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(rec.Collection).Error
+			if err != nil {
+				return stats, errors.Wrap(err, "Failed to import collection")
+			}
+			stats.Collections++
+		case rec.Kind == dumpKindSourceFile && rec.SourceFile != nil:
+			err = r.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(rec.SourceFile).Error
+			if err != nil {
+				return stats, errors.Wrap(err, "Failed to import source file")
+			}
+			stats.SourceFiles++
+		case rec.Kind == dumpKindChunk && rec.Chunk != nil:
+			chunk := rec.Chunk.DocumentChunk
+			if len(rec.Chunk.Embedding) > 0 {
+				chunk.Embedding, err = decodeDumpEmbedding(chunk.ID, rec.Chunk.Embedding)
+				if err != nil {
+					return stats, err
+				}
+				stats.Embeddings++
+			}
+			if len(rec.Chunk.EmbeddingInt8) > 0 {
+				_, err = dequantizeInt8(rec.Chunk.EmbeddingInt8)
+				if err != nil {
+					return stats, errors.Wrapf(err, "chunk %s", chunk.ID)
+				}
+				chunk.EmbeddingInt8 = rec.Chunk.EmbeddingInt8
+				stats.Quantized++
+			}
+			batch = append(batch, chunk)
+			if len(batch) == importBatchSize {
+				if err = flush(); err != nil {
+					return stats, err
+				}
+			}
+		case rec.Kind == dumpKindChunkEmbedding && rec.ChunkEmbedding != nil:
+			e := rec.ChunkEmbedding
+			hv, err := decodeDumpEmbedding(e.ChunkID, e.Embedding)
+			if err != nil {
+				return stats, err
+			}
+			embeddings = append(embeddings, ChunkEmbedding{ChunkID: e.ChunkID, Model: e.Model, Dims: e.Dims,
+				Embedding: hv, CreatedAt: e.CreatedAt})
+			if len(embeddings) == importBatchSize {
+				if err = flush(); err != nil {
+					return stats, err
+				}
+			}
+		default:
+			return stats, errors.Newf("unexpected record '%s' in index dump", rec.Kind)
+		}
+	}
+	return stats, flush()
+}
@@ -0,0 +1,106 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pgvector/pgvector-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexDumpRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	src := newTestRAG(db)
+
+	_, err := src.EnsureCollection(ctx, "handbook", "")
+	require.NoError(t, err)
+	d := &Document{Collection: "handbook", FileName: "guide.md", Tags: []string{"hr"},
+		SourcePath: "/docs/guide.md", SourceHash: "abc", Chunks: []*DocumentChunk{
+			{Text: "vacation requests go to your manager", Section: "Leave", Page: 2},
+			{Text: "expenses are reimbursed monthly"},
+		}}
+	upsertDocument(t, src, d)
+	other := &Document{FileName: "other.md", Chunks: []*DocumentChunk{{Text: "unrelated"}}}
+	upsertDocument(t, src, other)
+	embedChunks(t, src, &ComputeOptions{OnlyEmpty: true})
+
+	// the second chunk keeps only its int8 embedding, the first one has the
+	// embedding of another model side by side, as does the chunk of other.md
+	require.NoError(t, db.Create(&EmbeddingModel{Name: "words", Active: true}).Error)
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("1 = 1").Update("embedding_model", "words").Error)
+	var expenses DocumentChunk
+	require.NoError(t, db.Where("id = ?", d.Chunks[1].ID).Take(&expenses).Error)
+	quantized := quantizeInt8(expenses.Embedding.Slice())
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("id = ?", d.Chunks[1].ID).
+		Updates(map[string]any{"embedding": nil, "embedding_int8": quantized}).Error)
+	e := make([]float32, dims)
+	e[0] = 1
+	hv := pgvector.NewHalfVector(e)
+	for _, id := range []string{d.Chunks[0].ID, other.Chunks[0].ID} {
+		require.NoError(t, db.Create(&ChunkEmbedding{ChunkID: id, Model: "next", Dims: 1, Embedding: &hv}).Error)
+	}
+
+	var buf bytes.Buffer
+	stats, err := src.ExportIndex(ctx, &buf, &ExportIndexOptions{Collection: "handbook"})
+	require.NoError(t, err)
+	require.Equal(t, &IndexDumpStats{Models: 1, Collections: 1, SourceFiles: 1, Chunks: 2, Embeddings: 1,
+		Quantized: 1, ChunkEmbeddings: 1}, stats)
+
+	db = newTestDB(t)
+	dst := newTestRAG(db)
+	imported, err := dst.ImportIndex(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, stats, imported)
+
+	active, err := dst.ActiveEmbeddingModel(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "words", active.Name)
+	var chunk DocumentChunk
+	require.NoError(t, db.Where("id = ?", d.Chunks[1].ID).Take(&chunk).Error)
+	require.Nil(t, chunk.Embedding)
+	require.Equal(t, quantized, chunk.EmbeddingInt8)
+	require.Equal(t, "words", chunk.EmbeddingModel)
+	var embeddings []ChunkEmbedding
+	require.NoError(t, db.Find(&embeddings).Error)
+	require.Len(t, embeddings, 1)
+	require.Equal(t, d.Chunks[0].ID, embeddings[0].ChunkID)
+	require.Equal(t, 1, embeddings[0].Dims)
+	require.Equal(t, e, embeddings[0].Embedding.Slice())
+
+	unchanged, err := dst.SourceFileUnchanged(ctx, "handbook", "/docs/guide.md", "abc")
+	require.NoError(t, err)
+	require.True(t, unchanged)
+
+	chunks, err := dst.Search(ctx, &SearchOptions{Collection: "handbook", Query: "vacation manager", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "vacation requests go to your manager", chunks[0].Text)
+	require.Equal(t, "Leave", chunks[0].Section)
+	require.Equal(t, 2, chunks[0].Page)
+	require.Equal(t, []string{"hr"}, chunks[0].Tags)
+
+	chunks, err = dst.Search(ctx, &SearchOptions{Collection: "handbook", Query: "expenses", Limit: 1, Mode: SearchModeKeyword})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+
+	chunks, err = dst.Search(ctx, &SearchOptions{Query: "unrelated", Limit: 1, Mode: SearchModeKeyword})
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+
+	chunks, err = dst.Search(ctx, &SearchOptions{Collection: "handbook", Query: "expenses reimbursed", Limit: 1,
+		Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "expenses are reimbursed monthly", chunks[0].Text)
+
+	_, err = dst.ImportIndex(ctx, bytes.NewReader([]byte("not a dump")))
+	require.Error(t, err)
+
+	// chunks embedded by another model than the index's aren't imported
+	require.NoError(t, db.Model(&EmbeddingModel{}).Where("name = ?", "words").Update("active", false).Error)
+	require.NoError(t, db.Create(&EmbeddingModel{Name: "letters", Active: true}).Error)
+	_, err = dst.ImportIndex(ctx, bytes.NewReader(buf.Bytes()))
+	require.ErrorContains(t, err, "index dump is embedded with 'words', the index with 'letters'")
+}
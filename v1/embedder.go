@@ -0,0 +1,309 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"resty.dev/v3"
+)
+
+const (
+	EmbeddingProviderOpenAI   = "openai"
+	EmbeddingProviderOllama   = "ollama"
+	EmbeddingProviderInfinity = "infinity"
+	EmbeddingProviderCohere   = "cohere"
+)
+
+// Embedder turns texts into embeddings.
+type Embedder interface {
+	// Embed returns one embedding per text, in the same order.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// ModelEmbedder is implemented by embedders that know their model, which is
+// recorded with the embeddings so vectors of different models are never compared.
+type ModelEmbedder interface {
+	Model() string
+}
+
+// embedderModel returns the model of e, empty if it doesn't tell.
+func embedderModel(e Embedder) string {
+	if me, ok := e.(ModelEmbedder); ok {
+		return me.Model()
+	}
+	return ""
+}
+
+// QueryEmbedder is implemented by embedders whose models embed search
+// queries differently from documents.
+type QueryEmbedder interface {
+	EmbedQuery(ctx context.Context, query string) ([]float32, error)
+}
+
+type EmbedderOptions struct {
+	Provider string
+	BaseURL  string
+	Model    string
+	APIKey   string
+	// MaxRetries bounds retries with exponential backoff on 429 and 5xx responses.
+	MaxRetries int
+	// Transport sends the requests, e.g. a Transport shared with the other
+	// model clients, nil uses http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+func NewEmbedder(opts *EmbedderOptions) (Embedder, error) {
+	switch opts.Provider {
+	case EmbeddingProviderOpenAI, "":
+		return NewOpenAIEmbedder(opts), nil
+	case EmbeddingProviderOllama:
+		return &OllamaEmbedder{client: newEmbedderClient(opts, "http://localhost:11434"), model: opts.Model}, nil
+	case EmbeddingProviderInfinity:
+		client := NewInfinityClient(opts.BaseURL)
+		client.client.SetTransport(opts.Transport)
+		configureRetries(client.client, opts.MaxRetries)
+		return &InfinityEmbedder{client: client, model: opts.Model}, nil
+	case EmbeddingProviderCohere:
+		return &CohereEmbedder{client: newEmbedderClient(opts, "https://api.cohere.com"), model: opts.Model}, nil
+	default:
+		return nil, errors.Newf("unknown embedding provider: '%s'", opts.Provider)
+	}
+}
+
+func newEmbedderClient(opts *EmbedderOptions, defaultBaseURL string) *resty.Client {
+	baseURL := opts.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	client := resty.New().SetBaseURL(baseURL).SetTransport(opts.Transport)
+	if opts.APIKey != "" {
+		client.SetAuthToken(opts.APIKey)
+	}
+	configureRetries(client, opts.MaxRetries)
+	return client
+}
+
+func configureRetries(client *resty.Client, maxRetries int) {
+	client.SetRetryCount(maxRetries).SetAllowNonIdempotentRetry(true)
+}
+
+func postJSON(ctx context.Context, client *resty.Client, path string, body any, result any) error {
+	rsp, err := client.R().SetContext(ctx).SetBody(body).Post(path)
+	if err != nil {
+		return err
+	}
+	if code := rsp.StatusCode(); code != http.StatusOK {
+		return errors.Newf("status code: %d, response: '%s'", code, rsp.String())
+	}
+	return json.Unmarshal(rsp.Bytes(), result)
+}
+
+// OpenAIEmbedder calls an OpenAI-compatible /embeddings endpoint.
+type OpenAIEmbedder struct {
+	client     openai.Client
+	model      string
+	maxRetries int
+}
+
+func NewOpenAIEmbedder(opts *EmbedderOptions) *OpenAIEmbedder {
+	clientOpts := []option.RequestOption{option.WithBaseURL(opts.BaseURL)}
+	if opts.APIKey != "" {
+		clientOpts = append(clientOpts, option.WithAPIKey(opts.APIKey))
+	}
+	if opts.Transport != nil {
+		clientOpts = append(clientOpts, option.WithHTTPClient(&http.Client{Transport: opts.Transport}))
+	}
+	return &OpenAIEmbedder{
+		client:     openai.NewClient(clientOpts...),
+		model:      opts.Model,
+		maxRetries: opts.MaxRetries,
+	}
+}
+
+func (e *OpenAIEmbedder) Model() string { return e.model }
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	rsp, err := e.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+		Model: e.model,
+		Input: openai.EmbeddingNewParamsInputUnion{
+			OfArrayOfStrings: texts,
+		},
+		Dimensions:     openai.Int(dims),
+		EncodingFormat: openai.EmbeddingNewParamsEncodingFormatFloat,
+	}, option.WithMaxRetries(e.maxRetries))
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, d := range rsp.Data {
+		if d.Index < 0 || int(d.Index) >= len(texts) {
+			return nil, errors.Newf("embedding index %d out of range", d.Index)
+		}
+		embeddings[d.Index] = toFloat32Slice(d.Embedding)
+	}
+	return embeddings, nil
+}
+
+// OllamaEmbedder calls Ollama's native /api/embeddings endpoint, which embeds
+// one prompt per request.
+type OllamaEmbedder struct {
+	client *resty.Client
+	model  string
+}
+
+func (e *OllamaEmbedder) Model() string { return e.model }
+
+func (e *OllamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		var rsp struct {
+			Embedding []float32 `json:"embedding"`
+		}
+		err := postJSON(ctx, e.client, "/api/embeddings", map[string]any{
+			"model":  e.model,
+			"prompt": text,
+		}, &rsp)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[i] = rsp.Embedding
+	}
+	return embeddings, nil
+}
+
+type EmbeddingsRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	EncodingFormat string   `json:"encoding_format,omitempty"`
+}
+
+type EmbeddingsResponse struct {
+	Model string `json:"model"`
+	Data  []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func (c *InfinityClient) Embeddings(ctx context.Context, req *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	var response EmbeddingsResponse
+	err := postJSON(ctx, c.client, "/embeddings", req, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// InfinityEmbedder calls Infinity's /embeddings endpoint.
+type InfinityEmbedder struct {
+	client *InfinityClient
+	model  string
+}
+
+func (e *InfinityEmbedder) Model() string { return e.model }
+
+func (e *InfinityEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	rsp, err := e.client.Embeddings(ctx, &EmbeddingsRequest{
+		Model:          e.model,
+		Input:          texts,
+		EncodingFormat: "float",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, d := range rsp.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, errors.Newf("embedding index %d out of range", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+	return embeddings, nil
+}
+
+// CohereEmbedder calls Cohere's /v2/embed endpoint. Cohere models embed
+// documents and queries differently, so it also implements QueryEmbedder.
+type CohereEmbedder struct {
+	client *resty.Client
+	model  string
+}
+
+func (e *CohereEmbedder) embed(ctx context.Context, texts []string, inputType string) ([][]float32, error) {
+	var rsp struct {
+		Embeddings struct {
+			Float [][]float32 `json:"float"`
+		} `json:"embeddings"`
+	}
+	err := postJSON(ctx, e.client, "/v2/embed", map[string]any{
+		"model":           e.model,
+		"texts":           texts,
+		"input_type":      inputType,
+		"embedding_types": []string{"float"},
+	}, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Embeddings.Float, nil
+}
+
+func (e *CohereEmbedder) Model() string { return e.model }
+
+func (e *CohereEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.embed(ctx, texts, "search_document")
+}
+
+func (e *CohereEmbedder) EmbedQuery(ctx context.Context, query string) ([]float32, error) {
+	embeddings, err := e.embed(ctx, []string{query}, "search_query")
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) == 0 {
+		return nil, errors.New("empty embedding response")
+	}
+	return embeddings[0], nil
+}
+
+// embed validates that the embedder returned one embedding per text, all of
+// the same dimension of at most maxQuantizedDims; only those of at most dims
+// fit the halfvec column. Use padEmbedding to store them.
+func (r *RAG) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if r.Embedder == nil {
+		return nil, errors.New("embedder is not configured")
+	}
+	start := time.Now()
+	embeddings, err := r.Embedder.Embed(ctx, texts)
+	r.Metrics.observeEmbedding(start, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(texts) {
+		return nil, errors.Newf("expected %d embeddings, got %d", len(texts), len(embeddings))
+	}
+	for i, e := range embeddings {
+		if len(e) == 0 || len(e) > maxQuantizedDims {
+			return nil, errors.Newf("embedding %d has %d dimensions, expected at most %d", i, len(e), maxQuantizedDims)
+		}
+		if len(e) != len(embeddings[0]) {
+			return nil, errors.Newf("embedding %d has %d dimensions, embedding 0 has %d", i, len(e), len(embeddings[0]))
+		}
+	}
+	return embeddings, nil
+}
+
+// padEmbedding zero-pads e to the dims of the embedding column. Padding keeps
+// the distances between embeddings of the same model.
+func padEmbedding(e []float32) []float32 {
+	if len(e) >= dims {
+		return e
+	}
+	padded := make([]float32, dims)
+	copy(padded, e)
+	return padded
+}
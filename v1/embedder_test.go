@@ -0,0 +1,63 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbedderProviders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch r.URL.Path {
+		case "/api/embeddings":
+			_ = json.NewEncoder(w).Encode(map[string]any{"embedding": []float32{float32(len(req["prompt"].(string)))}})
+		case "/embeddings":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": []map[string]any{
+				{"index": 1, "embedding": []float32{2}},
+				{"index": 0, "embedding": []float32{1}},
+			}})
+		case "/v2/embed":
+			require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			value := float32(1)
+			if req["input_type"] == "search_query" {
+				value = -1
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"embeddings": map[string]any{"float": [][]float32{{value}}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	e, err := NewEmbedder(&EmbedderOptions{Provider: EmbeddingProviderOllama, BaseURL: ts.URL})
+	require.NoError(t, err)
+	embeddings, err := e.Embed(ctx, []string{"a", "abc"})
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1}, {3}}, embeddings)
+
+	e, err = NewEmbedder(&EmbedderOptions{Provider: EmbeddingProviderInfinity, BaseURL: ts.URL})
+	require.NoError(t, err)
+	embeddings, err = e.Embed(ctx, []string{"a", "b"})
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1}, {2}}, embeddings)
+
+	e, err = NewEmbedder(&EmbedderOptions{Provider: EmbeddingProviderCohere, BaseURL: ts.URL, APIKey: "secret"})
+	require.NoError(t, err)
+	embeddings, err = e.Embed(ctx, []string{"a"})
+	require.NoError(t, err)
+	require.Equal(t, [][]float32{{1}}, embeddings)
+	query, err := e.(QueryEmbedder).EmbedQuery(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, []float32{-1}, query)
+
+	_, err = NewEmbedder(&EmbedderOptions{Provider: "unknown"})
+	require.Error(t, err)
+}
@@ -0,0 +1,353 @@
+package rag
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pgvector/pgvector-go"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// The embedding dump is a zstd stream of a small header followed by records of
+// length-prefixed chunk and document IDs and little-endian float16 vectors.
+// Since version 2 the header names the model of the vectors and its dimension.
+const (
+	embeddingDumpMagic   = "RAGEMB"
+	embeddingDumpVersion = 2
+	importBatchSize      = 500
+)
+
+type embeddingRecord struct {
+	ChunkID  string
+	Document string
+	Vector   []float32
+}
+
+type embeddingEncoder struct {
+	w    *bufio.Writer
+	dims int
+	buf  []byte
+}
+
+// newEmbeddingEncoder writes the header of vectors of dims dimensions,
+// embedded by model with modelDims dimensions before padding.
+func newEmbeddingEncoder(w io.Writer, dims int, model string, modelDims int) (*embeddingEncoder, error) {
+	e := &embeddingEncoder{w: bufio.NewWriter(w), dims: dims, buf: make([]byte, 2*dims)}
+	_, err := e.w.WriteString(embeddingDumpMagic)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(e.w, binary.LittleEndian, []uint32{embeddingDumpVersion, uint32(dims)})
+	if err != nil {
+		return nil, err
+	}
+	err = e.writeString(model)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(e.w, binary.LittleEndian, uint32(modelDims))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *embeddingEncoder) writeString(s string) error {
+	if len(s) > 0xffff {
+		return errors.Newf("string too long: %d bytes", len(s))
+	}
+	err := binary.Write(e.w, binary.LittleEndian, uint16(len(s)))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.WriteString(s)
+	return err
+}
+
+func (e *embeddingEncoder) Encode(rec *embeddingRecord) error {
+	if len(rec.Vector) != e.dims {
+		return errors.Newf("chunk %s: expected %d dimensions, got %d", rec.ChunkID, e.dims, len(rec.Vector))
+	}
+	err := e.writeString(rec.ChunkID)
+	if err != nil {
+		return err
+	}
+	err = e.writeString(rec.Document)
+	if err != nil {
+		return err
+	}
+	for i, f := range rec.Vector {
+		binary.LittleEndian.PutUint16(e.buf[2*i:], float32ToHalf(f))
+	}
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+func (e *embeddingEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type embeddingDecoder struct {
+	r    *bufio.Reader
+	dims int
+	// model and modelDims are empty in version 1 dumps.
+	model     string
+	modelDims int
+	buf       []byte
+}
+
+func newEmbeddingDecoder(r io.Reader) (*embeddingDecoder, error) {
+	d := &embeddingDecoder{r: bufio.NewReader(r)}
+	magic := make([]byte, len(embeddingDumpMagic))
+	_, err := io.ReadFull(d.r, magic)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read header")
+	}
+	if string(magic) != embeddingDumpMagic {
+		return nil, errors.New("not an embedding dump")
+	}
+	header := make([]uint32, 2)
+	err = binary.Read(d.r, binary.LittleEndian, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read header")
+	}
+	if header[0] < 1 || header[0] > embeddingDumpVersion {
+		return nil, errors.Newf("unsupported embedding dump version %d", header[0])
+	}
+	d.dims = int(header[1])
+	d.buf = make([]byte, 2*d.dims)
+	if header[0] >= 2 {
+		d.model, err = d.readString()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read header")
+		}
+		var modelDims uint32
+		err = binary.Read(d.r, binary.LittleEndian, &modelDims)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read header")
+		}
+		d.modelDims = int(modelDims)
+	}
+	return d, nil
+}
+
+func (d *embeddingDecoder) readString() (string, error) {
+	var n uint16
+	err := binary.Read(d.r, binary.LittleEndian, &n)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(d.r, b)
+	return string(b), err
+}
+
+// Decode returns io.EOF once all records have been read.
+func (d *embeddingDecoder) Decode(rec *embeddingRecord) error {
+	var err error
+	rec.ChunkID, err = d.readString()
+	if err != nil {
+		return err
+	}
+	rec.Document, err = d.readString()
+	if err != nil {
+		return errors.Wrap(io.ErrUnexpectedEOF, err.Error())
+	}
+	_, err = io.ReadFull(d.r, d.buf)
+	if err != nil {
+		return errors.Wrap(io.ErrUnexpectedEOF, err.Error())
+	}
+	rec.Vector = make([]float32, d.dims)
+	for i := range rec.Vector {
+		rec.Vector[i] = halfToFloat32(binary.LittleEndian.Uint16(d.buf[2*i:]))
+	}
+	return nil
+}
+
+// ExportEmbeddings writes the embeddings of the active model, chunks embedded
+// by a model replaced since are left out. Chunks stored quantized only are
+// written dequantized.
+func (r *RAG) ExportEmbeddings(ctx context.Context, w io.Writer) (int, error) {
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return 0, err
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = zw.Close() }()
+
+	q := r.DB.WithContext(ctx).Model(&DocumentChunk{}).
+		Select("id", "document", "embedding", "embedding_int8").
+		Where("embedding IS NOT NULL OR embedding_int8 IS NOT NULL")
+	var enc *embeddingEncoder
+	if active != nil {
+		enc, err = newEmbeddingEncoder(zw, dims, active.Name, active.Dims)
+		q = q.Where("embedding_model IN ?", []string{active.Name, ""})
+	} else {
+		enc, err = newEmbeddingEncoder(zw, dims, "", 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := q.Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	count := 0
+	for rows.Next() {
+		var chunk DocumentChunk
+		err = r.DB.ScanRows(rows, &chunk)
+		if err != nil {
+			return count, err
+		}
+		var vector []float32
+		if chunk.Embedding != nil {
+			vector = chunk.Embedding.Slice()
+		} else {
+			vector, err = dequantizeInt8(chunk.EmbeddingInt8)
+			if err != nil {
+				return count, errors.Wrapf(err, "chunk %s", chunk.ID)
+			}
+			if len(vector) > dims {
+				log.Warn().Str("chunk_id", chunk.ID).Int("dims", len(vector)).Msg("Embedding too large to export")
+				continue
+			}
+		}
+		err = enc.Encode(&embeddingRecord{
+			ChunkID:  chunk.ID,
+			Document: chunk.Document,
+			Vector:   vector,
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		return count, err
+	}
+	return count, zw.Close()
+}
+
+type ImportEmbeddingsResult struct {
+	Imported int `json:"imported"`
+	Missing  int `json:"missing"`
+}
+
+func (r *RAG) ImportEmbeddings(ctx context.Context, rd io.Reader) (*ImportEmbeddingsResult, error) {
+	zr, err := zstd.NewReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	dec, err := newEmbeddingDecoder(zr)
+	if err != nil {
+		return nil, err
+	}
+	if dec.dims != dims {
+		return nil, errors.Newf("embedding dump has %d dimensions, expected %d", dec.dims, dims)
+	}
+	// the vectors replace the chunks' own, so they must be of the active model
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case active != nil && dec.model == "":
+		return nil, errors.Wrapf(ErrEmbeddingModelMismatch, "the embedding dump names no model, the index is embedded with %s",
+			active.Name)
+	case active != nil && dec.model != active.Name:
+		return nil, errors.Wrapf(ErrEmbeddingModelMismatch, "the embedding dump is embedded with %s, the index with %s",
+			dec.model, active.Name)
+	case active == nil && dec.model != "":
+		err = r.registerEmbeddingModel(ctx, dec.model, dec.modelDims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ImportEmbeddingsResult{}
+	batch := make([]embeddingRecord, 0, importBatchSize)
+	flush := func() error {
+		err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			// chunks stored quantized stay quantized, like at a switchover
+			ids := make([]string, len(batch))
+			for i, rec := range batch {
+				ids[i] = rec.ChunkID
+			}
+			var quantized []quantizedChunk
+			err := tx.Model(&DocumentChunk{}).Select("id", "embedding IS NULL AS dropped").
+				Where("id IN ? AND embedding_int8 IS NOT NULL", ids).Find(&quantized).Error
+			if err != nil {
+				return err
+			}
+			dropped := make(map[string]bool, len(quantized))
+			for _, c := range quantized {
+				dropped[c.ID] = c.Dropped
+			}
+
+			for _, rec := range batch {
+				hv := pgvector.NewHalfVector(rec.Vector)
+				values := map[string]any{"embedding": &hv, "embedding_int8": nil, "embedding_model": dec.model,
+					"embedding_dims": dec.modelDims}
+				if drop, ok := dropped[rec.ChunkID]; ok {
+					e := rec.Vector
+					if dec.modelDims > 0 && dec.modelDims < len(e) {
+						e = e[:dec.modelDims]
+					}
+					values["embedding_int8"] = quantizeInt8(e)
+					if drop {
+						values["embedding"] = nil
+					}
+				}
+				res := tx.Model(&DocumentChunk{}).Where("id = ?", rec.ChunkID).Updates(values)
+				if res.Error != nil {
+					return res.Error
+				}
+				if res.RowsAffected == 0 {
+					log.Warn().Str("chunk_id", rec.ChunkID).Str("document", rec.Document).Msg("Chunk not found")
+					result.Missing++
+				} else {
+					result.Imported++
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		var rec embeddingRecord
+		err = dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		batch = append(batch, rec)
+		if len(batch) == importBatchSize {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
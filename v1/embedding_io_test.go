@@ -0,0 +1,120 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddingDumpRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newEmbeddingEncoder(&buf, 4, "words", 3)
+	require.NoError(t, err)
+	records := []embeddingRecord{
+		{ChunkID: "a", Document: "doc1", Vector: []float32{0, 1, -2.5, 0.125}},
+		{ChunkID: "b", Document: "文档", Vector: []float32{65504, -0.0001, 3.140625, 1e-8}},
+	}
+	for _, rec := range records {
+		require.NoError(t, enc.Encode(&rec))
+	}
+	require.NoError(t, enc.Flush())
+
+	dec, err := newEmbeddingDecoder(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 4, dec.dims)
+	require.Equal(t, "words", dec.model)
+	require.Equal(t, 3, dec.modelDims)
+
+	var rec embeddingRecord
+	require.NoError(t, dec.Decode(&rec))
+	require.Equal(t, records[0], rec)
+	require.NoError(t, dec.Decode(&rec))
+	require.Equal(t, "b", rec.ChunkID)
+	require.Equal(t, "文档", rec.Document)
+	require.InDeltaSlice(t, records[1].Vector, rec.Vector, 1e-4)
+	require.ErrorIs(t, dec.Decode(&rec), io.EOF)
+}
+
+func TestImportEmbeddings(t *testing.T) {
+	ctx := context.Background()
+	fill := func(model string) *RAG {
+		r := &RAG{DB: newTestDB(t), Embedder: &modelEmbedder{name: model, n: 64}}
+		upsertTexts(t, r, "", "fruits.md", "apples are red", "bananas are yellow")
+		return r
+	}
+	src := fill("small")
+	embedChunks(t, src, &ComputeOptions{})
+	var buf bytes.Buffer
+	n, err := src.ExportEmbeddings(ctx, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// vectors of another model never replace the index's
+	other := fill("large")
+	embedChunks(t, other, &ComputeOptions{})
+	_, err = other.ImportEmbeddings(ctx, bytes.NewReader(buf.Bytes()))
+	require.ErrorIs(t, err, ErrEmbeddingModelMismatch)
+
+	// an index without embeddings takes the dump's model
+	dst := fill("small")
+	result, err := dst.ImportEmbeddings(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, &ImportEmbeddingsResult{Imported: 2}, result)
+	active, err := dst.ActiveEmbeddingModel(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "small", active.Name)
+	require.Equal(t, 64, active.Dims)
+	var chunks []DocumentChunk
+	require.NoError(t, dst.DB.Find(&chunks).Error)
+	for _, c := range chunks {
+		require.Equal(t, "small", c.EmbeddingModel)
+		require.Equal(t, 64, c.EmbeddingDims)
+	}
+	found, err := dst.Search(ctx, &SearchOptions{Query: "bananas", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "bananas are yellow", found[0].Text)
+}
+
+func TestExportQuantizedEmbeddings(t *testing.T) {
+	ctx := context.Background()
+	src := &RAG{DB: newTestDB(t), Embedder: &modelEmbedder{name: "small", n: 64}}
+	kept := upsertTexts(t, src, "", "fruits.md", "apples are red")
+	dropped := upsertTexts(t, src, "", "berries.md", "cherries are small")
+	embedChunks(t, src, &ComputeOptions{Documents: []string{kept.Document}})
+	embedChunks(t, src, &ComputeOptions{Documents: []string{dropped.Document}, Quantize: QuantizeInt8, DropOriginal: true})
+
+	// chunks stored quantized only are exported too
+	var buf bytes.Buffer
+	n, err := src.ExportEmbeddings(ctx, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// and stay quantized where they were
+	dst := &RAG{DB: newTestDB(t), Embedder: src.Embedder}
+	upsertDocument(t, dst, kept)
+	upsertDocument(t, dst, dropped)
+	embedChunks(t, dst, &ComputeOptions{Documents: []string{kept.Document}})
+	embedChunks(t, dst, &ComputeOptions{Documents: []string{dropped.Document}, Quantize: QuantizeInt8, DropOriginal: true})
+	require.NoError(t, dst.DB.Model(&DocumentChunk{}).Where("1 = 1").
+		Updates(map[string]any{"embedding_int8": quantizeInt8(make([]float32, 64))}).Error)
+	result, err := dst.ImportEmbeddings(ctx, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 2, result.Imported)
+
+	e, err := src.Embedder.Embed(ctx, []string{"cherries are small"})
+	require.NoError(t, err)
+	for _, d := range []*Document{kept, dropped} {
+		chunk, err := dst.GetDocumentChunk(d.Chunks[0].ID)
+		require.NoError(t, err)
+		require.Equal(t, d == dropped, chunk.Embedding == nil)
+		require.Len(t, chunk.EmbeddingInt8, 4+64)
+	}
+	chunk, err := dst.GetDocumentChunk(dropped.Chunks[0].ID)
+	require.NoError(t, err)
+	decoded, err := dequantizeInt8(chunk.EmbeddingInt8)
+	require.NoError(t, err)
+	require.InDeltaSlice(t, e[0], decoded[:64], 1.0/64)
+}
@@ -0,0 +1,171 @@
+package rag
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+)
+
+// EvalCase is a question with the chunks or the document that should be retrieved for it.
+type EvalCase struct {
+	Question         string   `json:"question"`
+	ExpectedChunkIDs []string `json:"expected_chunk_ids,omitempty"`
+	ExpectedDoc      string   `json:"expected_doc,omitempty"`
+}
+
+// ReadEvalCases parses one EvalCase per line, skipping blank lines.
+func ReadEvalCases(rd io.Reader) ([]EvalCase, error) {
+	cases := make([]EvalCase, 0)
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var c EvalCase
+		err := json.Unmarshal([]byte(text), &c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if strings.TrimSpace(c.Question) == "" {
+			return nil, errors.Newf("line %d: question is required", line)
+		}
+		if len(c.ExpectedChunkIDs) == 0 && c.ExpectedDoc == "" {
+			return nil, errors.Newf("line %d: expected_chunk_ids or expected_doc is required", line)
+		}
+		cases = append(cases, c)
+	}
+	return cases, scanner.Err()
+}
+
+type EvalOptions struct {
+	// Name labels the variant in reports, e.g. "v3+rerank".
+	Name       string
+	K          int
+	Collection string
+	Filter     *Filter
+	Rerank     bool
+}
+
+// EvalResult averages the metrics of all cases for one retrieval configuration.
+type EvalResult struct {
+	Name          string  `json:"name"`
+	ConfigVersion int64   `json:"config_version"`
+	Rerank        bool    `json:"rerank"`
+	K             int     `json:"k"`
+	Cases         int     `json:"cases"`
+	Recall        float64 `json:"recall"`
+	MRR           float64 `json:"mrr"`
+	NDCG          float64 `json:"ndcg"`
+	P50LatencyMS  float64 `json:"p50_latency_ms"`
+	P95LatencyMS  float64 `json:"p95_latency_ms"`
+	// Misses lists the questions without any expected result in the top k.
+	Misses []string `json:"misses,omitempty"`
+}
+
+// scoreRanking computes recall@k, the reciprocal rank and nDCG@k of the
+// retrieved chunks with binary relevance. Expected chunk IDs take precedence;
+// otherwise the expected document is the single relevant item, so further
+// chunks of it don't count again.
+func scoreRanking(c *EvalCase, chunks []DocumentChunk, k int) (recall float64, rr float64, ndcg float64) {
+	relevant := make(map[string]bool)
+	for _, id := range c.ExpectedChunkIDs {
+		relevant[id] = true
+	}
+	byDoc := len(relevant) == 0
+	if byDoc {
+		relevant[c.ExpectedDoc] = true
+	}
+
+	found := make(map[string]bool)
+	var dcg float64
+	for i, chunk := range chunks[:min(k, len(chunks))] {
+		key := chunk.ID
+		if byDoc {
+			key = c.ExpectedDoc
+			if chunk.Document != c.ExpectedDoc && chunk.RawDocument != c.ExpectedDoc {
+				continue
+			}
+		} else if !relevant[key] {
+			continue
+		}
+		if found[key] {
+			continue
+		}
+		found[key] = true
+		if rr == 0 {
+			rr = 1 / float64(i+1)
+		}
+		dcg += 1 / math.Log2(float64(i+2))
+	}
+
+	var idcg float64
+	for i := range min(len(relevant), k) {
+		idcg += 1 / math.Log2(float64(i+2))
+	}
+	return float64(len(found)) / float64(len(relevant)), rr, dcg / idcg
+}
+
+// Evaluate runs every case through the retrieval pipeline with the bound
+// configuration and reports the mean recall@k, MRR and nDCG@k.
+func (r *RAG) Evaluate(ctx context.Context, cases []EvalCase, opts *EvalOptions) (*EvalResult, error) {
+	if opts.K <= 0 {
+		return nil, errors.Newf("k must be positive, got %d", opts.K)
+	}
+	if len(cases) == 0 {
+		return nil, errors.New("no evaluation cases")
+	}
+	config := r.config()
+	cfg := &config.Config
+	result := &EvalResult{
+		Name:          opts.Name,
+		ConfigVersion: config.Version,
+		Rerank:        opts.Rerank,
+		K:             opts.K,
+		Cases:         len(cases),
+	}
+
+	latencies := make([]float64, 0, len(cases))
+	for i := range cases {
+		c := &cases[i]
+		start := time.Now()
+		chunks, err := r.Search(ctx, &SearchOptions{
+			Query:      c.Question,
+			Collection: opts.Collection,
+			Filter:     opts.Filter,
+			Limit:      opts.K,
+			Mode:       cfg.Mode,
+			Rerank:     opts.Rerank,
+			Candidates: opts.K * cfg.CandidatesPerResult,
+			Fusion:     cfg.Fusion,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to search '%s'", c.Question)
+		}
+		latencies = append(latencies, float64(time.Since(start).Microseconds())/1000)
+
+		recall, rr, ndcg := scoreRanking(c, chunks, opts.K)
+		result.Recall += recall
+		result.MRR += rr
+		result.NDCG += ndcg
+		if rr == 0 {
+			result.Misses = append(result.Misses, c.Question)
+		}
+	}
+
+	n := float64(len(cases))
+	result.Recall /= n
+	result.MRR /= n
+	result.NDCG /= n
+	latency := newDistribution(latencies)
+	result.P50LatencyMS = latency.P50
+	result.P95LatencyMS = latency.P95
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScoreRanking(t *testing.T) {
+	chunks := []DocumentChunk{
+		{ID: "a", Document: "intro"},
+		{ID: "b", Document: "guide"},
+		{ID: "c", Document: "guide"},
+		{ID: "d", Document: "faq"},
+	}
+
+	recall, rr, ndcg := scoreRanking(&EvalCase{ExpectedChunkIDs: []string{"b", "d"}}, chunks, 4)
+	require.InDelta(t, 1, recall, 1e-9)
+	require.InDelta(t, 0.5, rr, 1e-9)
+	// (1/log2(3) + 1/log2(5)) / (1 + 1/log2(3))
+	require.InDelta(t, 0.6509, ndcg, 1e-4)
+
+	recall, rr, _ = scoreRanking(&EvalCase{ExpectedChunkIDs: []string{"b", "d"}}, chunks, 2)
+	require.InDelta(t, 0.5, recall, 1e-9)
+	require.InDelta(t, 0.5, rr, 1e-9)
+
+	// further chunks of the expected document don't count twice
+	recall, rr, ndcg = scoreRanking(&EvalCase{ExpectedDoc: "guide"}, chunks, 4)
+	require.InDelta(t, 1, recall, 1e-9)
+	require.InDelta(t, 0.5, rr, 1e-9)
+	require.InDelta(t, 0.6309, ndcg, 1e-4)
+
+	recall, rr, ndcg = scoreRanking(&EvalCase{ExpectedDoc: "missing"}, chunks, 4)
+	require.Zero(t, recall)
+	require.Zero(t, rr)
+	require.Zero(t, ndcg)
+}
+
+func TestReadEvalCases(t *testing.T) {
+	cases, err := ReadEvalCases(strings.NewReader(`{"question": "where?", "expected_doc": "guide"}
+
+{"question": "what?", "expected_chunk_ids": ["a"]}
+`))
+	require.NoError(t, err)
+	require.Len(t, cases, 2)
+	require.Equal(t, []string{"a"}, cases[1].ExpectedChunkIDs)
+
+	_, err = ReadEvalCases(strings.NewReader(`{"question": "where?"}`))
+	require.ErrorContains(t, err, "line 1")
+}
+
+func TestEvaluate(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true})
+
+	cases := []EvalCase{
+		{Question: "yellow bananas", ExpectedChunkIDs: []string{d.Chunks[1].ID}},
+		{Question: "red apples", ExpectedDoc: d.Document},
+		{Question: "cherries", ExpectedDoc: "vegetables"},
+	}
+	result, err := r.Evaluate(ctx, cases, &EvalOptions{Name: "v0", K: 1})
+	require.NoError(t, err)
+	require.Equal(t, 3, result.Cases)
+	require.InDelta(t, 2.0/3, result.Recall, 1e-9)
+	require.InDelta(t, 2.0/3, result.MRR, 1e-9)
+	require.Equal(t, []string{"cherries"}, result.Misses)
+}
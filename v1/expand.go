@@ -0,0 +1,172 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/openai/openai-go"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// ExpandHyDE retrieves with hypothetical answers written by the assistant,
+	// which are closer to the indexed passages than terse questions.
+	ExpandHyDE = "hyde"
+	// ExpandMulti retrieves with paraphrases of the query written by the assistant.
+	ExpandMulti = "multi"
+)
+
+func ParseExpand(s string) (string, error) {
+	switch s {
+	case "", ExpandHyDE, ExpandMulti:
+		return s, nil
+	default:
+		return "", errors.Newf("unknown expansion: '%s', expected hyde or multi", s)
+	}
+}
+
+// validateExpansion rejects HyDE in keyword mode, where hypothetical answers
+// would have to match all of their terms.
+func validateExpansion(expand string, mode SearchMode) error {
+	if expand == ExpandHyDE && mode == SearchModeKeyword {
+		return errors.New("hyde expansion requires dense or hybrid search")
+	}
+	return nil
+}
+
+// defaultExpansions returns how many queries the assistant writes when Expansions is unset.
+func defaultExpansions(expand string) int {
+	if expand == ExpandHyDE {
+		return 1
+	}
+	return 3
+}
+
+// maxExpansions caps the queries a client may ask the assistant for, HyDE
+// writing them with as many concurrent completions.
+const maxExpansions = 10
+
+const hydePrompt = "请写一段可能出现在知识库文档中的文字来回答下面的问题。只输出这段文字，不要解释。问题："
+
+const multiQueryPrompt = "请将下面的问题改写为 %d 个表述不同但含义相同的搜索查询，每行一个，不要编号，不要解释。问题："
+
+// listMarker strips numbering and bullets the assistant may add to paraphrases anyway.
+var listMarker = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)、])\s*`)
+
+// complete returns the assistant's reply to prompt, written for feature.
+func (r *RAG) complete(ctx context.Context, feature string, prompt string) (string, error) {
+	if r.AssistantClient == nil {
+		return "", errors.Newf("%s requires the assistant", feature)
+	}
+	c, err := r.AssistantClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model:    r.AssistantModel,
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage(prompt)},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to complete %s", feature)
+	}
+	if len(c.Choices) == 0 {
+		return "", errors.New("no choices returned from completion")
+	}
+	return strings.TrimSpace(c.Choices[0].Message.Content), nil
+}
+
+// expandQuery asks the assistant for the additional queries of opts.Expand,
+// the original query not included.
+func (r *RAG) expandQuery(ctx context.Context, opts *SearchOptions) (queries []string, err error) {
+	n := opts.Expansions
+	if n <= 0 {
+		n = defaultExpansions(opts.Expand)
+	}
+	start := time.Now()
+	defer func() { r.Metrics.observeExpansion(opts.Expand, start, err) }()
+
+	switch opts.Expand {
+	case ExpandHyDE:
+		answers := make([]string, n)
+		g, ctx := errgroup.WithContext(ctx)
+		for i := range answers {
+			g.Go(func() error {
+				var err error
+				answers[i], err = r.complete(ctx, "query expansion", hydePrompt+opts.Query)
+				return err
+			})
+		}
+		err = g.Wait()
+		if err != nil {
+			return nil, err
+		}
+		return answers, nil
+
+	case ExpandMulti:
+		var text string
+		text, err = r.complete(ctx, "query expansion", fmt.Sprintf(multiQueryPrompt, n)+opts.Query)
+		if err != nil {
+			return nil, err
+		}
+		queries = make([]string, 0, n)
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(listMarker.ReplaceAllString(line, ""))
+			if line != "" && line != opts.Query {
+				queries = append(queries, line)
+			}
+		}
+		if len(queries) > n {
+			queries = queries[:n]
+		}
+		return queries, nil
+
+	default:
+		return nil, errors.Newf("unknown expansion: '%s'", opts.Expand)
+	}
+}
+
+// retrieveExpanded retrieves with the original query and every expansion and
+// fuses the results. Hypothetical answers are only embedded.
+func (r *RAG) retrieveExpanded(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	err := validateExpansion(opts.Expand, opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+	queries, err := r.expandQuery(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := r.retrieve(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	lists := [][]DocumentChunk{chunks}
+	for _, query := range queries {
+		o := *opts
+		o.Query = query
+		if opts.Expand == ExpandHyDE {
+			chunks, err = r.queryDense(ctx, &o)
+		} else {
+			chunks, err = r.retrieve(ctx, &o)
+		}
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, chunks)
+	}
+
+	fusion := opts.Fusion
+	if fusion.K == 0 {
+		fusion = DefaultConfig().Fusion
+	}
+	weights := make([]float64, len(lists))
+	for i := range weights {
+		weights[i] = 1
+	}
+	chunks = fuseLists(fusion.K, weights, lists...)
+	if len(chunks) > opts.Limit {
+		chunks = chunks[:opts.Limit]
+	}
+	return chunks, nil
+}
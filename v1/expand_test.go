@@ -0,0 +1,84 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAssistant answers every chat completion with content.
+func fakeAssistant(t *testing.T, content string) *openai.Client {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/chat/completions", r.URL.Path)
+		b, err := json.Marshal(content)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id":"1","object":"chat.completion","created":0,"model":"m",`+
+			`"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%s}}]}`, b)
+	}))
+	t.Cleanup(ts.Close)
+	client := openai.NewClient(option.WithBaseURL(ts.URL), option.WithAPIKey("test"))
+	return &client
+}
+
+func TestSearchExpandMulti(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db, Embedder: wordEmbedder{}, AssistantClient: fakeAssistant(t, "1. bananas\n- cherries\n\napples")}
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+		{Text: "cherries are dark"},
+	}}
+	upsertDocument(t, r, d)
+
+	opts := &SearchOptions{Query: "apples", Mode: SearchModeKeyword, Limit: 5}
+	chunks, err := r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+
+	opts.Expand = ExpandMulti
+	chunks, err = r.Search(ctx, opts)
+	require.NoError(t, err)
+	texts := make([]string, len(chunks))
+	for i, c := range chunks {
+		texts[i] = c.Text
+	}
+	require.Equal(t, []string{"apples are red", "bananas are yellow", "cherries are dark"}, texts)
+
+	opts.Expand = ExpandHyDE
+	_, err = r.Search(ctx, opts)
+	require.ErrorContains(t, err, "requires dense or hybrid")
+
+	s := NewServer(newTestRAG(db), &ServerOptions{})
+	req := httptest.NewRequest(http.MethodPost, "/v1/search", strings.NewReader(`{"query":"apples","expand":"multi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "requires the assistant")
+
+	s = NewServer(r, &ServerOptions{})
+	opts, err = s.buildSearchOptions(r, DefaultCollection, &SearchParam{Query: "apples", Expand: ExpandHyDE, Expansions: 1000}, nil)
+	require.NoError(t, err)
+	require.Equal(t, maxExpansions, opts.Expansions)
+}
+
+func TestParseExpand(t *testing.T) {
+	for _, s := range []string{"", ExpandHyDE, ExpandMulti} {
+		expand, err := ParseExpand(s)
+		require.NoError(t, err)
+		require.Equal(t, s, expand)
+	}
+	_, err := ParseExpand("rewrite")
+	require.Error(t, err)
+}
@@ -0,0 +1,365 @@
+package rag
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+// FilterField is chunk metadata that filter expressions can test.
+type FilterField string
+
+const (
+	FilterFieldTag      FilterField = "tag"
+	FilterFieldPath     FilterField = "path"
+	FilterFieldDocument FilterField = "document"
+	FilterFieldSection  FilterField = "section"
+	FilterFieldPage     FilterField = "page"
+	FilterFieldCreated  FilterField = "created"
+	FilterFieldUpdated  FilterField = "updated"
+)
+
+var filterColumns = map[FilterField]string{
+	FilterFieldPath:     "raw_document",
+	FilterFieldDocument: "document",
+	FilterFieldSection:  "section",
+	FilterFieldPage:     "page",
+	FilterFieldCreated:  "created_at",
+	FilterFieldUpdated:  "updated_at",
+}
+
+// filterOps lists the operators every field supports, longest first for parsing.
+var filterOps = map[FilterField][]string{
+	FilterFieldTag:      {"!=", "="},
+	FilterFieldPath:     {"!~", "!=", "=", "~"},
+	FilterFieldDocument: {"!~", "!=", "=", "~"},
+	FilterFieldSection:  {"!~", "!=", "=", "~"},
+	FilterFieldPage:     {"!=", "<=", ">=", "=", "<", ">"},
+	FilterFieldCreated:  {"<=", ">=", "<", ">"},
+	FilterFieldUpdated:  {"<=", ">=", "<", ">"},
+}
+
+// Filter restricts searches to chunks whose metadata matches an expression such as
+//
+//	tag=finance AND path~"reports/2024/*" AND NOT section="Appendix"
+//
+// Conditions are field, operator and value, combined with AND, OR, NOT and
+// parentheses. ~ and !~ match globs, page compares numbers and created and
+// updated compare against a date, a RFC 3339 time or a duration ago, e.g. 720h.
+type Filter struct {
+	src  string
+	expr filterExpr
+}
+
+func ParseFilter(s string) (*Filter, error) {
+	p := &filterParser{src: s}
+	expr, err := p.parseOr()
+	if err == nil {
+		p.skipSpace()
+		if p.pos < len(p.src) {
+			err = errors.Newf("unexpected '%s'", p.src[p.pos:])
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid filter '%s'", s)
+	}
+	return &Filter{src: s, expr: expr}, nil
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+// apply adds the filter to the WHERE clause of a query on document_chunks.
+func (f *Filter) apply(db *gorm.DB) *gorm.DB {
+	if f == nil {
+		return db
+	}
+	sql, vars := f.where(db.Dialector.Name())
+	return db.Where(sql, vars...)
+}
+
+func (f *Filter) where(dialect string) (string, []any) {
+	var vars []any
+	sql := f.expr.sql(dialect, &vars)
+	return sql, vars
+}
+
+type filterExpr interface {
+	sql(dialect string, vars *[]any) string
+}
+
+type filterAnd []filterExpr
+
+func (e filterAnd) sql(dialect string, vars *[]any) string {
+	terms := make([]string, len(e))
+	for i, x := range e {
+		terms[i] = x.sql(dialect, vars)
+	}
+	return "(" + strings.Join(terms, " AND ") + ")"
+}
+
+type filterOr []filterExpr
+
+func (e filterOr) sql(dialect string, vars *[]any) string {
+	terms := make([]string, len(e))
+	for i, x := range e {
+		terms[i] = x.sql(dialect, vars)
+	}
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
+
+type filterNot struct {
+	expr filterExpr
+}
+
+func (e filterNot) sql(dialect string, vars *[]any) string {
+	return "NOT " + e.expr.sql(dialect, vars)
+}
+
+// pageEndSQL is the page a chunk ends on, its start page if it has no end
+// page, as chunks ingested before page ends were recorded.
+const pageEndSQL = "COALESCE(NULLIF(page_end, 0), page)"
+
+type filterCond struct {
+	field FilterField
+	op    string
+	value any
+}
+
+func (e filterCond) sql(dialect string, vars *[]any) string {
+	negate := strings.HasPrefix(e.op, "!")
+	var sql string
+	switch {
+	case e.field == FilterFieldTag:
+		if dialect == sqliteDialect {
+			sql = "EXISTS (SELECT 1 FROM json_each(tags) WHERE value = ?)"
+			*vars = append(*vars, e.value)
+		} else {
+			tags, _ := json.Marshal([]any{e.value})
+			sql = "tags @> ?"
+			*vars = append(*vars, string(tags))
+		}
+	case e.field == FilterFieldPage:
+		// chunks match every page they span, a chunk without a page is on none
+		switch e.op {
+		case "=":
+			*vars = append(*vars, e.value, e.value)
+			return "(page <= ? AND " + pageEndSQL + " >= ?)"
+		case "!=":
+			*vars = append(*vars, e.value, e.value)
+			return "(page IS NULL OR NOT (page <= ? AND " + pageEndSQL + " >= ?))"
+		case ">", ">=":
+			*vars = append(*vars, e.value)
+			return pageEndSQL + " " + e.op + " ?"
+		default:
+			*vars = append(*vars, e.value)
+			return "(page > 0 AND page " + e.op + " ?)"
+		}
+	case e.op == "~" || e.op == "!~":
+		sql = filterColumns[e.field] + " " + regexpOperator(dialect) + " ?"
+		*vars = append(*vars, globToRegexp(e.value.(string)))
+	case e.op == "!=":
+		sql = filterColumns[e.field] + " = ?"
+		*vars = append(*vars, e.value)
+	default:
+		*vars = append(*vars, e.value)
+		return filterColumns[e.field] + " " + e.op + " ?"
+	}
+	if negate {
+		return "NOT (" + sql + ")"
+	}
+	return sql
+}
+
+type filterParser struct {
+	src string
+	pos int
+}
+
+func (p *filterParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes a case-insensitive keyword followed by a space or parenthesis.
+func (p *filterParser) keyword(kw string) bool {
+	p.skipSpace()
+	end := p.pos + len(kw)
+	if end > len(p.src) || !strings.EqualFold(p.src[p.pos:end], kw) {
+		return false
+	}
+	if end < len(p.src) && !unicode.IsSpace(rune(p.src[end])) && p.src[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := filterOr{expr}
+	for p.keyword("OR") {
+		expr, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := filterAnd{expr}
+	for p.keyword("AND") {
+		expr, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, expr)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.keyword("NOT") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '(' {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.src) || p.src[p.pos] != ')' {
+			return nil, errors.New("missing ')'")
+		}
+		p.pos++
+		return expr, nil
+	}
+	return p.parseCond()
+}
+
+func (p *filterParser) parseCond() (filterExpr, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || p.src[p.pos] == '_') {
+		p.pos++
+	}
+	field := FilterField(strings.ToLower(p.src[start:p.pos]))
+	ops, ok := filterOps[field]
+	if !ok {
+		if field == "" {
+			return nil, errors.New("expected a field")
+		}
+		return nil, errors.Newf("unknown field '%s'", field)
+	}
+
+	p.skipSpace()
+	var op string
+	for _, candidate := range ops {
+		if strings.HasPrefix(p.src[p.pos:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return nil, errors.Newf("expected one of %s after '%s'", strings.Join(ops, " "), field)
+	}
+	p.pos += len(op)
+
+	raw, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	cond := filterCond{field: field, op: op, value: raw}
+	switch field {
+	case FilterFieldPage:
+		cond.value, err = strconv.Atoi(raw)
+		if err != nil {
+			return nil, errors.Newf("page must be a number, got '%s'", raw)
+		}
+	case FilterFieldCreated, FilterFieldUpdated:
+		cond.value, err = parseFilterTime(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cond, nil
+}
+
+func (p *filterParser) parseValue() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return "", errors.New("expected a value")
+	}
+	if p.src[p.pos] != '"' {
+		start := p.pos
+		for p.pos < len(p.src) && !unicode.IsSpace(rune(p.src[p.pos])) && p.src[p.pos] != ')' {
+			p.pos++
+		}
+		return p.src[start:p.pos], nil
+	}
+
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		switch c := p.src[p.pos]; c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			if p.pos+1 < len(p.src) {
+				p.pos++
+				b.WriteByte(p.src[p.pos])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated string")
+}
+
+// regexpOperator matches a column against a regular expression.
+func regexpOperator(dialect string) string {
+	if dialect == sqliteDialect {
+		return "REGEXP"
+	}
+	return "~"
+}
+
+// parseFilterTime accepts a date, a RFC 3339 time or a duration before now.
+func parseFilterTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Newf("invalid time '%s', expected a date, a RFC 3339 time or a duration", s)
+}
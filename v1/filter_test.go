@@ -0,0 +1,60 @@
+package rag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter(`tag=finance AND path~"reports/2024/*" AND (page>=3 or NOT section="Appendix \"A\"")`)
+	require.NoError(t, err)
+
+	sql, vars := f.where("postgres")
+	require.Equal(t, `(tags @> ? AND raw_document ~ ? AND (COALESCE(NULLIF(page_end, 0), page) >= ? OR NOT section = ?))`, sql)
+	require.Equal(t, []any{`["finance"]`, `^reports/2024/[^/]*$`, 3, `Appendix "A"`}, vars)
+
+	sql, _ = f.where(sqliteDialect)
+	require.Equal(t, `(EXISTS (SELECT 1 FROM json_each(tags) WHERE value = ?) AND raw_document REGEXP ? AND (COALESCE(NULLIF(page_end, 0), page) >= ? OR NOT section = ?))`, sql)
+
+	f, err = ParseFilter("tag!=draft")
+	require.NoError(t, err)
+	sql, _ = f.where("postgres")
+	require.Equal(t, "NOT (tags @> ?)", sql)
+
+	for _, s := range []string{"", "tag", "tag~fin*", "color=red", "page=one", "updated>yesterday", `path="open`, "tag=a AND", "(tag=a"} {
+		_, err = ParseFilter(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestFilterPages(t *testing.T) {
+	forEachBackend(t, testFilterPages)
+}
+
+func testFilterPages(t *testing.T, db *gorm.DB) {
+	r := &RAG{DB: db}
+	d := &Document{FileName: "report.pdf", Chunks: []*DocumentChunk{
+		{Text: "no page"},
+		{Text: "page two", Page: 2, PageEnd: 2},
+		{Text: "pages three to five", Page: 3, PageEnd: 5},
+		{Text: "page six, ingested before page ends", Page: 6},
+	}}
+	upsertDocument(t, r, d)
+
+	match := func(s string) []string {
+		f, err := ParseFilter(s)
+		require.NoError(t, err)
+		var texts []string
+		require.NoError(t, f.apply(db.Model(&DocumentChunk{})).Order("chunk_index").Pluck("text", &texts).Error)
+		return texts
+	}
+	require.Equal(t, []string{"pages three to five"}, match("page=4"))
+	require.Equal(t, []string{"page six, ingested before page ends"}, match("page=6"))
+	require.Equal(t, []string{"no page", "page two", "page six, ingested before page ends"}, match("page!=4"))
+	require.Equal(t, []string{"pages three to five", "page six, ingested before page ends"}, match("page>=4"))
+	require.Equal(t, []string{"page two", "pages three to five"}, match("page<4"))
+	require.Empty(t, match("page<=1"))
+	require.Equal(t, []string{"no page", "page two"}, match("NOT page>=3"))
+}
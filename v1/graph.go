@@ -0,0 +1,376 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/schollz/progressbar/v3"
+	"github.com/sourcegraph/conc/pool"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const graphPrompt = "请从下面的文本中抽取实体以及实体之间的关系，每行一条。实体写作 ENTITY|名称|类型，" +
+	"关系写作 RELATION|主体|关系|客体，主体和客体须是抽取出的实体。不要编号，不要解释。" +
+	"如果没有实体，只输出 NONE。\n文本：\n%s"
+
+// graphNeighborsPerSeed bounds the chunks a graph search adds after every
+// result, so the best result doesn't take all the added places.
+const graphNeighborsPerSeed = 2
+
+// Entity is a node of the knowledge graph of a collection, named by the
+// assistant in the chunks mentioning it. Names are matched after folding
+// case and whitespace, the first spelling seen is kept.
+type Entity struct {
+	ID         string    `gorm:"primaryKey" json:"id"`
+	Collection string    `gorm:"not null;index" json:"collection"`
+	Name       string    `gorm:"not null" json:"name"`
+	Type       string    `gorm:"not null;default:''" json:"type"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// EntityMention links an entity to a chunk mentioning it.
+type EntityMention struct {
+	EntityID string `gorm:"primaryKey"`
+	ChunkID  string `gorm:"primaryKey;index"`
+}
+
+// EntityRelation is an edge of the knowledge graph, stated by a chunk.
+type EntityRelation struct {
+	SourceID string `gorm:"primaryKey"`
+	TargetID string `gorm:"primaryKey;index"`
+	Relation string `gorm:"primaryKey"`
+	ChunkID  string `gorm:"primaryKey;index"`
+}
+
+// GraphChunk records that the graph of a chunk was extracted, so chunks
+// without entities aren't sent to the assistant again.
+type GraphChunk struct {
+	ChunkID     string    `gorm:"primaryKey"`
+	Entities    int       `gorm:"not null;default:0"`
+	ExtractedAt time.Time `gorm:"not null"`
+}
+
+func entityID(collection string, name string) string {
+	return hashString(collection + "\x00" + normalizeText(name))
+}
+
+type GraphOptions struct {
+	// Collection restricts extraction to one collection, empty extracts all.
+	Collection string
+	// Force extracts the chunks extracted before again.
+	Force       bool
+	Concurrency int
+	// Progress is called with the number of chunks extracted, instead of
+	// showing a progress bar.
+	Progress func(n int)
+}
+
+// chunkGraph is the entities and relations the assistant found in a chunk.
+type chunkGraph struct {
+	entities  []Entity
+	relations []EntityRelation
+}
+
+// parseGraph reads the reply to graphPrompt. Relations between entities the
+// assistant didn't list add them without a type, malformed lines are skipped.
+func parseGraph(collection string, chunkID string, reply string) *chunkGraph {
+	g := &chunkGraph{}
+	seen := make(map[string]bool)
+	entity := func(name string, typ string) string {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return ""
+		}
+		id := entityID(collection, name)
+		if !seen[id] {
+			seen[id] = true
+			g.entities = append(g.entities, Entity{ID: id, Collection: collection, Name: name, Type: typ})
+		}
+		return id
+	}
+	relations := make(map[EntityRelation]bool)
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Split(strings.TrimSpace(listMarker.ReplaceAllString(line, "")), "|")
+		switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+		case "ENTITY":
+			if len(fields) >= 2 {
+				typ := ""
+				if len(fields) >= 3 {
+					typ = strings.TrimSpace(fields[2])
+				}
+				entity(fields[1], typ)
+			}
+		case "RELATION":
+			if len(fields) < 4 {
+				continue
+			}
+			relation := strings.TrimSpace(fields[2])
+			source, target := entity(fields[1], ""), entity(fields[3], "")
+			if relation == "" || source == "" || target == "" || source == target {
+				continue
+			}
+			rel := EntityRelation{SourceID: source, TargetID: target, Relation: relation, ChunkID: chunkID}
+			if !relations[rel] {
+				relations[rel] = true
+				g.relations = append(g.relations, rel)
+			}
+		}
+	}
+	return g
+}
+
+// ExtractGraph asks the assistant for the entities and relations of every
+// chunk not extracted yet and stores them as the knowledge graph searched by
+// SearchOptions.Graph. Entries of deleted chunks are pruned first.
+func (r *RAG) ExtractGraph(ctx context.Context, opts *GraphOptions) error {
+	if r.AssistantClient == nil {
+		return errors.New("graph extraction requires the assistant")
+	}
+	db := r.DB.WithContext(ctx)
+	err := pruneGraph(db)
+	if err != nil {
+		return errors.Wrap(err, "Failed to prune graph")
+	}
+
+	q := db.Model(&DocumentChunk{}).Where(notDuplicate("document_chunks")).Where(leafChunks("document_chunks"))
+	if opts.Collection != "" {
+		q = q.Where("collection = ?", opts.Collection)
+	}
+	if !opts.Force {
+		q = q.Where("NOT EXISTS (SELECT 1 FROM graph_chunks g WHERE g.chunk_id = document_chunks.id)")
+	}
+	var total int64
+	err = q.Session(&gorm.Session{}).Count(&total).Error
+	if err != nil {
+		return err
+	}
+	rows, err := q.Select("id", "collection", "text").Order("id").Rows()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var bar *progressbar.ProgressBar
+	if opts.Progress == nil {
+		bar = progressbar.Default(total)
+		bar.Describe("Extracting graph")
+		defer func() { _ = bar.Finish() }()
+	}
+
+	var failed atomic.Int64
+	p := pool.New().WithMaxGoroutines(max(opts.Concurrency, 1))
+	for rows.Next() {
+		var chunk DocumentChunk
+		err = r.DB.ScanRows(rows, &chunk)
+		if err != nil {
+			p.Wait()
+			return err
+		}
+		p.Go(func() {
+			if bar != nil {
+				defer func() { _ = bar.Add(1) }()
+			}
+			err := r.extractChunkGraph(ctx, &chunk)
+			if err != nil {
+				failed.Add(1)
+				log.Error().Err(err).Str("chunk_id", chunk.ID).Msg("Extracting graph")
+				return
+			}
+			if opts.Progress != nil {
+				opts.Progress(1)
+			}
+		})
+	}
+	p.Wait()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if f := failed.Load(); f > 0 {
+		return errors.Newf("failed to extract the graph of %d chunks", f)
+	}
+	return nil
+}
+
+// extractChunkGraph replaces the graph entries of a chunk with those the
+// assistant finds in it.
+func (r *RAG) extractChunkGraph(ctx context.Context, c *DocumentChunk) error {
+	reply, err := r.complete(ctx, "graph extraction", fmt.Sprintf(graphPrompt, c.Text))
+	if err != nil {
+		return err
+	}
+	g := parseGraph(c.Collection, c.ID, reply)
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("chunk_id = ?", c.ID).Delete(&EntityMention{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("chunk_id = ?", c.ID).Delete(&EntityRelation{}).Error
+		if err != nil {
+			return err
+		}
+		if len(g.entities) > 0 {
+			err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&g.entities).Error
+			if err != nil {
+				return err
+			}
+			mentions := make([]EntityMention, len(g.entities))
+			for i, e := range g.entities {
+				mentions[i] = EntityMention{EntityID: e.ID, ChunkID: c.ID}
+			}
+			err = tx.Create(&mentions).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(g.relations) > 0 {
+			err = tx.Create(&g.relations).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(&GraphChunk{ChunkID: c.ID, Entities: len(g.entities), ExtractedAt: time.Now()}).Error
+	})
+}
+
+// pruneGraph deletes the entries of chunks that no longer exist, and the
+// entities no chunk mentions anymore.
+func pruneGraph(db *gorm.DB) error {
+	const gone = "NOT EXISTS (SELECT 1 FROM document_chunks c WHERE c.id = chunk_id)"
+	for _, model := range []any{&EntityMention{}, &EntityRelation{}, &GraphChunk{}} {
+		err := db.Where(gone).Delete(model).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Where("NOT EXISTS (SELECT 1 FROM entity_mentions m WHERE m.entity_id = entities.id)").
+		Delete(&Entity{}).Error
+}
+
+// expandGraph adds after every seed the chunks mentioning its entities or
+// the entities they are related to, a hop across the knowledge graph which
+// reaches the other documents a multi-hop question needs. The added chunks
+// take the score of the seed leading to them, and are ordered by how many of
+// those entities they mention.
+func (r *RAG) expandGraph(ctx context.Context, opts *SearchOptions, seeds []DocumentChunk) ([]DocumentChunk, error) {
+	db := r.DB.WithContext(ctx)
+	ids := make([]string, len(seeds))
+	for i, c := range seeds {
+		ids[i] = c.ID
+	}
+
+	// the rank of the best seed every entity is reached from
+	reached := make(map[string]int)
+	reach := func(entity string, seed int) {
+		if best, ok := reached[entity]; !ok || seed < best {
+			reached[entity] = seed
+		}
+	}
+	var mentions []EntityMention
+	err := db.Where("chunk_id IN ?", ids).Find(&mentions).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(mentions) == 0 {
+		return seeds, nil
+	}
+	rank := make(map[string]int, len(seeds))
+	for i, id := range ids {
+		rank[id] = i
+	}
+	for _, m := range mentions {
+		reach(m.EntityID, rank[m.ChunkID])
+	}
+	mentioned := make([]string, 0, len(reached))
+	for e := range reached {
+		mentioned = append(mentioned, e)
+	}
+	var relations []EntityRelation
+	err = db.Where("source_id IN ? OR target_id IN ?", mentioned, mentioned).Find(&relations).Error
+	if err != nil {
+		return nil, err
+	}
+	// one hop from the mentioned entities, not from those reached on the way
+	direct := maps.Clone(reached)
+	for _, rel := range relations {
+		if seed, ok := direct[rel.SourceID]; ok {
+			reach(rel.TargetID, seed)
+		}
+		if seed, ok := direct[rel.TargetID]; ok {
+			reach(rel.SourceID, seed)
+		}
+	}
+
+	entities := make([]string, 0, len(reached))
+	for e := range reached {
+		entities = append(entities, e)
+	}
+	mentions = nil
+	err = db.Where("entity_id IN ? AND chunk_id NOT IN ?", entities, ids).Find(&mentions).Error
+	if err != nil {
+		return nil, err
+	}
+	type neighbor struct {
+		seed   int
+		shared int
+	}
+	neighbors := make(map[string]*neighbor)
+	for _, m := range mentions {
+		seed := reached[m.EntityID]
+		n, ok := neighbors[m.ChunkID]
+		if !ok {
+			neighbors[m.ChunkID] = &neighbor{seed: seed, shared: 1}
+			continue
+		}
+		n.seed = min(n.seed, seed)
+		n.shared++
+	}
+	if len(neighbors) == 0 {
+		return seeds, nil
+	}
+	neighborIDs := make([]string, 0, len(neighbors))
+	for id := range neighbors {
+		neighborIDs = append(neighborIDs, id)
+	}
+
+	var found []DocumentChunk
+	err = opts.Filter.apply(db.Where("id IN ? AND collection = ?", neighborIDs, opts.collection()).
+		Where(notDuplicate("document_chunks"))).Find(&found).Error
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(found, func(a, b DocumentChunk) int {
+		na, nb := neighbors[a.ID], neighbors[b.ID]
+		if na.seed != nb.seed {
+			return na.seed - nb.seed
+		}
+		if na.shared != nb.shared {
+			return nb.shared - na.shared
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	expanded := make([]DocumentChunk, 0, len(seeds)+len(found))
+	next := 0
+	for i, seed := range seeds {
+		expanded = append(expanded, seed)
+		added := 0
+		for ; next < len(found) && neighbors[found[next].ID].seed == i; next++ {
+			if added < graphNeighborsPerSeed {
+				c := found[next]
+				c.Score = seed.Score
+				expanded = append(expanded, c)
+				added++
+			}
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,122 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"github.com/stretchr/testify/require"
+)
+
+// graphAssistant replies to graph extraction prompts with the reply of a
+// key the prompt contains, NONE if it contains none.
+func graphAssistant(t *testing.T, replies map[string]string) *openai.Client {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		content := "NONE"
+		for key, reply := range replies {
+			if strings.Contains(req.Messages[0].Content, key) {
+				content = reply
+			}
+		}
+		b, err := json.Marshal(content)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id":"1","object":"chat.completion","created":0,"model":"m",`+
+			`"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":%s}}]}`, b)
+	}))
+	t.Cleanup(ts.Close)
+	client := openai.NewClient(option.WithBaseURL(ts.URL), option.WithAPIKey("test"))
+	return &client
+}
+
+func TestParseGraph(t *testing.T) {
+	g := parseGraph("default", "c1", "1. ENTITY|Alice|person\nENTITY| acme corp |org\n"+
+		"RELATION|Alice|founded|ACME  Corp\nRELATION|Alice|knows|Bob\nRELATION|Alice|is|Alice\nRELATION|broken\nnoise")
+	names := make([]string, len(g.entities))
+	for i, e := range g.entities {
+		names[i] = e.Name
+	}
+	require.Equal(t, []string{"Alice", "acme corp", "Bob"}, names)
+	require.Equal(t, "person", g.entities[0].Type)
+	require.Empty(t, g.entities[2].Type)
+	require.Len(t, g.relations, 2)
+	require.Equal(t, entityID("default", "alice"), g.relations[0].SourceID)
+	require.Equal(t, g.entities[1].ID, g.relations[0].TargetID)
+	require.Equal(t, "founded", g.relations[0].Relation)
+}
+
+func TestGraphSearch(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db, Embedder: wordEmbedder{}, AssistantClient: graphAssistant(t, map[string]string{
+		"Alice founded": "ENTITY|Alice|person\nENTITY|Acme|org\nRELATION|Alice|founded|Acme",
+		"headquarters":  "ENTITY|Acme|org\nENTITY|Berlin|city\nRELATION|Acme|based in|Berlin",
+		"Berlin hosts":  "ENTITY|Berlin|city\nRELATION|Berlin|twinned with|Paris",
+		"Paris":         "ENTITY|Paris|city",
+	})}
+	ctx := context.Background()
+
+	for _, d := range []*Document{
+		{FileName: "people.md", Chunks: []*DocumentChunk{{Text: "Alice founded the company in 2010"}}},
+		{FileName: "company.md", Chunks: []*DocumentChunk{{Text: "Acme has its headquarters downtown"}}},
+		{FileName: "city.md", Chunks: []*DocumentChunk{{Text: "Berlin hosts many startups"}}},
+		{FileName: "paris.md", Chunks: []*DocumentChunk{{Text: "Paris in spring"}}},
+		{FileName: "fruits.md", Chunks: []*DocumentChunk{{Text: "bananas are yellow"}}},
+	} {
+		upsertDocument(t, r, d)
+	}
+	extracted := 0
+	require.NoError(t, r.ExtractGraph(ctx, &GraphOptions{Concurrency: 2, Progress: func(n int) { extracted += n }}))
+	require.Equal(t, 5, extracted)
+
+	stats, err := r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), stats.Entities)
+	require.Equal(t, int64(3), stats.Relations)
+
+	opts := &SearchOptions{Query: "Alice", Mode: SearchModeKeyword, Limit: 5}
+	chunks, err := r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+
+	// the result mentions Acme, which is based in Berlin, which is twinned
+	// with Paris two hops away
+	opts.Graph = true
+	chunks, err = r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	require.Equal(t, "people", chunks[0].Document)
+	require.Equal(t, "company", chunks[1].Document)
+	require.Equal(t, "city", chunks[2].Document)
+	require.Equal(t, chunks[0].Score, chunks[2].Score)
+
+	opts.Filter, err = ParseFilter("document=people")
+	require.NoError(t, err)
+	chunks, err = r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+
+	// extracted chunks are skipped, and the graph of deleted chunks is pruned
+	_, _, err = r.DeleteDocuments(ctx, DefaultCollection, "company", false)
+	require.NoError(t, err)
+	extracted = 0
+	require.NoError(t, r.ExtractGraph(ctx, &GraphOptions{Concurrency: 1, Progress: func(n int) { extracted += n }}))
+	require.Zero(t, extracted)
+	stats, err = r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), stats.Entities)
+	require.Equal(t, int64(2), stats.Relations)
+
+	require.ErrorContains(t, (&RAG{DB: db}).ExtractGraph(ctx, &GraphOptions{}), "requires the assistant")
+}
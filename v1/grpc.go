@@ -0,0 +1,345 @@
+package rag
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	"github.com/fanyang89/rag/v1/ragpb"
+)
+
+// grpcService implements ragpb.RagServiceServer on top of the HTTP server's
+// RAG and options, so both APIs behave the same.
+type grpcService struct {
+	ragpb.UnimplementedRagServiceServer
+	s *Server
+}
+
+// StartGRPC serves the gRPC API on bind until Shutdown.
+func (s *Server) StartGRPC(bind string) error {
+	lis, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	return s.ServeGRPC(lis)
+}
+
+func (s *Server) ServeGRPC(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+func (s *Server) newGRPCServer() *grpc.Server {
+	var opts []grpc.ServerOption
+	if s.opts.Auth != nil {
+		opts = append(opts, grpc.UnaryInterceptor(s.opts.Auth.unaryInterceptor))
+	}
+	if s.opts.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.opts.TLS)))
+	}
+	server := grpc.NewServer(opts...)
+	ragpb.RegisterRagServiceServer(server, &grpcService{s: s})
+	return server
+}
+
+// stopGRPC waits for in-flight calls until ctx expires, then closes them.
+func (s *Server) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpc.Stop()
+	}
+}
+
+// grpcError translates errors of the shared handlers into gRPC statuses.
+func grpcError(err error) error {
+	var httpErr *echo.HTTPError
+	var hookErr *HookError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.As(err, &httpErr):
+		code := codes.Unknown
+		switch httpErr.Code {
+		case http.StatusBadRequest:
+			code = codes.InvalidArgument
+		case http.StatusForbidden:
+			code = codes.PermissionDenied
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusServiceUnavailable:
+			code = codes.Unavailable
+		}
+		return status.Errorf(code, "%v", httpErr.Message)
+	case errors.As(err, &hookErr):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (g *grpcService) collection(name string) (string, error) {
+	if name == "" {
+		return g.s.opts.Collection, nil
+	}
+	if err := ValidateCollectionName(name); err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return name, nil
+}
+
+func toProtoChunk(c *DocumentChunk) *ragpb.Chunk {
+	pc := &ragpb.Chunk{
+		Id:          c.ID,
+		Collection:  c.Collection,
+		Document:    c.Document,
+		RawDocument: c.RawDocument,
+		Text:        c.Text,
+		Index:       int32(c.Index),
+		Tags:        c.Tags,
+		SourcePath:  c.SourcePath,
+		Page:        int32(c.Page),
+		Section:     c.Section,
+		Collapsed:   int32(c.Collapsed),
+		Score:       c.Score,
+		Level:       int32(c.Level),
+		PageEnd:     int32(c.PageEnd),
+		Headings:    c.Headings,
+		StartOffset: int32(c.StartOffset),
+		EndOffset:   int32(c.EndOffset),
+	}
+	if c.Span != nil {
+		pc.Span = &ragpb.ChunkSpan{From: int32(c.Span.From), To: int32(c.Span.To), Ids: c.Span.IDs}
+	}
+	if !c.CreatedAt.IsZero() {
+		pc.CreatedAt = timestamppb.New(c.CreatedAt)
+	}
+	if !c.UpdatedAt.IsZero() {
+		pc.UpdatedAt = timestamppb.New(c.UpdatedAt)
+	}
+	if c.DocumentTime != nil {
+		pc.DocumentTime = timestamppb.New(*c.DocumentTime)
+	}
+	return pc
+}
+
+func (g *grpcService) Search(ctx context.Context, req *ragpb.SearchRequest) (*ragpb.SearchResponse, error) {
+	if req.GetQuery() == "" {
+		return nil, status.Error(codes.InvalidArgument, "query is required")
+	}
+	collection, err := g.collection(req.GetCollection())
+	if err != nil {
+		return nil, err
+	}
+	current, release := g.s.holdRAG()
+	defer release()
+	header := incomingHeader(ctx)
+	start := time.Now()
+	r, m, err := configureRequest(ctx, current, header.Get(HeaderSession), ragpb.RagService_Search_FullMethodName)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	rsp, err := g.search(ctx, r, collection, req, header)
+	if m != nil {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(HeaderRequestID, strconv.FormatUint(m.ID, 10)))
+		m.Status = http.StatusOK
+		switch code := status.Code(err); {
+		case code == codes.InvalidArgument:
+			m.Status = http.StatusBadRequest
+		case code != codes.OK:
+			m.Status = http.StatusInternalServerError
+		case rsp != nil:
+			m.Results = len(rsp.Chunks)
+		}
+		current.finishCanaryMetric(ctx, m, start)
+	}
+	return rsp, err
+}
+
+func (g *grpcService) search(ctx context.Context, r *RAG, collection string, req *ragpb.SearchRequest,
+	header http.Header,
+) (*ragpb.SearchResponse, error) {
+	p := &SearchParam{
+		Query:           req.GetQuery(),
+		Mode:            req.GetMode(),
+		Limit:           int(req.GetLimit()),
+		Rerank:          req.Rerank,
+		Candidates:      int(req.GetCandidates()),
+		Collapse:        req.GetCollapse(),
+		Filter:          req.GetFilter(),
+		Expand:          req.GetExpand(),
+		Expansions:      int(req.GetExpansions()),
+		MinScore:        req.GetMinScore(),
+		EfSearch:        int(req.GetEfSearch()),
+		Neighbors:       int(req.GetNeighbors()),
+		ParentSection:   req.GetParentSection(),
+		MMR:             req.GetMmr(),
+		Lambda:          req.Lambda,
+		Compress:        req.GetCompress(),
+		RecencyHalfLife: req.GetRecencyHalfLife(),
+		Graph:           req.GetGraph(),
+		Summaries:       req.GetSummaries(),
+	}
+	for _, b := range req.GetBoosts() {
+		p.Boosts = append(p.Boosts, BoostRule{Field: BoostField(b.GetField()), Value: b.GetValue(), Factor: b.GetFactor()})
+	}
+	opts, err := g.s.buildSearchOptions(r, collection, p, header)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	chunks, err := r.Search(ctx, opts)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	rsp := &ragpb.SearchResponse{
+		Chunks:        make([]*ragpb.Chunk, len(chunks)),
+		ConfigVersion: r.config().Version,
+	}
+	for i := range chunks {
+		rsp.Chunks[i] = toProtoChunk(&chunks[i])
+	}
+	return rsp, nil
+}
+
+// incomingHeader returns the metadata of a request as HTTP headers, e.g. for
+// search hooks and the canary session.
+func incomingHeader(ctx context.Context) http.Header {
+	header := make(http.Header)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, v := range md {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	return header
+}
+
+func (g *grpcService) GetChunk(ctx context.Context, req *ragpb.GetChunkRequest) (*ragpb.GetChunkResponse, error) {
+	collection, err := g.collection(req.GetCollection())
+	if err != nil {
+		return nil, err
+	}
+	var chunk DocumentChunk
+	err = g.s.rag().DB.WithContext(ctx).Omit("embedding").
+		Where("collection = ? AND id = ?", collection, req.GetId()).
+		First(&chunk).Error
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &ragpb.GetChunkResponse{Chunk: toProtoChunk(&chunk)}, nil
+}
+
+func (g *grpcService) UpsertDocument(ctx context.Context, req *ragpb.UpsertDocumentRequest) (*ragpb.UpsertDocumentResponse, error) {
+	if g.s.opts.Replicator != nil {
+		return nil, status.Error(codes.FailedPrecondition, "server is a read-only standby")
+	}
+	if req.GetFileName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "file_name is required")
+	}
+	if len(req.GetChunks()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "chunks are required")
+	}
+	name, err := g.collection(req.GetCollection())
+	if err != nil {
+		return nil, err
+	}
+	collection, err := g.s.rag().EnsureCollection(ctx, name, "")
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	document := &Document{
+		Collection:       collection.Name,
+		FileName:         req.GetFileName(),
+		Tags:             req.GetTags(),
+		TextSearchConfig: collection.TextSearchConfig,
+		Chunks:           make([]*DocumentChunk, len(req.GetChunks())),
+	}
+	if req.Timestamp != nil {
+		t := req.GetTimestamp().AsTime()
+		document.Timestamp = &t
+	}
+	for i, c := range req.GetChunks() {
+		document.Chunks[i] = &DocumentChunk{
+			Text:        c.GetText(),
+			Page:        int(c.GetPage()),
+			Section:     c.GetSection(),
+			PageEnd:     int(c.GetPageEnd()),
+			Headings:    c.GetHeadings(),
+			StartOffset: int(c.GetStartOffset()),
+			EndOffset:   int(c.GetEndOffset()),
+		}
+	}
+	document.Fix()
+	err = g.s.rag().UpsertDocumentChunks(document)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	rsp := &ragpb.UpsertDocumentResponse{Document: document.Document, ChunkIds: make([]string, len(document.Chunks))}
+	for i, c := range document.Chunks {
+		rsp.ChunkIds[i] = c.ID
+	}
+	return rsp, nil
+}
+
+func (g *grpcService) DeleteDocument(ctx context.Context, req *ragpb.DeleteDocumentRequest) (*ragpb.DeleteDocumentResponse, error) {
+	if g.s.opts.Replicator != nil && !req.GetDryRun() {
+		return nil, status.Error(codes.FailedPrecondition, "server is a read-only standby")
+	}
+	if req.GetPattern() == "" {
+		return nil, status.Error(codes.InvalidArgument, "pattern is required")
+	}
+	collection, err := g.collection(req.GetCollection())
+	if err != nil {
+		return nil, err
+	}
+	documents, chunks, err := g.s.rag().DeleteDocuments(ctx, collection, req.GetPattern(), req.GetDryRun())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &ragpb.DeleteDocumentResponse{Documents: documents, Chunks: chunks}, nil
+}
+
+func (g *grpcService) Health(ctx context.Context, _ *ragpb.HealthRequest) (*ragpb.HealthResponse, error) {
+	r, release := g.s.holdRAG()
+	defer release()
+	report := r.CheckHealth(ctx, g.s.opts.Health)
+	rsp := &ragpb.HealthResponse{
+		Healthy:    report.Healthy,
+		CheckedAt:  timestamppb.New(report.CheckedAt),
+		Components: make([]*ragpb.ProbeResult, len(report.Components)),
+	}
+	for i, c := range report.Components {
+		rsp.Components[i] = &ragpb.ProbeResult{
+			Component: c.Component,
+			Required:  c.Required,
+			Status:    c.Status,
+			Error:     c.Error,
+			LatencyMs: c.LatencyMS,
+		}
+	}
+	return rsp, nil
+}
@@ -0,0 +1,198 @@
+package rag
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/fanyang89/rag/v1/ragpb"
+)
+
+func TestGRPCService(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	client := dialGRPC(t, NewServer(r, &ServerOptions{}))
+
+	upserted, err := client.UpsertDocument(ctx, &ragpb.UpsertDocumentRequest{
+		FileName: "fruits.md",
+		Chunks:   []*ragpb.ChunkInput{{Text: "apples are red"}, {Text: "bananas are yellow"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, upserted.ChunkIds, 2)
+
+	rerank := false
+	rsp, err := client.Search(ctx, &ragpb.SearchRequest{Query: "bananas", Mode: "keyword", Limit: 5, Rerank: &rerank})
+	require.NoError(t, err)
+	require.Len(t, rsp.Chunks, 1)
+	require.Equal(t, "bananas are yellow", rsp.Chunks[0].Text)
+	require.Equal(t, upserted.ChunkIds[1], rsp.Chunks[0].Id)
+
+	_, err = client.Search(ctx, &ragpb.SearchRequest{Query: "bananas", Mode: "fuzzy"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	chunk, err := client.GetChunk(ctx, &ragpb.GetChunkRequest{Id: upserted.ChunkIds[0]})
+	require.NoError(t, err)
+	require.Equal(t, "apples are red", chunk.Chunk.Text)
+
+	_, err = client.GetChunk(ctx, &ragpb.GetChunkRequest{Collection: "other", Id: upserted.ChunkIds[0]})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	deleted, err := client.DeleteDocument(ctx, &ragpb.DeleteDocumentRequest{Pattern: "fruits*", DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{upserted.Document}, deleted.Documents)
+	require.EqualValues(t, 2, deleted.Chunks)
+
+	health, err := client.Health(ctx, &ragpb.HealthRequest{})
+	require.NoError(t, err)
+	require.NotEmpty(t, health.Components)
+}
+
+// dialGRPC serves the gRPC API of s in memory until the test ends.
+func dialGRPC(t *testing.T, s *Server) ragpb.RagServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = s.ServeGRPC(lis) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return ragpb.NewRagServiceClient(conn)
+}
+
+// TestSearchTransports searches over HTTP and gRPC alike, both building
+// their options with buildSearchOptions.
+func TestSearchTransports(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+	for _, d := range []*Document{
+		{FileName: "green.md", Chunks: []*DocumentChunk{{Text: "apples apples apples are green"}}},
+		{FileName: "red.md", Tags: []string{"official"}, Chunks: []*DocumentChunk{{Text: "apples are red"}}},
+	} {
+		upsertDocument(t, r, d)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Limit = 1
+	canaryVersion, err := r.SetConfig(ctx, &cfg, "alice", "")
+	require.NoError(t, err)
+	_, err = r.RollbackConfig(ctx, 0, "alice")
+	require.NoError(t, err)
+	_, err = r.StartCanary(ctx, canaryVersion.Version, 50)
+	require.NoError(t, err)
+
+	s := NewServer(r, &ServerOptions{})
+	client := dialGRPC(t, s)
+	type result struct {
+		invalid bool
+		texts   []string
+		version string
+	}
+	searchHTTP := func(session string, body string) result {
+		req := httptest.NewRequest(http.MethodPost, "/v1/search", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderSession, session)
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		if rec.Code == http.StatusBadRequest {
+			return result{invalid: true}
+		}
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var rsp struct{ Chunks []DocumentChunk }
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+		res := result{texts: []string{}, version: rec.Header().Get(HeaderConfigVersion)}
+		for _, c := range rsp.Chunks {
+			res.texts = append(res.texts, c.Text)
+		}
+		return res
+	}
+	searchGRPC := func(session string, req *ragpb.SearchRequest) result {
+		ctx := metadata.AppendToOutgoingContext(ctx, HeaderSession, session)
+		rsp, err := client.Search(ctx, req)
+		if status.Code(err) == codes.InvalidArgument {
+			return result{invalid: true}
+		}
+		require.NoError(t, err)
+		res := result{texts: []string{}, version: strconv.FormatInt(rsp.ConfigVersion, 10)}
+		for _, c := range rsp.Chunks {
+			res.texts = append(res.texts, c.Text)
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		body string
+		req  *ragpb.SearchRequest
+	}{
+		{`{"query":"apples","mode":"keyword"}`, &ragpb.SearchRequest{Query: "apples", Mode: "keyword"}},
+		{`{"query":"apples","mode":"keyword","boosts":[{"field":"tag","value":"official","factor":10}]}`,
+			&ragpb.SearchRequest{Query: "apples", Mode: "keyword",
+				Boosts: []*ragpb.BoostRule{{Field: "tag", Value: "official", Factor: 10}}}},
+		{`{"query":"apples","mode":"keyword","boosts":[{"field":"tag","value":"official","factor":0}]}`,
+			&ragpb.SearchRequest{Query: "apples", Mode: "keyword",
+				Boosts: []*ragpb.BoostRule{{Field: "tag", Value: "official", Factor: 0}}}},
+		// expansion needs the assistant
+		{`{"query":"apples","mode":"dense","expand":"hyde"}`, &ragpb.SearchRequest{Query: "apples", Mode: "dense", Expand: "hyde"}},
+		{`{"query":"apples","limit":1000}`, &ragpb.SearchRequest{Query: "apples", Limit: 1000}},
+	} {
+		versions := make(map[string]bool)
+		for i := range 8 {
+			// the same session gets the same canary arm on both transports
+			session := "session-" + strconv.Itoa(i)
+			want := searchHTTP(session, tc.body)
+			require.Equal(t, want, searchGRPC(session, tc.req), tc.body)
+			versions[want.version] = true
+		}
+		if !versions[""] {
+			require.Len(t, versions, 2, tc.body)
+		}
+	}
+	require.Equal(t, []string{"apples apples apples are green"},
+		searchGRPC("session-0", &ragpb.SearchRequest{Query: "apples", Mode: "keyword", Limit: 1}).texts)
+	require.Equal(t, []string{"apples are red"},
+		searchGRPC("session-0", &ragpb.SearchRequest{Query: "apples", Mode: "keyword", Limit: 1,
+			Boosts: []*ragpb.BoostRule{{Field: "tag", Value: "official", Factor: 10}}}).texts)
+
+	report, err := r.ReportCanary(ctx)
+	require.NoError(t, err)
+	requests := 0
+	for _, a := range report.Arms {
+		requests += a.Requests
+	}
+	require.Equal(t, 5*8*2+2, requests)
+}
+
+func TestSearchOptionsCandidates(t *testing.T) {
+	r := newTestRAG(newTestDB(t))
+	s := NewServer(r, &ServerOptions{})
+	cfg := DefaultConfig()
+	for _, tc := range []struct {
+		limit, candidates, expected int
+	}{
+		{limit: 5, expected: 5 * cfg.CandidatesPerResult},
+		{limit: 5, candidates: 7, expected: 7},
+		{limit: 5, candidates: 1 << 30, expected: maxSearchLimit * cfg.CandidatesPerResult},
+		{limit: 1000, expected: maxSearchLimit * cfg.CandidatesPerResult},
+	} {
+		opts, err := s.buildSearchOptions(r, DefaultCollection, &SearchParam{Query: "apples", Limit: tc.limit, Candidates: tc.candidates}, nil)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, opts.Candidates)
+	}
+}
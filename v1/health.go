@@ -0,0 +1,342 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/openai/openai-go"
+)
+
+const (
+	ComponentDatabase  = "database"
+	ComponentEmbedding = "embedding"
+	ComponentReranker  = "reranker"
+	ComponentAssistant = "assistant"
+)
+
+var Components = []string{ComponentDatabase, ComponentEmbedding, ComponentReranker, ComponentAssistant}
+
+const (
+	ProbeOK      = "ok"
+	ProbeFailed  = "failed"
+	ProbeSkipped = "skipped"
+)
+
+type HealthOptions struct {
+	// Required lists the components that must be configured and working for
+	// the deployment to be healthy, the others are probed only if configured.
+	Required []string
+	// Timeout bounds every probe.
+	Timeout time.Duration
+	// CacheTTL is how long /readyz answers with the last report instead of
+	// probing again, so frequent probes don't call the models every time.
+	// Zero probes on every request.
+	CacheTTL time.Duration
+}
+
+func DefaultHealthOptions() *HealthOptions {
+	return &HealthOptions{
+		Required: []string{ComponentDatabase, ComponentEmbedding},
+		Timeout:  10 * time.Second,
+		CacheTTL: 30 * time.Second,
+	}
+}
+
+func (o *HealthOptions) Validate() error {
+	for _, c := range o.Required {
+		if !slices.Contains(Components, c) {
+			return errors.Newf("unknown component '%s', expected one of %v", c, Components)
+		}
+	}
+	return nil
+}
+
+type ProbeResult struct {
+	Component string  `json:"component"`
+	Required  bool    `json:"required"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+type HealthReport struct {
+	Healthy    bool          `json:"healthy"`
+	CheckedAt  time.Time     `json:"checked_at"`
+	Components []ProbeResult `json:"components"`
+}
+
+// probes returns a probe per component, nil for components not configured.
+func (r *RAG) probes() map[string]func(ctx context.Context) error {
+	probes := map[string]func(ctx context.Context) error{
+		ComponentDatabase: nil, ComponentEmbedding: nil, ComponentReranker: nil, ComponentAssistant: nil,
+	}
+	if r.DB != nil {
+		probes[ComponentDatabase] = func(ctx context.Context) error {
+			db, err := r.DB.DB()
+			if err != nil {
+				return err
+			}
+			return db.PingContext(ctx)
+		}
+	}
+	if r.Embedder != nil {
+		probes[ComponentEmbedding] = func(ctx context.Context) error {
+			_, err := r.embed(ctx, []string{"Hello world"})
+			return err
+		}
+	}
+	if r.Reranker != nil {
+		probes[ComponentReranker] = func(ctx context.Context) error {
+			results, err := r.Reranker.Rerank(ctx, r.RerankerModel, "Where is Munich?",
+				[]string{"Munich is in Germany.", "The sky is blue."}, 2)
+			if err != nil {
+				return err
+			}
+			if len(results) == 0 {
+				return errors.New("empty response")
+			}
+			return nil
+		}
+	}
+	if r.AssistantClient != nil {
+		probes[ComponentAssistant] = func(ctx context.Context) error {
+			c, err := r.AssistantClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+				Model: r.AssistantModel,
+				Messages: []openai.ChatCompletionMessageParamUnion{
+					openai.UserMessage("Hello world"),
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if len(c.Choices) == 0 || c.Choices[0].Message.Content == "" {
+				return errors.New("empty response")
+			}
+			return nil
+		}
+	}
+	return probes
+}
+
+// CheckHealth probes all components concurrently. The report is healthy when
+// every required component is configured and passes its probe.
+func (r *RAG) CheckHealth(ctx context.Context, opts *HealthOptions) *HealthReport {
+	probes := r.probes()
+	report := &HealthReport{
+		Healthy:    true,
+		CheckedAt:  time.Now(),
+		Components: make([]ProbeResult, len(Components)),
+	}
+
+	var wg sync.WaitGroup
+	for i, component := range Components {
+		result := &report.Components[i]
+		result.Component = component
+		result.Required = slices.Contains(opts.Required, component)
+		probe := probes[component]
+		if probe == nil {
+			result.Status = ProbeSkipped
+			if result.Required {
+				result.Status = ProbeFailed
+				result.Error = "not configured"
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := runProbe(ctx, opts.Timeout, probe, &result.LatencyMS)
+			result.Status = ProbeOK
+			if err != nil {
+				result.Status = ProbeFailed
+				result.Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Components {
+		if result.Required && result.Status != ProbeOK {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// runProbe gives up after timeout even if the probe ignores its context, e.g.
+// clients without context support.
+func runProbe(ctx context.Context, timeout time.Duration, probe func(ctx context.Context) error, latencyMS *float64) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- probe(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Newf("timed out after %s", timeout)
+	}
+	*latencyMS = float64(time.Since(start).Microseconds()) / 1000
+	return err
+}
+
+func (s *Server) deepHealthHandler(c echo.Context) error {
+	report := s.ragOf(c).CheckHealth(c.Request().Context(), s.opts.Health)
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, report)
+}
+
+// probePaths are the routes of the Kubernetes probes, served without an API key.
+var probePaths = []string{"/healthz", "/readyz"}
+
+// publicProbes serves the probes without the middleware m, e.g. auth.
+func publicProbes(m echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := m(next)
+		return func(c echo.Context) error {
+			if slices.Contains(probePaths, c.Path()) {
+				return next(c)
+			}
+			return h(c)
+		}
+	}
+}
+
+// readyCache keeps the last readiness report for HealthOptions.CacheTTL.
+type readyCache struct {
+	mu      sync.Mutex
+	report  *HealthReport
+	expires time.Time
+}
+
+// readiness returns the cached report, or probes again once it expired.
+// Concurrent callers wait for one probe rather than each probing. The probe
+// outlives the caller's context, bounded by HealthOptions.Timeout alone, so a
+// client that went away caches no failure for the others.
+func (s *Server) readiness(ctx context.Context) *HealthReport {
+	s.ready.mu.Lock()
+	defer s.ready.mu.Unlock()
+	if s.ready.report != nil && time.Now().Before(s.ready.expires) {
+		return s.ready.report
+	}
+	s.ready.report = s.rag().CheckHealth(context.WithoutCancel(ctx), s.opts.Health)
+	s.ready.expires = time.Now().Add(s.opts.Health.CacheTTL)
+	return s.ready.report
+}
+
+// livenessHandler answers while the process serves requests, without
+// probing anything, so a slow model never gets the server restarted.
+func (s *Server) livenessHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{"status": ProbeOK})
+}
+
+// readinessHandler answers 503 while a required component fails, see
+// HealthOptions, or the server is shutting down.
+func (s *Server) readinessHandler(c echo.Context) error {
+	report := s.readiness(c.Request().Context())
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, report)
+}
+
+// Diagnostics describes a running server: its build, the models it calls,
+// the index it serves and its last readiness report.
+type Diagnostics struct {
+	Version   string    `json:"version"`
+	Revision  string    `json:"revision,omitempty"`
+	GoVersion string    `json:"go_version"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+	// Standby is true for read-only replicas following a primary.
+	Standby       bool             `json:"standby"`
+	Collection    string           `json:"collection"`
+	SchemaVersion int              `json:"schema_version"`
+	ConfigVersion int64            `json:"config_version"`
+	Models        DiagnosticModels `json:"models"`
+	Index         *IndexStats      `json:"index"`
+	Health        *HealthReport    `json:"health"`
+}
+
+// DiagnosticModels are the models a server calls, empty when not configured.
+type DiagnosticModels struct {
+	// Embedding is the model of the embedder, ActiveEmbedding the model whose
+	// vectors searches query, see ActiveEmbeddingModel.
+	Embedding       string `json:"embedding"`
+	ActiveEmbedding string `json:"active_embedding"`
+	Reranker        string `json:"reranker"`
+	Assistant       string `json:"assistant"`
+}
+
+// buildRevision returns the VCS revision the binary was built from, if known.
+func buildRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
+
+func (s *Server) diagnosticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	r := s.ragOf(c)
+	d := &Diagnostics{
+		Version:    Version,
+		Revision:   buildRevision(),
+		GoVersion:  runtime.Version(),
+		StartedAt:  s.startedAt,
+		Uptime:     time.Since(s.startedAt).Round(time.Second).String(),
+		Standby:    s.opts.Replicator != nil,
+		Collection: s.opts.Collection,
+		Models:     DiagnosticModels{Embedding: embedderModel(r.Embedder)},
+	}
+	if r.Reranker != nil {
+		d.Models.Reranker = r.RerankerModel
+	}
+	if r.AssistantClient != nil {
+		d.Models.Assistant = r.AssistantModel
+	}
+
+	var err error
+	d.SchemaVersion, err = schemaVersion(r.DB.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	cfg, err := r.CurrentConfig(ctx)
+	if err != nil {
+		return err
+	}
+	d.ConfigVersion = cfg.Version
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return err
+	}
+	if active != nil {
+		d.Models.ActiveEmbedding = active.Name
+	}
+	d.Index, err = r.Stats(ctx, "")
+	if err != nil {
+		return err
+	}
+	d.Health = s.readiness(ctx)
+	return c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,99 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+// stuckEmbedder never answers and ignores cancellation.
+type stuckEmbedder struct{}
+
+func (stuckEmbedder) Embed(context.Context, []string) ([][]float32, error) {
+	select {}
+}
+
+func TestCheckHealth(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	report := r.CheckHealth(ctx, DefaultHealthOptions())
+	require.True(t, report.Healthy)
+	require.Equal(t, []string{ProbeOK, ProbeOK, ProbeSkipped, ProbeSkipped}, probeStatuses(report))
+
+	report = r.CheckHealth(ctx, &HealthOptions{Required: []string{ComponentDatabase, ComponentReranker}, Timeout: time.Second})
+	require.False(t, report.Healthy)
+	require.Equal(t, "not configured", report.Components[2].Error)
+
+	r.Embedder = stuckEmbedder{}
+	report = r.CheckHealth(ctx, &HealthOptions{Required: []string{ComponentEmbedding}, Timeout: 50 * time.Millisecond})
+	require.False(t, report.Healthy)
+	require.Equal(t, []string{ProbeOK, ProbeFailed, ProbeSkipped, ProbeSkipped}, probeStatuses(report))
+	require.Contains(t, report.Components[1].Error, "timed out")
+
+	s := NewServer(r, &ServerOptions{Health: &HealthOptions{Required: []string{ComponentDatabase}, Timeout: 50 * time.Millisecond}})
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/deep", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"component":"embedding","required":false,"status":"failed"`)
+}
+
+func probeStatuses(report *HealthReport) []string {
+	statuses := make([]string, len(report.Components))
+	for i, c := range report.Components {
+		statuses[i] = c.Status
+	}
+	return statuses
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	db := newTestDB(t)
+	embedder := &countingEmbedder{}
+	r := &RAG{DB: db, Embedder: embedder}
+	s := NewServer(r, &ServerOptions{Auth: NewAuthenticator(r), Health: &HealthOptions{
+		Required: []string{ComponentDatabase, ComponentEmbedding},
+		Timeout:  time.Second,
+		CacheTTL: time.Minute,
+	}})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// a client gone before readiness was probed leaves no failure cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+
+	// probes need no API key, and readiness is probed once per TTL
+	require.Equal(t, http.StatusOK, get("/healthz").Code)
+	for range 3 {
+		rec := get("/readyz")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"healthy":true`)
+	}
+	require.Equal(t, int32(1), embedder.calls.Load())
+	require.Equal(t, http.StatusUnauthorized, get("/v1/diagnostics").Code)
+
+	s = NewServer(r, &ServerOptions{Health: &HealthOptions{Required: []string{ComponentReranker}, Timeout: time.Second}})
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz").Code)
+	rec := get("/v1/diagnostics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var d Diagnostics
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+	require.Equal(t, Version, d.Version)
+	require.Equal(t, len(migrations), d.SchemaVersion)
+	require.Equal(t, DefaultCollection, d.Collection)
+	require.False(t, d.Health.Healthy)
+	require.NotNil(t, d.Index)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	require.Equal(t, http.StatusServiceUnavailable, get("/healthz").Code)
+}
@@ -0,0 +1,194 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"resty.dev/v3"
+)
+
+type HookStage string
+
+const (
+	HookStagePreQuery       HookStage = "pre-query"
+	HookStagePostCandidates HookStage = "post-candidates"
+	HookStagePostRerank     HookStage = "post-rerank"
+)
+
+// SearchHooks intercepts the retrieval pipeline. PreQuery may rewrite the
+// options, the post stages may filter or reorder chunks.
+type SearchHooks interface {
+	PreQuery(ctx context.Context, opts *SearchOptions) error
+	PostCandidates(ctx context.Context, opts *SearchOptions, chunks []DocumentChunk) ([]DocumentChunk, error)
+	PostRerank(ctx context.Context, opts *SearchOptions, chunks []DocumentChunk) ([]DocumentChunk, error)
+}
+
+// HookRequest is posted to plugins. Headers carry selected headers of the
+// original request so plugins can apply caller-specific rules such as entitlements.
+type HookRequest struct {
+	Stage   HookStage         `json:"stage"`
+	Query   string            `json:"query"`
+	Limit   int               `json:"limit"`
+	Mode    SearchMode        `json:"mode"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Chunks  []HookChunk       `json:"chunks,omitempty"`
+}
+
+type HookChunk struct {
+	ID          string   `json:"id"`
+	Document    string   `json:"document"`
+	RawDocument string   `json:"raw_document"`
+	Tags        []string `json:"tags,omitempty"`
+	Text        string   `json:"text"`
+}
+
+// HookResponse is returned by plugins. Query replaces the query in the pre-query
+// stage; ChunkIDs, when present, is the ordered subset of chunks to keep.
+type HookResponse struct {
+	Query    *string  `json:"query,omitempty"`
+	ChunkIDs []string `json:"chunk_ids,omitempty"`
+}
+
+// HookError aborts a search with the status code returned by a plugin.
+type HookError struct {
+	Stage      HookStage
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *HookError) Error() string {
+	return string(e.Stage) + " hook " + e.URL + " returned " + http.StatusText(e.StatusCode) + ": " + e.Body
+}
+
+func ParseHookStage(s string) (HookStage, error) {
+	switch stage := HookStage(s); stage {
+	case HookStagePreQuery, HookStagePostCandidates, HookStagePostRerank:
+		return stage, nil
+	default:
+		return "", errors.Newf("unknown hook stage: '%s'", s)
+	}
+}
+
+type HTTPHooks struct {
+	client  *resty.Client
+	urls    map[HookStage][]string
+	headers []string
+}
+
+// NewHTTPHooks creates hooks from "stage=url" specs. Listed request headers are
+// forwarded to plugins.
+func NewHTTPHooks(specs []string, forwardHeaders []string, timeout time.Duration) (*HTTPHooks, error) {
+	h := &HTTPHooks{
+		client:  resty.New().SetTimeout(timeout),
+		urls:    make(map[HookStage][]string),
+		headers: forwardHeaders,
+	}
+	for _, spec := range specs {
+		s, url, ok := strings.Cut(spec, "=")
+		if !ok || url == "" {
+			return nil, errors.Newf("invalid hook: '%s', expected stage=url", spec)
+		}
+		stage, err := ParseHookStage(s)
+		if err != nil {
+			return nil, err
+		}
+		h.urls[stage] = append(h.urls[stage], url)
+	}
+	return h, nil
+}
+
+func (h *HTTPHooks) Close() error {
+	return h.client.Close()
+}
+
+// ForRequest binds the hooks to the headers of an incoming request.
+func (h *HTTPHooks) ForRequest(header http.Header) SearchHooks {
+	headers := make(map[string]string)
+	for _, name := range h.headers {
+		if v := header.Get(name); v != "" {
+			headers[name] = v
+		}
+	}
+	return &requestHooks{h: h, headers: headers}
+}
+
+type requestHooks struct {
+	h       *HTTPHooks
+	headers map[string]string
+}
+
+func (rh *requestHooks) call(ctx context.Context, stage HookStage, opts *SearchOptions, chunks []DocumentChunk) (*SearchOptions, []DocumentChunk, error) {
+	for _, url := range rh.h.urls[stage] {
+		req := HookRequest{
+			Stage:   stage,
+			Query:   opts.Query,
+			Limit:   opts.Limit,
+			Mode:    opts.Mode,
+			Headers: rh.headers,
+		}
+		for _, c := range chunks {
+			req.Chunks = append(req.Chunks, HookChunk{
+				ID:          c.ID,
+				Document:    c.Document,
+				RawDocument: c.RawDocument,
+				Tags:        c.Tags,
+				Text:        c.Text,
+			})
+		}
+
+		res, err := rh.h.client.R().SetContext(ctx).SetBody(&req).Post(url)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "%s hook %s", stage, url)
+		}
+		if res.StatusCode() < 200 || res.StatusCode() >= 300 {
+			return nil, nil, &HookError{Stage: stage, URL: url, StatusCode: res.StatusCode(), Body: res.String()}
+		}
+
+		var rsp HookResponse
+		if body := res.Bytes(); len(bytes.TrimSpace(body)) > 0 {
+			err = json.Unmarshal(body, &rsp)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "%s hook %s returned invalid response", stage, url)
+			}
+		}
+
+		if rsp.Query != nil {
+			opts.Query = *rsp.Query
+		}
+		if rsp.ChunkIDs != nil {
+			byID := make(map[string]DocumentChunk, len(chunks))
+			for _, c := range chunks {
+				byID[c.ID] = c
+			}
+			kept := make([]DocumentChunk, 0, len(rsp.ChunkIDs))
+			for _, id := range rsp.ChunkIDs {
+				if c, ok := byID[id]; ok {
+					kept = append(kept, c)
+				}
+			}
+			chunks = kept
+		}
+	}
+	return opts, chunks, nil
+}
+
+func (rh *requestHooks) PreQuery(ctx context.Context, opts *SearchOptions) error {
+	_, _, err := rh.call(ctx, HookStagePreQuery, opts, nil)
+	return err
+}
+
+func (rh *requestHooks) PostCandidates(ctx context.Context, opts *SearchOptions, chunks []DocumentChunk) ([]DocumentChunk, error) {
+	_, chunks, err := rh.call(ctx, HookStagePostCandidates, opts, chunks)
+	return chunks, err
+}
+
+func (rh *requestHooks) PostRerank(ctx context.Context, opts *SearchOptions, chunks []DocumentChunk) ([]DocumentChunk, error) {
+	_, chunks, err := rh.call(ctx, HookStagePostRerank, opts, chunks)
+	return chunks, err
+}
@@ -0,0 +1,53 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPHooks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req HookRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Headers["Authorization"] != "Bearer alice" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ids := make([]string, 0)
+		for _, c := range req.Chunks {
+			if c.Document != "secret" {
+				ids = append(ids, c.ID)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(HookResponse{ChunkIDs: ids})
+	}))
+	defer ts.Close()
+
+	hooks, err := NewHTTPHooks([]string{"post-candidates=" + ts.URL}, []string{"Authorization"}, time.Second)
+	require.NoError(t, err)
+	defer func() { _ = hooks.Close() }()
+
+	chunks := []DocumentChunk{{ID: "a", Document: "public"}, {ID: "b", Document: "secret"}, {ID: "c", Document: "public"}}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer alice")
+	kept, err := hooks.ForRequest(header).PostCandidates(context.Background(), &SearchOptions{}, chunks)
+	require.NoError(t, err)
+	require.Len(t, kept, 2)
+	require.Equal(t, "c", kept[1].ID)
+
+	_, err = hooks.ForRequest(http.Header{}).PostCandidates(context.Background(), &SearchOptions{}, chunks)
+	var hookErr *HookError
+	require.ErrorAs(t, err, &hookErr)
+	require.Equal(t, http.StatusForbidden, hookErr.StatusCode)
+
+	kept, err = hooks.ForRequest(header).PostRerank(context.Background(), &SearchOptions{}, chunks)
+	require.NoError(t, err)
+	require.Len(t, kept, 3)
+}
@@ -0,0 +1,458 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+)
+
+const (
+	ContentTypeChunks   = "application/x-rag-chunks+json"
+	ContentTypeMarkdown = "text/markdown"
+	ContentTypeText     = "text/plain"
+	ContentTypeHTML     = "text/html"
+	ContentTypePDF      = "application/pdf"
+	ContentTypeDOCX     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+)
+
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+// SniffContentType detects the content type from magic bytes, refined by the
+// file extension where magic bytes are ambiguous.
+func SniffContentType(name string, data []byte) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return ContentTypePDF
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		if ext == ".docx" {
+			return ContentTypeDOCX
+		}
+		return "application/zip"
+	}
+
+	detected, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	switch detected {
+	case ContentTypeHTML:
+		return ContentTypeHTML
+	case ContentTypeText:
+		trimmed := bytes.TrimSpace(data)
+		switch {
+		case ext == ".json" && bytes.HasPrefix(trimmed, []byte("{")):
+			return ContentTypeChunks
+		case ext == ".md" || ext == ".markdown":
+			return ContentTypeMarkdown
+		case ext == ".html" || ext == ".htm":
+			return ContentTypeHTML
+		}
+		return ContentTypeText
+	}
+	return detected
+}
+
+type Converter interface {
+	Name() string
+	// Convert extracts the text of a file as Markdown or plain text.
+	Convert(ctx context.Context, name string, data []byte) (string, error)
+}
+
+type Chunker interface {
+	Name() string
+	Chunk(text string) []string
+}
+
+type textConverter struct{}
+
+func (textConverter) Name() string { return "text" }
+
+func (textConverter) Convert(_ context.Context, _ string, data []byte) (string, error) {
+	if !utf8.Valid(data) {
+		return "", errors.New("text is not valid UTF-8")
+	}
+	return string(data), nil
+}
+
+// CommandConverter runs an external program such as pdftotext. The "{input}"
+// argument is replaced with the path of the file, and the text is read from
+// stdout. With an "{output}" argument the program writes into a temporary
+// directory instead, like mineru does, and the Markdown file it produces is read.
+type CommandConverter struct {
+	Command []string
+	// Markdown marks the output as Markdown, so chunks get the section they fall under.
+	Markdown bool
+}
+
+func (c *CommandConverter) Name() string {
+	return filepath.Base(c.Command[0])
+}
+
+func (c *CommandConverter) markdown() bool {
+	return c.Markdown
+}
+
+func (c *CommandConverter) Convert(ctx context.Context, name string, data []byte) (string, error) {
+	f, err := os.CreateTemp("", "rag-*"+filepath.Ext(name))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var outputDir string
+	args := make([]string, len(c.Command)-1)
+	for i, arg := range c.Command[1:] {
+		if strings.Contains(arg, "{output}") && outputDir == "" {
+			outputDir, err = os.MkdirTemp("", "rag-output-*")
+			if err != nil {
+				return "", err
+			}
+			defer func() { _ = os.RemoveAll(outputDir) }()
+		}
+		arg = strings.ReplaceAll(arg, "{input}", f.Name())
+		args[i] = strings.ReplaceAll(arg, "{output}", outputDir)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Command[0], args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: %s", c.Name(), strings.TrimSpace(stderr.String()))
+	}
+	if outputDir == "" {
+		return stdout.String(), nil
+	}
+	return readMarkdownOutput(outputDir)
+}
+
+// readMarkdownOutput reads the first Markdown file found under dir.
+func readMarkdownOutput(dir string) (string, error) {
+	var path string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".md") {
+			path = p
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", errors.New("converter produced no Markdown file")
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// ParagraphChunker packs paragraphs into chunks of at most MaxRunes runes,
+// hard-splitting paragraphs that are longer than that. With a Tokenizer,
+// chunks of more than MaxTokens tokens are split again the same way.
+type ParagraphChunker struct {
+	MaxRunes  int
+	MaxTokens int
+	Tokenizer *Tokenizer
+}
+
+func (c *ParagraphChunker) Name() string { return "paragraph" }
+
+func (c *ParagraphChunker) Chunk(text string) []string {
+	chunks := c.chunkRunes(text)
+	if c.Tokenizer == nil || c.MaxTokens <= 0 {
+		return chunks
+	}
+	limited := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		if c.Tokenizer.Count(chunk) <= c.MaxTokens {
+			limited = append(limited, chunk)
+			continue
+		}
+		limited = append(limited, c.splitTokens(chunk)...)
+	}
+	return limited
+}
+
+// splitTokens packs the paragraphs of a chunk into chunks of at most
+// MaxTokens tokens, hard-splitting paragraphs that are longer than that.
+func (c *ParagraphChunker) splitTokens(chunk string) []string {
+	chunks := make([]string, 0)
+	current := ""
+	flush := func() {
+		if current != "" {
+			chunks = append(chunks, current)
+		}
+		current = ""
+	}
+	for _, p := range strings.Split(chunk, "\n\n") {
+		joined := p
+		if current != "" {
+			joined = current + "\n\n" + p
+		}
+		if c.Tokenizer.Count(joined) <= c.MaxTokens {
+			current = joined
+			continue
+		}
+		flush()
+		if c.Tokenizer.Count(p) <= c.MaxTokens {
+			current = p
+			continue
+		}
+		for _, piece := range c.Tokenizer.Split(p, c.MaxTokens) {
+			if s := strings.TrimSpace(piece); s != "" {
+				chunks = append(chunks, s)
+			}
+		}
+	}
+	flush()
+	return chunks
+}
+
+func (c *ParagraphChunker) chunkRunes(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	chunks := make([]string, 0)
+	var current []rune
+	flush := func() {
+		if s := strings.TrimSpace(string(current)); s != "" {
+			chunks = append(chunks, s)
+		}
+		current = current[:0]
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		p := []rune(strings.TrimSpace(paragraph))
+		if len(p) == 0 {
+			continue
+		}
+		if len(current) > 0 && len(current)+2+len(p) > c.MaxRunes {
+			flush()
+		}
+		for len(p) > c.MaxRunes {
+			flush()
+			current = append(current, p[:c.MaxRunes]...)
+			flush()
+			p = p[c.MaxRunes:]
+		}
+		if len(current) > 0 {
+			current = append(current, '\n', '\n')
+		}
+		current = append(current, p...)
+	}
+	flush()
+	return chunks
+}
+
+// markdownSections returns the heading each chunk falls under: the chunk's own
+// leading heading, or else the last heading of the chunks before it.
+func markdownSections(chunks []string) []string {
+	sections := make([]string, len(chunks))
+	for i, path := range markdownHeadingPaths(chunks) {
+		if len(path) > 0 {
+			sections[i] = path[len(path)-1]
+		}
+	}
+	return sections
+}
+
+// markdownHeadingPaths returns the headings each chunk falls under, outermost
+// first, ending with the heading markdownSections returns.
+func markdownHeadingPaths(chunks []string) [][]string {
+	paths := make([][]string, len(chunks))
+	// current holds the heading of every level, empty for levels skipped
+	current := make([]string, 0, 6)
+	for i, chunk := range chunks {
+		first := true
+		for _, line := range strings.Split(chunk, "\n") {
+			heading, level, ok := markdownHeading(line)
+			if ok {
+				for len(current) < level-1 {
+					current = append(current, "")
+				}
+				current = append(current[:level-1], heading)
+			}
+			if first {
+				path := make([]string, 0, len(current))
+				for _, h := range current {
+					if h != "" {
+						path = append(path, h)
+					}
+				}
+				paths[i] = path
+				first = false
+			}
+		}
+	}
+	return paths
+}
+
+func markdownHeading(line string) (string, int, bool) {
+	trimmed := strings.TrimLeft(line, "#")
+	level := len(line) - len(trimmed)
+	if level == 0 || level > 6 || !strings.HasPrefix(trimmed, " ") {
+		return "", 0, false
+	}
+	return strings.TrimSpace(trimmed), level, true
+}
+
+// chunkPosition is where a chunk was found in the text it was split from.
+type chunkPosition struct {
+	page, pageEnd          int
+	startOffset, endOffset int
+}
+
+// locateChunks finds the chunks in order in text, by their first and last
+// paragraph as chunkers join paragraphs again, and returns their rune offsets
+// and, if text has form feeds between pages like pdftotext writes, the pages
+// they start and end on. Chunks that aren't found are left at zero.
+func locateChunks(text string, chunks []string) []chunkPosition {
+	positions := make([]chunkPosition, len(chunks))
+	paged := strings.Contains(text, "\f")
+	cursor, runes, pages := 0, 0, 1
+	// advance moves the cursor to byte offset i, counting runes and pages
+	advance := func(i int) {
+		runes += utf8.RuneCountInString(text[cursor:i])
+		pages += strings.Count(text[cursor:i], "\f")
+		cursor = i
+	}
+	for i, chunk := range chunks {
+		first, _, joined := strings.Cut(chunk, "\n\n")
+		start := strings.Index(text[cursor:], first)
+		if start < 0 {
+			continue
+		}
+		start += cursor
+		end := start + len(first)
+		if joined {
+			last := chunk[strings.LastIndex(chunk, "\n\n")+2:]
+			e := strings.Index(text[end:], last)
+			if e < 0 {
+				continue
+			}
+			end += e + len(last)
+		}
+		advance(start)
+		p := &positions[i]
+		p.startOffset = runes
+		if paged {
+			p.page = pages
+		}
+		advance(end)
+		p.endOffset = runes
+		if paged {
+			p.pageEnd = pages
+		}
+	}
+	return positions
+}
+
+type Ingestor struct {
+	Converters map[string]Converter
+	Chunker    Chunker
+}
+
+func NewIngestor() *Ingestor {
+	return &Ingestor{
+		Converters: map[string]Converter{
+			ContentTypeText:     textConverter{},
+			ContentTypeMarkdown: textConverter{},
+			ContentTypeHTML:     htmlConverter{},
+			ContentTypeDOCX:     docxConverter{},
+		},
+		Chunker: &ParagraphChunker{MaxRunes: 1000},
+	}
+}
+
+type IngestReport struct {
+	FileName    string `json:"file_name"`
+	Document    string `json:"document"`
+	ContentType string `json:"content_type"`
+	Converter   string `json:"converter"`
+	Chunker     string `json:"chunker"`
+	Chunks      int    `json:"chunks"`
+}
+
+// Load turns a file of any supported type into a chunked document.
+func (ing *Ingestor) Load(ctx context.Context, name string, data []byte) (*Document, *IngestReport, error) {
+	return ing.LoadAs(ctx, name, SniffContentType(name, data), data)
+}
+
+// LoadAs is like Load but trusts the given content type instead of sniffing it.
+func (ing *Ingestor) LoadAs(ctx context.Context, name string, contentType string, data []byte) (*Document, *IngestReport, error) {
+	report := &IngestReport{
+		FileName:    name,
+		ContentType: contentType,
+	}
+
+	var document Document
+	if report.ContentType == ContentTypeChunks {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&document)
+		if err != nil {
+			return nil, report, errors.Wrap(err, "Failed to decode chunks")
+		}
+		report.Converter = "chunks-json"
+		report.Chunker = "none"
+	} else {
+		converter, ok := ing.Converters[report.ContentType]
+		if !ok {
+			return nil, report, errors.Wrapf(ErrUnsupportedContentType, "%s", report.ContentType)
+		}
+		text, err := converter.Convert(ctx, name, data)
+		if err != nil {
+			return nil, report, err
+		}
+		report.Converter = converter.Name()
+		report.Chunker = ing.Chunker.Name()
+
+		document.FileName = strings.TrimSuffix(name, filepath.Ext(name)) + ".md"
+		// offsets are into the text with the line endings chunkers normalize
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		chunks := ing.Chunker.Chunk(text)
+		var headings [][]string
+		md, ok := converter.(interface{ markdown() bool })
+		if report.ContentType == ContentTypeMarkdown || ok && md.markdown() {
+			headings = markdownHeadingPaths(chunks)
+		}
+		positions := locateChunks(text, chunks)
+		for i, chunk := range chunks {
+			c := &DocumentChunk{
+				Text:        chunk,
+				Page:        positions[i].page,
+				PageEnd:     positions[i].pageEnd,
+				StartOffset: positions[i].startOffset,
+				EndOffset:   positions[i].endOffset,
+			}
+			if headings != nil && len(headings[i]) > 0 {
+				c.Headings = headings[i]
+				c.Section = headings[i][len(headings[i])-1]
+			}
+			document.Chunks = append(document.Chunks, c)
+		}
+	}
+
+	document.Fix()
+	report.Document = document.Document
+	report.Chunks = len(document.Chunks)
+	return &document, report, nil
+}
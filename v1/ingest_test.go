@@ -0,0 +1,115 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffContentType(t *testing.T) {
+	require.Equal(t, ContentTypePDF, SniffContentType("a.bin", []byte("%PDF-1.7\n")))
+	require.Equal(t, ContentTypeDOCX, SniffContentType("a.docx", []byte("PK\x03\x04rest")))
+	require.Equal(t, ContentTypeChunks, SniffContentType("a.md.chunks.json", []byte(`{"chunks": []}`)))
+	require.Equal(t, ContentTypeMarkdown, SniffContentType("a.md", []byte("# Title\n\ntext")))
+	require.Equal(t, ContentTypeHTML, SniffContentType("a.txt", []byte("<!DOCTYPE html><html></html>")))
+	require.Equal(t, ContentTypeText, SniffContentType("a.txt", []byte("hello")))
+}
+
+func TestParagraphChunker(t *testing.T) {
+	c := &ParagraphChunker{MaxRunes: 10}
+	chunks := c.Chunk("一二三\n\n四五六\n\n" + strings.Repeat("x", 25))
+	require.Equal(t, []string{"一二三\n\n四五六", "xxxxxxxxxx", "xxxxxxxxxx", "xxxxx"}, chunks)
+}
+
+func TestMarkdownSections(t *testing.T) {
+	sections := markdownSections([]string{
+		"intro",
+		"# Revenue\n\ngrew",
+		"more on revenue\n\n## Costs",
+		"fell",
+	})
+	require.Equal(t, []string{"", "Revenue", "Revenue", "Costs"}, sections)
+}
+
+func TestMarkdownHeadingPaths(t *testing.T) {
+	paths := markdownHeadingPaths([]string{
+		"intro",
+		"# Report\n\n## Revenue\n\ngrew",
+		"#### Details",
+		"## Costs",
+		"fell",
+	})
+	require.Equal(t, [][]string{{}, {"Report"}, {"Report", "Revenue", "Details"}, {"Report", "Costs"},
+		{"Report", "Costs"}}, paths)
+}
+
+func TestChunkPositions(t *testing.T) {
+	text := "第一页\r\n\r\nalpha\f\n\n\nbeta\n\ngamma\fdelta"
+	ing := NewIngestor()
+	ing.Chunker = &ParagraphChunker{MaxRunes: 12}
+	document, _, err := ing.Load(context.Background(), "paper.txt", []byte(text))
+	require.NoError(t, err)
+	require.Len(t, document.Chunks, 3)
+
+	normalized := strings.ReplaceAll(text, "\r\n", "\n")
+	runes := []rune(normalized)
+	for _, c := range document.Chunks {
+		require.NotZero(t, c.EndOffset)
+		located := string(runes[c.StartOffset:c.EndOffset])
+		require.Equal(t, strings.Fields(c.Text), strings.Fields(located))
+	}
+	require.Equal(t, "第一页\n\nalpha", document.Chunks[0].Text)
+	require.Equal(t, 0, document.Chunks[0].StartOffset)
+	require.Equal(t, 1, document.Chunks[0].Page)
+	require.Equal(t, 1, document.Chunks[0].PageEnd)
+	require.Equal(t, "beta", document.Chunks[1].Text)
+	require.Equal(t, 2, document.Chunks[1].Page)
+	require.Equal(t, 2, document.Chunks[1].PageEnd)
+	require.Equal(t, 2, document.Chunks[2].Page)
+	require.Equal(t, 3, document.Chunks[2].PageEnd)
+
+	// without form feeds pages are unknown
+	document, _, err = ing.Load(context.Background(), "notes.md", []byte("# A\n\n## B\n\ntext"))
+	require.NoError(t, err)
+	require.Zero(t, document.Chunks[0].Page)
+	require.Equal(t, []string{"A"}, document.Chunks[0].Headings)
+	require.Equal(t, "A", document.Chunks[0].Section)
+	require.Equal(t, []string{"A", "B"}, document.Chunks[1].Headings)
+	require.Equal(t, "B", document.Chunks[1].Section)
+
+	// positions are stored, and widened results cover their chunks'
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	require.NoError(t, r.UpsertDocumentChunks(document))
+	c, err := r.GetDocumentChunk(document.Chunks[1].ID)
+	require.NoError(t, err)
+	require.Equal(t, document.Chunks[1].Headings, c.Headings)
+	require.Equal(t, document.Chunks[1].StartOffset, c.StartOffset)
+	require.Equal(t, document.Chunks[1].EndOffset, c.EndOffset)
+	widened, err := widenResults(db, []DocumentChunk{*c}, 1, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, widened[0].StartOffset)
+	require.Equal(t, document.Chunks[1].EndOffset, widened[0].EndOffset)
+}
+
+func TestCommandConverterOutputDir(t *testing.T) {
+	ing := NewIngestor()
+	ing.Converters[ContentTypePDF] = &CommandConverter{Markdown: true, Command: []string{
+		"sh", "-c", `mkdir -p "$1/doc/auto" && printf '# Intro\n\nhello\n\n# Usage\n\nrun it' > "$1/doc/auto/doc.md"`,
+		"sh", "{output}",
+	}}
+	ing.Chunker = &ParagraphChunker{MaxRunes: 20}
+	document, report, err := ing.Load(context.Background(), "manuals/doc.pdf", []byte("%PDF-1.7\n"))
+	require.NoError(t, err)
+	require.Equal(t, "sh", report.Converter)
+	require.Equal(t, "manuals/doc", document.Document)
+	require.Len(t, document.Chunks, 2)
+	require.Equal(t, "Intro", document.Chunks[0].Section)
+	require.Equal(t, "Usage", document.Chunks[1].Section)
+
+	ing.Converters[ContentTypePDF] = &CommandConverter{Command: []string{"true", "{output}"}}
+	_, _, err = ing.Load(context.Background(), "doc.pdf", []byte("%PDF-1.7\n"))
+	require.ErrorContains(t, err, "no Markdown file")
+}
@@ -0,0 +1,425 @@
+package rag
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+const (
+	jobPollInterval = time.Second
+	// jobLease is how long a running job may go without progress before
+	// another worker takes it over, e.g. after its server crashed.
+	jobLease = 5 * time.Minute
+)
+
+// errJobTakenOver stops a worker whose job another worker claimed meanwhile,
+// e.g. after it went longer than jobLease without progress.
+var errJobTakenOver = errors.New("ingest job was taken over by another worker")
+
+// IngestJob upserts and embeds documents submitted to the server in the
+// background. Its progress is written as it goes, so any server can report it.
+type IngestJob struct {
+	ID         uint64 `gorm:"primaryKey" json:"id"`
+	Collection string `gorm:"not null" json:"collection"`
+	Status     string `gorm:"not null;index" json:"status"`
+	// Attempts counts the workers that took the job, more than one if a
+	// worker was interrupted.
+	Attempts int `gorm:"not null;default:0" json:"attempts"`
+	// Total is the number of submitted documents and files, Processed those
+	// upserted or failed so far.
+	Total     int `gorm:"not null;default:0" json:"total"`
+	Processed int `gorm:"not null;default:0" json:"processed"`
+	// Chunks is the number of chunks upserted, Embedded those embedded since.
+	Chunks   int        `gorm:"not null;default:0" json:"chunks"`
+	Embedded int        `gorm:"not null;default:0" json:"embedded"`
+	Errors   []JobError `gorm:"type:jsonb;serializer:json;default:'[]'" json:"errors,omitempty"`
+	// Payload is the IngestRequest, cleared when the job finishes.
+	Payload    []byte     `gorm:"not null" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type JobError struct {
+	// Document is the document or file that failed, empty if embedding failed.
+	Document string `json:"document,omitempty"`
+	Error    string `json:"error"`
+}
+
+// IngestFile is a raw file converted and chunked by the server's Ingestor.
+type IngestFile struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+// IngestRequest is the body of POST /v1/documents: chunked documents in the
+// format of chunks files, raw files, or both.
+type IngestRequest struct {
+	Documents []*Document  `json:"documents,omitempty"`
+	Files     []IngestFile `json:"files,omitempty"`
+	// Tags are given to documents without tags of their own.
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (req *IngestRequest) Validate() error {
+	if len(req.Documents) == 0 && len(req.Files) == 0 {
+		return errors.New("no documents or files to ingest")
+	}
+	for i, d := range req.Documents {
+		if d == nil || d.FileName == "" {
+			return errors.Newf("document %d has no file_name", i)
+		}
+	}
+	for i, f := range req.Files {
+		if f.Name == "" {
+			return errors.Newf("file %d has no name", i)
+		}
+	}
+	return nil
+}
+
+// SubmitIngestJob queues req for ingestion into collection.
+func (r *RAG) SubmitIngestJob(ctx context.Context, collection string, req *IngestRequest) (*IngestJob, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	job := &IngestJob{
+		Collection: collection,
+		Status:     JobQueued,
+		Total:      len(req.Documents) + len(req.Files),
+		Errors:     []JobError{},
+		Payload:    payload,
+	}
+	err = r.DB.WithContext(ctx).Create(job).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create ingest job")
+	}
+	return job, nil
+}
+
+// IngestJob returns the job with id, nil if there is none.
+func (r *RAG) IngestJob(ctx context.Context, id uint64) (*IngestJob, error) {
+	var job IngestJob
+	err := r.DB.WithContext(ctx).Omit("payload").Take(&job, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// claimIngestJob takes the oldest queued job, or a running one whose worker
+// stopped making progress, nil if there is none.
+func (r *RAG) claimIngestJob(ctx context.Context) (*IngestJob, error) {
+	db := r.DB.WithContext(ctx)
+	for {
+		var job IngestJob
+		err := db.Where("status = ? OR (status = ? AND updated_at < ?)", JobQueued, JobRunning, time.Now().Add(-jobLease)).
+			Order("id").Take(&job).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Attempts guards against another worker claiming the job meanwhile
+		now := time.Now()
+		claimed := IngestJob{Status: JobRunning, Attempts: job.Attempts + 1, Errors: []JobError{}, StartedAt: &now}
+		res := db.Model(&IngestJob{}).Where("id = ? AND attempts = ?", job.ID, job.Attempts).
+			Select("status", "attempts", "processed", "chunks", "embedded", "errors", "started_at").Updates(&claimed)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected == 1 {
+			job.Status, job.Attempts, job.StartedAt = claimed.Status, claimed.Attempts, claimed.StartedAt
+			job.Processed, job.Chunks, job.Embedded, job.Errors = 0, 0, 0, claimed.Errors
+			return &job, nil
+		}
+	}
+}
+
+// RunIngestJobs processes ingest jobs on workers goroutines, converting raw
+// files with ing, until ctx is done. Jobs interrupted then are queued again.
+func (r *RAG) RunIngestJobs(ctx context.Context, ing *Ingestor, workers int) {
+	runIngestWorkers(ctx, ing, workers, func() *RAG { return r })
+}
+
+// RunIngestJobs is RAG.RunIngestJobs with the server's ingestor, every job
+// runs with the RAG of the configuration loaded when it started.
+func (s *Server) RunIngestJobs(ctx context.Context, workers int) {
+	runIngestWorkers(ctx, s.opts.Ingestor, workers, s.rag)
+}
+
+func runIngestWorkers(ctx context.Context, ing *Ingestor, workers int, current func() *RAG) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ingestWorker(ctx, ing, current)
+		}()
+	}
+	wg.Wait()
+}
+
+func ingestWorker(ctx context.Context, ing *Ingestor, current func() *RAG) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		r := current()
+		job, err := r.claimIngestJob(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("Claim ingest job")
+		}
+		if job != nil {
+			r.runIngestJob(ctx, ing, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// owned scopes an update to job as long as no other worker claimed it since.
+func (job *IngestJob) owned(db *gorm.DB) *gorm.DB {
+	return db.Model(&IngestJob{}).Where("id = ? AND attempts = ?", job.ID, job.Attempts)
+}
+
+func (r *RAG) runIngestJob(ctx context.Context, ing *Ingestor, job *IngestJob) {
+	log.Info().Uint64("job", job.ID).Str("collection", job.Collection).Int("total", job.Total).Msg("Ingest job started")
+	err := r.processIngestJob(ctx, ing, job)
+	if errors.Is(err, errJobTakenOver) {
+		log.Warn().Uint64("job", job.ID).Int("attempts", job.Attempts).Msg("Ingest job was taken over")
+		return
+	}
+	db := r.DB.WithContext(context.WithoutCancel(ctx))
+	if ctx.Err() != nil {
+		err = job.owned(db).Update("status", JobQueued).Error
+		if err != nil {
+			log.Error().Err(err).Uint64("job", job.ID).Msg("Requeue interrupted ingest job")
+		}
+		return
+	}
+
+	if err != nil {
+		job.Errors = append(job.Errors, JobError{Error: err.Error()})
+	}
+	job.Status = JobSucceeded
+	if len(job.Errors) > 0 {
+		job.Status = JobFailed
+	}
+	now := time.Now()
+	job.Payload, job.FinishedAt = []byte{}, &now
+	res := job.owned(db).Select("status", "errors", "payload", "finished_at").Updates(job)
+	if res.Error != nil {
+		log.Error().Err(res.Error).Uint64("job", job.ID).Msg("Finish ingest job")
+		return
+	}
+	if res.RowsAffected == 0 {
+		log.Warn().Uint64("job", job.ID).Int("attempts", job.Attempts).Msg("Ingest job was taken over")
+		return
+	}
+	log.Info().Uint64("job", job.ID).Str("status", job.Status).Int("chunks", job.Chunks).
+		Int("embedded", job.Embedded).Int("errors", len(job.Errors)).Msg("Ingest job finished")
+	if job.Status == JobFailed {
+		r.Webhooks.jobFailed(job)
+	}
+}
+
+// processIngestJob upserts the documents of job one by one, recording those
+// failing in job.Errors, then embeds their new chunks. It stops with
+// errJobTakenOver as soon as a progress update finds another worker owns job.
+func (r *RAG) processIngestJob(ctx context.Context, ing *Ingestor, job *IngestJob) error {
+	var req IngestRequest
+	err := json.Unmarshal(job.Payload, &req)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decode ingest job")
+	}
+	collection, err := r.EnsureCollection(ctx, job.Collection, "")
+	if err != nil {
+		return err
+	}
+
+	db := r.DB.WithContext(ctx)
+	documents := make([]string, 0, job.Total)
+	upsert := func(name string, document *Document, err error) error {
+		if err == nil {
+			document.Collection = collection.Name
+			document.TextSearchConfig = collection.TextSearchConfig
+			if len(document.Tags) == 0 {
+				document.Tags = req.Tags
+			}
+			document.Fix()
+			// the server embeds chunks with its own model
+			for _, c := range document.Chunks {
+				c.Embedding, c.EmbeddingModel, c.EmbeddingDims = nil, "", 0
+			}
+			err = r.UpsertDocumentChunks(document)
+		}
+		if err != nil {
+			job.Errors = append(job.Errors, JobError{Document: name, Error: err.Error()})
+		} else {
+			documents = append(documents, document.Document)
+			job.Chunks += len(document.Chunks)
+		}
+		job.Processed++
+		res := job.owned(db).Select("processed", "chunks", "errors").Updates(job)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errJobTakenOver
+		}
+		return nil
+	}
+	for _, document := range req.Documents {
+		err = upsert(document.FileName, document, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range req.Files {
+		document, _, loadErr := ing.Load(ctx, f.Name, f.Data)
+		err = upsert(f.Name, document, loadErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(documents) == 0 || r.Embedder == nil {
+		return nil
+	}
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	err = r.ComputeEmbeddings(ctx, &ComputeOptions{
+		Collection:  collection.Name,
+		Documents:   documents,
+		OnlyEmpty:   true,
+		Concurrency: 3,
+		BatchSize:   32,
+		Progress: func(n int) {
+			mu.Lock()
+			job.Embedded += n
+			mu.Unlock()
+			res := job.owned(db).Update("embedded", gorm.Expr("embedded + ?", n))
+			if res.Error != nil {
+				log.Error().Err(res.Error).Uint64("job", job.ID).Msg("Update ingest job")
+			} else if res.RowsAffected == 0 {
+				cancel(errJobTakenOver)
+			}
+		},
+	})
+	if errors.Is(context.Cause(ctx), errJobTakenOver) {
+		return errJobTakenOver
+	}
+	return err
+}
+
+func (s *Server) documentsHandler(c echo.Context) error {
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxUploadSize)
+	var req IngestRequest
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return ingestBodyError(err)
+		}
+		for _, fh := range form.File["file"] {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(f)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+			req.Files = append(req.Files, IngestFile{Name: fh.Filename, Data: data})
+		}
+		if tags := c.FormValue("tags"); tags != "" {
+			req.Tags = strings.Split(tags, ",")
+		}
+	} else if err := c.Bind(&req); err != nil {
+		return ingestBodyError(err)
+	}
+	err := req.Validate()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// reject what no worker could convert now rather than in the job
+	for _, f := range req.Files {
+		contentType := SniffContentType(f.Name, f.Data)
+		if _, ok := s.opts.Ingestor.Converters[contentType]; !ok && contentType != ContentTypeChunks {
+			return echo.NewHTTPError(http.StatusUnsupportedMediaType,
+				errors.Wrapf(ErrUnsupportedContentType, "%s: %s", f.Name, contentType).Error())
+		}
+	}
+
+	ctx := c.Request().Context()
+	collection, err := s.ragOf(c).EnsureCollection(ctx, s.collection(c), "")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	job, err := s.ragOf(c).SubmitIngestJob(ctx, collection.Name, &req)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, "/v1/jobs/"+strconv.FormatUint(job.ID, 10))
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func ingestBodyError(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "request is too large")
+	}
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+func (s *Server) jobHandler(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid job ID")
+	}
+	job, err := s.ragOf(c).IngestJob(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "job not found")
+	}
+	return c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,191 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestJobs(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	s := NewServer(r, &ServerOptions{})
+
+	submit := func(contentType string, body []byte) (int, *IngestJob) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/collections/fruits/documents", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusAccepted {
+			return rec.Code, nil
+		}
+		var job IngestJob
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		require.Equal(t, "/v1/jobs/"+strconv.FormatUint(job.ID, 10), rec.Header().Get("Location"))
+		return rec.Code, &job
+	}
+
+	code, _ := submit("application/json", []byte(`{"documents":[]}`))
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, chunked := submit("application/json", []byte(`{"tags":["fruit"],"documents":[
+  {"file_name":"apples.md","chunks":[{"text":"apples are red"},{"text":"apples are sweet"}]}]}`))
+	require.Equal(t, http.StatusAccepted, code)
+	require.Equal(t, JobQueued, chunked.Status)
+	require.Equal(t, "fruits", chunked.Collection)
+	require.Equal(t, 1, chunked.Total)
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, content := range map[string]string{"bananas.txt": "bananas are yellow", "cherries.md": "cherries are dark"} {
+		part, err := w.CreateFormFile("file", name)
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	code, raw := submit(w.FormDataContentType(), body.Bytes())
+	require.Equal(t, http.StatusAccepted, code)
+	require.Equal(t, 2, raw.Total)
+
+	code, _ = submit("application/json", []byte(`{"files":[{"name":"image.png","data":"iVBORw0KGgo="}]}`))
+	require.Equal(t, http.StatusUnsupportedMediaType, code)
+
+	get := func(id string) (int, *IngestJob) {
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/jobs/"+id, nil))
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		var job IngestJob
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return rec.Code, &job
+	}
+	code, _ = get("1000")
+	require.Equal(t, http.StatusNotFound, code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.RunIngestJobs(ctx, NewIngestor(), 2)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, id := range []string{"1", "2"} {
+		var job *IngestJob
+		require.Eventually(t, func() bool {
+			code, job = get(id)
+			return code == http.StatusOK && job.FinishedAt != nil
+		}, 10*time.Second, 50*time.Millisecond)
+		require.Equal(t, JobSucceeded, job.Status, job.Errors)
+		require.Equal(t, job.Total, job.Processed)
+		require.Equal(t, job.Chunks, job.Embedded)
+		require.Equal(t, 1, job.Attempts)
+	}
+
+	chunks, err := r.Search(context.Background(), &SearchOptions{Query: "apples", Collection: "fruits", Limit: 5})
+	require.NoError(t, err)
+	require.NotEmpty(t, chunks)
+	require.Equal(t, []string{"fruit"}, chunks[0].Tags)
+	chunks, err = r.Search(context.Background(), &SearchOptions{Query: "bananas", Collection: "fruits", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+}
+
+func TestClaimIngestJob(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	ctx := context.Background()
+
+	submitted, err := r.SubmitIngestJob(ctx, DefaultCollection, &IngestRequest{
+		Files: []IngestFile{{Name: "broken.docx", Data: []byte("PK\x03\x04")}},
+	})
+	require.NoError(t, err)
+	job, err := r.claimIngestJob(ctx)
+	require.NoError(t, err)
+	require.Equal(t, submitted.ID, job.ID)
+	require.Equal(t, JobRunning, job.Status)
+
+	// a running job is only taken over once its lease expired
+	job, err = r.claimIngestJob(ctx)
+	require.NoError(t, err)
+	require.Nil(t, job)
+	require.NoError(t, db.Model(&IngestJob{}).Where("id = ?", submitted.ID).
+		UpdateColumn("updated_at", time.Now().Add(-2*jobLease)).Error)
+	job, err = r.claimIngestJob(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, job.Attempts)
+
+	r.runIngestJob(ctx, NewIngestor(), job)
+	job, err = r.IngestJob(ctx, submitted.ID)
+	require.NoError(t, err)
+	require.Equal(t, JobFailed, job.Status)
+	require.Equal(t, 1, job.Processed)
+	require.Len(t, job.Errors, 1)
+	require.Equal(t, "broken.docx", job.Errors[0].Document)
+}
+
+// takeoverEmbedder lets another worker claim the running job before embedding.
+type takeoverEmbedder struct {
+	t       *testing.T
+	r       *RAG
+	id      uint64
+	claimed *IngestJob
+}
+
+func (e *takeoverEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if e.claimed == nil {
+		require.NoError(e.t, e.r.DB.Model(&IngestJob{}).Where("id = ?", e.id).
+			UpdateColumn("updated_at", time.Now().Add(-2*jobLease)).Error)
+		job, err := e.r.claimIngestJob(ctx)
+		require.NoError(e.t, err)
+		e.claimed = job
+	}
+	return wordEmbedder{}.Embed(ctx, texts)
+}
+
+func TestIngestJobTakenOver(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	submitted, err := r.SubmitIngestJob(ctx, DefaultCollection, &IngestRequest{
+		Documents: []*Document{{FileName: "fruits.md", Chunks: []*DocumentChunk{{Text: "apples are red"}}}},
+	})
+	require.NoError(t, err)
+	job, err := r.claimIngestJob(ctx)
+	require.NoError(t, err)
+	embedder := &takeoverEmbedder{t: t, r: r, id: submitted.ID}
+	r.Embedder = embedder
+
+	// the first worker stops without touching the job of the second one
+	r.runIngestJob(ctx, NewIngestor(), job)
+	require.NotNil(t, embedder.claimed)
+	job, err = r.IngestJob(ctx, submitted.ID)
+	require.NoError(t, err)
+	require.Equal(t, JobRunning, job.Status)
+	require.Equal(t, 2, job.Attempts)
+	require.Zero(t, job.Processed)
+	require.Zero(t, job.Embedded)
+	require.Nil(t, job.FinishedAt)
+
+	r.runIngestJob(ctx, NewIngestor(), embedder.claimed)
+	job, err = r.IngestJob(ctx, submitted.ID)
+	require.NoError(t, err)
+	require.Equal(t, JobSucceeded, job.Status)
+	require.Equal(t, 1, job.Processed)
+	// the first worker stored its embeddings before it noticed
+	require.Zero(t, job.Embedded)
+}
@@ -0,0 +1,203 @@
+package rag
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlConverter extracts the main text of a page as Markdown, dropping
+// scripts, styles and boilerplate such as navigation, headers and footers.
+type htmlConverter struct{}
+
+func (htmlConverter) Name() string { return "html" }
+
+func (htmlConverter) markdown() bool { return true }
+
+var htmlBoilerplate = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true,
+	atom.Form: true, atom.Iframe: true, atom.Svg: true, atom.Button: true,
+}
+
+var htmlBlocks = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+	atom.Ul: true, atom.Ol: true, atom.Table: true, atom.Tr: true, atom.Blockquote: true,
+	atom.Pre: true, atom.Br: true, atom.Hr: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.Figure: true, atom.Figcaption: true,
+}
+
+var htmlHeadings = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+func (htmlConverter) Convert(_ context.Context, _ string, data []byte) (string, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to parse HTML")
+	}
+	root := doc
+	if main := findHTMLElement(doc, atom.Main); main != nil {
+		root = main
+	} else if body := findHTMLElement(doc, atom.Body); body != nil {
+		root = body
+	}
+
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			text := strings.Join(strings.Fields(n.Data), " ")
+			if text == "" {
+				return
+			}
+			// text split by inline elements is joined with a space, except before punctuation
+			s := b.String()
+			if s != "" && !strings.HasSuffix(s, "\n") && !strings.HasSuffix(s, " ") &&
+				!strings.ContainsAny(text[:1], ".,;:!?)") {
+				b.WriteByte(' ')
+			}
+			b.WriteString(text)
+			return
+		case html.ElementNode:
+			if htmlBoilerplate[n.DataAtom] {
+				return
+			}
+		}
+
+		level, heading := htmlHeadings[n.DataAtom]
+		block := heading || htmlBlocks[n.DataAtom]
+		if block {
+			b.WriteString("\n\n")
+		}
+		if heading {
+			b.WriteString(strings.Repeat("#", level) + " ")
+		}
+		if n.DataAtom == atom.Li {
+			b.WriteString("\n- ")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if block {
+			b.WriteString("\n\n")
+		}
+	}
+	walk(root)
+
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")), nil
+}
+
+func findHTMLElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findHTMLElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// docxConverter extracts the paragraphs of word/document.xml, turning
+// Heading styles into Markdown headings.
+type docxConverter struct{}
+
+func (docxConverter) Name() string { return "docx" }
+
+func (docxConverter) markdown() bool { return true }
+
+func (docxConverter) Convert(_ context.Context, _ string, data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to open DOCX")
+	}
+	f, err := zr.Open("word/document.xml")
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to open DOCX body")
+	}
+	defer func() { _ = f.Close() }()
+
+	var b strings.Builder
+	var paragraph strings.Builder
+	heading := 0
+	inText := false
+	decoder := xml.NewDecoder(f)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to parse DOCX body")
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				paragraph.Reset()
+				heading = 0
+			case "pStyle":
+				heading = docxHeadingLevel(t)
+			case "t":
+				inText = true
+			case "tab":
+				paragraph.WriteByte('\t')
+			case "br", "cr":
+				paragraph.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text := strings.TrimSpace(paragraph.String())
+				if text == "" {
+					continue
+				}
+				if heading > 0 {
+					b.WriteString(strings.Repeat("#", heading) + " ")
+				}
+				b.WriteString(text)
+				b.WriteString("\n\n")
+			}
+		case xml.CharData:
+			if inText {
+				paragraph.Write(t)
+			}
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// docxHeadingLevel returns n for the styles Heading1 to Heading6 and Title, 0 otherwise.
+func docxHeadingLevel(style xml.StartElement) int {
+	for _, attr := range style.Attr {
+		if attr.Name.Local != "val" {
+			continue
+		}
+		switch v := strings.ToLower(attr.Value); {
+		case v == "title":
+			return 1
+		case strings.HasPrefix(v, "heading") && len(v) == len("heading")+1 && v[7] >= '1' && v[7] <= '6':
+			return int(v[7] - '0')
+		}
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package rag
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTMLConverter(t *testing.T) {
+	page := `<!DOCTYPE html><html><head><title>Handbook</title><style>p{}</style></head><body>
+<nav><a href="/">Home</a></nav>
+<header>Company site</header>
+<main>
+  <h1>Leave</h1>
+  <p>Request   vacation
+     from your <b>manager</b>.</p>
+  <ul><li>Sick leave</li><li>Parental leave</li></ul>
+  <script>track()</script>
+</main>
+<footer>© 2024</footer>
+</body></html>`
+	text, err := htmlConverter{}.Convert(context.Background(), "a.html", []byte(page))
+	require.NoError(t, err)
+	require.Equal(t, "# Leave\n\nRequest vacation from your manager.\n\n- Sick leave\n- Parental leave", text)
+}
+
+func TestDOCXConverter(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("word/document.xml")
+	require.NoError(t, err)
+	_, err = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Expenses</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Receipts are </w:t></w:r><w:r><w:t>required.</w:t></w:r></w:p>
+<w:p></w:p>
+<w:p><w:r><w:t>Limit</w:t><w:tab/><w:t>100</w:t></w:r></w:p>
+</w:body></w:document>`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	ing := NewIngestor()
+	document, report, err := ing.Load(context.Background(), "policies/expenses.docx", buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, ContentTypeDOCX, report.ContentType)
+	require.Equal(t, "policies/expenses", document.Document)
+	require.Len(t, document.Chunks, 1)
+	require.Equal(t, "# Expenses\n\nReceipts are required.\n\nLimit\t100", document.Chunks[0].Text)
+	require.Equal(t, "Expenses", document.Chunks[0].Section)
+
+	_, _, err = ing.LoadAs(context.Background(), "broken.docx", ContentTypeDOCX, []byte("not a zip"))
+	require.ErrorContains(t, err, "Failed to open DOCX")
+}
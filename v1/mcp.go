@@ -0,0 +1,133 @@
+package rag
+
+import (
+	"context"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"gorm.io/gorm"
+)
+
+type mcpChunk struct {
+	ID          string  `json:"id"`
+	Document    string  `json:"document"`
+	RawDocument string  `json:"raw_document"`
+	Index       int     `json:"index"`
+	Score       float64 `json:"score,omitempty"`
+	Text        string  `json:"text"`
+}
+
+func newMCPChunk(c *DocumentChunk) mcpChunk {
+	return mcpChunk{
+		ID:          c.ID,
+		Document:    c.Document,
+		RawDocument: c.RawDocument,
+		Index:       c.Index,
+		Score:       c.Score,
+		Text:        c.Text,
+	}
+}
+
+func mcpJSONResult(v any) (*mcp.CallToolResult, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return mcp.NewToolResultText(string(b)), nil
+}
+
+// NewMCPServer exposes the index as Model Context Protocol tools.
+func NewMCPServer(r *RAG) *server.MCPServer {
+	s := server.NewMCPServer("SlimRAG", Version,
+		server.WithToolCapabilities(false),
+		server.WithRecovery(),
+	)
+
+	s.AddTool(mcp.NewTool("search",
+		mcp.WithDescription("Search the knowledge base and return the most relevant document chunks"),
+		mcp.WithString("query", mcp.Required(), mcp.Description("Search query")),
+		mcp.WithNumber("limit", mcp.Description("Maximum number of chunks to return, defaults to 10, at most 100")),
+		mcp.WithString("mode", mcp.Description("dense, keyword or hybrid, defaults to dense")),
+		mcp.WithString("collection", mcp.Description("Collection to search, defaults to the default collection")),
+		mcp.WithString("filter", mcp.Description(`Metadata filter, e.g. tag=finance AND path~"reports/2024/*"`)),
+	), func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		query, err := req.RequireString("query")
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		var filter *Filter
+		if s := req.GetString("filter", ""); s != "" {
+			filter, err = ParseFilter(s)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+		}
+		mode, err := ParseSearchMode(req.GetString("mode", ""))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		limit := req.GetInt("limit", 10)
+		if limit <= 0 {
+			limit = 10
+		}
+		limit = min(limit, maxSearchLimit)
+		chunks, err := r.Search(ctx, &SearchOptions{
+			Query:      query,
+			Collection: req.GetString("collection", ""),
+			Filter:     filter,
+			Limit:      limit,
+			Mode:       mode,
+			Rerank:     r.Reranker != nil,
+			Candidates: limit * 4,
+		})
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("search failed", err), nil
+		}
+		results := make([]mcpChunk, len(chunks))
+		for i := range chunks {
+			results[i] = newMCPChunk(&chunks[i])
+		}
+		return mcpJSONResult(results)
+	})
+
+	s.AddTool(mcp.NewTool("get_chunk",
+		mcp.WithDescription("Get a document chunk by ID"),
+		mcp.WithString("id", mcp.Required(), mcp.Description("Chunk ID")),
+	), func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		id, err := req.RequireString("id")
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		chunk, err := r.GetDocumentChunk(id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return mcp.NewToolResultErrorf("chunk %s not found", id), nil
+		}
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("get chunk failed", err), nil
+		}
+		return mcpJSONResult(newMCPChunk(chunk))
+	})
+
+	s.AddTool(mcp.NewTool("list_documents",
+		mcp.WithDescription("List indexed documents with their chunk counts"),
+		mcp.WithString("pattern", mcp.Description("Glob matched against document paths")),
+		mcp.WithString("collection", mcp.Description("Only list documents of this collection")),
+		mcp.WithNumber("limit", mcp.Description("Maximum number of documents, defaults to 100")),
+		mcp.WithNumber("offset", mcp.Description("Number of documents to skip")),
+	), func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		documents, err := r.ListDocuments(ctx, &ListDocumentsOptions{
+			Collection: req.GetString("collection", ""),
+			Pattern:    req.GetString("pattern", ""),
+			Limit:      req.GetInt("limit", 100),
+			Offset:     req.GetInt("offset", 0),
+		})
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("list documents failed", err), nil
+		}
+		return mcpJSONResult(documents)
+	})
+
+	return s
+}
@@ -0,0 +1,37 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMCPSearchLimit(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	d := &Document{FileName: "apples.md"}
+	for i := range maxSearchLimit + 20 {
+		d.Chunks = append(d.Chunks, &DocumentChunk{Text: fmt.Sprintf("apple %d", i)})
+	}
+	upsertDocument(t, r, d)
+
+	s := NewMCPServer(r)
+	search := func(limit int) int {
+		msg := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"search",`+
+			`"arguments":{"query":"apple","mode":"keyword","limit":%d}}}`, limit)
+		rsp, ok := s.HandleMessage(context.Background(), []byte(msg)).(mcp.JSONRPCResponse)
+		require.True(t, ok)
+		result := rsp.Result.(mcp.CallToolResult)
+		require.False(t, result.IsError)
+		var chunks []mcpChunk
+		require.NoError(t, json.Unmarshal([]byte(result.Content[0].(mcp.TextContent).Text), &chunks))
+		return len(chunks)
+	}
+	require.Equal(t, 5, search(5))
+	require.Equal(t, 10, search(0))
+	require.Equal(t, maxSearchLimit, search(100000))
+}
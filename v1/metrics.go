@@ -0,0 +1,227 @@
+package rag
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+const (
+	statusOK    = "ok"
+	statusError = "error"
+)
+
+// Metrics instruments the server and the retrieval pipeline. A nil *Metrics
+// records nothing, so library users and CLI commands don't pay for it.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests    *prometheus.CounterVec
+	httpLatency     *prometheus.HistogramVec
+	searchLatency   *prometheus.HistogramVec
+	embedLatency    *prometheus.HistogramVec
+	rerankLatency   *prometheus.HistogramVec
+	answerLatency   *prometheus.HistogramVec
+	expandLatency   *prometheus.HistogramVec
+	compressLatency *prometheus.HistogramVec
+	chunksScanned   *prometheus.CounterVec
+	cacheRequests   *prometheus.CounterVec
+	databaseErrors  *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rag_http_requests_total",
+			Help: "HTTP requests by route and status code.",
+		}, []string{"method", "route", "code"}),
+		httpLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_http_request_duration_seconds",
+			Help:    "HTTP request latency by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		searchLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_search_duration_seconds",
+			Help:    "Search latency including embedding, retrieval and reranking.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"mode", "rerank", "status"}),
+		embedLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_embedding_duration_seconds",
+			Help:    "Latency of embedding API calls.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"status"}),
+		rerankLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_rerank_duration_seconds",
+			Help:    "Latency of reranker API calls.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"status"}),
+		answerLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_answer_duration_seconds",
+			Help:    "Latency of answer generation by the assistant.",
+			Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+		}, []string{"status"}),
+		expandLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_query_expansion_duration_seconds",
+			Help:    "Latency of writing HyDE answers or query paraphrases with the assistant.",
+			Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+		}, []string{"strategy", "status"}),
+		compressLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rag_compression_duration_seconds",
+			Help:    "Latency of extracting the relevant sentences of the results with the assistant.",
+			Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+		}, []string{"status"}),
+		chunksScanned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rag_chunks_scanned_total",
+			Help: "Candidate chunks retrieved from the database by dense and keyword queries.",
+		}, []string{"source"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rag_query_cache_requests_total",
+			Help: "Query cache lookups of embeddings and result sets by outcome.",
+		}, []string{"kind", "result"}),
+		databaseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rag_database_errors_total",
+			Help: "Failed database statements by operation.",
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpLatency, m.searchLatency, m.embedLatency,
+		m.rerankLatency, m.answerLatency, m.expandLatency, m.compressLatency, m.chunksScanned, m.cacheRequests, m.databaseErrors,
+	)
+	return m
+}
+
+func metricStatus(err error) string {
+	if err != nil {
+		return statusError
+	}
+	return statusOK
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *Metrics) observeSearch(opts *SearchOptions, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	mode := opts.Mode
+	if mode == "" {
+		mode = SearchModeDense
+	}
+	m.searchLatency.WithLabelValues(string(mode), strconv.FormatBool(opts.Rerank), metricStatus(err)).
+		Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeEmbedding(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.embedLatency.WithLabelValues(metricStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeRerank(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.rerankLatency.WithLabelValues(metricStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeAnswer(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.answerLatency.WithLabelValues(metricStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeCompression(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.compressLatency.WithLabelValues(metricStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) observeExpansion(strategy string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.expandLatency.WithLabelValues(strategy, metricStatus(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) addChunksScanned(source SearchMode, n int) {
+	if m == nil {
+		return
+	}
+	m.chunksScanned.WithLabelValues(string(source)).Add(float64(n))
+}
+
+func (m *Metrics) observeCache(kind string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheRequests.WithLabelValues(kind, result).Inc()
+}
+
+// InstrumentDB counts failed statements of db, not found errors excluded.
+func (m *Metrics) InstrumentDB(db *gorm.DB) error {
+	count := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				m.databaseErrors.WithLabelValues(operation).Inc()
+			}
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().After("gorm:create").Register("rag:metrics", count("create")),
+		cb.Query().After("gorm:query").Register("rag:metrics", count("query")),
+		cb.Update().After("gorm:update").Register("rag:metrics", count("update")),
+		cb.Delete().After("gorm:delete").Register("rag:metrics", count("delete")),
+		cb.Row().After("gorm:row").Register("rag:metrics", count("row")),
+		cb.Raw().After("gorm:raw").Register("rag:metrics", count("raw")),
+	} {
+		if err != nil {
+			return errors.Wrap(err, "Failed to instrument database")
+		}
+	}
+	return nil
+}
+
+// middleware records request counts and latency by route pattern, so that
+// chunk IDs and collection names don't blow up the label cardinality.
+func (m *Metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		code := c.Response().Status
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			code = httpErr.Code
+		} else if err != nil {
+			code = http.StatusInternalServerError
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+		m.httpRequests.WithLabelValues(method, route, strconv.Itoa(code)).Inc()
+		m.httpLatency.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
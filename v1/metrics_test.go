@@ -0,0 +1,49 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	db := newTestDB(t)
+	m := NewMetrics()
+	require.NoError(t, m.InstrumentDB(db))
+	r := &RAG{DB: db, Embedder: wordEmbedder{}, Metrics: m}
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+	}}
+	upsertDocument(t, r, d)
+	require.NoError(t, r.ComputeEmbeddings(context.Background(), &ComputeOptions{OnlyEmpty: true, Concurrency: 1, BatchSize: 8}))
+
+	s := NewServer(r, &ServerOptions{Metrics: m})
+	for _, body := range []string{`{"query":"apples","mode":"hybrid"}`, `{"query":"apples","mode":"fuzzy"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/search?rerank=false", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		s.e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	require.Error(t, db.WithContext(context.Background()).Exec("SELECT * FROM missing_table").Error)
+
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, line := range []string{
+		`rag_http_requests_total{code="200",method="POST",route="/v1/search"} 1`,
+		`rag_http_requests_total{code="400",method="POST",route="/v1/search"} 1`,
+		`rag_search_duration_seconds_count{mode="hybrid",rerank="false",status="ok"} 1`,
+		`rag_embedding_duration_seconds_count{status="ok"} 2`,
+		`rag_chunks_scanned_total{source="dense"} 2`,
+		`rag_chunks_scanned_total{source="keyword"} 1`,
+		`rag_database_errors_total{operation="raw"} 1`,
+	} {
+		require.Contains(t, body, line)
+	}
+}
@@ -0,0 +1,495 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var ErrSchemaOutdated = errors.New("database schema is outdated")
+
+// Migration is a versioned schema change compiled into the binary. Versions
+// are applied in order, each in its own transaction together with its row in
+// schema_version, so a failed migration leaves the previous version intact.
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// migrations must only be appended to: released versions are never edited,
+// a later version changes what an earlier one did. Like the baseline, they
+// work on frozen copies of the models, named after their version, or SQL.
+var migrations = []Migration{
+	{Version: 1, Name: "baseline", up: migrateBaseline, down: dropBaseline},
+	{Version: 2, Name: "ingest_jobs", up: migrateIngestJobs, down: dropIngestJobs},
+	{Version: 3, Name: "chunk_duplicates", up: migrateChunkDuplicates, down: dropChunkDuplicates},
+	{Version: 4, Name: "collection_distance", up: migrateCollectionDistance, down: dropCollectionDistance},
+	{Version: 5, Name: "quantized_embeddings", up: migrateQuantizedEmbeddings, down: dropQuantizedEmbeddings},
+	{Version: 6, Name: "document_time", up: migrateDocumentTime, down: dropDocumentTime},
+	{Version: 7, Name: "knowledge_graph", up: migrateKnowledgeGraph, down: dropKnowledgeGraph},
+	{Version: 8, Name: "chunk_level", up: migrateChunkLevel, down: dropChunkLevel},
+	{Version: 9, Name: "chunk_positions", up: migrateChunkPositions, down: dropChunkPositions},
+	{Version: 10, Name: "quantized_bits", up: migrateQuantizedBits, down: dropQuantizedBits},
+	{Version: 11, Name: "row_changes", up: migrateRowChanges, down: dropRowChanges},
+}
+
+// LatestSchemaVersion is the version this binary expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion records an applied migration.
+type SchemaVersion struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"not null" json:"name"`
+	AppliedAt time.Time `gorm:"not null" json:"applied_at"`
+}
+
+func (SchemaVersion) TableName() string { return "schema_version" }
+
+// migrateBaseline creates the schema as it was when versioned migrations
+// were introduced, from the frozen models in baseline.go. It is idempotent,
+// so databases created before adopt it.
+func migrateBaseline(tx *gorm.DB) error {
+	return backendOf(tx).migrate(tx)
+}
+
+func dropBaseline(tx *gorm.DB) error {
+	return backendOf(tx).dropSchema(tx)
+}
+
+type ingestJobV2 struct {
+	ID         uint64 `gorm:"primaryKey"`
+	Collection string `gorm:"not null"`
+	Status     string `gorm:"not null;index"`
+	Attempts   int    `gorm:"not null;default:0"`
+	Total      int    `gorm:"not null;default:0"`
+	Processed  int    `gorm:"not null;default:0"`
+	Chunks     int    `gorm:"not null;default:0"`
+	Embedded   int    `gorm:"not null;default:0"`
+	Errors     string `gorm:"type:jsonb;default:'[]'"`
+	Payload    []byte `gorm:"not null"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+func (ingestJobV2) TableName() string { return "ingest_jobs" }
+
+func migrateIngestJobs(tx *gorm.DB) error {
+	return tx.AutoMigrate(&ingestJobV2{})
+}
+
+func dropIngestJobs(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&ingestJobV2{})
+}
+
+type chunkDuplicatesV3 struct {
+	DuplicateOf string `gorm:"not null;default:'';index"`
+}
+
+func (chunkDuplicatesV3) TableName() string { return "document_chunks" }
+
+// migrateChunkDuplicates adds duplicate_of, unless the database already had
+// it from before migrations existed.
+func migrateChunkDuplicates(tx *gorm.DB) error {
+	m := tx.Migrator()
+	if !m.HasColumn(&chunkDuplicatesV3{}, "DuplicateOf") {
+		err := m.AddColumn(&chunkDuplicatesV3{}, "DuplicateOf")
+		if err != nil {
+			return err
+		}
+	}
+	if !m.HasIndex(&chunkDuplicatesV3{}, "DuplicateOf") {
+		return m.CreateIndex(&chunkDuplicatesV3{}, "DuplicateOf")
+	}
+	return nil
+}
+
+func dropChunkDuplicates(tx *gorm.DB) error {
+	m := tx.Migrator()
+	if m.HasIndex(&chunkDuplicatesV3{}, "DuplicateOf") {
+		err := m.DropIndex(&chunkDuplicatesV3{}, "DuplicateOf")
+		if err != nil {
+			return err
+		}
+	}
+	return m.DropColumn(&chunkDuplicatesV3{}, "DuplicateOf")
+}
+
+type collectionDistanceV4 struct {
+	Distance string `gorm:"not null;default:'l2'"`
+}
+
+func (collectionDistanceV4) TableName() string { return "collections" }
+
+// migrateCollectionDistance adds the distance of collections, l2 for the
+// existing ones as searches ranked by before.
+func migrateCollectionDistance(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn(&collectionDistanceV4{}, "Distance") {
+		return nil
+	}
+	return tx.Migrator().AddColumn(&collectionDistanceV4{}, "Distance")
+}
+
+func dropCollectionDistance(tx *gorm.DB) error {
+	return tx.Migrator().DropColumn(&collectionDistanceV4{}, "Distance")
+}
+
+// quantizedIndexSQL indexes the chunks whose original embedding was dropped,
+// which dense search scans apart from the vector index.
+const quantizedIndexSQL = "CREATE INDEX IF NOT EXISTS idx_document_chunks_quantized ON document_chunks (collection) " +
+	"WHERE embedding IS NULL AND embedding_int8 IS NOT NULL"
+
+type chunkInt8V5 struct {
+	EmbeddingInt8 []byte `gorm:"column:embedding_int8"`
+}
+
+func (chunkInt8V5) TableName() string { return "document_chunks" }
+
+func migrateQuantizedEmbeddings(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn(&chunkInt8V5{}, "EmbeddingInt8") {
+		err := tx.Migrator().AddColumn(&chunkInt8V5{}, "EmbeddingInt8")
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Exec(quantizedIndexSQL).Error
+}
+
+func dropQuantizedEmbeddings(tx *gorm.DB) error {
+	err := tx.Exec("DROP INDEX IF EXISTS idx_document_chunks_quantized").Error
+	if err != nil {
+		return err
+	}
+	return tx.Migrator().DropColumn(&chunkInt8V5{}, "EmbeddingInt8")
+}
+
+type chunkDocumentTimeV6 struct {
+	DocumentTime *time.Time
+}
+
+func (chunkDocumentTimeV6) TableName() string { return "document_chunks" }
+
+func migrateDocumentTime(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn(&chunkDocumentTimeV6{}, "DocumentTime") {
+		return nil
+	}
+	return tx.Migrator().AddColumn(&chunkDocumentTimeV6{}, "DocumentTime")
+}
+
+func dropDocumentTime(tx *gorm.DB) error {
+	return tx.Migrator().DropColumn(&chunkDocumentTimeV6{}, "DocumentTime")
+}
+
+type entityV7 struct {
+	ID         string `gorm:"primaryKey"`
+	Collection string `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Type       string `gorm:"not null;default:''"`
+	CreatedAt  time.Time
+}
+
+func (entityV7) TableName() string { return "entities" }
+
+type entityMentionV7 struct {
+	EntityID string `gorm:"primaryKey"`
+	ChunkID  string `gorm:"primaryKey;index"`
+}
+
+func (entityMentionV7) TableName() string { return "entity_mentions" }
+
+type entityRelationV7 struct {
+	SourceID string `gorm:"primaryKey"`
+	TargetID string `gorm:"primaryKey;index"`
+	Relation string `gorm:"primaryKey"`
+	ChunkID  string `gorm:"primaryKey;index"`
+}
+
+func (entityRelationV7) TableName() string { return "entity_relations" }
+
+type graphChunkV7 struct {
+	ChunkID     string    `gorm:"primaryKey"`
+	Entities    int       `gorm:"not null;default:0"`
+	ExtractedAt time.Time `gorm:"not null"`
+}
+
+func (graphChunkV7) TableName() string { return "graph_chunks" }
+
+func migrateKnowledgeGraph(tx *gorm.DB) error {
+	return tx.AutoMigrate(&entityV7{}, &entityMentionV7{}, &entityRelationV7{}, &graphChunkV7{})
+}
+
+func dropKnowledgeGraph(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&entityV7{}, &entityMentionV7{}, &entityRelationV7{}, &graphChunkV7{})
+}
+
+type chunkLevelV8 struct {
+	Level int `gorm:"not null;default:0"`
+}
+
+func (chunkLevelV8) TableName() string { return "document_chunks" }
+
+func migrateChunkLevel(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn(&chunkLevelV8{}, "Level") {
+		return nil
+	}
+	return tx.Migrator().AddColumn(&chunkLevelV8{}, "Level")
+}
+
+func dropChunkLevel(tx *gorm.DB) error {
+	return tx.Migrator().DropColumn(&chunkLevelV8{}, "Level")
+}
+
+type chunkPositionsV9 struct {
+	PageEnd     int    `gorm:"not null;default:0"`
+	Headings    string `gorm:"type:jsonb;default:'[]'"`
+	StartOffset int    `gorm:"not null;default:0"`
+	EndOffset   int    `gorm:"not null;default:0"`
+}
+
+func (chunkPositionsV9) TableName() string { return "document_chunks" }
+
+var chunkPositionFields = []string{"PageEnd", "Headings", "StartOffset", "EndOffset"}
+
+func migrateChunkPositions(tx *gorm.DB) error {
+	for _, field := range chunkPositionFields {
+		if tx.Migrator().HasColumn(&chunkPositionsV9{}, field) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(&chunkPositionsV9{}, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropChunkPositions(tx *gorm.DB) error {
+	for _, field := range chunkPositionFields {
+		if err := tx.Migrator().DropColumn(&chunkPositionsV9{}, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateQuantizedBits indexes the binary quantization of int8 embeddings
+// on Postgres, so dense search finds the chunks whose original embedding was
+// dropped without scanning them. SQLite scans all embeddings anyway.
+func migrateQuantizedBits(tx *gorm.DB) error {
+	if tx.Dialector.Name() == sqliteDialect {
+		return nil
+	}
+	for _, stmt := range []string{
+		int8BitsFunctionSQL,
+		fmt.Sprintf("ALTER TABLE document_chunks ADD COLUMN IF NOT EXISTS embedding_bits bit(%d) "+
+			"GENERATED ALWAYS AS (rag_int8_bits(embedding_int8)) STORED", maxQuantizedDims),
+		"CREATE INDEX IF NOT EXISTS idx_document_chunks_bits ON document_chunks USING hnsw (embedding_bits bit_hamming_ops) " +
+			"WHERE embedding IS NULL AND embedding_int8 IS NOT NULL",
+	} {
+		err := tx.Exec(stmt).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropQuantizedBits(tx *gorm.DB) error {
+	if tx.Dialector.Name() == sqliteDialect {
+		return nil
+	}
+	for _, stmt := range []string{
+		"DROP INDEX IF EXISTS idx_document_chunks_bits",
+		"ALTER TABLE document_chunks DROP COLUMN IF EXISTS embedding_bits",
+		"DROP FUNCTION IF EXISTS rag_int8_bits(bytea)",
+	} {
+		err := tx.Exec(stmt).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the applied version, 0 for an empty database.
+func schemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// checkSchemaVersion refuses databases migrated to an older version, which
+// are missing tables or columns this binary uses.
+func checkSchemaVersion(db *gorm.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read schema version")
+	}
+	latest := LatestSchemaVersion()
+	if version < latest {
+		return errors.Wrapf(ErrSchemaOutdated, "the database is at version %d, this binary needs %d; run migrate up",
+			version, latest)
+	}
+	if version > latest {
+		log.Warn().Int("version", version).Int("latest", latest).
+			Msg("Database schema is newer than this binary, upgrade it")
+	}
+	return nil
+}
+
+// migrateStep applies or reverts one migration while holding the schema lock,
+// skipping it if another process got there first.
+func migrateStep(ctx context.Context, db *gorm.DB, m Migration, up bool) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		applied, err := tryMigrateStep(ctx, db, m, up)
+		if err == nil || !isSQLiteBusy(err) || attempt == 10 {
+			return applied, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 50 * time.Millisecond):
+		}
+	}
+}
+
+func tryMigrateStep(ctx context.Context, db *gorm.DB, m Migration, up bool) (bool, error) {
+	applied := false
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := backendOf(tx).lockSchema(tx)
+		if err != nil {
+			return errors.Wrap(err, "Failed to lock schema")
+		}
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if up {
+			if version >= m.Version {
+				return nil
+			}
+			if version != m.Version-1 {
+				return errors.Newf("schema version %d can't be migrated to %d", version, m.Version)
+			}
+			err = m.up(tx)
+			if err == nil {
+				err = tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			}
+		} else {
+			if version != m.Version {
+				return nil
+			}
+			err = m.down(tx)
+			if err == nil {
+				err = tx.Where("version = ?", m.Version).Delete(&SchemaVersion{}).Error
+			}
+		}
+		if err != nil {
+			return err
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		direction := "apply"
+		if !up {
+			direction = "revert"
+		}
+		return false, errors.Wrapf(err, "Failed to %s migration %d %s", direction, m.Version, m.Name)
+	}
+	return applied, nil
+}
+
+// MigrateUp applies the pending migrations and returns those it applied.
+// Processes racing to migrate wait for each other and apply each version once.
+func (r *RAG) MigrateUp(ctx context.Context) ([]Migration, error) {
+	applied := make([]Migration, 0)
+	for _, m := range migrations {
+		ok, err := migrateStep(ctx, r.DB, m, true)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			log.Info().Int("version", m.Version).Str("name", m.Name).Msg("Applied migration")
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the migrations above version and returns those it reverted.
+// Reverting the baseline, version 0, drops all tables.
+func (r *RAG) MigrateDown(ctx context.Context, version int) ([]Migration, error) {
+	if version < 0 {
+		return nil, errors.Newf("invalid schema version %d", version)
+	}
+	reverted := make([]Migration, 0)
+	for i := len(migrations) - 1; i >= 0 && migrations[i].Version > version; i-- {
+		m := migrations[i]
+		ok, err := migrateStep(ctx, r.DB, m, false)
+		if err != nil {
+			return reverted, err
+		}
+		if ok {
+			log.Info().Int("version", m.Version).Str("name", m.Name).Msg("Reverted migration")
+			reverted = append(reverted, m)
+		}
+	}
+	return reverted, nil
+}
+
+// MigrationStatus is a migration known to the binary or recorded in the database.
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is nil for pending migrations.
+	AppliedAt *time.Time `json:"applied_at"`
+	// Unknown marks versions applied by a newer binary.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// MigrationStatus lists all migrations in version order with when they were applied.
+func (r *RAG) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	db := r.DB.WithContext(ctx)
+	var versions []SchemaVersion
+	if db.Migrator().HasTable(&SchemaVersion{}) {
+		err := db.Order("version").Find(&versions).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	applied := make(map[int]SchemaVersion, len(versions))
+	for _, v := range versions {
+		applied[v.Version] = v
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Migration: m}
+		if v, ok := applied[m.Version]; ok {
+			s.AppliedAt = &v.AppliedAt
+			delete(applied, m.Version)
+		}
+		statuses = append(statuses, s)
+	}
+	for _, v := range versions {
+		if _, ok := applied[v.Version]; ok {
+			statuses = append(statuses, MigrationStatus{
+				Migration: Migration{Version: v.Version, Name: v.Name},
+				AppliedAt: &v.AppliedAt,
+				Unknown:   true,
+			})
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,127 @@
+package rag
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestMigrate(t *testing.T) {
+	path := sqliteScheme + filepath.Join(t.TempDir(), "index.db")
+	db, err := OpenDB(path)
+	require.NoError(t, err)
+	r := &RAG{DB: db}
+	ctx := context.Background()
+
+	statuses, err := r.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, len(migrations))
+	for _, s := range statuses {
+		require.NotNil(t, s.AppliedAt)
+	}
+	require.NoError(t, checkSchemaVersion(db))
+
+	added := false
+	defer func(saved []Migration) { migrations = saved }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)], Migration{
+		Version: LatestSchemaVersion() + 1,
+		Name:    "add notes",
+		up: func(tx *gorm.DB) error {
+			added = true
+			return tx.Exec("CREATE TABLE notes (id integer PRIMARY KEY)").Error
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP TABLE notes").Error
+		},
+	})
+	require.ErrorIs(t, checkSchemaVersion(db), ErrSchemaOutdated)
+
+	// instances racing to migrate apply every version once
+	var wg sync.WaitGroup
+	applied := make([][]Migration, 4)
+	for i := range applied {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := ConnectDB(path)
+			require.NoError(t, err)
+			applied[i], err = (&RAG{DB: db}).MigrateUp(ctx)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	total := 0
+	for _, a := range applied {
+		total += len(a)
+	}
+	require.Equal(t, 1, total)
+	require.True(t, added)
+	require.True(t, db.Migrator().HasTable("notes"))
+
+	reverted, err := r.MigrateDown(ctx, LatestSchemaVersion()-1)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1)
+	require.False(t, db.Migrator().HasTable("notes"))
+	statuses, err = r.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.Nil(t, statuses[len(statuses)-1].AppliedAt)
+
+	// reverting the baseline drops everything
+	_, err = r.MigrateDown(ctx, 0)
+	require.NoError(t, err)
+	require.False(t, db.Migrator().HasTable(&DocumentChunk{}))
+	version, err := schemaVersion(db)
+	require.NoError(t, err)
+	require.Zero(t, version)
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	forEachBackend(t, testMigrateBaseline)
+}
+
+func testMigrateBaseline(t *testing.T, db *gorm.DB) {
+	r := &RAG{DB: db}
+	ctx := context.Background()
+	_, err := r.MigrateDown(ctx, 0)
+	require.NoError(t, err)
+
+	// the baseline lacks what later versions add
+	applied, err := migrateStep(ctx, db, migrations[0], true)
+	require.NoError(t, err)
+	require.True(t, applied)
+	m := db.Migrator()
+	require.True(t, m.HasTable(&DocumentChunk{}))
+	for _, table := range []any{&IngestJob{}, &Entity{}, &EntityMention{}, &EntityRelation{}, &GraphChunk{}} {
+		require.False(t, m.HasTable(table))
+	}
+	for _, column := range []string{"duplicate_of", "embedding_int8", "document_time", "level", "page_end"} {
+		require.False(t, m.HasColumn(&DocumentChunk{}, column), column)
+	}
+	require.False(t, m.HasColumn(&Collection{}, "distance"))
+
+	// the migrations after it add every column of the live models
+	_, err = r.MigrateUp(ctx)
+	require.NoError(t, err)
+	for _, model := range []any{
+		&Collection{}, &DocumentChunk{}, &SourceFile{}, &IndexTuneSample{}, &RetentionPolicy{}, &ChunkVersion{},
+		&ConfigVersion{}, &Canary{}, &CanaryMetric{}, &APIKey{}, &QueryCacheEntry{}, &EmbeddingModel{},
+		&ChunkEmbedding{}, &IngestJob{}, &Entity{}, &EntityMention{}, &EntityRelation{}, &GraphChunk{},
+	} {
+		stmt := &gorm.Statement{DB: db}
+		require.NoError(t, stmt.Parse(model))
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" {
+				require.True(t, m.HasColumn(model, field.DBName), "%s.%s", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+
+	_, err = r.MigrateDown(ctx, 0)
+	require.NoError(t, err)
+	require.False(t, m.HasTable(&DocumentChunk{}))
+	require.False(t, m.HasTable(&IngestJob{}))
+}
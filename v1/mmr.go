@@ -0,0 +1,105 @@
+package rag
+
+import (
+	"context"
+	"math"
+
+	"github.com/cockroachdb/errors"
+	"github.com/pgvector/pgvector-go"
+)
+
+// DefaultMMRLambda weighs relevance and diversity equally.
+const DefaultMMRLambda = 0.5
+
+func ValidateMMRLambda(lambda float64) error {
+	if lambda < 0 || lambda > 1 || math.IsNaN(lambda) {
+		return errors.Newf("lambda must be between 0 and 1, got %g", lambda)
+	}
+	return nil
+}
+
+// candidateEmbeddings loads the embeddings of chunks in the space they were
+// retrieved from, see embeddingSpace. Chunks without one are left out.
+func (r *RAG) candidateEmbeddings(ctx context.Context, chunks []DocumentChunk, space string) (map[string][]float32, error) {
+	ids := make([]string, len(chunks))
+	for i, c := range chunks {
+		ids[i] = c.ID
+	}
+	var rows []struct {
+		ID        string
+		Embedding pgvector.HalfVector
+	}
+	db := r.DB.WithContext(ctx)
+	var err error
+	if space == "" {
+		err = db.Model(&DocumentChunk{}).Select("id", "embedding").
+			Where("id IN ? AND embedding IS NOT NULL", ids).Find(&rows).Error
+	} else {
+		err = db.Model(&ChunkEmbedding{}).Select("chunk_id AS id", "embedding").
+			Where("model = ? AND chunk_id IN ?", space, ids).Find(&rows).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make(map[string][]float32, len(rows))
+	for _, row := range rows {
+		embeddings[row.ID] = row.Embedding.Slice()
+	}
+	return embeddings, nil
+}
+
+// diversify reorders chunks by maximal marginal relevance to the query.
+func (r *RAG) diversify(ctx context.Context, query string, chunks []DocumentChunk, lambda float64) ([]DocumentChunk, error) {
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	space, err := r.embeddingSpace(ctx, active)
+	if err != nil {
+		return nil, err
+	}
+	queryEmbedding, err := r.embedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := r.candidateEmbeddings(ctx, chunks, space)
+	if err != nil {
+		return nil, err
+	}
+	return selectMMR(queryEmbedding.Slice(), chunks, embeddings, lambda), nil
+}
+
+// selectMMR orders chunks greedily, every pick maximizing lambda times its
+// similarity to the query minus 1-lambda times its highest similarity to the
+// chunks picked before. Chunks without an embedding count as unrelated to all.
+func selectMMR(query []float32, chunks []DocumentChunk, embeddings map[string][]float32, lambda float64) []DocumentChunk {
+	relevance := make([]float64, len(chunks))
+	for i, c := range chunks {
+		relevance[i] = cosineSimilarity(query, embeddings[c.ID])
+	}
+	// redundancy[i] is the highest similarity of chunk i to a picked chunk
+	redundancy := make([]float64, len(chunks))
+	picked := make([]bool, len(chunks))
+	selected := make([]DocumentChunk, 0, len(chunks))
+	for range chunks {
+		best, bestScore := -1, math.Inf(-1)
+		for i := range chunks {
+			if picked[i] {
+				continue
+			}
+			score := lambda*relevance[i] - (1-lambda)*redundancy[i]
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked[best] = true
+		selected = append(selected, chunks[best])
+		e := embeddings[chunks[best].ID]
+		for i := range chunks {
+			if !picked[i] {
+				redundancy[i] = max(redundancy[i], cosineSimilarity(e, embeddings[chunks[i].ID]))
+			}
+		}
+	}
+	return selected
+}
@@ -0,0 +1,57 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectMMR(t *testing.T) {
+	chunks := []DocumentChunk{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "missing"}}
+	embeddings := map[string][]float32{
+		"a": {1, 0.1, 0},
+		"b": {1, 0.12, 0}, // a near duplicate of a
+		"c": {0.6, 0, 0.8},
+	}
+	query := []float32{1, 0, 0}
+	ids := func(chunks []DocumentChunk) []string {
+		ids := make([]string, len(chunks))
+		for i, c := range chunks {
+			ids[i] = c.ID
+		}
+		return ids
+	}
+
+	require.Equal(t, []string{"a", "b", "c", "missing"}, ids(selectMMR(query, chunks, embeddings, 1)))
+	require.Equal(t, []string{"a", "c", "missing", "b"}, ids(selectMMR(query, chunks, embeddings, DefaultMMRLambda)))
+}
+
+func TestSearchMMR(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "yellow bananas are sweet"},
+		{Text: "yellow bananas are sweet fruit"},
+		{Text: "yellow lemons are sour"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, BatchSize: 3})
+
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 2, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "yellow bananas are sweet", chunks[0].Text)
+	require.Equal(t, "yellow bananas are sweet fruit", chunks[1].Text)
+
+	chunks, err = r.Search(ctx, &SearchOptions{
+		Query: "yellow bananas", Limit: 2, Mode: SearchModeDense, Candidates: 3, MMR: true, Lambda: 0.3,
+	})
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, "yellow bananas are sweet", chunks[0].Text)
+	require.Equal(t, "yellow lemons are sour", chunks[1].Text)
+
+	require.Error(t, ValidateMMRLambda(1.5))
+}
@@ -3,6 +3,7 @@ package rag
 import (
 	"encoding/hex"
 	"strings"
+	"time"
 
 	"github.com/cespare/xxhash"
 	"github.com/negrel/assert"
@@ -11,15 +12,62 @@ import (
 
 const dims = 2560
 
+const defaultTextSearchConfig = "simple"
+
 var zeroVector = pgvector.NewHalfVector(make([]float32, dims))
 
 type DocumentChunk struct {
-	ID          string               `gorm:"primaryKey"`
-	Document    string               `gorm:"not null"`
-	RawDocument string               `gorm:"not null"`
-	Text        string               `gorm:"not null" json:"text,omitzero"`
-	Embedding   *pgvector.HalfVector `gorm:"type:halfvec(2560)" json:"embedding,omitzero"`
-	Index       int                  `gorm:"-:all" json:"index"`
+	ID               string               `gorm:"primaryKey"`
+	Collection       string               `gorm:"not null;default:'default';index" json:"collection,omitempty"`
+	Document         string               `gorm:"not null;index"`
+	RawDocument      string               `gorm:"not null"`
+	Text             string               `gorm:"not null" json:"text,omitzero"`
+	Embedding        *pgvector.HalfVector `gorm:"type:halfvec(2560)" json:"embedding,omitzero"`
+	Index            int                  `gorm:"column:chunk_index;not null;default:0" json:"index"`
+	Tags             []string             `gorm:"type:jsonb;serializer:json;default:'[]'" json:"tags,omitempty"`
+	TextSearchConfig string               `gorm:"type:regconfig;not null;default:'simple'" json:"text_search_config,omitempty"`
+	SourcePath       string               `gorm:"index" json:"source_path,omitempty"`
+	Page             int                  `gorm:"not null;default:0" json:"page,omitempty"`
+	Section          string               `gorm:"not null;default:''" json:"section,omitempty"`
+	// PageEnd is the page a chunk ends on, Page the one it starts on, both
+	// 0 when unknown. Pages are counted from the form feeds pdftotext writes.
+	PageEnd int `gorm:"not null;default:0" json:"page_end,omitempty"`
+	// Headings are the Markdown headings a chunk falls under, outermost
+	// first, the last one being its Section.
+	Headings []string `gorm:"type:jsonb;serializer:json;default:'[]'" json:"headings,omitempty"`
+	// StartOffset and EndOffset are the rune offsets of a chunk in the text
+	// extracted from its document, with line endings normalized to \n, both 0
+	// when unknown.
+	StartOffset int       `gorm:"not null;default:0" json:"start_offset,omitempty"`
+	EndOffset   int       `gorm:"not null;default:0" json:"end_offset,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitzero"`
+	UpdatedAt   time.Time `json:"updated_at,omitzero"`
+	Collapsed   int       `gorm:"-:all" json:"collapsed,omitempty"`
+	// EmbeddingModel and EmbeddingDims record the model that computed Embedding
+	// and its dimension before padding, empty and 0 for unnamed models.
+	EmbeddingModel string `gorm:"not null;default:''" json:"embedding_model,omitempty"`
+	EmbeddingDims  int    `gorm:"not null;default:0" json:"embedding_dims,omitempty"`
+	// EmbeddingInt8 is the embedding quantized by compute --quantize int8,
+	// which searches scan where pgvector has no index for it. Embedding
+	// keeps the original for re-scoring unless it was dropped.
+	EmbeddingInt8 Int8Embedding `gorm:"column:embedding_int8" json:"-"`
+	// Score is the relevance of a search result: the cosine similarity of dense
+	// search, the text rank of keyword search, the fused score of hybrid search
+	// or the reranker's relevance score. Higher is better.
+	Score float64 `gorm:"-:all" json:"score,omitempty"`
+	// Span lists the chunks a result was widened to, Text joining theirs.
+	Span *ChunkSpan `gorm:"-:all" json:"span,omitempty"`
+	// DuplicateOf is the chunk this one was collapsed into by dedup, which
+	// hides it from search while its canonical chunk exists.
+	DuplicateOf string `gorm:"not null;default:'';index" json:"duplicate_of,omitempty"`
+	// Duplicates lists the chunks collapsed into a search result.
+	Duplicates []DuplicateSource `gorm:"-:all" json:"duplicates,omitempty"`
+	// DocumentTime is when the document was written, from its timestamp
+	// metadata or the modification time of its file, nil when unknown.
+	DocumentTime *time.Time `json:"document_time,omitempty"`
+	// Level is LevelChunk for the chunks of a document, LevelSection and
+	// LevelDocument for the summaries written by Summarize.
+	Level int `gorm:"not null;default:0" json:"level,omitempty"`
 }
 
 func hashString(s string) string {
@@ -30,24 +78,78 @@ func hashString(s string) string {
 	return hex.EncodeToString(b)
 }
 
-func (c *DocumentChunk) Fix(d *Document) {
+// chunkID derives a stable ID from the owning document and the chunk content, so
+// re-ingesting an unchanged document yields the same IDs and keeps embeddings valid.
+// IDs in the default collection omit it, keeping those created before collections.
+func chunkID(collection string, document string, text string) string {
+	if collection == DefaultCollection {
+		return hashString(document + "\x00" + text)
+	}
+	return hashString(collection + "\x00" + document + "\x00" + text)
+}
+
+func (c *DocumentChunk) Fix(d *Document, index int) {
 	c.Text = strings.ReplaceAll(c.Text, "\u0000", "")
-	c.ID = hashString(c.Text)
+	c.ID = chunkID(d.Collection, d.Document, c.Text)
+	c.Collection = d.Collection
 	c.Document = d.Document
 	c.RawDocument = d.RawDocument
+	c.Index = index
+	if len(c.Tags) == 0 {
+		c.Tags = d.Tags
+	}
+	// a nil slice is inserted as DEFAULT, which SQLite rejects in batches
+	// mixing chunks with and without headings
+	if c.Headings == nil {
+		c.Headings = []string{}
+	}
+	c.TextSearchConfig = d.TextSearchConfig
+	c.SourcePath = d.SourcePath
+	c.DocumentTime = d.Timestamp
+}
+
+type SourceFile struct {
+	Path       string `gorm:"primaryKey"`
+	SHA256     string `gorm:"column:sha256;not null"`
+	Collection string `gorm:"not null;default:'default'"`
+	Document   string `gorm:"not null;index"`
+	UpdatedAt  time.Time
 }
 
 type Document struct {
-	FileName    string           `json:"file_name"`
-	Document    string           `json:"document"`
-	RawDocument string           `json:"raw_document"`
-	Chunks      []*DocumentChunk `json:"chunks"`
+	// Collection is set by whoever ingests the document, not by the chunks file.
+	Collection  string   `json:"-"`
+	FileName    string   `json:"file_name"`
+	Document    string   `json:"document"`
+	RawDocument string   `json:"raw_document"`
+	Tags        []string `json:"tags,omitempty"`
+
+	// TextSearchConfig is the Postgres text search configuration used to build
+	// the lexical index of the chunks, e.g. "english" or a zhparser configuration.
+	TextSearchConfig string `json:"text_search_config,omitempty"`
+
+	// SourcePath is the file the document was ingested from, used to prune
+	// documents whose files were removed.
+	SourcePath string `json:"source_path,omitempty"`
+	// SourceHash is the SHA-256 of the source file, used to skip unchanged files.
+	SourceHash string `json:"-"`
+	// Timestamp is when the document was written, which ranking by recency
+	// prefers over the modification time of its file.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	Chunks []*DocumentChunk `json:"chunks"`
 }
 
 func (d *Document) Fix() {
 	d.Document = strings.TrimSuffix(d.FileName, ".md")
 	d.RawDocument = d.FileName
-	for _, chunk := range d.Chunks {
-		chunk.Fix(d)
+	if d.Collection == "" {
+		d.Collection = DefaultCollection
+	}
+	if d.TextSearchConfig == "" {
+		d.TextSearchConfig = defaultTextSearchConfig
+	}
+	for i, chunk := range d.Chunks {
+		chunk.Fix(d, i)
 	}
 }
@@ -0,0 +1,275 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const maxNeighbors = 50
+
+type DocumentInfo struct {
+	Collection  string    `json:"collection"`
+	Document    string    `json:"document"`
+	RawDocument string    `json:"raw_document"`
+	Tags        []string  `gorm:"serializer:json" json:"tags,omitempty"`
+	Chunks      int64     `json:"chunks"`
+	Embedded    int64     `json:"embedded"`
+	UpdatedAt   time.Time `gorm:"serializer:aggtime" json:"updated_at,omitzero"`
+}
+
+type ChunkContext struct {
+	Chunk    DocumentChunk   `json:"chunk"`
+	Before   []DocumentChunk `json:"before"`
+	After    []DocumentChunk `json:"after"`
+	Document DocumentInfo    `json:"document"`
+}
+
+// GetChunkContext returns a chunk together with up to before/after chunks
+// surrounding it in its document, ordered by position.
+func (r *RAG) GetChunkContext(ctx context.Context, id string, before int, after int) (*ChunkContext, error) {
+	db := r.DB.WithContext(ctx)
+
+	var chunk DocumentChunk
+	err := db.Omit("embedding").Where("id = ?", id).First(&chunk).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var neighbors []DocumentChunk
+	err = db.Omit("embedding").
+		Where("collection = ? AND document = ? AND chunk_index BETWEEN ? AND ? AND id <> ?",
+			chunk.Collection, chunk.Document, chunk.Index-before, chunk.Index+after, chunk.ID).
+		Where(leafChunks("document_chunks")).
+		Order("chunk_index").
+		Find(&neighbors).Error
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ChunkContext{
+		Chunk:  chunk,
+		Before: make([]DocumentChunk, 0, before),
+		After:  make([]DocumentChunk, 0, after),
+		Document: DocumentInfo{
+			Collection:  chunk.Collection,
+			Document:    chunk.Document,
+			RawDocument: chunk.RawDocument,
+			Tags:        chunk.Tags,
+		},
+	}
+	for _, n := range neighbors {
+		if n.Index < chunk.Index {
+			c.Before = append(c.Before, n)
+		} else {
+			c.After = append(c.After, n)
+		}
+	}
+
+	err = db.Model(&DocumentChunk{}).
+		Select("COUNT(*) AS chunks, "+countEmbeddedSQL+" AS embedded, MAX(updated_at) AS updated_at").
+		Where("collection = ? AND document = ?", chunk.Collection, chunk.Document).Where(leafChunks("document_chunks")).
+		Scan(&c.Document).Error
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ChunkSpan is the range of chunks a search result was widened to, see SearchOptions.Neighbors.
+type ChunkSpan struct {
+	// From and To are the first and last chunk index, IDs the chunks in order.
+	From int      `json:"from"`
+	To   int      `json:"to"`
+	IDs  []string `json:"ids"`
+}
+
+type chunkWindow struct {
+	collection string
+	document   string
+	from, to   int
+	// summary windows are left as they are, see SearchOptions.Summaries
+	summary bool
+}
+
+func (w *chunkWindow) touches(o *chunkWindow) bool {
+	return !w.summary && !o.summary && w.collection == o.collection && w.document == o.document && w.from <= o.to+1 && o.from <= w.to+1
+}
+
+// widenResults replaces every result by its neighbors chunks before and after,
+// or the run of chunks sharing its section, and its position by theirs.
+// Results whose windows overlap or touch are merged into the best ranked one,
+// so no chunk is returned twice.
+func widenResults(db *gorm.DB, chunks []DocumentChunk, neighbors int, section bool) ([]DocumentChunk, error) {
+	neighbors = min(neighbors, maxNeighbors)
+	sections := make(map[[2]string][]DocumentChunk)
+	windows := make([]chunkWindow, len(chunks))
+	for i, c := range chunks {
+		w := chunkWindow{collection: c.Collection, document: c.Document, from: c.Index - neighbors, to: c.Index + neighbors}
+		if c.Level > LevelChunk {
+			w.summary = true
+		} else if section && c.Section != "" {
+			key := [2]string{c.Collection, c.Document}
+			outline, ok := sections[key]
+			if !ok {
+				err := db.Model(&DocumentChunk{}).Select("chunk_index", "section").
+					Where("collection = ? AND document = ?", c.Collection, c.Document).
+					Where(leafChunks("document_chunks")).Order("chunk_index").Find(&outline).Error
+				if err != nil {
+					return nil, err
+				}
+				sections[key] = outline
+			}
+			w.from, w.to = sectionRun(outline, c.Index, c.Section)
+		}
+		windows[i] = w
+	}
+
+	// merge in rank order, then again as merged windows may touch others
+	kept := make([]int, 0, len(chunks))
+	for i := range chunks {
+		merged := false
+		for _, k := range kept {
+			if windows[k].touches(&windows[i]) {
+				windows[k].from, windows[k].to = min(windows[k].from, windows[i].from), max(windows[k].to, windows[i].to)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			kept = append(kept, i)
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for a := 0; a < len(kept) && !changed; a++ {
+			for b := a + 1; b < len(kept); b++ {
+				wa, wb := &windows[kept[a]], &windows[kept[b]]
+				if wa.touches(wb) {
+					wa.from, wa.to = min(wa.from, wb.from), max(wa.to, wb.to)
+					kept = append(kept[:b], kept[b+1:]...)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	type documentKey struct{ collection, document string }
+	bounds := make(map[documentKey]chunkWindow)
+	for _, k := range kept {
+		w := windows[k]
+		if w.summary {
+			continue
+		}
+		key := documentKey{w.collection, w.document}
+		if b, ok := bounds[key]; ok {
+			w.from, w.to = min(w.from, b.from), max(w.to, b.to)
+		}
+		bounds[key] = w
+	}
+	texts := make(map[documentKey][]DocumentChunk, len(bounds))
+	for key, b := range bounds {
+		var found []DocumentChunk
+		err := db.Omit("embedding").
+			Where("collection = ? AND document = ? AND chunk_index BETWEEN ? AND ?", key.collection, key.document, b.from, b.to).
+			Where(leafChunks("document_chunks")).Order("chunk_index").Find(&found).Error
+		if err != nil {
+			return nil, err
+		}
+		texts[key] = found
+	}
+
+	widened := make([]DocumentChunk, 0, len(kept))
+	for _, k := range kept {
+		c, w := chunks[k], windows[k]
+		if w.summary {
+			widened = append(widened, c)
+			continue
+		}
+		span := &ChunkSpan{From: c.Index, To: c.Index, IDs: make([]string, 0)}
+		parts := make([]string, 0)
+		for _, n := range texts[documentKey{w.collection, w.document}] {
+			if n.Index < w.from || n.Index > w.to {
+				continue
+			}
+			// the position of the result covers the chunks it was widened to
+			if len(span.IDs) == 0 {
+				span.From = n.Index
+				c.Page, c.StartOffset = n.Page, n.StartOffset
+			}
+			span.To = n.Index
+			c.PageEnd, c.EndOffset = n.PageEnd, n.EndOffset
+			span.IDs = append(span.IDs, n.ID)
+			parts = append(parts, n.Text)
+		}
+		if len(parts) > 0 {
+			c.Text = strings.Join(parts, "\n\n")
+		}
+		c.Span = span
+		widened = append(widened, c)
+	}
+	return widened, nil
+}
+
+// sectionRun returns the first and last index of the consecutive chunks of
+// outline in the same section as the chunk at index, at most maxNeighbors away.
+func sectionRun(outline []DocumentChunk, index int, section string) (int, int) {
+	pos := -1
+	for i, c := range outline {
+		if c.Index == index {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return index, index
+	}
+	first, last := pos, pos
+	for first > 0 && pos-first < maxNeighbors && outline[first-1].Section == section {
+		first--
+	}
+	for last < len(outline)-1 && last-pos < maxNeighbors && outline[last+1].Section == section {
+		last++
+	}
+	return outline[first].Index, outline[last].Index
+}
+
+func queryParamInt(c echo.Context, name string, def int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid "+name)
+	}
+	return n, nil
+}
+
+func (s *Server) chunkContextHandler(c echo.Context) error {
+	before, err := queryParamInt(c, "before", 2)
+	if err != nil {
+		return err
+	}
+	after, err := queryParamInt(c, "after", 2)
+	if err != nil {
+		return err
+	}
+
+	cc, err := s.ragOf(c).GetChunkContext(c.Request().Context(), c.Param("id"),
+		min(before, maxNeighbors), min(after, maxNeighbors))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && cc.Chunk.Collection != s.collection(c)) {
+		return echo.NewHTTPError(http.StatusNotFound, "chunk not found")
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, cc)
+}
@@ -0,0 +1,185 @@
+package rag
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"github.com/openai/openai-go"
+)
+
+type chatMessage map[string]json.RawMessage
+
+func (m chatMessage) role() string {
+	var role string
+	_ = json.Unmarshal(m["role"], &role)
+	return role
+}
+
+// text returns the textual content of a message, which is either a plain string
+// or an array of content parts.
+func (m chatMessage) text() string {
+	var s string
+	if json.Unmarshal(m["content"], &s) == nil {
+		return s
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(m["content"], &parts) != nil {
+		return ""
+	}
+	for _, part := range parts {
+		if part.Type == "text" {
+			s += part.Text
+		}
+	}
+	return s
+}
+
+func newChatMessage(role string, content string) chatMessage {
+	r, _ := json.Marshal(role)
+	c, _ := json.Marshal(content)
+	return chatMessage{"role": r, "content": c}
+}
+
+// chatCompletionsHandler speaks the OpenAI chat completions protocol. It retrieves
+// chunks for the last user message, injects them as a system message and relays
+// the upstream response, streamed or not, unchanged. Retrieval can be tuned with
+// an optional "rag" object holding the same fields as the search endpoint. The
+// chunks are fitted into Config.ContextTokens along with the conversation, and
+// the tokens they take are reported in HeaderContextTokens.
+func (s *Server) chatCompletionsHandler(c echo.Context) error {
+	if s.ragOf(c).AssistantClient == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "assistant is not configured")
+	}
+
+	var body map[string]json.RawMessage
+	err := json.NewDecoder(c.Request().Body).Decode(&body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var messages []chatMessage
+	err = json.Unmarshal(body["messages"], &messages)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid messages").Error())
+	}
+
+	var p SearchParam
+	if raw, ok := body["rag"]; ok {
+		err = json.Unmarshal(raw, &p)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid rag options").Error())
+		}
+		delete(body, "rag")
+	}
+
+	r, err := s.configure(c)
+	if err != nil {
+		return err
+	}
+	var model string
+	_ = json.Unmarshal(body["model"], &model)
+	if model == "" {
+		model = r.AssistantModel
+		body["model"], _ = json.Marshal(model)
+	}
+	tokenizer, err := NewTokenizer(model)
+	if err != nil {
+		return err
+	}
+	cfg := &r.config().Config
+	contextTokens := 0
+	ctx := c.Request().Context()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].role() != "user" {
+			continue
+		}
+		p.Query = messages[i].text()
+		if p.Query == "" {
+			break
+		}
+
+		opts, err := s.searchOptions(c, r, &p)
+		if err != nil {
+			return err
+		}
+		chunks, err := r.Search(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if m := canaryMetric(c); m != nil {
+			m.Results = len(chunks)
+		}
+		if cfg.ContextTokens > 0 && len(chunks) > 0 {
+			texts := []string{cfg.SystemPrompt + "\n\n"}
+			for _, m := range messages {
+				texts = append(texts, m.text())
+			}
+			chunks = tokenizer.fitContext(cfg.ContextTokens-tokenizer.countMessages(texts...), chunks)
+		}
+		if len(chunks) > 0 {
+			knowledge := buildContext(chunks)
+			contextTokens = tokenizer.Count(knowledge)
+			system := newChatMessage("system", cfg.SystemPrompt+"\n\n"+knowledge)
+			messages = append(messages[:i], append([]chatMessage{system}, messages[i:]...)...)
+		}
+		break
+	}
+
+	body["messages"], err = json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	req, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	var stream bool
+	_ = json.Unmarshal(body["stream"], &stream)
+	if stream {
+		done := s.trackStream()
+		defer done()
+	}
+
+	var rsp *http.Response
+	err = r.AssistantClient.Post(ctx, "chat/completions", req, &rsp)
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		rsp = apiErr.Response
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+	}
+	if rsp == nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "empty upstream response")
+	}
+	defer func() { _ = rsp.Body.Close() }()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, rsp.Header.Get(echo.HeaderContentType))
+	w.Header().Set(HeaderContextTokens, strconv.Itoa(contextTokens))
+	w.WriteHeader(rsp.StatusCode)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := rsp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			w.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,16 +2,62 @@ package rag
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-func buildPrompt(query string, documents []DocumentChunk) string {
+const systemPrompt = "你是一个知识库问答助手。只根据用户提供的知识片段回答问题，" +
+	"在用到某个知识片段的句子后用 [编号] 标注来源，例如 [1]。如果知识片段中没有答案，请直接说明不知道。"
+
+const answerPrompt = "根据以下知识，使用中文回答问题："
+
+func buildContext(documents []DocumentChunk) string {
 	var b strings.Builder
-	b.WriteString("根据以下知识，使用中文回答问题：\n\n")
-	for i, doc := range documents {
-		b.WriteString(fmt.Sprintf("知识片段 %d：%s\n\n", i, doc.Text))
+	for i := range documents {
+		b.WriteString(contextEntry(i, &documents[i]))
 	}
+	return b.String()
+}
+
+// contextEntry is the i-th chunk of the context, cited as [i+1].
+func contextEntry(i int, doc *DocumentChunk) string {
+	return fmt.Sprintf("知识片段 [%d]（来源：%s）：%s\n\n", i+1, doc.RawDocument, doc.Text)
+}
+
+func buildPrompt(instruction string, query string, documents []DocumentChunk) string {
+	var b strings.Builder
+	b.WriteString(instruction)
+	b.WriteString("\n\n")
+	b.WriteString(buildContext(documents))
 	b.WriteString("问题：")
 	b.WriteString(query)
 	return b.String()
 }
+
+var citationPattern = regexp.MustCompile(`\[(\d+)]`)
+
+type Citation struct {
+	Index       int    `json:"index"`
+	ChunkID     string `json:"chunk_id"`
+	RawDocument string `json:"raw_document"`
+}
+
+// extractCitations returns the sources referenced by [n] markers in the answer, in order of first use.
+func extractCitations(answer string, documents []DocumentChunk) []Citation {
+	seen := make(map[int]bool)
+	citations := make([]Citation, 0)
+	for _, m := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < 1 || n > len(documents) || seen[n] {
+			continue
+		}
+		seen[n] = true
+		citations = append(citations, Citation{
+			Index:       n,
+			ChunkID:     documents[n-1].ID,
+			RawDocument: documents[n-1].RawDocument,
+		})
+	}
+	return citations
+}
@@ -0,0 +1,19 @@
+package rag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractCitations(t *testing.T) {
+	chunks := []DocumentChunk{
+		{ID: "c1", RawDocument: "a.md"},
+		{ID: "c2", RawDocument: "b.md"},
+	}
+	citations := extractCitations("Chubby uses Paxos [2]. Locks are advisory [1][2]. See [7].", chunks)
+	require.Equal(t, []Citation{
+		{Index: 2, ChunkID: "c2", RawDocument: "b.md"},
+		{Index: 1, ChunkID: "c1", RawDocument: "a.md"},
+	}, citations)
+}
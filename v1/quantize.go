@@ -0,0 +1,232 @@
+package rag
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+)
+
+// QuantizeInt8 stores every dimension of an embedding in a signed byte,
+// scaled by the embedding's largest magnitude.
+const QuantizeInt8 = "int8"
+
+// maxQuantizedDims bounds the dimension of int8 embeddings. Unlike the
+// halfvec column they aren't limited to dims, so the embeddings of larger
+// models are stored quantized with their originals dropped.
+const maxQuantizedDims = 4096
+
+// rescoreOversample is how many times the limit of candidates ranked by
+// their quantized embeddings is ranked again by their originals.
+const rescoreOversample = 4
+
+// embeddedSQL matches the chunks with an embedding, original or quantized.
+const embeddedSQL = "(embedding IS NOT NULL OR embedding_int8 IS NOT NULL)"
+
+// countEmbeddedSQL counts the chunks matched by embeddedSQL.
+const countEmbeddedSQL = "COUNT(CASE WHEN " + embeddedSQL + " THEN 1 END)"
+
+// Int8Embedding is an embedding encoded by quantizeInt8, stored as NULL when
+// empty since SQLite drivers store nil byte slices as empty blobs.
+type Int8Embedding []byte
+
+func (e Int8Embedding) Value() (driver.Value, error) {
+	if len(e) == 0 {
+		return nil, nil
+	}
+	return []byte(e), nil
+}
+
+func ParseQuantize(s string) (string, error) {
+	switch s {
+	case "", QuantizeInt8:
+		return s, nil
+	default:
+		return "", errors.Newf("unknown quantization: '%s', expected int8", s)
+	}
+}
+
+// quantizeInt8 encodes e as its scale, a little-endian float32, followed by
+// one byte per dimension. Unlike the halfvec column it is not padded.
+func quantizeInt8(e []float32) Int8Embedding {
+	var scale float32
+	for _, v := range e {
+		scale = max(scale, float32(math.Abs(float64(v))))
+	}
+	scale /= 127
+	b := make(Int8Embedding, 4+len(e))
+	binary.LittleEndian.PutUint32(b, math.Float32bits(scale))
+	if scale == 0 {
+		return b
+	}
+	for i, v := range e {
+		b[4+i] = byte(int8(math.Round(float64(v / scale))))
+	}
+	return b
+}
+
+// dequantizeInt8 decodes an embedding encoded by quantizeInt8, padded to the
+// dims of the halfvec column so it compares with query embeddings, which are
+// padded alike.
+func dequantizeInt8(b Int8Embedding) ([]float32, error) {
+	if len(b) < 4 || len(b)-4 > maxQuantizedDims {
+		return nil, errors.Newf("invalid int8 embedding of %d bytes", len(b))
+	}
+	scale := math.Float32frombits(binary.LittleEndian.Uint32(b))
+	e := make([]float32, max(dims, len(b)-4))
+	for i, v := range b[4:] {
+		e[i] = float32(int8(v)) * scale
+	}
+	return e, nil
+}
+
+// scanQuantized ranks the chunks selected by chunks that have quantized
+// embeddings by scanning them, then ranks the best candidates again by their
+// original embeddings where those were kept.
+func scanQuantized(db *gorm.DB, chunks *gorm.DB, q []float32, distance string, opts *SearchOptions) ([]scoredID, error) {
+	rows, err := chunks.Select("id", "raw_document", "embedding_int8", "tags", "updated_at").
+		Where("embedding_int8 IS NOT NULL").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	boost := newBoostMatcher(opts.Boosts)
+	factors := make(map[string]float64)
+	ranked := make([]scoredID, 0)
+	for rows.Next() {
+		var c DocumentChunk
+		err = db.ScanRows(rows, &c)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dequantizeInt8(c.EmbeddingInt8)
+		if err != nil {
+			return nil, errors.Wrapf(err, "chunk %s", c.ID)
+		}
+		if len(e) > len(q) {
+			// embedded by a larger model than the query, CorpusHealth flags it
+			continue
+		}
+		factor := boost.factor(&c)
+		d, relevance := vectorDistance(distance, q, e)
+		ranked = append(ranked, scoredID{ID: c.ID, Score: boostDistance(d, factor), Relevance: relevance})
+		factors[c.ID] = factor
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	if len(ranked) > opts.Limit*rescoreOversample {
+		ranked = ranked[:opts.Limit*rescoreOversample]
+	}
+	if len(ranked) == 0 {
+		return ranked, nil
+	}
+
+	ids := make([]string, len(ranked))
+	for i, s := range ranked {
+		ids[i] = s.ID
+	}
+	var originals []DocumentChunk
+	err = db.Model(&DocumentChunk{}).Select("id", "embedding").
+		Where("id IN ? AND embedding IS NOT NULL", ids).Find(&originals).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*pgvector.HalfVector, len(originals))
+	for _, c := range originals {
+		byID[c.ID] = c.Embedding
+	}
+	for i, s := range ranked {
+		if e, ok := byID[s.ID]; ok {
+			d, relevance := vectorDistance(distance, q, e.Slice())
+			ranked[i].Score, ranked[i].Relevance = boostDistance(d, factors[s.ID]), relevance
+		}
+	}
+	return ranked, nil
+}
+
+// int8BitsFunctionSQL binary-quantizes an int8 embedding as pgvector's
+// binary_quantize does a vector: a bit per dimension, set where it is
+// positive, padded to maxQuantizedDims.
+var int8BitsFunctionSQL = fmt.Sprintf(`CREATE OR REPLACE FUNCTION rag_int8_bits(b bytea) RETURNS bit(%[1]d) AS $$
+SELECT rpad(string_agg(CASE WHEN get_byte(b, i) BETWEEN 1 AND 127 THEN '1' ELSE '0' END, '' ORDER BY i), %[1]d, '0')::bit(%[1]d)
+FROM generate_series(4, length(b) - 1) AS i
+$$ LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE`, maxQuantizedDims)
+
+// binaryQuantize returns the bits of e as rag_int8_bits does for its int8
+// embedding, as the text of a bit string.
+func binaryQuantize(e []float32) string {
+	var sb strings.Builder
+	sb.Grow(maxQuantizedDims)
+	for i := range maxQuantizedDims {
+		if i < len(e) && e[i] > 0 {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	}
+	return sb.String()
+}
+
+// hasQuantizedOnly reports whether a collection has chunks whose original
+// embedding was dropped, which idx_document_chunks_quantized answers.
+func hasQuantizedOnly(db *gorm.DB, collection string) (bool, error) {
+	var ids []string
+	err := db.Model(&DocumentChunk{}).
+		Where("collection = ? AND embedding IS NULL AND embedding_int8 IS NOT NULL", collection).
+		Limit(1).Pluck("id", &ids).Error
+	return len(ids) > 0, err
+}
+
+// mergeQuantized merges the chunks found by the vector index with the
+// quantized ones scanned, ranking both by distance.
+func mergeQuantized(db *gorm.DB, chunks []DocumentChunk, quantized []scoredID, q []float32, distance string,
+	opts *SearchOptions,
+) ([]DocumentChunk, error) {
+	boost := newBoostMatcher(opts.Boosts)
+	found := make(map[string]DocumentChunk, len(chunks))
+	ranked := quantized
+	for _, c := range chunks {
+		if c.Embedding == nil {
+			continue
+		}
+		d, _ := vectorDistance(distance, q, c.Embedding.Slice())
+		ranked = append(ranked, scoredID{ID: c.ID, Score: boostDistance(d, boost.factor(&c)), Relevance: c.Score})
+		found[c.ID] = c
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	if len(ranked) > opts.Limit {
+		ranked = ranked[:opts.Limit]
+	}
+
+	missing := make([]scoredID, 0)
+	for _, s := range ranked {
+		if _, ok := found[s.ID]; !ok {
+			missing = append(missing, s)
+		}
+	}
+	fetched, err := fetchOrdered(db, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range fetched {
+		found[c.ID] = c
+	}
+	merged := make([]DocumentChunk, 0, len(ranked))
+	for _, s := range ranked {
+		if c, ok := found[s.ID]; ok {
+			c.Score = s.Relevance
+			merged = append(merged, c)
+		}
+	}
+	return merged, nil
+}
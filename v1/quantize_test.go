@@ -0,0 +1,89 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestQuantizeInt8(t *testing.T) {
+	e := []float32{0.5, -1, 0.25, 0}
+	b := quantizeInt8(e)
+	require.Len(t, b, 4+len(e))
+
+	decoded, err := dequantizeInt8(b)
+	require.NoError(t, err)
+	require.Len(t, decoded, dims)
+	for i, v := range e {
+		require.InDelta(t, v, decoded[i], 1.0/127)
+	}
+
+	zero, err := dequantizeInt8(quantizeInt8(make([]float32, 3)))
+	require.NoError(t, err)
+	require.Equal(t, float32(0), zero[0])
+
+	_, err = dequantizeInt8([]byte{1})
+	require.Error(t, err)
+
+	// int8 embeddings aren't bound to the halfvec column
+	decoded, err = dequantizeInt8(quantizeInt8(make([]float32, maxQuantizedDims)))
+	require.NoError(t, err)
+	require.Len(t, decoded, maxQuantizedDims)
+	_, err = dequantizeInt8(quantizeInt8(make([]float32, maxQuantizedDims+1)))
+	require.Error(t, err)
+
+	bits := binaryQuantize([]float32{0.5, -1, 0, 2})
+	require.Len(t, bits, maxQuantizedDims)
+	require.Equal(t, "1001", bits[:4])
+	require.NotContains(t, bits[4:], "1")
+}
+
+func TestQuantizedSearch(t *testing.T) {
+	for _, dropOriginal := range []bool{false, true} {
+		forEachBackend(t, func(t *testing.T, db *gorm.DB) {
+			testQuantizedSearch(t, db, dropOriginal)
+		})
+	}
+}
+
+func testQuantizedSearch(t *testing.T, db *gorm.DB, dropOriginal bool) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	upsertTexts(t, r, "", "fruits.md", "apples are red", "bananas are yellow", "cherries are small")
+	embedChunks(t, r, &ComputeOptions{BatchSize: 2, Quantize: QuantizeInt8, DropOriginal: dropOriginal})
+
+	var chunk DocumentChunk
+	require.NoError(t, db.Where("text = ?", "apples are red").First(&chunk).Error)
+	require.NotEmpty(t, chunk.EmbeddingInt8)
+	require.Equal(t, dropOriginal, chunk.Embedding == nil)
+
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "red apples", Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, "apples are red", chunks[0].Text)
+	require.Greater(t, chunks[0].Score, chunks[1].Score)
+
+	stats, err := r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), stats.Embedded)
+	require.Equal(t, int64(3), stats.Quantized)
+	if dropOriginal {
+		require.Equal(t, int64(3), stats.QuantizedOnly)
+	}
+
+	// quantized chunks are not computed again
+	computed := 0
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, BatchSize: 2, Progress: func(n int) { computed += n }})
+	require.Zero(t, computed)
+}
+
+func TestQuantizeOptions(t *testing.T) {
+	r := newTestRAG(newTestDB(t))
+	ctx := context.Background()
+
+	require.Error(t, r.ComputeEmbeddings(ctx, &ComputeOptions{Quantize: "int4"}))
+	require.ErrorContains(t, r.ComputeEmbeddings(ctx, &ComputeOptions{DropOriginal: true}), "requires quantizing")
+}
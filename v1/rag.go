@@ -3,7 +3,10 @@ package rag
 import (
 	"context"
 	"database/sql"
-	"sync"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/minio/minio-go/v7"
@@ -22,15 +25,42 @@ import (
 type RAG struct {
 	DB              *gorm.DB
 	OSS             *minio.Client
-	EmbeddingClient *openai.Client
-	EmbeddingModel  string
-	RerankerClient  *InfinityClient
+	Embedder        Embedder
+	Reranker        Reranker
 	RerankerModel   string
 	AssistantClient *openai.Client
 	AssistantModel  string
+	// Config holds prompts and retrieval defaults, nil uses DefaultConfig.
+	Config *ConfigVersion
+	// Metrics records latencies and errors of the pipeline, nil disables them.
+	Metrics *Metrics
+	// Cache serves repeated queries without embedding and retrieving them again, nil disables it.
+	Cache *QueryCache
+	// Webhooks are notified of ingested documents, computed embeddings and failed jobs, nil disables them.
+	Webhooks *Webhooks
 }
 
+// OpenDB opens the database and checks that its schema is migrated to the
+// version of this binary. SQLite files are migrated instead, they are local
+// to one host and only ever opened by its processes.
 func OpenDB(dsn string) (*gorm.DB, error) {
+	db, err := ConnectDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if db.Dialector.Name() == sqliteDialect {
+		_, err = (&RAG{DB: db}).MigrateUp(context.Background())
+	} else {
+		err = checkSchemaVersion(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// ConnectDB opens the database without checking its schema, see MigrateUp.
+func ConnectDB(dsn string) (*gorm.DB, error) {
 	if len(dsn) == 0 {
 		return nil, errors.New("dsn is required")
 	}
@@ -38,33 +68,133 @@ func OpenDB(dsn string) (*gorm.DB, error) {
 	logger := gormzerolog.NewGormLogger()
 	logger.IgnoreRecordNotFoundError(true)
 	logger.LogMode(gormlogger.Error)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+	dialector := postgres.Open(dsn)
+	if path, ok := strings.CutPrefix(dsn, sqliteScheme); ok {
+		dialector = openSQLite(path)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{
 		Logger: logger,
 	})
 	if err != nil {
 		return nil, err
 	}
+	return db, nil
+}
 
-	err = migrate(db)
+func migrateModels(db *gorm.DB) error {
+	err := db.AutoMigrate(baselineModels...)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return db, nil
+	// chunks ingested before created_at existed count as ingested at their last update
+	err = db.Exec("UPDATE document_chunks SET created_at = updated_at WHERE created_at IS NULL").Error
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&baselineCollection{Name: DefaultCollection, TextSearchConfig: defaultTextSearchConfig}).Error
+}
+
+// schemaLockKey is the advisory lock migrations hold on Postgres.
+const schemaLockKey = 0x72616773
+
+func (postgresBackend) lockSchema(tx *gorm.DB) error {
+	err := tx.Exec("SELECT pg_advisory_xact_lock(?)", schemaLockKey).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version
+  (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL)`).Error
+}
+
+func (postgresBackend) dropSchema(tx *gorm.DB) error {
+	tables := append(slices.Clone(baselineModels), &baselineChunkChange{}, &baselineReplicationState{})
+	err := tx.Migrator().DropTable(tables...)
+	if err != nil {
+		return err
+	}
+	err = tx.Exec("DROP FUNCTION IF EXISTS record_chunk_change()").Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec("DROP SEQUENCE IF EXISTS chunk_changes_seq").Error
 }
 
-func migrate(db *gorm.DB) error {
+func (postgresBackend) migrate(db *gorm.DB) error {
 	err := db.Exec("CREATE EXTENSION IF NOT EXISTS vector").Error
 	if err != nil {
 		return errors.Wrap(err, "Failed to create vector extension")
 	}
 
-	err = db.AutoMigrate(&DocumentChunk{})
+	legacyIDs := !db.Migrator().HasColumn(&DocumentChunk{}, "chunk_index")
+	legacyTSV := !db.Migrator().HasColumn(&DocumentChunk{}, "text_search_config")
+
+	err = migrateModels(db)
 	if err != nil {
 		return errors.Wrap(err, "Failed to migrate document chunks")
 	}
+
+	if legacyTSV {
+		err = db.Exec("ALTER TABLE document_chunks DROP COLUMN IF EXISTS tsv").Error
+		if err != nil {
+			return errors.Wrap(err, "Failed to drop legacy full-text search column")
+		}
+	}
+
+	err = db.Exec("ALTER TABLE document_chunks ADD COLUMN IF NOT EXISTS tsv tsvector " +
+		"GENERATED ALWAYS AS (to_tsvector(text_search_config, text)) STORED").Error
+	if err != nil {
+		return errors.Wrap(err, "Failed to create full-text search column")
+	}
+
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_document_chunks_tsv ON document_chunks USING gin (tsv)").Error
+	if err != nil {
+		return errors.Wrap(err, "Failed to create full-text search index")
+	}
+
+	err = migrateChangeFeed(db)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create change feed")
+	}
+
+	if legacyIDs {
+		err = migrateChunkIDs(db)
+		if err != nil {
+			return errors.Wrap(err, "Failed to migrate chunk IDs")
+		}
+	}
 	return nil
 }
 
+// migrateChunkIDs rewrites IDs created before chunk IDs were scoped to their document.
+func migrateChunkIDs(db *gorm.DB) error {
+	type row struct {
+		ID       string
+		Document string
+		Text     string
+	}
+
+	var rows []row
+	err := db.Model(&DocumentChunk{}).Select("id", "document", "text").Find(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, c := range rows {
+			id := chunkID(DefaultCollection, c.Document, c.Text)
+			if id == c.ID {
+				continue
+			}
+			err := tx.Model(&DocumentChunk{}).Where("id = ?", c.ID).Update("id", id).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (r *RAG) UpsertDocumentChunks(document *Document) error {
 	if len(document.Chunks) == 0 {
 		return nil
@@ -85,75 +215,272 @@ func (r *RAG) UpsertDocumentChunks(document *Document) error {
 		}
 	}
 
-	return r.DB.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "id"}},
-		UpdateAll: true,
-	}).Create(&chunks).Error
+	ids := make([]string, len(chunks))
+	for i, c := range chunks {
+		ids[i] = c.ID
+	}
+
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"collection", "document", "raw_document", "text",
+				"chunk_index", "tags", "text_search_config", "source_path", "page", "section", "page_end", "headings", "start_offset", "end_offset", "updated_at",
+				"document_time"}),
+		}).Create(&chunks).Error
+		if err != nil {
+			return err
+		}
+
+		err = archiveSupersededChunks(tx, document, ids)
+		if err != nil {
+			return err
+		}
+
+		_, err = deleteChunks(tx, "collection = ? AND document = ? AND id NOT IN ?", document.Collection, document.Document, ids)
+		if err != nil {
+			return err
+		}
+
+		if document.SourcePath == "" || document.SourceHash == "" {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&SourceFile{
+			Path:       document.SourcePath,
+			SHA256:     document.SourceHash,
+			Collection: document.Collection,
+			Document:   document.Document,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	r.Webhooks.documentIngested(document, len(chunks))
+	return nil
+}
+
+// SourceFileUnchanged reports whether the file at path was already ingested into the collection with the given hash.
+func (r *RAG) SourceFileUnchanged(ctx context.Context, collection string, path string, hash string) (bool, error) {
+	var count int64
+	err := r.DB.WithContext(ctx).Model(&SourceFile{}).
+		Where("path = ? AND sha256 = ? AND collection = ?", path, hash, collection).
+		Count(&count).Error
+	return count > 0, err
 }
 
-func (r *RAG) ComputeEmbeddings(ctx context.Context, onlyEmpty bool, workers int) error {
-	var err error
-	var rows *sql.Rows
-	if onlyEmpty {
-		rows, err = r.DB.Model(&DocumentChunk{}).Where("embedding IS NULL").Rows()
-	} else {
-		rows, err = r.DB.Model(&DocumentChunk{}).Rows()
+// ValidateTextSearchConfig checks that a text search configuration such as
+// "english" or a custom zhparser configuration exists in the database.
+func (r *RAG) ValidateTextSearchConfig(name string) error {
+	return backendOf(r.DB).validateTextSearchConfig(r.DB, name)
+}
+
+func (postgresBackend) validateTextSearchConfig(db *gorm.DB, name string) error {
+	var found *string
+	err := db.Raw("SELECT to_regconfig(?)::text", name).Scan(&found).Error
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return errors.Newf("text search configuration '%s' does not exist", name)
+	}
+	return nil
+}
+
+type ComputeOptions struct {
+	// Collection restricts computation to one collection, empty computes all.
+	Collection string
+	// Documents restricts computation to these documents, empty computes all.
+	Documents   []string
+	OnlyEmpty   bool
+	Concurrency int
+	BatchSize   int
+	// Quantize is QuantizeInt8 to store the embeddings quantized as well,
+	// empty stores them as halfvec only. DropOriginal stores them quantized
+	// only, halving their size at the cost of exact re-scoring and of the
+	// vector index on Postgres.
+	Quantize     string
+	DropOriginal bool
+	// Progress replaces the progress bar, called with the number of chunks
+	// embedded by every batch.
+	Progress func(n int)
+}
+
+func (r *RAG) ComputeEmbeddings(ctx context.Context, opts *ComputeOptions) error {
+	model := embedderModel(r.Embedder)
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return err
+	}
+	space, err := r.embeddingSpace(ctx, active)
+	if err != nil {
+		return err
 	}
+	quantize, err := ParseQuantize(opts.Quantize)
 	if err != nil {
 		return err
 	}
+	if opts.DropOriginal && quantize == "" {
+		return errors.New("dropping the original embeddings requires quantizing them")
+	}
+
+	q := r.DB.WithContext(ctx).Model(&DocumentChunk{}).Where("text <> ''")
+	if space != "" {
+		if quantize != "" {
+			return errors.Newf("only the embeddings of the active model are quantized, not %s", space)
+		}
+		// a model side by side with the active one fills its own embeddings
+		if opts.OnlyEmpty {
+			q = r.pendingReindex(ctx, space)
+		}
+		if opts.Collection != "" {
+			q = q.Where("collection = ?", opts.Collection)
+		}
+		if len(opts.Documents) > 0 {
+			q = q.Where("document IN ?", opts.Documents)
+		}
+		_, err = r.embedChunks(ctx, q, "Computing embeddings with "+space, opts.Concurrency, opts.BatchSize,
+			r.storeChunkEmbeddings(space), opts.Progress)
+		return err
+	}
+	if opts.Collection != "" {
+		q = q.Where("collection = ?", opts.Collection)
+	}
+	if len(opts.Documents) > 0 {
+		q = q.Where("document IN ?", opts.Documents)
+	}
+	if opts.OnlyEmpty {
+		q = q.Where("NOT " + embeddedSQL)
+	}
+	n, err := r.embedChunks(ctx, q, "Computing embeddings", opts.Concurrency, opts.BatchSize,
+		r.storeEmbeddings(quantize, opts.DropOriginal), opts.Progress)
+
+	// the first named model to compute embeddings becomes the active one
+	if active == nil && model != "" && n > 0 {
+		err = errors.CombineErrors(err, r.registerEmbeddingModel(ctx, model, n))
+	}
+	return err
+}
+
+// embedChunks embeds the chunks selected by q in batches of batchSize on
+// concurrency workers and passes them to store. It returns the dimension of
+// the embeddings, 0 if none were computed. Progress is shown on a progress
+// bar unless progress is given.
+func (r *RAG) embedChunks(ctx context.Context, q *gorm.DB, description string, concurrency int, batchSize int,
+	store func(ctx context.Context, chunks []DocumentChunk, embeddings [][]float32) error, progress func(n int),
+) (int, error) {
+	var total int64
+	err := q.Session(&gorm.Session{}).Count(&total).Error
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := q.Select("id", "collection", "document", "text").Rows()
+	if err != nil {
+		return 0, err
+	}
 	defer func() { _ = rows.Close() }()
 
-	bar := progressbar.Default(-1)
-	bar.Describe("Computing embeddings")
-	defer func() { _ = bar.Finish() }()
+	var bar *progressbar.ProgressBar
+	if progress == nil {
+		bar = progressbar.Default(total)
+		bar.Describe(description)
+		defer func() { _ = bar.Finish() }()
+	}
 
-	p := pool.New().WithMaxGoroutines(workers)
-	var wg sync.WaitGroup
+	var failed atomic.Int64
+	var n atomic.Int64
+	p := pool.New().WithMaxGoroutines(max(concurrency, 1))
+	batchSize = max(batchSize, 1)
+	batch := make([]DocumentChunk, 0, batchSize)
+	submit := func(chunks []DocumentChunk) {
+		p.Go(func() {
+			if bar != nil {
+				defer func() { _ = bar.Add(len(chunks)) }()
+			}
+			texts := make([]string, len(chunks))
+			for i, c := range chunks {
+				texts[i] = c.Text
+			}
+			embeddings, err := r.embed(ctx, texts)
+			if err == nil {
+				err = store(ctx, chunks, embeddings)
+			}
+			if err != nil {
+				failed.Add(int64(len(chunks)))
+				log.Error().Err(err).Stack().Str("first_chunk_id", chunks[0].ID).Int("count", len(chunks)).
+					Msg(description)
+				return
+			}
+			n.Store(int64(len(embeddings[0])))
+			if progress != nil {
+				progress(len(chunks))
+			}
+		})
+	}
 
 	for rows.Next() {
 		var chunk DocumentChunk
 		err = r.DB.ScanRows(rows, &chunk)
 		if err != nil {
-			return err
+			p.Wait()
+			return 0, err
 		}
-
-		if chunk.Embedding != nil || len(chunk.Text) == 0 {
-			_ = bar.Add(1)
-			continue
+		batch = append(batch, chunk)
+		if len(batch) == batchSize {
+			submit(batch)
+			batch = make([]DocumentChunk, 0, batchSize)
 		}
+	}
+	if len(batch) > 0 {
+		submit(batch)
+	}
+	p.Wait()
 
-		p.Go(func() {
-			wg.Add(1)
-			defer func() {
-				_ = bar.Add(1)
-				wg.Done()
-			}()
-
-			var rsp *openai.CreateEmbeddingResponse
-			rsp, err = r.EmbeddingClient.Embeddings.New(ctx, openai.EmbeddingNewParams{
-				Model: r.EmbeddingModel,
-				Input: openai.EmbeddingNewParamsInputUnion{
-					OfString: openai.String(chunk.Text),
-				},
-				Dimensions:     openai.Int(dims),
-				EncodingFormat: openai.EmbeddingNewParamsEncodingFormatFloat,
-			})
-			if err != nil {
-				log.Error().Err(err).Stack().Str("chunk_id", chunk.ID).Msg("Compute embedding")
-				return
-			}
-
-			hv := pgvector.NewHalfVector(toFloat32Slice(rsp.Data[0].Embedding))
-			chunk.Embedding = &hv
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if f := failed.Load(); f > 0 {
+		return int(n.Load()), errors.Newf("failed to compute embeddings for %d chunks", f)
+	}
+	return int(n.Load()), nil
+}
 
-			r.DB.Save(&chunk)
+// storeEmbeddings returns a store for embedChunks setting the embeddings of
+// chunks along with the model that computed them, see ComputeOptions.Quantize.
+func (r *RAG) storeEmbeddings(quantize string, dropOriginal bool) func(context.Context, []DocumentChunk, [][]float32) error {
+	model := embedderModel(r.Embedder)
+	return func(ctx context.Context, chunks []DocumentChunk, embeddings [][]float32) error {
+		err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for i, e := range embeddings {
+				if len(e) > dims && !dropOriginal {
+					return errors.Newf("embeddings of %d dimensions only fit quantized to int8, with the originals dropped",
+						len(e))
+				}
+				values := map[string]any{
+					"embedding":       nil,
+					"embedding_int8":  nil,
+					"embedding_model": model,
+					"embedding_dims":  len(e),
+				}
+				if !dropOriginal {
+					hv := pgvector.NewHalfVector(padEmbedding(e))
+					values["embedding"] = &hv
+				}
+				if quantize == QuantizeInt8 {
+					values["embedding_int8"] = quantizeInt8(e)
+				}
+				err := tx.Model(&DocumentChunk{}).Where("id = ?", chunks[i].ID).Updates(values).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+		r.Webhooks.embeddingsComputed(model, chunks)
+		return nil
 	}
-
-	wg.Wait()
-	p.Wait()
-	return nil
 }
 
 func toFloat32Slice(v []float64) []float32 {
@@ -165,29 +492,7 @@ func toFloat32Slice(v []float64) []float32 {
 }
 
 func (r *RAG) QueryDocumentChunks(ctx context.Context, query string, limit int) ([]DocumentChunk, error) {
-	rsp, err := r.EmbeddingClient.Embeddings.New(ctx, openai.EmbeddingNewParams{
-		Model: r.EmbeddingModel,
-		Input: openai.EmbeddingNewParamsInputUnion{
-			OfString: openai.String(query),
-		},
-		Dimensions: openai.Int(dims),
-	})
-	if err != nil {
-		return nil, err
-	}
-	queryEmbedding := toFloat32Slice(rsp.Data[0].Embedding)
-
-	var chunks []DocumentChunk
-	err = r.DB.Clauses(clause.OrderBy{
-		Expression: clause.Expr{
-			SQL:  "embedding <-> ?",
-			Vars: []interface{}{pgvector.NewVector(queryEmbedding)},
-		}},
-	).Limit(limit).Find(&chunks).Error
-	if err != nil {
-		return nil, err
-	}
-	return chunks, nil
+	return r.queryDense(ctx, &SearchOptions{Query: query, Limit: limit})
 }
 
 func (r *RAG) GetDocumentChunk(id string) (*DocumentChunk, error) {
@@ -204,76 +509,233 @@ func (r *RAG) FindInvalidChunks(ctx context.Context, cb func(chunk *DocumentChun
 	bar.Describe("Cleaning up chunks")
 	defer func() { _ = bar.Finish() }()
 
-	var err error
-	var rows *sql.Rows
-	rows, err = r.DB.
-		Model(&DocumentChunk{}).
-		Where("embedding IS NULL OR (text = '') IS NOT FALSE OR embedding <-> ? = 0", zeroVector).
+	return backendOf(r.DB).invalidChunks(r.DB.WithContext(ctx), func(chunk *DocumentChunk) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cb(chunk)
+		return nil
+	})
+}
+
+// invalidChunksSQL matches the chunks without an embedding or text. Chunks
+// embedded as the zero vector are invalid as well, backends check those.
+const invalidChunksSQL = "NOT " + embeddedSQL + " OR (text = '') IS NOT FALSE"
+
+func (postgresBackend) invalidChunks(db *gorm.DB, fn func(chunk *DocumentChunk) error) error {
+	rows, err := db.Model(&DocumentChunk{}).
+		Where(invalidChunksSQL+" OR embedding <-> ? = 0", zeroVector).
 		Rows()
 	if err != nil {
 		return err
 	}
-	defer func() { _ = rows.Close() }()
+	return scanChunks(db, rows, fn)
+}
 
+// scanChunks calls fn with every chunk of rows and closes them.
+func scanChunks(db *gorm.DB, rows *sql.Rows, fn func(chunk *DocumentChunk) error) error {
+	defer func() { _ = rows.Close() }()
 	for rows.Next() {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
 		var chunk DocumentChunk
-		err = r.DB.ScanRows(rows, &chunk)
+		err := db.ScanRows(rows, &chunk)
+		if err != nil {
+			return err
+		}
+		err = fn(&chunk)
 		if err != nil {
 			return err
 		}
-		cb(&chunk)
 	}
-
-	return nil
+	return rows.Err()
 }
 
 func (r *RAG) DeleteChunk(id string) error {
-	return r.DB.Where("id = ?", id).Delete(&DocumentChunk{}).Error
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		_, err := deleteChunks(tx, "id = ?", id)
+		return err
+	})
 }
 
-func (r *RAG) Rerank(query string, chunks []DocumentChunk, topN int) ([]DocumentChunk, error) {
-	m := make(map[string]int)
+// deleteChunks deletes the chunks matching query along with their embeddings
+// in the models side by side, returning how many chunks it deleted. Run it in
+// a transaction.
+func deleteChunks(tx *gorm.DB, query string, args ...any) (int64, error) {
+	err := tx.Where("chunk_id IN (?)", tx.Model(&DocumentChunk{}).Select("id").Where(query, args...)).
+		Delete(&ChunkEmbedding{}).Error
+	if err != nil {
+		return 0, err
+	}
+	res := tx.Where(query, args...).Delete(&DocumentChunk{})
+	return res.RowsAffected, res.Error
+}
+
+func (r *RAG) Rerank(ctx context.Context, query string, chunks []DocumentChunk, topN int) ([]DocumentChunk, error) {
+	if r.Reranker == nil {
+		return nil, errors.New("reranker is not configured")
+	}
+
 	docs := make([]string, len(chunks))
 	for i, c := range chunks {
 		docs[i] = c.Text
-		m[hashString(c.Text)] = i
 	}
 
-	rsp, err := r.RerankerClient.Rerank(&RerankRequest{
-		Model:           r.RerankerModel,
-		Query:           query,
-		Documents:       docs,
-		TopN:            topN,
-		ReturnDocuments: true, // TODO:	maybe we don't need this
-	})
+	start := time.Now()
+	results, err := r.Reranker.Rerank(ctx, r.RerankerModel, query, docs, topN)
+	r.Metrics.observeRerank(start, err)
 	if err != nil {
 		return nil, err
 	}
 
-	cs := make([]DocumentChunk, len(rsp.Results))
-	for i, x := range rsp.Results {
-		cs[i] = chunks[m[hashString(x.Document)]]
+	cs := make([]DocumentChunk, len(results))
+	for i, x := range results {
+		if x.Index < 0 || x.Index >= len(chunks) {
+			return nil, errors.Newf("rerank index %d out of range", x.Index)
+		}
+		cs[i] = chunks[x.Index]
+		cs[i].Score = x.Score
 	}
 	return cs, nil
 }
 
-func (r *RAG) Ask(ctx context.Context, query string, chunks []DocumentChunk) (string, error) {
-	prompt := buildPrompt(query, chunks)
-	c, err := r.AssistantClient.Completions.New(ctx, openai.CompletionNewParams{
-		Model:  openai.CompletionNewParamsModel(r.AssistantModel),
-		Prompt: openai.CompletionNewParamsPromptUnion{OfString: openai.String(prompt)},
-	})
+type Answer struct {
+	Text      string     `json:"text"`
+	Citations []Citation `json:"citations"`
+	// ConfigVersion is the configuration version the answer was produced with.
+	ConfigVersion int64 `json:"config_version"`
+	// Usage is reported by the assistant, or counted when it doesn't.
+	Usage TokenUsage `json:"usage"`
+	// Chunks are the chunks the prompt held, which citations index: the
+	// retrieved ones that fit Config.ContextTokens, the last maybe truncated.
+	Chunks []DocumentChunk `json:"-"`
+}
+
+// chatPrompt is a question to the assistant with the chunks fitted into it.
+type chatPrompt struct {
+	params openai.ChatCompletionNewParams
+	chunks []DocumentChunk
+	// usage counts the prompt tokens, answers add the completion's
+	usage     TokenUsage
+	tokenizer *Tokenizer
+}
+
+func (r *RAG) chatPrompt(query string, chunks []DocumentChunk) (*chatPrompt, error) {
+	cfg := &r.config().Config
+	tokenizer, err := NewTokenizer(r.AssistantModel)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	prompt := buildPrompt(cfg.AnswerPrompt, query, chunks)
+	promptTokens := tokenizer.countMessages(cfg.SystemPrompt, prompt)
+	if cfg.ContextTokens > 0 {
+		budget := cfg.ContextTokens - tokenizer.countMessages(cfg.SystemPrompt, buildPrompt(cfg.AnswerPrompt, query, nil))
+		if budget <= 0 {
+			return nil, errors.Newf("the question takes more than the %d context tokens configured", cfg.ContextTokens)
+		}
+		// tokens merge across the joins of the prompt, so the fitted prompt
+		// can still be a few tokens over and is fitted again by as many
+		fitted := chunks
+		for promptTokens > cfg.ContextTokens && len(fitted) > 0 {
+			fitted = tokenizer.fitContext(budget, chunks)
+			prompt = buildPrompt(cfg.AnswerPrompt, query, fitted)
+			promptTokens = tokenizer.countMessages(cfg.SystemPrompt, prompt)
+			budget -= promptTokens - cfg.ContextTokens
+		}
+		chunks = fitted
 	}
-	if len(c.Choices) > 0 {
-		return c.Choices[0].Text, nil
+	return &chatPrompt{
+		params: openai.ChatCompletionNewParams{
+			Model: r.AssistantModel,
+			Messages: []openai.ChatCompletionMessageParamUnion{
+				openai.SystemMessage(cfg.SystemPrompt),
+				openai.UserMessage(prompt),
+			},
+		},
+		chunks: chunks,
+		usage: TokenUsage{
+			PromptTokens:  promptTokens,
+			TotalTokens:   promptTokens,
+			ContextTokens: tokenizer.Count(buildContext(chunks)),
+		},
+		tokenizer: tokenizer,
+	}, nil
+}
+
+// answer returns the answer to the prompt, taking the usage the assistant
+// reported if it did.
+func (p *chatPrompt) answer(text string, usage openai.CompletionUsage, configVersion int64) *Answer {
+	u := p.usage
+	if usage.TotalTokens > 0 {
+		u.PromptTokens = int(usage.PromptTokens)
+		u.CompletionTokens = int(usage.CompletionTokens)
+	} else {
+		u.CompletionTokens = p.tokenizer.Count(text)
+	}
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return &Answer{
+		Text:          text,
+		Citations:     extractCitations(text, p.chunks),
+		ConfigVersion: configVersion,
+		Usage:         u,
+		Chunks:        p.chunks,
+	}
+}
+
+func (r *RAG) Ask(ctx context.Context, query string, chunks []DocumentChunk) (*Answer, error) {
+	if r.AssistantClient == nil {
+		return nil, errors.New("assistant is not configured")
+	}
+	prompt, err := r.chatPrompt(query, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	c, err := r.AssistantClient.Chat.Completions.New(ctx, prompt.params)
+	r.Metrics.observeAnswer(start, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Choices) == 0 {
+		return nil, errors.New("no choices returned from completion")
+	}
+	return prompt.answer(c.Choices[0].Message.Content, c.Usage, r.config().Version), nil
+}
+
+// AskStream is like Ask but calls onToken for every content delta as it arrives.
+func (r *RAG) AskStream(ctx context.Context, query string, chunks []DocumentChunk, onToken func(string) error) (*Answer, error) {
+	if r.AssistantClient == nil {
+		return nil, errors.New("assistant is not configured")
+	}
+	prompt, err := r.chatPrompt(query, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	stream := r.AssistantClient.Chat.Completions.NewStreaming(ctx, prompt.params)
+	defer func() { _ = stream.Close() }()
+
+	var b strings.Builder
+	var usage openai.CompletionUsage
+	for stream.Next() {
+		chunk := stream.Current()
+		// servers that report usage when streaming do in the last chunk
+		if chunk.Usage.TotalTokens > 0 {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		token := chunk.Choices[0].Delta.Content
+		b.WriteString(token)
+		if err := onToken(token); err != nil {
+			return nil, err
+		}
+	}
+	err = stream.Err()
+	r.Metrics.observeAnswer(start, err)
+	if err != nil {
+		return nil, err
 	}
-	return "", errors.New("no choices returned from completion")
+	return prompt.answer(b.String(), usage, r.config().Version), nil
 }
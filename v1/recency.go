@@ -0,0 +1,75 @@
+package rag
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// recencyOversample is how many chunks per requested result are retrieved when
+// ranking by recency, so that newer chunks ranked a little lower are found.
+const recencyOversample = 3
+
+// ParseHalfLife parses a recency half-life such as 90d, 2w or 36h. Days and
+// weeks are added to the units of time.ParseDuration, which changelogs and
+// incident reports are dated in.
+func ParseHalfLife(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if n, unit := s[:len(s)-1], s[len(s)-1]; unit == 'd' || unit == 'w' {
+		var f float64
+		f, err = strconv.ParseFloat(strings.TrimSpace(n), 64)
+		days := 24 * time.Hour
+		if unit == 'w' {
+			days *= 7
+		}
+		d = time.Duration(f * float64(days))
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, errors.Newf("invalid half-life '%s', expected a positive duration such as 90d, 2w or 36h", s)
+	}
+	return d, nil
+}
+
+// chunkTime is when the document of a chunk was written: its timestamp, or
+// when it was ingested for documents without one.
+func chunkTime(c *DocumentChunk) time.Time {
+	if c.DocumentTime != nil {
+		return *c.DocumentTime
+	}
+	return c.UpdatedAt
+}
+
+// recencyDecay halves for every halfLife the document of a chunk is older
+// than now. Documents dated in the future don't decay.
+func recencyDecay(c *DocumentChunk, halfLife time.Duration, now time.Time) float64 {
+	age := now.Sub(chunkTime(c))
+	if age <= 0 {
+		return 1
+	}
+	return math.Exp2(-float64(age) / float64(halfLife))
+}
+
+// decayByRecency scales the score of every chunk by the decay of its
+// document's age and ranks the chunks again. Negative scores, such as inner
+// products, are divided instead, so older chunks still rank lower.
+func decayByRecency(chunks []DocumentChunk, halfLife time.Duration, now time.Time) {
+	for i := range chunks {
+		decay := recencyDecay(&chunks[i], halfLife, now)
+		if chunks[i].Score < 0 {
+			chunks[i].Score /= max(decay, math.SmallestNonzeroFloat64)
+		} else {
+			chunks[i].Score *= decay
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Score > chunks[j].Score })
+}
@@ -0,0 +1,75 @@
+package rag
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestParseHalfLife(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"":     0,
+		"90d":  90 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"1.5d": 36 * time.Hour,
+		"36h":  36 * time.Hour,
+	} {
+		d, err := ParseHalfLife(s)
+		require.NoError(t, err, s)
+		require.Equal(t, want, d, s)
+	}
+	for _, s := range []string{"d", "-3d", "0h", "soon"} {
+		_, err := ParseHalfLife(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestRecencySearch(t *testing.T) {
+	forEachBackend(t, testRecencySearch)
+}
+
+func testRecencySearch(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	stale, fresh := now.AddDate(-1, 0, 0), now.AddDate(0, 0, -1)
+	for _, d := range []*Document{
+		{FileName: "2024-outage.md", Timestamp: &stale, Chunks: []*DocumentChunk{{Text: "database outage"}}},
+		{FileName: "2025-outage.md", Timestamp: &fresh, Chunks: []*DocumentChunk{{Text: "database outage postmortem"}}},
+		{FileName: "undated.md", Chunks: []*DocumentChunk{{Text: "unrelated notes"}}},
+	} {
+		upsertDocument(t, r, d)
+	}
+	embedChunks(t, r, &ComputeOptions{BatchSize: 3})
+
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "database outage", Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, "2024-outage", chunks[0].Document)
+	require.WithinDuration(t, stale, *chunks[0].DocumentTime, time.Second)
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "database outage", Limit: 2, RecencyHalfLife: 90 * 24 * time.Hour})
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, "2025-outage", chunks[0].Document)
+	require.Equal(t, "2024-outage", chunks[1].Document)
+	require.Less(t, chunks[1].Score, 0.1)
+}
+
+func TestDecayByRecency(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	chunks := []DocumentChunk{
+		{ID: "old", Score: 1, DocumentTime: &old},
+		{ID: "ingested", Score: 0.5, UpdatedAt: now},
+		{ID: "negative", Score: -1, DocumentTime: &old},
+	}
+	decayByRecency(chunks, 24*time.Hour, now)
+	require.Equal(t, "ingested", chunks[0].ID)
+	require.InDelta(t, 0.5, chunks[0].Score, 1e-9)
+	require.InDelta(t, 0.25, chunks[1].Score, 1e-9)
+	require.InDelta(t, -4, chunks[2].Score, 1e-9)
+}
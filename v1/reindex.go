@@ -0,0 +1,352 @@
+package rag
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrEmbeddingModelMismatch = errors.New("embedding model mismatch")
+
+// EmbeddingModel is a model whose embeddings are stored. Chunk embeddings are
+// those of the active model, the others' are kept side by side in chunk_embeddings.
+type EmbeddingModel struct {
+	Name string `gorm:"primaryKey" json:"name"`
+	// Dims is the dimension of the model's embeddings before padding.
+	Dims      int       `gorm:"not null;default:0" json:"dims"`
+	Active    bool      `gorm:"not null;default:false;index" json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChunkEmbedding is the embedding of a chunk by a model other than the active
+// one. A reindex moves them to their chunks when it switches over to the model.
+type ChunkEmbedding struct {
+	ChunkID   string               `gorm:"primaryKey"`
+	Model     string               `gorm:"primaryKey"`
+	Dims      int                  `gorm:"not null"`
+	Embedding *pgvector.HalfVector `gorm:"type:halfvec(2560);not null"`
+	CreatedAt time.Time
+}
+
+// ActiveEmbeddingModel returns the model of the chunk embeddings, nil if no
+// named model computed them yet.
+func (r *RAG) ActiveEmbeddingModel(ctx context.Context) (*EmbeddingModel, error) {
+	var m EmbeddingModel
+	err := r.DB.WithContext(ctx).Where("active = ?", true).Take(&m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// checkEmbeddingModel refuses to compare embeddings of model with those of the
+// active model. Unnamed models can't be checked and are let through.
+func checkEmbeddingModel(active *EmbeddingModel, model string) error {
+	if active == nil || model == "" || model == active.Name {
+		return nil
+	}
+	return errors.Wrapf(ErrEmbeddingModelMismatch,
+		"the index is embedded with %s, not %s; use %s or add the model with reindex --model %s",
+		active.Name, model, active.Name, model)
+}
+
+// embeddingSpace returns where the embeddings of r.Embedder's model are:
+// empty for the chunks' own, the model for chunk_embeddings. It fails for
+// models without stored embeddings.
+func (r *RAG) embeddingSpace(ctx context.Context, active *EmbeddingModel) (string, error) {
+	model := embedderModel(r.Embedder)
+	if active == nil || model == "" || model == active.Name {
+		return "", nil
+	}
+	var n int64
+	err := r.DB.WithContext(ctx).Model(&EmbeddingModel{}).Where("name = ?", model).Count(&n).Error
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", checkEmbeddingModel(active, model)
+	}
+	return model, nil
+}
+
+// storeChunkEmbeddings returns a store for embedChunks writing to chunk_embeddings.
+func (r *RAG) storeChunkEmbeddings(model string) func(context.Context, []DocumentChunk, [][]float32) error {
+	return func(ctx context.Context, chunks []DocumentChunk, embeddings [][]float32) error {
+		rows := make([]ChunkEmbedding, len(chunks))
+		for i, e := range embeddings {
+			if len(e) > dims {
+				return errors.Newf("embeddings of %d dimensions don't fit side by side, at most %d do", len(e), dims)
+			}
+			hv := pgvector.NewHalfVector(padEmbedding(e))
+			rows[i] = ChunkEmbedding{ChunkID: chunks[i].ID, Model: model, Dims: len(e), Embedding: &hv}
+		}
+		return r.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&rows).Error
+	}
+}
+
+func (r *RAG) registerEmbeddingModel(ctx context.Context, model string, dims int) error {
+	return r.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&EmbeddingModel{Name: model, Dims: dims, Active: true}).Error
+}
+
+// EmbeddingModelStatus is a model with the progress of a reindex into it.
+type EmbeddingModelStatus struct {
+	EmbeddingModel
+	// Embedded is the number of chunks embedded with the model.
+	Embedded int64 `json:"embedded"`
+	// Chunks is the number of chunks with text.
+	Chunks int64 `json:"chunks"`
+}
+
+// EmbeddingModels returns the known models, the active one first.
+func (r *RAG) EmbeddingModels(ctx context.Context) ([]EmbeddingModelStatus, error) {
+	db := r.DB.WithContext(ctx)
+	var models []EmbeddingModel
+	err := db.Order("active DESC, name").Find(&models).Error
+	if err != nil {
+		return nil, err
+	}
+	var chunks int64
+	err = db.Model(&DocumentChunk{}).Where("text <> ''").Count(&chunks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]EmbeddingModelStatus, len(models))
+	for i, m := range models {
+		statuses[i] = EmbeddingModelStatus{EmbeddingModel: m, Chunks: chunks}
+		q := db.Model(&ChunkEmbedding{}).Where("model = ?", m.Name)
+		if m.Active {
+			q = db.Model(&DocumentChunk{}).Where("embedding_model = ? AND embedding IS NOT NULL", m.Name)
+		}
+		err = q.Count(&statuses[i].Embedded).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+type ReindexOptions struct {
+	Concurrency int
+	BatchSize   int
+	// NoSwitch keeps the embeddings side by side with those of the active
+	// model instead of switching over, for searches choosing the model.
+	NoSwitch bool
+}
+
+type ReindexReport struct {
+	Model string `json:"model"`
+	Dims  int    `json:"dims"`
+	// Computed is the number of chunks embedded by this run, Resumed those
+	// embedded by interrupted runs before.
+	Computed int64 `json:"computed"`
+	Resumed  int64 `json:"resumed"`
+	// Cleared is the number of chunks left without embedding because they
+	// were added while switching over, compute embeds them.
+	Cleared int64 `json:"cleared"`
+}
+
+// keepQuantizedEmbeddings keeps the embeddings of chunks whose original was
+// dropped side by side like the others, dequantized. Those of models beyond
+// the halfvec column don't fit and are dropped with their chunks' int8 ones.
+func keepQuantizedEmbeddings(tx *gorm.DB, model string, at time.Time) error {
+	var chunks []DocumentChunk
+	return tx.Model(&DocumentChunk{}).Select("id", "embedding_model", "embedding_dims", "embedding_int8").
+		Where("embedding IS NULL AND embedding_int8 IS NOT NULL AND embedding_model <> '' AND embedding_model <> ?", model).
+		FindInBatches(&chunks, importBatchSize, func(tx *gorm.DB, _ int) error {
+			rows := make([]ChunkEmbedding, 0, len(chunks))
+			for _, c := range chunks {
+				e, err := dequantizeInt8(c.EmbeddingInt8)
+				if err != nil {
+					return errors.Wrapf(err, "chunk %s", c.ID)
+				}
+				if len(e) > dims {
+					continue
+				}
+				hv := pgvector.NewHalfVector(e)
+				rows = append(rows, ChunkEmbedding{ChunkID: c.ID, Model: c.EmbeddingModel, Dims: c.EmbeddingDims,
+					Embedding: &hv, CreatedAt: at})
+			}
+			if len(rows) == 0 {
+				return nil
+			}
+			return tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "chunk_id"}, {Name: "model"}},
+				DoUpdates: clause.AssignmentColumns([]string{"dims", "embedding"}),
+			}).Create(&rows).Error
+		}).Error
+}
+
+// quantizedChunk is a chunk with an int8 embedding at a switchover, Dropped
+// if its original embedding was.
+type quantizedChunk struct {
+	ID      string
+	Dropped bool
+}
+
+// requantize quantizes the chunks' new embeddings of n dimensions,
+// dropping them again where the previous ones were.
+func requantize(tx *gorm.DB, chunks []quantizedChunk, n int) error {
+	dropped := make(map[string]bool, len(chunks))
+	for _, c := range chunks {
+		dropped[c.ID] = c.Dropped
+	}
+	for batch := range slices.Chunk(chunks, importBatchSize) {
+		ids := make([]string, len(batch))
+		for i, c := range batch {
+			ids[i] = c.ID
+		}
+		var embedded []DocumentChunk
+		err := tx.Model(&DocumentChunk{}).Select("id", "embedding").Where("id IN ? AND embedding IS NOT NULL", ids).
+			Find(&embedded).Error
+		if err != nil {
+			return err
+		}
+		for _, c := range embedded {
+			e := c.Embedding.Slice()
+			if n > 0 && n < len(e) {
+				e = e[:n]
+			}
+			values := map[string]any{"embedding_int8": quantizeInt8(e)}
+			if dropped[c.ID] {
+				values["embedding"] = nil
+			}
+			err = tx.Model(&DocumentChunk{}).Where("id = ?", c.ID).Updates(values).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// notReindexed matches chunks with text and without an embedding of the model bound to it.
+const notReindexed = "text <> '' AND NOT EXISTS " +
+	"(SELECT 1 FROM chunk_embeddings e WHERE e.chunk_id = document_chunks.id AND e.model = ?)"
+
+// pendingReindex selects the chunks not embedded with model yet.
+func (r *RAG) pendingReindex(ctx context.Context, model string) *gorm.DB {
+	return r.DB.WithContext(ctx).Model(&DocumentChunk{}).Where(notReindexed, model)
+}
+
+// Reindex embeds all chunks with r.Embedder into chunk_embeddings while the
+// current embeddings keep serving queries, then switches over in one
+// transaction, keeping the previous embeddings side by side. An interrupted
+// reindex resumes with the chunks it missed.
+func (r *RAG) Reindex(ctx context.Context, opts *ReindexOptions) (*ReindexReport, error) {
+	model := embedderModel(r.Embedder)
+	if model == "" {
+		return nil, errors.New("reindex requires a named embedding model")
+	}
+	db := r.DB.WithContext(ctx)
+	err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&EmbeddingModel{Name: model}).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to register embedding model")
+	}
+
+	report := &ReindexReport{Model: model}
+	err = db.Model(&ChunkEmbedding{}).Where("model = ?", model).Count(&report.Resumed).Error
+	if err != nil {
+		return nil, err
+	}
+	store := r.storeChunkEmbeddings(model)
+	// chunks ingested during a pass are picked up by the next one
+	for {
+		var pending int64
+		err = r.pendingReindex(ctx, model).Count(&pending).Error
+		if err != nil {
+			return nil, err
+		}
+		if pending == 0 {
+			break
+		}
+		n, err := r.embedChunks(ctx, r.pendingReindex(ctx, model), "Reindexing "+model,
+			opts.Concurrency, opts.BatchSize, store, nil)
+		if err != nil {
+			return nil, err
+		}
+		report.Computed += pending
+		report.Dims = n
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if report.Dims == 0 {
+			err := tx.Model(&ChunkEmbedding{}).Where("model = ?", model).Limit(1).Pluck("dims", &report.Dims).Error
+			if err != nil {
+				return err
+			}
+		}
+		if opts.NoSwitch {
+			return tx.Model(&EmbeddingModel{}).Where("name = ?", model).Update("dims", report.Dims).Error
+		}
+
+		// the previous model's embeddings stay searchable side by side
+		now := time.Now()
+		err := tx.Exec(`INSERT INTO chunk_embeddings (chunk_id, model, dims, embedding, created_at)
+SELECT id, embedding_model, embedding_dims, embedding, ? FROM document_chunks
+WHERE embedding IS NOT NULL AND embedding_model <> '' AND embedding_model <> ?
+ON CONFLICT (chunk_id, model) DO UPDATE SET dims = excluded.dims, embedding = excluded.embedding`,
+			now, model).Error
+		if err != nil {
+			return err
+		}
+		err = keepQuantizedEmbeddings(tx, model, now)
+		if err != nil {
+			return err
+		}
+		res := tx.Model(&DocumentChunk{}).Where(notReindexed, model).
+			Updates(map[string]any{"embedding": nil, "embedding_int8": nil, "embedding_model": "", "embedding_dims": 0})
+		if res.Error != nil {
+			return res.Error
+		}
+		report.Cleared = res.RowsAffected
+		var quantized []quantizedChunk
+		err = tx.Model(&DocumentChunk{}).Select("id, embedding IS NULL AS dropped").
+			Where("embedding_int8 IS NOT NULL AND NOT ("+notReindexed+")", model).Scan(&quantized).Error
+		if err != nil {
+			return err
+		}
+		// the int8 embeddings of the previous model are quantized again below
+		err = tx.Exec(`UPDATE document_chunks SET
+  embedding = (SELECT e.embedding FROM chunk_embeddings e WHERE e.chunk_id = document_chunks.id AND e.model = ?),
+  embedding_int8 = NULL, embedding_model = ?, embedding_dims = ?
+WHERE EXISTS (SELECT 1 FROM chunk_embeddings e WHERE e.chunk_id = document_chunks.id AND e.model = ?)`,
+			model, model, report.Dims, model).Error
+		if err != nil {
+			return err
+		}
+		err = requantize(tx, quantized, report.Dims)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&EmbeddingModel{}).Where("name <> ?", model).Update("active", false).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&EmbeddingModel{}).Where("name = ?", model).
+			Updates(map[string]any{"active": true, "dims": report.Dims}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("model = ?", model).Delete(&ChunkEmbedding{}).Error
+		if err != nil {
+			return err
+		}
+		// cached query embeddings belong to the previous model
+		return tx.Where("1 = 1").Delete(&QueryCacheEntry{}).Error
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to switch embedding model")
+	}
+	return report, nil
+}
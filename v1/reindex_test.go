@@ -0,0 +1,242 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cespare/xxhash"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// modelEmbedder embeds bags of words into n dimensions and fails after
+// failAfter calls if it is positive.
+type modelEmbedder struct {
+	name      string
+	n         int
+	failAfter int64
+	calls     atomic.Int64
+}
+
+func (e *modelEmbedder) Model() string { return e.name }
+
+func (e *modelEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	if c := e.calls.Add(1); e.failAfter > 0 && c > e.failAfter {
+		return nil, errors.New("embedding service unavailable")
+	}
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i] = make([]float32, e.n)
+		for _, w := range strings.Fields(strings.ToLower(text)) {
+			embeddings[i][xxhash.Sum64String(w)%uint64(e.n)]++
+		}
+	}
+	return embeddings, nil
+}
+
+func TestReindex(t *testing.T) {
+	forEachBackend(t, testReindex)
+}
+
+func testReindex(t *testing.T, db *gorm.DB) {
+	small := &modelEmbedder{name: "small", n: 64}
+	r := &RAG{DB: db, Embedder: small}
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+		{Text: "cherries are small"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{BatchSize: 2})
+
+	active, err := r.ActiveEmbeddingModel(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "small", active.Name)
+	require.Equal(t, 64, active.Dims)
+	chunk, err := r.GetDocumentChunk(d.Chunks[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, "small", chunk.EmbeddingModel)
+	require.Equal(t, 64, chunk.EmbeddingDims)
+
+	// vectors of another model are never compared with the stored ones
+	large := &RAG{DB: db, Embedder: &modelEmbedder{name: "large", n: 128}}
+	_, err = large.Search(ctx, &SearchOptions{Query: "bananas", Limit: 1, Mode: SearchModeDense})
+	require.ErrorIs(t, err, ErrEmbeddingModelMismatch)
+	err = large.ComputeEmbeddings(ctx, &ComputeOptions{Concurrency: 1, BatchSize: 2})
+	require.ErrorIs(t, err, ErrEmbeddingModelMismatch)
+
+	// an interrupted reindex keeps serving the previous model
+	failing := &RAG{DB: db, Embedder: &modelEmbedder{name: "large", n: 128, failAfter: 1}}
+	_, err = failing.Reindex(ctx, &ReindexOptions{Concurrency: 1, BatchSize: 1})
+	require.Error(t, err)
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "bananas", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+
+	models, err := r.EmbeddingModels(ctx)
+	require.NoError(t, err)
+	require.Len(t, models, 2)
+	require.Equal(t, "small", models[0].Name)
+	require.EqualValues(t, 3, models[0].Embedded)
+	require.Equal(t, "large", models[1].Name)
+	require.EqualValues(t, 1, models[1].Embedded)
+
+	// and resumes with the chunks it missed
+	report, err := large.Reindex(ctx, &ReindexOptions{Concurrency: 1, BatchSize: 1})
+	require.NoError(t, err)
+	require.Equal(t, &ReindexReport{Model: "large", Dims: 128, Computed: 2, Resumed: 1}, report)
+
+	chunks, err = large.Search(ctx, &SearchOptions{Query: "bananas", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+	// the previous model stays searchable side by side
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "bananas", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+
+	chunk, err = r.GetDocumentChunk(d.Chunks[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, "large", chunk.EmbeddingModel)
+	require.Equal(t, 128, chunk.EmbeddingDims)
+	var staged int64
+	require.NoError(t, db.Model(&ChunkEmbedding{}).Where("model = ?", "large").Count(&staged).Error)
+	require.Zero(t, staged)
+}
+
+func TestSideBySideEmbeddings(t *testing.T) {
+	forEachBackend(t, testSideBySideEmbeddings)
+}
+
+func testSideBySideEmbeddings(t *testing.T, db *gorm.DB) {
+	small := &RAG{DB: db, Embedder: &modelEmbedder{name: "small", n: 64}}
+	large := &RAG{DB: db, Embedder: &modelEmbedder{name: "large", n: 128}}
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+	}}
+	upsertDocument(t, small, d)
+	embedChunks(t, small, &ComputeOptions{BatchSize: 2})
+
+	report, err := large.Reindex(ctx, &ReindexOptions{Concurrency: 1, BatchSize: 2, NoSwitch: true})
+	require.NoError(t, err)
+	require.Equal(t, &ReindexReport{Model: "large", Dims: 128, Computed: 2}, report)
+	active, err := small.ActiveEmbeddingModel(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "small", active.Name)
+
+	// both spaces are searchable
+	for _, r := range []*RAG{small, large} {
+		chunks, err := r.Search(ctx, &SearchOptions{Query: "bananas", Limit: 1, Mode: SearchModeDense})
+		require.NoError(t, err)
+		require.Equal(t, "bananas are yellow", chunks[0].Text)
+	}
+
+	// compute fills the space of its model
+	d = &Document{FileName: "berries.md", Chunks: []*DocumentChunk{{Text: "cherries are small"}}}
+	upsertDocument(t, small, d)
+	embedChunks(t, small, &ComputeOptions{OnlyEmpty: true, BatchSize: 2})
+	embedChunks(t, large, &ComputeOptions{OnlyEmpty: true, BatchSize: 2})
+	chunks, err := large.Search(ctx, &SearchOptions{Query: "cherries", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "cherries are small", chunks[0].Text)
+
+	models, err := small.EmbeddingModels(ctx)
+	require.NoError(t, err)
+	require.Len(t, models, 2)
+	require.EqualValues(t, 3, models[0].Embedded)
+	require.EqualValues(t, 3, models[1].Embedded)
+
+	// deleted chunks take their embeddings in every space along
+	_, deleted, err := small.DeleteDocuments(ctx, DefaultCollection, "berries.md", false)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, deleted)
+	models, err = small.EmbeddingModels(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, models[0].Embedded)
+	require.EqualValues(t, 2, models[1].Embedded)
+	chunks, err = small.Search(ctx, &SearchOptions{Query: "apples", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.NoError(t, small.DeleteChunk(chunks[0].ID))
+	var side int64
+	require.NoError(t, db.Model(&ChunkEmbedding{}).Where("model = ?", "large").Count(&side).Error)
+	require.EqualValues(t, 1, side)
+}
+
+func TestReindexQuantized(t *testing.T) {
+	forEachBackend(t, testReindexQuantized)
+}
+
+func testReindexQuantized(t *testing.T, db *gorm.DB) {
+	small := &RAG{DB: db, Embedder: &modelEmbedder{name: "small", n: 64}}
+	large := &RAG{DB: db, Embedder: &modelEmbedder{name: "large", n: 128}}
+	ctx := context.Background()
+
+	kept := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{{Text: "apples are red"}}}
+	dropped := &Document{FileName: "berries.md", Chunks: []*DocumentChunk{{Text: "cherries are small"}}}
+	for _, d := range []*Document{kept, dropped} {
+		upsertDocument(t, small, d)
+		embedChunks(t, small, &ComputeOptions{Documents: []string{d.Document}, BatchSize: 2, Quantize: QuantizeInt8,
+			DropOriginal: d == dropped})
+	}
+	_, err := large.Reindex(ctx, &ReindexOptions{Concurrency: 1, BatchSize: 2})
+	require.NoError(t, err)
+
+	// int8 embeddings are of the new model, dropped originals stay dropped
+	for _, d := range []*Document{kept, dropped} {
+		chunk, err := small.GetDocumentChunk(d.Chunks[0].ID)
+		require.NoError(t, err)
+		require.Equal(t, "large", chunk.EmbeddingModel)
+		require.Equal(t, d == dropped, chunk.Embedding == nil)
+		require.Len(t, chunk.EmbeddingInt8, 4+128)
+		e, err := large.Embedder.Embed(ctx, []string{chunk.Text})
+		require.NoError(t, err)
+		decoded, err := dequantizeInt8(chunk.EmbeddingInt8)
+		require.NoError(t, err)
+		require.InDeltaSlice(t, e[0], decoded[:128], 1.0/127)
+	}
+
+	// the previous model's int8-only embeddings are kept side by side, dequantized
+	var previous ChunkEmbedding
+	require.NoError(t, db.Where("chunk_id = ? AND model = ?", dropped.Chunks[0].ID, "small").Take(&previous).Error)
+	require.Equal(t, 64, previous.Dims)
+	for _, r := range []*RAG{small, large} {
+		chunks, err := r.Search(ctx, &SearchOptions{Query: "small cherries", Limit: 1, Mode: SearchModeDense})
+		require.NoError(t, err)
+		require.Equal(t, "cherries are small", chunks[0].Text)
+	}
+}
+
+func TestQuantizedBeyondHalfvec(t *testing.T) {
+	forEachBackend(t, testQuantizedBeyondHalfvec)
+}
+
+func testQuantizedBeyondHalfvec(t *testing.T, db *gorm.DB) {
+	r := &RAG{DB: db, Embedder: &modelEmbedder{name: "huge", n: maxQuantizedDims}}
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+	}}
+	upsertDocument(t, r, d)
+
+	// only int8 embeddings hold more dimensions than the halfvec column
+	computed := 0
+	require.Error(t, r.ComputeEmbeddings(ctx, &ComputeOptions{Concurrency: 1, BatchSize: 2, Quantize: QuantizeInt8,
+		Progress: func(n int) { computed += n }}))
+	require.Zero(t, computed)
+	require.NoError(t, r.ComputeEmbeddings(ctx, &ComputeOptions{Concurrency: 1, BatchSize: 2, Quantize: QuantizeInt8,
+		DropOriginal: true, Progress: func(n int) { computed += n }}))
+	require.Equal(t, 2, computed)
+
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 1, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+}
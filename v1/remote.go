@@ -0,0 +1,230 @@
+package rag
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"resty.dev/v3"
+)
+
+// RemoteClient runs searches and questions against a rag server, so operators
+// need the server's URL and API key rather than database credentials.
+type RemoteClient struct {
+	client *resty.Client
+}
+
+func NewRemoteClient(baseURL string, apiKey string) *RemoteClient {
+	client := resty.New().SetBaseURL(strings.TrimSuffix(baseURL, "/"))
+	if apiKey != "" {
+		client.SetAuthToken(apiKey)
+	}
+	return &RemoteClient{client: client}
+}
+
+func (c *RemoteClient) Close() error {
+	return c.client.Close()
+}
+
+// collectionPath returns the API prefix of routes scoped to collection.
+func collectionPath(collection string) string {
+	if collection == "" {
+		return "/v1"
+	}
+	return "/v1/collections/" + url.PathEscape(collection)
+}
+
+func remoteError(rsp *resty.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(rsp.Bytes(), &body) == nil && body.Message != "" {
+		return errors.Newf("status code: %d, %s", rsp.StatusCode(), body.Message)
+	}
+	return errors.Newf("status code: %d, response: '%s'", rsp.StatusCode(), rsp.String())
+}
+
+type SearchResponse struct {
+	Count  int             `json:"count"`
+	Chunks []DocumentChunk `json:"chunks"`
+}
+
+func (c *RemoteClient) Search(ctx context.Context, collection string, p *SearchParam) ([]DocumentChunk, error) {
+	var response SearchResponse
+	rsp, err := c.client.R().SetContext(ctx).
+		SetQueryParam("limit", strconv.Itoa(p.Limit)).
+		SetBody(p).SetResult(&response).
+		Post(collectionPath(collection) + "/search")
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode() != http.StatusOK {
+		return nil, remoteError(rsp)
+	}
+	return response.Chunks, nil
+}
+
+func (c *RemoteClient) GetChunkContext(ctx context.Context, collection string, id string, before int, after int) (*ChunkContext, error) {
+	var response ChunkContext
+	rsp, err := c.client.R().SetContext(ctx).
+		SetQueryParam("before", strconv.Itoa(before)).
+		SetQueryParam("after", strconv.Itoa(after)).
+		SetResult(&response).
+		Get(collectionPath(collection) + "/chunks/" + url.PathEscape(id) + "/context")
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode() != http.StatusOK {
+		return nil, remoteError(rsp)
+	}
+	return &response, nil
+}
+
+// ListDocuments lists documents as RAG.ListDocuments does, paging through
+// them if opts.Limit is zero or above what the server returns at once.
+func (c *RemoteClient) ListDocuments(ctx context.Context, opts *ListDocumentsOptions) ([]DocumentInfo, error) {
+	documents := make([]DocumentInfo, 0)
+	offset := opts.Offset
+	for {
+		limit := maxListDocuments
+		if opts.Limit > 0 {
+			limit = min(opts.Limit-len(documents), maxListDocuments)
+		}
+		var response struct {
+			Documents []DocumentInfo `json:"documents"`
+		}
+		rsp, err := c.client.R().SetContext(ctx).
+			SetQueryParam("pattern", opts.Pattern).
+			SetQueryParam("limit", strconv.Itoa(limit)).
+			SetQueryParam("offset", strconv.Itoa(offset)).
+			SetResult(&response).
+			Get(collectionPath(opts.Collection) + "/documents")
+		if err != nil {
+			return nil, err
+		}
+		if rsp.StatusCode() != http.StatusOK {
+			return nil, remoteError(rsp)
+		}
+		documents = append(documents, response.Documents...)
+		offset += len(response.Documents)
+		if len(response.Documents) < limit || (opts.Limit > 0 && len(documents) >= opts.Limit) {
+			return documents, nil
+		}
+	}
+}
+
+// Stats summarizes the index as RAG.Stats does.
+func (c *RemoteClient) Stats(ctx context.Context, collection string) (*IndexStats, error) {
+	var stats IndexStats
+	rsp, err := c.client.R().SetContext(ctx).SetResult(&stats).
+		Get(collectionPath(collection) + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode() != http.StatusOK {
+		return nil, remoteError(rsp)
+	}
+	return &stats, nil
+}
+
+// SubmitDocuments queues documents and files for ingestion into collection
+// and returns the job tracking it, see GetJob.
+func (c *RemoteClient) SubmitDocuments(ctx context.Context, collection string, req *IngestRequest) (*IngestJob, error) {
+	var job IngestJob
+	rsp, err := c.client.R().SetContext(ctx).SetBody(req).SetResult(&job).
+		Post(collectionPath(collection) + "/documents")
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode() != http.StatusAccepted {
+		return nil, remoteError(rsp)
+	}
+	return &job, nil
+}
+
+func (c *RemoteClient) GetJob(ctx context.Context, id uint64) (*IngestJob, error) {
+	var job IngestJob
+	rsp, err := c.client.R().SetContext(ctx).SetResult(&job).
+		Get("/v1/jobs/" + strconv.FormatUint(id, 10))
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode() != http.StatusOK {
+		return nil, remoteError(rsp)
+	}
+	return &job, nil
+}
+
+// Chat asks the server a question, calling onToken for every streamed token
+// if not nil, and returns the final answer.
+func (c *RemoteClient) Chat(ctx context.Context, collection string, p *ChatParam, onToken func(token string) error) (*ChatResult, error) {
+	rsp, err := c.client.R().SetContext(ctx).
+		SetQueryParam("limit", strconv.Itoa(p.Limit)).
+		SetHeader("Accept", "text/event-stream").
+		SetBody(p).SetDoNotParseResponse(true).
+		Post(collectionPath(collection) + "/chat")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rsp.Body.Close() }()
+	if rsp.StatusCode() != http.StatusOK {
+		return nil, remoteError(rsp)
+	}
+
+	var event string
+	scanner := bufio.NewScanner(rsp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		switch event {
+		case "token":
+			if onToken == nil {
+				continue
+			}
+			var token struct {
+				Content string `json:"content"`
+			}
+			err = json.Unmarshal([]byte(data), &token)
+			if err != nil {
+				return nil, err
+			}
+			err = onToken(token.Content)
+			if err != nil {
+				return nil, err
+			}
+		case "error":
+			var e struct {
+				Error string `json:"error"`
+			}
+			err = json.Unmarshal([]byte(data), &e)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errors.New(e.Error)
+		case "done":
+			var result ChatResult
+			err = json.Unmarshal([]byte(data), &result)
+			if err != nil {
+				return nil, err
+			}
+			return &result, nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("chat stream ended without an answer")
+}
@@ -0,0 +1,134 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteClient(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+	}}
+	upsertDocument(t, r, d)
+
+	ts := httptest.NewServer(NewServer(r, &ServerOptions{}).e)
+	defer ts.Close()
+	client := NewRemoteClient(ts.URL, "secret")
+	defer func() { _ = client.Close() }()
+
+	rerank := false
+	chunks, err := client.Search(ctx, DefaultCollection, &SearchParam{Query: "bananas", Mode: "keyword", Limit: 5, Rerank: &rerank})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+
+	cc, err := client.GetChunkContext(ctx, DefaultCollection, chunks[0].ID, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, chunks[0].ID, cc.Chunk.ID)
+	require.Empty(t, cc.Before)
+
+	_, err = client.GetChunkContext(ctx, "other", chunks[0].ID, 0, 0)
+	require.ErrorContains(t, err, "chunk not found")
+
+	_, err = client.Search(ctx, DefaultCollection, &SearchParam{Query: "bananas", Mode: "fuzzy"})
+	require.ErrorContains(t, err, "status code: 400")
+
+	job, err := client.SubmitDocuments(ctx, "notes", &IngestRequest{
+		Files: []IngestFile{{Name: "cherries.txt", Data: []byte("cherries are dark")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, JobQueued, job.Status)
+	job, err = client.GetJob(ctx, job.ID)
+	require.NoError(t, err)
+	require.Equal(t, "notes", job.Collection)
+	_, err = client.SubmitDocuments(ctx, "notes", &IngestRequest{})
+	require.ErrorContains(t, err, "no documents or files")
+}
+
+func TestRemoteClientListAndStats(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	ctx := context.Background()
+
+	for i := range maxListDocuments + 5 {
+		d := &Document{FileName: fmt.Sprintf("notes/%04d.md", i), Chunks: []*DocumentChunk{{Text: "note"}}}
+		upsertDocument(t, r, d)
+	}
+	d := &Document{FileName: "fruits.md", Collection: "fruits", Chunks: []*DocumentChunk{{Text: "apples"}, {Text: "plums"}}}
+	upsertDocument(t, r, d)
+
+	ts := httptest.NewServer(NewServer(r, &ServerOptions{}).e)
+	defer ts.Close()
+	client := NewRemoteClient(ts.URL, "")
+	defer func() { _ = client.Close() }()
+
+	// no limit pages through all documents of all collections
+	documents, err := client.ListDocuments(ctx, &ListDocumentsOptions{})
+	require.NoError(t, err)
+	require.Len(t, documents, maxListDocuments+6)
+	require.Equal(t, "fruits.md", documents[maxListDocuments+5].RawDocument)
+
+	documents, err = client.ListDocuments(ctx, &ListDocumentsOptions{Pattern: "notes/*", Limit: 2, Offset: 3})
+	require.NoError(t, err)
+	require.Len(t, documents, 2)
+	require.Equal(t, "notes/0003.md", documents[0].RawDocument)
+
+	documents, err = client.ListDocuments(ctx, &ListDocumentsOptions{Collection: "fruits"})
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+	require.EqualValues(t, 2, documents[0].Chunks)
+
+	// /v1 summarizes all collections, the collection routes one
+	stats, err := client.Stats(ctx, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats.Collections)
+	require.EqualValues(t, maxListDocuments+7, stats.Chunks)
+	stats, err = client.Stats(ctx, "fruits")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, stats.Documents)
+	require.EqualValues(t, 2, stats.Chunks)
+
+	rsp, err := http.Get(ts.URL + "/v1/stats?collection=fruits")
+	require.NoError(t, err)
+	_ = rsp.Body.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	rsp, err = http.Get(ts.URL + "/v1/documents?collection=-bad")
+	require.NoError(t, err)
+	_ = rsp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
+
+func TestRemoteClientChat(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/collections/docs/chat", r.URL.Path)
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "event: token\ndata: {\"content\":\"Red\"}\n\n")
+		_, _ = fmt.Fprint(w, "event: token\ndata: {\"content\":\" [1]\"}\n\n")
+		_, _ = fmt.Fprint(w, "event: done\ndata: {\"answer\":\"Red [1]\",\"citations\":[{\"index\":1,\"chunk_id\":\"a\"}],\"config_version\":3}\n\n")
+	}))
+	defer ts.Close()
+	client := NewRemoteClient(ts.URL+"/", "secret")
+	defer func() { _ = client.Close() }()
+
+	var tokens string
+	result, err := client.Chat(context.Background(), "docs", &ChatParam{SearchParam{Query: "apples?"}}, func(token string) error {
+		tokens += token
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Red [1]", tokens)
+	require.Equal(t, "Red [1]", result.Answer)
+	require.Equal(t, []Citation{{Index: 1, ChunkID: "a"}}, result.Citations)
+	require.EqualValues(t, 3, result.ConfigVersion)
+}
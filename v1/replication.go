@@ -0,0 +1,415 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// RowChange is the outbox a standby follows. Triggers keep one row per row
+// of every replicated table, so the outbox stays bounded by the number of rows
+// ever written and a standby only fetches each row's latest state. Xid is the
+// transaction that wrote the change: changes are read in transaction order,
+// and only once every transaction before them has ended, so a transaction
+// committing after a later one is never skipped.
+type RowChange struct {
+	Table   string `gorm:"column:table_name;primaryKey"`
+	Key     string `gorm:"type:jsonb;primaryKey"`
+	Xid     int64  `gorm:"not null;index:idx_row_changes_order,priority:1"`
+	Seq     int64  `gorm:"not null;index:idx_row_changes_order,priority:2"`
+	Deleted bool   `gorm:"not null;default:false"`
+}
+
+// ReplicationState records how far a standby has applied the primary's outbox.
+type ReplicationState struct {
+	ID        uint  `gorm:"primaryKey"`
+	Xid       int64 `gorm:"not null;default:0"`
+	Seq       int64 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+// migrateChangeFeed creates the chunk_changes outbox of the baseline,
+// replaced by row_changes in schema version 11.
+func migrateChangeFeed(db *gorm.DB) error {
+	backfill := !db.Migrator().HasTable(&baselineChunkChange{})
+
+	err := db.Exec("CREATE SEQUENCE IF NOT EXISTS chunk_changes_seq").Error
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(&baselineChunkChange{}, &baselineReplicationState{})
+	if err != nil {
+		return err
+	}
+
+	err = db.Exec(`CREATE OR REPLACE FUNCTION record_chunk_change() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    INSERT INTO chunk_changes (chunk_id, seq, deleted) VALUES (OLD.id, nextval('chunk_changes_seq'), true)
+    ON CONFLICT (chunk_id) DO UPDATE SET seq = EXCLUDED.seq, deleted = true;
+    RETURN OLD;
+  END IF;
+  INSERT INTO chunk_changes (chunk_id, seq, deleted) VALUES (NEW.id, nextval('chunk_changes_seq'), false)
+  ON CONFLICT (chunk_id) DO UPDATE SET seq = EXCLUDED.seq, deleted = false;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return err
+	}
+	err = db.Exec("DROP TRIGGER IF EXISTS document_chunks_change_feed ON document_chunks").Error
+	if err != nil {
+		return err
+	}
+	err = db.Exec(`CREATE TRIGGER document_chunks_change_feed
+AFTER INSERT OR UPDATE OR DELETE ON document_chunks
+FOR EACH ROW EXECUTE FUNCTION record_chunk_change()`).Error
+	if err != nil {
+		return err
+	}
+
+	if backfill {
+		return db.Exec(`INSERT INTO chunk_changes (chunk_id, seq, deleted)
+SELECT id, nextval('chunk_changes_seq'), false FROM document_chunks
+ON CONFLICT (chunk_id) DO NOTHING`).Error
+	}
+	return nil
+}
+
+// replicatedTable is a table the outbox covers, keyed by the columns of its
+// primary key. The rest are local to a server: API keys, canary metrics,
+// the query cache, ingest jobs and index tuning samples.
+type replicatedTable struct {
+	name string
+	keys []string
+	// rows returns a pointer to an empty slice of the table's model.
+	rows func() any
+	// serial is the column whose sequence is moved past the replicated rows,
+	// so a promoted standby doesn't reuse their IDs.
+	serial string
+}
+
+var replicatedTables = []replicatedTable{
+	{name: "collections", keys: []string{"name"}, rows: func() any { return &[]Collection{} }},
+	{name: "config_versions", keys: []string{"version"}, rows: func() any { return &[]ConfigVersion{} }, serial: "version"},
+	{name: "canaries", keys: []string{"version"}, rows: func() any { return &[]Canary{} }},
+	{name: "retention_policies", keys: []string{"name"}, rows: func() any { return &[]RetentionPolicy{} }},
+	{name: "embedding_models", keys: []string{"name"}, rows: func() any { return &[]EmbeddingModel{} }},
+	{name: "source_files", keys: []string{"path"}, rows: func() any { return &[]SourceFile{} }},
+	{name: "document_chunks", keys: []string{"id"}, rows: func() any { return &[]DocumentChunk{} }},
+	{name: "chunk_embeddings", keys: []string{"chunk_id", "model"}, rows: func() any { return &[]ChunkEmbedding{} }},
+	{name: "chunk_versions", keys: []string{"version_id"}, rows: func() any { return &[]ChunkVersion{} }, serial: "version_id"},
+	{name: "entities", keys: []string{"id"}, rows: func() any { return &[]Entity{} }},
+	{name: "entity_mentions", keys: []string{"entity_id", "chunk_id"}, rows: func() any { return &[]EntityMention{} }},
+	{name: "entity_relations", keys: []string{"source_id", "target_id", "relation", "chunk_id"},
+		rows: func() any { return &[]EntityRelation{} }},
+	{name: "graph_chunks", keys: []string{"chunk_id"}, rows: func() any { return &[]GraphChunk{} }},
+}
+
+// keyIn matches the rows of the keys given as [][]any, compared as text like
+// the keys of the outbox.
+func (t *replicatedTable) keyIn() string {
+	columns := make([]string, len(t.keys))
+	for i, key := range t.keys {
+		columns[i] = key + "::text"
+	}
+	return "(" + strings.Join(columns, ", ") + ") IN ?"
+}
+
+// recordRowChangeSQL records a write to the outbox, the key columns being
+// the arguments of the trigger. An update of the key deletes the old row.
+const recordRowChangeSQL = `CREATE OR REPLACE FUNCTION record_row_change() RETURNS trigger AS $$
+DECLARE
+  old_key jsonb;
+  new_key jsonb;
+BEGIN
+  IF TG_OP <> 'INSERT' THEN
+    SELECT jsonb_agg(to_jsonb(OLD) ->> k ORDER BY i) INTO old_key FROM unnest(TG_ARGV) WITH ORDINALITY AS a(k, i);
+  END IF;
+  IF TG_OP <> 'DELETE' THEN
+    SELECT jsonb_agg(to_jsonb(NEW) ->> k ORDER BY i) INTO new_key FROM unnest(TG_ARGV) WITH ORDINALITY AS a(k, i);
+  END IF;
+  IF old_key IS NOT NULL AND old_key IS DISTINCT FROM new_key THEN
+    INSERT INTO row_changes (table_name, key, xid, seq, deleted)
+    VALUES (TG_TABLE_NAME, old_key, pg_current_xact_id()::text::bigint, nextval('row_changes_seq'), true)
+    ON CONFLICT (table_name, key) DO UPDATE SET xid = EXCLUDED.xid, seq = EXCLUDED.seq, deleted = true;
+  END IF;
+  IF new_key IS NOT NULL THEN
+    INSERT INTO row_changes (table_name, key, xid, seq, deleted)
+    VALUES (TG_TABLE_NAME, new_key, pg_current_xact_id()::text::bigint, nextval('row_changes_seq'), false)
+    ON CONFLICT (table_name, key) DO UPDATE SET xid = EXCLUDED.xid, seq = EXCLUDED.seq, deleted = false;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`
+
+type rowChangeV11 struct {
+	Table   string `gorm:"column:table_name;primaryKey"`
+	Key     string `gorm:"type:jsonb;primaryKey"`
+	Xid     int64  `gorm:"not null;index:idx_row_changes_order,priority:1"`
+	Seq     int64  `gorm:"not null;index:idx_row_changes_order,priority:2"`
+	Deleted bool   `gorm:"not null;default:false"`
+}
+
+func (rowChangeV11) TableName() string { return "row_changes" }
+
+type replicationStateV11 struct {
+	ID        uint  `gorm:"primaryKey"`
+	Xid       int64 `gorm:"not null;default:0"`
+	Seq       int64 `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+func (replicationStateV11) TableName() string { return "replication_states" }
+
+// migrateRowChanges replaces the chunk_changes outbox with row_changes,
+// covering every replicated table. Standbys apply everything again, as
+// their sequence numbers no longer match.
+func migrateRowChanges(tx *gorm.DB) error {
+	if tx.Dialector.Name() == sqliteDialect {
+		return nil
+	}
+	stmts := []string{
+		"DROP TRIGGER IF EXISTS document_chunks_change_feed ON document_chunks",
+		"DROP FUNCTION IF EXISTS record_chunk_change()",
+		"DROP TABLE IF EXISTS chunk_changes",
+		"DROP SEQUENCE IF EXISTS chunk_changes_seq",
+		"CREATE SEQUENCE IF NOT EXISTS row_changes_seq",
+		recordRowChangeSQL,
+	}
+	for _, stmt := range stmts {
+		err := tx.Exec(stmt).Error
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.AutoMigrate(&rowChangeV11{}, &replicationStateV11{})
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&replicationStateV11{}).Where("1 = 1").Updates(map[string]any{"xid": 0, "seq": 0}).Error
+	if err != nil {
+		return err
+	}
+
+	for _, t := range replicatedTables {
+		columns := make([]string, len(t.keys))
+		for i, key := range t.keys {
+			columns[i] = "'" + key + "'"
+		}
+		err = tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %[1]s_row_changes ON %[1]s", t.name)).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(fmt.Sprintf("CREATE TRIGGER %[1]s_row_changes AFTER INSERT OR UPDATE OR DELETE ON %[1]s "+
+			"FOR EACH ROW EXECUTE FUNCTION record_row_change(%s)", t.name, strings.Join(columns, ", "))).Error
+		if err != nil {
+			return err
+		}
+
+		key := make([]string, len(t.keys))
+		for i, k := range t.keys {
+			key[i] = k + "::text"
+		}
+		err = tx.Exec(fmt.Sprintf(`INSERT INTO row_changes (table_name, key, xid, seq, deleted)
+SELECT ?, jsonb_build_array(%s), pg_current_xact_id()::text::bigint, nextval('row_changes_seq'), false FROM %s
+ON CONFLICT (table_name, key) DO NOTHING`, strings.Join(key, ", "), t.name), t.name).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropRowChanges(tx *gorm.DB) error {
+	if tx.Dialector.Name() == sqliteDialect {
+		return nil
+	}
+	for _, t := range replicatedTables {
+		err := tx.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %[1]s_row_changes ON %[1]s", t.name)).Error
+		if err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS row_changes",
+		"DROP FUNCTION IF EXISTS record_row_change()",
+		"DROP SEQUENCE IF EXISTS row_changes_seq",
+		"ALTER TABLE replication_states DROP COLUMN IF EXISTS xid",
+		"UPDATE replication_states SET seq = 0",
+	} {
+		err := tx.Exec(stmt).Error
+		if err != nil {
+			return err
+		}
+	}
+	return migrateChangeFeed(tx)
+}
+
+type ReplicationStatus struct {
+	Xid      int64     `json:"xid"`
+	Seq      int64     `json:"seq"`
+	Applied  int64     `json:"applied"`
+	LastSync time.Time `json:"last_sync"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Replicator keeps a standby database in sync with a primary by following
+// the primary's row_changes outbox.
+type Replicator struct {
+	Primary   *gorm.DB
+	Standby   *gorm.DB
+	Interval  time.Duration
+	BatchSize int
+
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+func (rp *Replicator) Status() ReplicationStatus {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.status
+}
+
+// Run applies changes until ctx is done, polling every Interval once caught up.
+func (rp *Replicator) Run(ctx context.Context) {
+	ticker := time.NewTicker(rp.Interval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := rp.Sync(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Msg("Replicate chunks")
+				}
+				break
+			}
+			if n < rp.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync applies one batch of changes and returns how many were applied.
+func (rp *Replicator) Sync(ctx context.Context) (int, error) {
+	n, err := rp.sync(ctx)
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err != nil {
+		rp.status.Error = err.Error()
+		return 0, err
+	}
+	rp.status.Error = ""
+	rp.status.Applied += int64(n)
+	rp.status.LastSync = time.Now()
+	return n, nil
+}
+
+func (rp *Replicator) sync(ctx context.Context) (int, error) {
+	state := ReplicationState{ID: 1}
+	err := rp.Standby.WithContext(ctx).FirstOrCreate(&state).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to load replication state")
+	}
+
+	// transactions before the oldest one still running have all ended, so no
+	// change will appear behind the cursor later
+	var changes []RowChange
+	err = rp.Primary.WithContext(ctx).
+		Where("xid < pg_snapshot_xmin(pg_current_snapshot())::text::bigint AND (xid, seq) > (?, ?)", state.Xid, state.Seq).
+		Order("xid, seq").Limit(rp.BatchSize).Find(&changes).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to read change feed")
+	}
+	if len(changes) == 0 {
+		rp.mu.Lock()
+		rp.status.Xid, rp.status.Seq = state.Xid, state.Seq
+		rp.mu.Unlock()
+		return 0, nil
+	}
+
+	keys := make(map[string][][]any)
+	for _, c := range changes {
+		var key []string
+		err = json.Unmarshal([]byte(c.Key), &key)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Invalid key of %s in change feed", c.Table)
+		}
+		values := make([]any, len(key))
+		for i, v := range key {
+			values[i] = v
+		}
+		keys[c.Table] = append(keys[c.Table], values)
+	}
+
+	// every changed row is deleted, then copied again if the primary still
+	// has it, deletes and key updates included
+	type tableRows struct {
+		table *replicatedTable
+		keys  [][]any
+		rows  any
+		n     int64
+	}
+	var tables []tableRows
+	for i := range replicatedTables {
+		t := &replicatedTables[i]
+		if len(keys[t.name]) == 0 {
+			continue
+		}
+		rows := t.rows()
+		result := rp.Primary.WithContext(ctx).Where(t.keyIn(), keys[t.name]).Find(rows)
+		if result.Error != nil {
+			return 0, errors.Wrapf(result.Error, "Failed to read %s from primary", t.name)
+		}
+		tables = append(tables, tableRows{table: t, keys: keys[t.name], rows: rows, n: result.RowsAffected})
+	}
+
+	last := changes[len(changes)-1]
+	err = rp.Standby.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, t := range tables {
+			err := tx.Exec("DELETE FROM "+t.table.name+" WHERE "+t.table.keyIn(), t.keys).Error
+			if err != nil {
+				return err
+			}
+			if t.n == 0 {
+				continue
+			}
+			err = tx.Create(t.rows).Error
+			if err != nil {
+				return err
+			}
+			if t.table.serial != "" {
+				err = tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', '%[2]s'), max(%[2]s)) FROM %[1]s",
+					t.table.name, t.table.serial)).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&ReplicationState{}).Where("id = ?", state.ID).
+			Updates(map[string]any{"xid": last.Xid, "seq": last.Seq}).Error
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to apply changes")
+	}
+
+	rp.mu.Lock()
+	rp.status.Xid, rp.status.Seq = last.Xid, last.Seq
+	rp.mu.Unlock()
+	return len(changes), nil
+}
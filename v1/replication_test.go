@@ -0,0 +1,98 @@
+package rag
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pgvector/pgvector-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	primary, standby := openPostgresTestDB(t, dsn), openPostgresTestDB(t, dsn)
+	rp := &Replicator{Primary: primary, Standby: standby, Interval: time.Second, BatchSize: 5}
+	r := &RAG{DB: primary, Embedder: wordEmbedder{}}
+	ctx := context.Background()
+
+	syncAll := func() int {
+		applied := 0
+		for {
+			n, err := rp.Sync(ctx)
+			require.NoError(t, err)
+			if n == 0 {
+				return applied
+			}
+			applied += n
+		}
+	}
+	count := func(table string) (int64, int64) {
+		var p, s int64
+		require.NoError(t, primary.Table(table).Count(&p).Error)
+		require.NoError(t, standby.Table(table).Count(&s).Error)
+		return p, s
+	}
+
+	// a transaction writing before another one commits after it
+	early := primary.Begin()
+	require.NoError(t, early.Create(&Collection{Name: "early", Distance: "cosine"}).Error)
+	late := &Document{FileName: "late.md", Chunks: []*DocumentChunk{{Text: "apples are red"}, {Text: "plums"}}}
+	late.Fix()
+	require.NoError(t, r.UpsertDocumentChunks(late))
+	require.Zero(t, syncAll())
+	require.NoError(t, early.Commit().Error)
+	require.Positive(t, syncAll())
+	var collection Collection
+	require.NoError(t, standby.First(&collection, "name = ?", "early").Error)
+	require.Equal(t, "cosine", collection.Distance)
+	_, chunks := count("document_chunks")
+	require.EqualValues(t, 2, chunks)
+
+	// every replicated table follows, deletes included
+	require.NoError(t, r.ComputeEmbeddings(ctx, &ComputeOptions{OnlyEmpty: true, Concurrency: 1, BatchSize: 3}))
+	e := make([]float32, dims)
+	e[0] = 1
+	hv := pgvector.NewHalfVector(e)
+	now := time.Now()
+	for _, v := range []any{
+		&ConfigVersion{Author: "test", Message: "first"},
+		&Canary{Version: 1, Percent: 10, StartedAt: now},
+		&RetentionPolicy{Name: "all", Pattern: "*", KeepVersions: 1},
+		&EmbeddingModel{Name: "next", Dims: 1},
+		&ChunkEmbedding{ChunkID: late.Chunks[0].ID, Model: "next", Dims: 1, Embedding: &hv},
+		&SourceFile{Path: "late.md", SHA256: "00", Document: late.Chunks[0].Document},
+		&Entity{ID: "apple", Collection: DefaultCollection, Name: "apple"},
+		&Entity{ID: "red", Collection: DefaultCollection, Name: "red"},
+		&EntityMention{EntityID: "apple", ChunkID: late.Chunks[0].ID},
+		&EntityRelation{SourceID: "apple", TargetID: "red", Relation: "is", ChunkID: late.Chunks[0].ID},
+		&GraphChunk{ChunkID: late.Chunks[0].ID, Entities: 2, ExtractedAt: now},
+	} {
+		require.NoError(t, primary.Create(v).Error)
+	}
+	late.Chunks[1].Text = "plums are purple"
+	require.NoError(t, r.UpsertDocumentChunks(late))
+	require.NoError(t, primary.Delete(&Entity{}, "id = ?", "red").Error)
+	require.NoError(t, primary.Model(&DocumentChunk{}).Where("id = ?", late.Chunks[0].ID).Update("id", "renamed").Error)
+	syncAll()
+	for _, table := range replicatedTables {
+		p, s := count(table.name)
+		require.Equal(t, p, s, table.name)
+	}
+	var ids []string
+	require.NoError(t, standby.Model(&DocumentChunk{}).Pluck("id", &ids).Error)
+	require.ElementsMatch(t, []string{late.Chunks[1].ID, "renamed"}, ids)
+	var text string
+	require.NoError(t, standby.Model(&DocumentChunk{}).Where("id = ?", late.Chunks[1].ID).Pluck("text", &text).Error)
+	require.Equal(t, "plums are purple", text)
+
+	// a promoted standby doesn't reuse the replicated IDs
+	promoted := &ConfigVersion{Author: "test", Message: "promoted"}
+	require.NoError(t, standby.Create(promoted).Error)
+	require.EqualValues(t, 2, promoted.Version)
+	require.NotZero(t, rp.Status().Xid)
+}
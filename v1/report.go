@@ -0,0 +1,398 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/errors"
+	"gorm.io/gorm"
+)
+
+type Distribution struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	P50    float64 `json:"p50"`
+	P95    float64 `json:"p95"`
+}
+
+func newDistribution(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+	var variance float64
+	for _, v := range sorted {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(sorted))
+
+	return Distribution{
+		Count:  len(sorted),
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Mean:   mean,
+		StdDev: math.Sqrt(variance),
+		P50:    percentile(sorted, 0.5),
+		P95:    percentile(sorted, 0.95),
+	}
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(math.Round(p*float64(len(sorted)-1)))]
+}
+
+func (d *Distribution) zScore(v float64) float64 {
+	if d.StdDev == 0 {
+		return 0
+	}
+	return (v - d.Mean) / d.StdDev
+}
+
+type HistogramBucket struct {
+	Lower int `json:"lower"`
+	Upper int `json:"upper"`
+	Count int `json:"count"`
+}
+
+var textLengthBuckets = []int{0, 128, 256, 512, 1024, 2048, 4096}
+
+type ChunkOutlier struct {
+	ID       string  `json:"id"`
+	Document string  `json:"document"`
+	Distance float64 `json:"distance"`
+}
+
+type DocumentAnomaly struct {
+	Document string  `json:"document"`
+	Chunks   int     `json:"chunks"`
+	Reason   string  `json:"reason"`
+	Value    float64 `json:"value"`
+}
+
+// CorpusHealthReport covers the leaf chunks of one collection, summaries are
+// generated from them and left out.
+type CorpusHealthReport struct {
+	Collection string `json:"collection"`
+	// Model is the active embedding model, empty when no named model embedded the chunks.
+	Model    string `json:"model,omitempty"`
+	Chunks   int    `json:"chunks"`
+	Embedded int    `json:"embedded"`
+	// Quantized is the number of chunks embedded in int8 only, whose norms
+	// are those of their dequantized embeddings.
+	Quantized int `json:"quantized"`
+	// Norms are those of the chunks' embeddings, Models those of the
+	// embeddings by other models kept side by side in chunk_embeddings.
+	Norms             Distribution      `json:"norms"`
+	Models            []ModelNorms      `json:"models,omitempty"`
+	NeighborDistances Distribution      `json:"neighbor_distances"`
+	TextLengths       Distribution      `json:"text_lengths"`
+	LengthHistogram   []HistogramBucket `json:"length_histogram"`
+	Outliers          []ChunkOutlier    `json:"outliers"`
+	Anomalies         []DocumentAnomaly `json:"anomalies"`
+}
+
+type ModelNorms struct {
+	Model string       `json:"model"`
+	Norms Distribution `json:"norms"`
+}
+
+type chunkStat struct {
+	ID             string
+	Document       string
+	Length         int
+	EmbeddingModel string
+	// Norm is the L2 norm of the embedding, nil if it was dropped or not
+	// computed; EmbeddingInt8 is read only then.
+	Norm          *float64
+	EmbeddingInt8 Int8Embedding
+}
+
+type modelNorm struct {
+	Model string
+	Norm  float64
+}
+
+type chunkNeighbor struct {
+	ID       string
+	Document string
+	// Distance is the L2 distance to the nearest other chunk.
+	Distance float64
+}
+
+type CorpusHealthOptions struct {
+	// Collection is the collection reported on, empty means DefaultCollection.
+	Collection string
+	SampleSize int
+	ZThreshold float64
+}
+
+func (r *RAG) CorpusHealth(ctx context.Context, opts *CorpusHealthOptions) (*CorpusHealthReport, error) {
+	collection := opts.Collection
+	if collection == "" {
+		collection = DefaultCollection
+	}
+	db := r.DB.WithContext(ctx)
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := backendOf(r.DB).chunkStats(db, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CorpusHealthReport{Collection: collection, Chunks: len(stats)}
+	if active != nil {
+		report.Model = active.Name
+	}
+
+	lengths := make([]float64, 0, len(stats))
+	norms := make([]float64, 0, len(stats))
+	documentNorms := make(map[string][]float64)
+	otherModels := make(map[[2]string]int)
+	histogram := make([]HistogramBucket, len(textLengthBuckets))
+	for i, lower := range textLengthBuckets {
+		histogram[i].Lower = lower
+		if i+1 < len(textLengthBuckets) {
+			histogram[i].Upper = textLengthBuckets[i+1]
+		} else {
+			histogram[i].Upper = -1
+		}
+	}
+
+	for _, s := range stats {
+		lengths = append(lengths, float64(s.Length))
+		for i := len(histogram) - 1; i >= 0; i-- {
+			if s.Length >= histogram[i].Lower {
+				histogram[i].Count++
+				break
+			}
+		}
+		if s.Norm == nil && s.EmbeddingInt8 != nil {
+			e, err := dequantizeInt8(s.EmbeddingInt8)
+			if err != nil {
+				return nil, errors.Wrapf(err, "chunk %s", s.ID)
+			}
+			norm := l2Norm(e)
+			s.Norm = &norm
+			report.Quantized++
+		}
+		if s.Norm != nil {
+			norms = append(norms, *s.Norm)
+			documentNorms[s.Document] = append(documentNorms[s.Document], *s.Norm)
+			if report.Model != "" && s.EmbeddingModel != "" && s.EmbeddingModel != report.Model {
+				otherModels[[2]string{s.Document, s.EmbeddingModel}]++
+			}
+		}
+	}
+	report.Embedded = len(norms)
+	report.TextLengths = newDistribution(lengths)
+	report.LengthHistogram = histogram
+	report.Norms = newDistribution(norms)
+
+	for document, ns := range documentNorms {
+		d := newDistribution(ns)
+		if z := report.Norms.zScore(d.Mean); math.Abs(z) >= opts.ZThreshold {
+			report.Anomalies = append(report.Anomalies, DocumentAnomaly{
+				Document: document,
+				Chunks:   len(ns),
+				Reason:   "mean embedding norm deviates from corpus, possibly embedded with a different model",
+				Value:    d.Mean,
+			})
+		}
+	}
+	for key, count := range otherModels {
+		report.Anomalies = append(report.Anomalies, DocumentAnomaly{
+			Document: key[0],
+			Chunks:   count,
+			Reason:   fmt.Sprintf("embedded with %s, not the active model %s", key[1], report.Model),
+			Value:    float64(count),
+		})
+	}
+
+	spaceNorms, err := backendOf(r.DB).modelNorms(db, collection)
+	if err != nil {
+		return nil, err
+	}
+	byModel := make(map[string][]float64)
+	for _, n := range spaceNorms {
+		byModel[n.Model] = append(byModel[n.Model], n.Norm)
+	}
+	for model, ns := range byModel {
+		report.Models = append(report.Models, ModelNorms{Model: model, Norms: newDistribution(ns)})
+	}
+	sort.Slice(report.Models, func(i, j int) bool { return report.Models[i].Model < report.Models[j].Model })
+
+	// chunks embedded in int8 only have no distance operator to find their neighbors
+	neighbors, err := backendOf(r.DB).nearestNeighbors(db, collection, opts.SampleSize)
+	if err != nil {
+		return nil, err
+	}
+
+	distances := make([]float64, len(neighbors))
+	for i, n := range neighbors {
+		distances[i] = n.Distance
+	}
+	report.NeighborDistances = newDistribution(distances)
+
+	outliersPerDocument := make(map[string]int)
+	for _, n := range neighbors {
+		if report.NeighborDistances.zScore(n.Distance) >= opts.ZThreshold {
+			report.Outliers = append(report.Outliers, ChunkOutlier{ID: n.ID, Document: n.Document, Distance: n.Distance})
+			outliersPerDocument[n.Document]++
+		}
+	}
+	for document, count := range outliersPerDocument {
+		if count > 1 {
+			report.Anomalies = append(report.Anomalies, DocumentAnomaly{
+				Document: document,
+				Chunks:   count,
+				Reason:   "cluster of isolated chunks far from any neighbor",
+				Value:    float64(count),
+			})
+		}
+	}
+
+	sort.Slice(report.Outliers, func(i, j int) bool {
+		return report.Outliers[i].Distance > report.Outliers[j].Distance
+	})
+	sort.SliceStable(report.Anomalies, func(i, j int) bool {
+		if report.Anomalies[i].Document != report.Anomalies[j].Document {
+			return report.Anomalies[i].Document < report.Anomalies[j].Document
+		}
+		return report.Anomalies[i].Reason < report.Anomalies[j].Reason
+	})
+	return report, nil
+}
+
+func l2Norm(v []float32) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	return math.Sqrt(sum)
+}
+
+// reportedChunks selects the leaf chunks of collection.
+func reportedChunks(db *gorm.DB, collection string) *gorm.DB {
+	return db.Model(&DocumentChunk{}).Where("collection = ?", collection).Where(leafChunks("document_chunks"))
+}
+
+func (postgresBackend) chunkStats(db *gorm.DB, collection string) ([]chunkStat, error) {
+	var stats []chunkStat
+	err := reportedChunks(db, collection).
+		Select("id, document, char_length(text) AS length, embedding_model, l2_norm(embedding) AS norm, " +
+			"CASE WHEN embedding IS NULL THEN embedding_int8 END AS embedding_int8").
+		Find(&stats).Error
+	return stats, err
+}
+
+func (postgresBackend) modelNorms(db *gorm.DB, collection string) ([]modelNorm, error) {
+	var norms []modelNorm
+	err := db.Raw(`SELECT e.model, l2_norm(e.embedding) AS norm
+FROM chunk_embeddings e JOIN document_chunks c ON c.id = e.chunk_id
+WHERE c.collection = ? AND `+leafChunks("c"), collection).Scan(&norms).Error
+	return norms, err
+}
+
+func (postgresBackend) nearestNeighbors(db *gorm.DB, collection string, sampleSize int) ([]chunkNeighbor, error) {
+	var neighbors []chunkNeighbor
+	err := db.Raw(`SELECT s.id, s.document, nn.distance FROM
+  (SELECT id, document, embedding FROM document_chunks c
+   WHERE c.collection = ? AND `+leafChunks("c")+` AND c.embedding IS NOT NULL ORDER BY random() LIMIT ?) s
+  CROSS JOIN LATERAL
+  (SELECT c.embedding <-> s.embedding AS distance FROM document_chunks c
+   WHERE c.collection = ? AND `+leafChunks("c")+` AND c.id <> s.id AND c.embedding IS NOT NULL
+   ORDER BY c.embedding <-> s.embedding LIMIT 1) nn`,
+		collection, sampleSize, collection).Scan(&neighbors).Error
+	return neighbors, err
+}
+
+func (sqliteBackend) chunkStats(db *gorm.DB, collection string) ([]chunkStat, error) {
+	var chunks []DocumentChunk
+	err := reportedChunks(db, collection).
+		Select("id", "document", "text", "embedding_model", "embedding", "embedding_int8").Find(&chunks).Error
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]chunkStat, len(chunks))
+	for i, c := range chunks {
+		stats[i] = chunkStat{
+			ID:             c.ID,
+			Document:       c.Document,
+			Length:         utf8.RuneCountInString(c.Text),
+			EmbeddingModel: c.EmbeddingModel,
+		}
+		if c.Embedding != nil {
+			norm := l2Norm(c.Embedding.Slice())
+			stats[i].Norm = &norm
+		} else {
+			stats[i].EmbeddingInt8 = c.EmbeddingInt8
+		}
+	}
+	return stats, nil
+}
+
+func (sqliteBackend) modelNorms(db *gorm.DB, collection string) ([]modelNorm, error) {
+	var embeddings []ChunkEmbedding
+	err := db.Model(&ChunkEmbedding{}).Select("chunk_embeddings.model", "chunk_embeddings.embedding").
+		Joins("JOIN document_chunks c ON c.id = chunk_embeddings.chunk_id").
+		Where("c.collection = ? AND "+leafChunks("c"), collection).Find(&embeddings).Error
+	if err != nil {
+		return nil, err
+	}
+	norms := make([]modelNorm, len(embeddings))
+	for i, e := range embeddings {
+		norms[i] = modelNorm{Model: e.Model, Norm: l2Norm(e.Embedding.Slice())}
+	}
+	return norms, nil
+}
+
+func (sqliteBackend) nearestNeighbors(db *gorm.DB, collection string, sampleSize int) ([]chunkNeighbor, error) {
+	var chunks []DocumentChunk
+	err := reportedChunks(db, collection).Select("id", "document", "embedding").
+		Where("embedding IS NOT NULL").Find(&chunks).Error
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float32, len(chunks))
+	for i, c := range chunks {
+		embeddings[i] = c.Embedding.Slice()
+	}
+	sample := rand.Perm(len(chunks))
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	neighbors := make([]chunkNeighbor, 0, len(sample))
+	for _, i := range sample {
+		nearest := math.Inf(1)
+		for j := range chunks {
+			if j == i {
+				continue
+			}
+			d, _ := vectorDistance(DistanceL2, embeddings[i], embeddings[j])
+			nearest = min(nearest, d)
+		}
+		if !math.IsInf(nearest, 1) {
+			neighbors = append(neighbors, chunkNeighbor{ID: chunks[i].ID, Document: chunks[i].Document, Distance: nearest})
+		}
+	}
+	return neighbors, nil
+}
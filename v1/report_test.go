@@ -0,0 +1,95 @@
+package rag
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/pgvector/pgvector-go"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestCorpusHealth(t *testing.T) {
+	forEachBackend(t, testCorpusHealth)
+}
+
+func testCorpusHealth(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	fruits := upsertTexts(t, r, "", "fruits.md", "apples are red", "bananas are yellow", "cherries are small", "plums")
+	upsertTexts(t, r, "", "nuts.md", "walnuts are brown")
+	upsertTexts(t, r, "", "figs.md", "figs are purple")
+	upsertTexts(t, r, "veggies", "veggies.md", "carrots are orange")
+	embedChunks(t, r, &ComputeOptions{Documents: []string{"fruits"}, BatchSize: 3})
+	require.NoError(t, r.ComputeEmbeddings(ctx, &ComputeOptions{Documents: []string{"nuts"}, Concurrency: 1, BatchSize: 3,
+		Quantize: QuantizeInt8, DropOriginal: true}))
+	embedChunks(t, r, &ComputeOptions{Collection: "veggies", BatchSize: 3})
+
+	// summaries are left out
+	summary := &DocumentChunk{Text: "fruits of all colors"}
+	summary.Fix(fruits, len(fruits.Chunks))
+	summary.Level = LevelSection
+	require.NoError(t, db.Create(summary).Error)
+
+	// one chunk was embedded by a model replaced since, another model is kept side by side
+	require.NoError(t, db.Create(&EmbeddingModel{Name: "words", Active: true}).Error)
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("embedding_model = ''").Update("embedding_model", "words").Error)
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("id = ?", fruits.Chunks[0].ID).
+		Update("embedding_model", "letters").Error)
+	e := make([]float32, dims)
+	e[0], e[1] = 3, 4
+	hv := pgvector.NewHalfVector(e)
+	require.NoError(t, db.Create(&ChunkEmbedding{ChunkID: fruits.Chunks[1].ID, Model: "next", Dims: 2, Embedding: &hv}).Error)
+
+	report, err := r.CorpusHealth(ctx, &CorpusHealthOptions{SampleSize: 3, ZThreshold: 3})
+	require.NoError(t, err)
+	require.Equal(t, DefaultCollection, report.Collection)
+	require.Equal(t, "words", report.Model)
+	require.Equal(t, 6, report.Chunks)
+	require.Equal(t, 5, report.Embedded)
+	require.Equal(t, 1, report.Quantized)
+	require.Equal(t, 5, report.Norms.Count)
+	require.InDelta(t, 1, report.Norms.Min, 1e-3)
+	require.InDelta(t, math.Sqrt(3), report.Norms.Max, 1e-2)
+	require.Len(t, report.Models, 1)
+	require.Equal(t, "next", report.Models[0].Model)
+	require.InDelta(t, 5, report.Models[0].Norms.Mean, 1e-3)
+	require.Equal(t, 6, report.TextLengths.Count)
+	require.Equal(t, 6, report.LengthHistogram[0].Count)
+	require.Equal(t, 3, report.NeighborDistances.Count)
+	require.Positive(t, report.NeighborDistances.Min)
+	require.Contains(t, report.Anomalies, DocumentAnomaly{Document: "fruits", Chunks: 1,
+		Reason: "embedded with letters, not the active model words", Value: 1})
+
+	report, err = r.CorpusHealth(ctx, &CorpusHealthOptions{Collection: "veggies", SampleSize: 3, ZThreshold: 3})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Chunks)
+	require.Equal(t, 1, report.Embedded)
+	require.Empty(t, report.Models)
+	require.Empty(t, report.NeighborDistances.Count)
+}
+
+func TestFindInvalidChunks(t *testing.T) {
+	forEachBackend(t, testFindInvalidChunks)
+}
+
+func testFindInvalidChunks(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"}, {Text: "bananas are yellow"}, {Text: ""}, {Text: "cherries are small"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{Documents: []string{"fruits"}, BatchSize: 4})
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("id = ?", d.Chunks[1].ID).Update("embedding", zeroVector).Error)
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("id = ?", d.Chunks[3].ID).Update("embedding", nil).Error)
+
+	invalid := make([]string, 0)
+	require.NoError(t, r.FindInvalidChunks(ctx, func(chunk *DocumentChunk) {
+		invalid = append(invalid, chunk.ID)
+	}))
+	require.ElementsMatch(t, []string{d.Chunks[1].ID, d.Chunks[2].ID, d.Chunks[3].ID}, invalid)
+}
@@ -0,0 +1,174 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"resty.dev/v3"
+)
+
+const (
+	RerankerProviderInfinity = "infinity"
+	RerankerProviderCohere   = "cohere"
+	RerankerProviderJina     = "jina"
+	// RerankerProviderOpenAI is an OpenAI-compatible /score endpoint, as served by vLLM.
+	RerankerProviderOpenAI = "openai"
+)
+
+// Reranker scores documents by their relevance to a query.
+type Reranker interface {
+	// Rerank returns the topN documents most relevant to the query, most relevant first.
+	Rerank(ctx context.Context, model string, query string, documents []string, topN int) ([]RerankResult, error)
+	Close() error
+}
+
+// RerankResult is the relevance score of the document at Index.
+type RerankResult struct {
+	Index int     `json:"index"`
+	Score float64 `json:"score"`
+}
+
+type RerankerOptions struct {
+	Provider string
+	BaseURL  string
+	APIKey   string
+	// Timeout bounds every request, retries included, zero waits forever.
+	Timeout time.Duration
+	// MaxRetries bounds retries with exponential backoff on 429 and 5xx responses.
+	MaxRetries int
+	// Transport sends the requests, nil uses http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+func NewReranker(opts *RerankerOptions) (Reranker, error) {
+	var defaultBaseURL string
+	switch opts.Provider {
+	case RerankerProviderInfinity, "", RerankerProviderOpenAI:
+	case RerankerProviderCohere:
+		defaultBaseURL = "https://api.cohere.com"
+	case RerankerProviderJina:
+		defaultBaseURL = "https://api.jina.ai"
+	default:
+		return nil, errors.Newf("unknown reranker provider: '%s'", opts.Provider)
+	}
+	baseURL := opts.BaseURL
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	if baseURL == "" {
+		return nil, errors.Newf("%s reranker requires a base URL", opts.Provider)
+	}
+
+	client := resty.New().SetBaseURL(baseURL).SetTimeout(opts.Timeout).SetTransport(opts.Transport)
+	if opts.APIKey != "" {
+		client.SetAuthToken(opts.APIKey)
+	}
+	configureRetries(client, opts.MaxRetries)
+	switch opts.Provider {
+	case RerankerProviderCohere:
+		return &CohereReranker{client: client}, nil
+	case RerankerProviderJina:
+		return &JinaReranker{client: client}, nil
+	case RerankerProviderOpenAI:
+		return &OpenAIReranker{client: client}, nil
+	default:
+		return &InfinityClient{client: client}, nil
+	}
+}
+
+// rerankAPI calls a /rerank endpoint in the request and response format
+// Cohere introduced and Infinity and Jina adopted.
+func rerankAPI(ctx context.Context, client *resty.Client, path string, req *RerankRequest) ([]RerankResult, error) {
+	var rsp RerankResponse
+	err := postJSON(ctx, client, path, req, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]RerankResult, len(rsp.Results))
+	for i, x := range rsp.Results {
+		results[i] = RerankResult{Index: x.Index, Score: x.RelevanceScore}
+	}
+	return topResults(results, req.TopN), nil
+}
+
+// topResults orders results by score and keeps the topN, some APIs return them all.
+func topResults(results []RerankResult, topN int) []RerankResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if topN > 0 && len(results) > topN {
+		results = results[:topN]
+	}
+	return results
+}
+
+// CohereReranker calls Cohere's /v2/rerank endpoint.
+type CohereReranker struct {
+	client *resty.Client
+}
+
+func (c *CohereReranker) Rerank(ctx context.Context, model string, query string, documents []string, topN int) ([]RerankResult, error) {
+	return rerankAPI(ctx, c.client, "/v2/rerank", &RerankRequest{
+		Model:     model,
+		Query:     query,
+		Documents: documents,
+		TopN:      topN,
+	})
+}
+
+func (c *CohereReranker) Close() error {
+	return c.client.Close()
+}
+
+// JinaReranker calls Jina's /v1/rerank endpoint.
+type JinaReranker struct {
+	client *resty.Client
+}
+
+func (c *JinaReranker) Rerank(ctx context.Context, model string, query string, documents []string, topN int) ([]RerankResult, error) {
+	return rerankAPI(ctx, c.client, "/v1/rerank", &RerankRequest{
+		Model:     model,
+		Query:     query,
+		Documents: documents,
+		TopN:      topN,
+	})
+}
+
+func (c *JinaReranker) Close() error {
+	return c.client.Close()
+}
+
+// OpenAIReranker calls the /score endpoint that OpenAI-compatible servers such
+// as vLLM offer for cross-encoder models, the base URL includes the /v1 prefix.
+type OpenAIReranker struct {
+	client *resty.Client
+}
+
+func (c *OpenAIReranker) Rerank(ctx context.Context, model string, query string, documents []string, topN int) ([]RerankResult, error) {
+	var rsp struct {
+		Data []struct {
+			Index int     `json:"index"`
+			Score float64 `json:"score"`
+		} `json:"data"`
+	}
+	err := postJSON(ctx, c.client, "/score", map[string]any{
+		"model":  model,
+		"text_1": query,
+		"text_2": documents,
+	}, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]RerankResult, len(rsp.Data))
+	for i, d := range rsp.Data {
+		results[i] = RerankResult{Index: d.Index, Score: d.Score}
+	}
+	return topResults(results, topN), nil
+}
+
+func (c *OpenAIReranker) Close() error {
+	return c.client.Close()
+}
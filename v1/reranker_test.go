@@ -0,0 +1,107 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRerankerProviders(t *testing.T) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch r.URL.Path {
+		case "/rerank", "/v1/rerank", "/v2/rerank":
+			require.Equal(t, "m", req["model"])
+			require.Equal(t, "q", req["query"])
+			require.NotContains(t, req, "return_documents")
+			if r.URL.Path != "/rerank" {
+				require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"results": []map[string]any{
+				{"index": 2, "relevance_score": 0.9},
+				{"index": 0, "relevance_score": 0.5},
+			}})
+		case "/score":
+			require.Equal(t, "q", req["text_1"])
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": []map[string]any{
+				{"index": 0, "score": 0.5},
+				{"index": 1, "score": 0.1},
+				{"index": 2, "score": 0.9},
+			}})
+		case "/flaky/rerank":
+			if attempts.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"results": []map[string]any{{"index": 1, "relevance_score": 1}}})
+		case "/slow/rerank":
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	docs := []string{"a", "b", "c"}
+	for _, opts := range []*RerankerOptions{
+		{Provider: RerankerProviderInfinity, BaseURL: ts.URL},
+		{Provider: RerankerProviderCohere, BaseURL: ts.URL, APIKey: "secret"},
+		{Provider: RerankerProviderJina, BaseURL: ts.URL, APIKey: "secret"},
+		{Provider: RerankerProviderOpenAI, BaseURL: ts.URL},
+	} {
+		reranker, err := NewReranker(opts)
+		require.NoError(t, err)
+		results, err := reranker.Rerank(ctx, "m", "q", docs, 2)
+		require.NoError(t, err, opts.Provider)
+		require.Equal(t, []RerankResult{{Index: 2, Score: 0.9}, {Index: 0, Score: 0.5}}, results, opts.Provider)
+		require.NoError(t, reranker.Close())
+	}
+
+	reranker, err := NewReranker(&RerankerOptions{BaseURL: ts.URL + "/flaky", MaxRetries: 1})
+	require.NoError(t, err)
+	results, err := reranker.Rerank(ctx, "m", "q", docs, 1)
+	require.NoError(t, err)
+	require.Equal(t, []RerankResult{{Index: 1, Score: 1}}, results)
+	require.EqualValues(t, 2, attempts.Load())
+
+	reranker, err = NewReranker(&RerankerOptions{BaseURL: ts.URL + "/slow", Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = reranker.Rerank(ctx, "m", "q", docs, 1)
+	require.Error(t, err)
+
+	_, err = NewReranker(&RerankerOptions{Provider: RerankerProviderInfinity})
+	require.ErrorContains(t, err, "requires a base URL")
+	_, err = NewReranker(&RerankerOptions{Provider: "unknown"})
+	require.Error(t, err)
+}
+
+type fakeReranker struct{ results []RerankResult }
+
+func (f fakeReranker) Rerank(context.Context, string, string, []string, int) ([]RerankResult, error) {
+	return f.results, nil
+}
+
+func (fakeReranker) Close() error { return nil }
+
+func TestRAGRerank(t *testing.T) {
+	chunks := []DocumentChunk{{ID: "a", Text: "a"}, {ID: "b", Text: "a"}}
+	r := &RAG{Reranker: fakeReranker{results: []RerankResult{{Index: 1, Score: 2}, {Index: 0, Score: 1}}}}
+	// chunks with the same text are told apart by their index
+	reranked, err := r.Rerank(context.Background(), "q", chunks, 2)
+	require.NoError(t, err)
+	require.Equal(t, "b", reranked[0].ID)
+	require.Equal(t, 2.0, reranked[0].Score)
+
+	r.Reranker = fakeReranker{results: []RerankResult{{Index: 2}}}
+	_, err = r.Rerank(context.Background(), "q", chunks, 2)
+	require.ErrorContains(t, err, "out of range")
+}
@@ -0,0 +1,365 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/minio/minio-go/v7"
+	"github.com/pgvector/pgvector-go"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy governs how long documents and their superseded versions
+// are kept. A document is governed by the first policy, by name, whose
+// pattern matches it; documents matching no policy are kept forever and
+// their superseded versions are not recorded.
+type RetentionPolicy struct {
+	Name string `gorm:"primaryKey" json:"name"`
+	// Collection restricts the policy to one collection, empty applies to all.
+	Collection string `json:"collection,omitempty"`
+	// Pattern is a glob matched against the document ID or raw document path.
+	Pattern string `gorm:"not null" json:"pattern"`
+	// KeepVersions is the number of superseded versions kept per document.
+	KeepVersions int `gorm:"not null;default:0" json:"keep_versions"`
+	// ExpireAfter removes documents and versions not updated for this long, 0 never expires.
+	ExpireAfter time.Duration `gorm:"not null;default:0" json:"expire_after"`
+	// ArchiveBucket, if set, receives removed chunks as JSON lines before deletion.
+	ArchiveBucket string    `json:"archive_bucket,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	re *regexp.Regexp
+}
+
+func (p *RetentionPolicy) Validate() error {
+	if p.Name == "" {
+		return errors.New("policy name is required")
+	}
+	if p.Pattern == "" {
+		return errors.New("policy pattern is required")
+	}
+	if p.KeepVersions < 0 {
+		return errors.New("keep versions must not be negative")
+	}
+	if p.ExpireAfter < 0 {
+		return errors.New("expire after must not be negative")
+	}
+	return nil
+}
+
+func (p *RetentionPolicy) matches(collection, document, rawDocument string) bool {
+	if p.Collection != "" && p.Collection != collection {
+		return false
+	}
+	if p.re == nil {
+		p.re = regexp.MustCompile(globToRegexp(p.Pattern))
+	}
+	return p.re.MatchString(document) || p.re.MatchString(rawDocument)
+}
+
+// ChunkVersion is a chunk superseded by a later upsert of its document. All
+// chunks superseded by one upsert share SupersededAt, which identifies the version.
+type ChunkVersion struct {
+	VersionID    uint                 `gorm:"primaryKey" json:"-"`
+	ChunkID      string               `gorm:"not null" json:"id"`
+	Collection   string               `gorm:"not null;default:'default'" json:"collection"`
+	Document     string               `gorm:"not null;index" json:"document"`
+	RawDocument  string               `json:"raw_document"`
+	Text         string               `json:"text"`
+	Embedding    *pgvector.HalfVector `gorm:"type:halfvec(2560)" json:"-"`
+	Index        int                  `gorm:"column:chunk_index;not null;default:0" json:"index"`
+	Tags         []string             `gorm:"type:jsonb;serializer:json;default:'[]'" json:"tags"`
+	UpdatedAt    time.Time            `json:"updated_at"`
+	SupersededAt time.Time            `gorm:"not null;index" json:"superseded_at"`
+}
+
+func (r *RAG) SetRetentionPolicy(ctx context.Context, p *RetentionPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return r.DB.WithContext(ctx).Save(p).Error
+}
+
+func (r *RAG) DeleteRetentionPolicy(ctx context.Context, name string) error {
+	res := r.DB.WithContext(ctx).Where("name = ?", name).Delete(&RetentionPolicy{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.Newf("retention policy '%s' does not exist", name)
+	}
+	return nil
+}
+
+func (r *RAG) ListRetentionPolicies(ctx context.Context) ([]RetentionPolicy, error) {
+	return listRetentionPolicies(r.DB.WithContext(ctx))
+}
+
+func listRetentionPolicies(db *gorm.DB) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	err := db.Order("name").Find(&policies).Error
+	return policies, err
+}
+
+func matchPolicy(policies []RetentionPolicy, collection, document, rawDocument string) *RetentionPolicy {
+	for i := range policies {
+		if policies[i].matches(collection, document, rawDocument) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// archiveSupersededChunks records the chunks an upsert is about to delete as
+// a version of the document, if its retention policy keeps versions.
+func archiveSupersededChunks(tx *gorm.DB, document *Document, ids []string) error {
+	policies, err := listRetentionPolicies(tx)
+	if err != nil {
+		return err
+	}
+	p := matchPolicy(policies, document.Collection, document.Document, document.RawDocument)
+	if p == nil || p.KeepVersions == 0 {
+		return nil
+	}
+	return tx.Exec(`INSERT INTO chunk_versions
+  (chunk_id, collection, document, raw_document, text, embedding, chunk_index, tags, updated_at, superseded_at)
+SELECT id, collection, document, raw_document, text, embedding, chunk_index, tags, updated_at, ?
+FROM document_chunks WHERE collection = ? AND document = ? AND id NOT IN ?`,
+		time.Now(), document.Collection, document.Document, ids).Error
+}
+
+const (
+	RetentionExpired    = "expired"
+	RetentionSuperseded = "superseded"
+)
+
+type RetentionItem struct {
+	Policy     string `json:"policy"`
+	Collection string `json:"collection"`
+	Document   string `json:"document"`
+	// Reason is RetentionExpired for live documents, RetentionSuperseded for old versions.
+	Reason       string     `json:"reason"`
+	Chunks       int64      `json:"chunks"`
+	SupersededAt *time.Time `json:"superseded_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// PlanRetention computes what a retention run would remove at now.
+func (r *RAG) PlanRetention(ctx context.Context, now time.Time) ([]RetentionItem, error) {
+	policies, err := r.ListRetentionPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]RetentionItem, 0)
+	documents, err := r.ListDocuments(ctx, &ListDocumentsOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range documents {
+		p := matchPolicy(policies, d.Collection, d.Document, d.RawDocument)
+		if p == nil || p.ExpireAfter == 0 || now.Sub(d.UpdatedAt) < p.ExpireAfter {
+			continue
+		}
+		items = append(items, RetentionItem{
+			Policy:     p.Name,
+			Collection: d.Collection,
+			Document:   d.Document,
+			Reason:     RetentionExpired,
+			Chunks:     d.Chunks,
+			UpdatedAt:  d.UpdatedAt,
+		})
+	}
+
+	var versions []struct {
+		Collection   string
+		Document     string
+		RawDocument  string
+		SupersededAt time.Time
+		UpdatedAt    time.Time `gorm:"serializer:aggtime"`
+		Chunks       int64
+	}
+	err = r.DB.WithContext(ctx).Model(&ChunkVersion{}).
+		Select("collection, document, MAX(raw_document) AS raw_document, superseded_at, " +
+			"MAX(updated_at) AS updated_at, COUNT(*) AS chunks").
+		Group("collection, document, superseded_at").
+		Order("collection, document, superseded_at DESC").
+		Scan(&versions).Error
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[[2]string]int)
+	for _, v := range versions {
+		p := matchPolicy(policies, v.Collection, v.Document, v.RawDocument)
+		policy := ""
+		key := [2]string{v.Collection, v.Document}
+		if p != nil {
+			policy = p.Name
+			if kept[key] < p.KeepVersions && (p.ExpireAfter == 0 || now.Sub(v.SupersededAt) < p.ExpireAfter) {
+				kept[key]++
+				continue
+			}
+		}
+		supersededAt := v.SupersededAt
+		items = append(items, RetentionItem{
+			Policy:       policy,
+			Collection:   v.Collection,
+			Document:     v.Document,
+			Reason:       RetentionSuperseded,
+			Chunks:       v.Chunks,
+			SupersededAt: &supersededAt,
+			UpdatedAt:    v.UpdatedAt,
+		})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Collection != items[j].Collection {
+			return items[i].Collection < items[j].Collection
+		}
+		return items[i].Document < items[j].Document
+	})
+	return items, nil
+}
+
+// ApplyRetention removes the planned items, archiving them first where the
+// governing policy has an archive bucket.
+func (r *RAG) ApplyRetention(ctx context.Context, items []RetentionItem) error {
+	policies, err := r.ListRetentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	buckets := make(map[string]string, len(policies))
+	for _, p := range policies {
+		buckets[p.Name] = p.ArchiveBucket
+	}
+
+	for _, item := range items {
+		var q *gorm.DB
+		if item.Reason == RetentionExpired {
+			q = r.DB.WithContext(ctx).Model(&DocumentChunk{}).
+				Where("collection = ? AND document = ?", item.Collection, item.Document)
+		} else {
+			q = r.DB.WithContext(ctx).Model(&ChunkVersion{}).
+				Where("collection = ? AND document = ? AND superseded_at = ?",
+					item.Collection, item.Document, item.SupersededAt)
+		}
+
+		if bucket := buckets[item.Policy]; bucket != "" {
+			err = r.archiveRetentionItem(ctx, bucket, &item, q.Session(&gorm.Session{}))
+			if err != nil {
+				return errors.Wrapf(err, "Failed to archive %s", item.Document)
+			}
+		}
+
+		err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if item.Reason == RetentionExpired {
+				_, err := deleteChunks(tx, "collection = ? AND document = ?", item.Collection, item.Document)
+				if err != nil {
+					return err
+				}
+				return tx.Where("collection = ? AND document = ?", item.Collection, item.Document).
+					Delete(&SourceFile{}).Error
+			}
+			return tx.Where("collection = ? AND document = ? AND superseded_at = ?",
+				item.Collection, item.Document, item.SupersededAt).
+				Delete(&ChunkVersion{}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove %s", item.Document)
+		}
+	}
+	return nil
+}
+
+type archivedChunk struct {
+	DocumentChunk
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+func (r *RAG) archiveRetentionItem(ctx context.Context, bucket string, item *RetentionItem, q *gorm.DB) error {
+	if r.OSS == nil {
+		return errors.New("object storage is not configured")
+	}
+
+	var chunks []DocumentChunk
+	if item.Reason == RetentionExpired {
+		err := q.Order("chunk_index").Find(&chunks).Error
+		if err != nil {
+			return err
+		}
+	} else {
+		var versions []ChunkVersion
+		err := q.Order("chunk_index").Find(&versions).Error
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			chunks = append(chunks, DocumentChunk{
+				ID:          v.ChunkID,
+				Collection:  v.Collection,
+				Document:    v.Document,
+				RawDocument: v.RawDocument,
+				Text:        v.Text,
+				Embedding:   v.Embedding,
+				Index:       v.Index,
+				Tags:        v.Tags,
+				UpdatedAt:   v.UpdatedAt,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, c := range chunks {
+		a := archivedChunk{DocumentChunk: c}
+		if c.Embedding != nil {
+			a.Embedding = c.Embedding.Slice()
+		}
+		if err := enc.Encode(&a); err != nil {
+			return err
+		}
+	}
+
+	at := item.UpdatedAt
+	if item.SupersededAt != nil {
+		at = *item.SupersededAt
+	}
+	name := fmt.Sprintf("retention/%s/%s.jsonl", item.Document, at.UTC().Format("20060102T150405.000000Z"))
+	_, err := r.OSS.PutObject(ctx, bucket, name, &buf, int64(buf.Len()), minio.PutObjectOptions{
+		ContentType: "application/x-ndjson",
+	})
+	return err
+}
+
+// RunRetentionJanitor applies retention policies every interval until ctx is done.
+func (r *RAG) RunRetentionJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		items, err := r.PlanRetention(ctx, time.Now())
+		if err == nil && len(items) > 0 {
+			err = r.ApplyRetention(ctx, items)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("Apply retention policies")
+			}
+			continue
+		}
+		if len(items) > 0 {
+			log.Info().Int("items", len(items)).Msg("Applied retention policies")
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	ctx := context.Background()
+
+	require.ErrorContains(t, r.SetRetentionPolicy(ctx, &RetentionPolicy{Name: "a", Pattern: "*", KeepVersions: -1}),
+		"keep versions")
+	require.NoError(t, r.SetRetentionPolicy(ctx, &RetentionPolicy{Name: "a", Collection: "a", Pattern: "*",
+		KeepVersions: 1, ExpireAfter: 24 * time.Hour}))
+	require.NoError(t, r.SetRetentionPolicy(ctx, &RetentionPolicy{Name: "b", Collection: "b", Pattern: "*",
+		KeepVersions: 2}))
+
+	// every upsert but the first supersedes a version of the document
+	for _, collection := range []string{"a", "b"} {
+		for version := range 3 {
+			d := &Document{FileName: "notes.md", Collection: collection, Chunks: []*DocumentChunk{
+				{Text: fmt.Sprintf("notes version %d", version)},
+			}}
+			upsertDocument(t, r, d)
+		}
+	}
+	versions := func(collection string) []time.Time {
+		var at []time.Time
+		require.NoError(t, db.Model(&ChunkVersion{}).Where("collection = ?", collection).
+			Order("superseded_at").Pluck("superseded_at", &at).Error)
+		return at
+	}
+	require.Len(t, versions("a"), 2)
+	require.Len(t, versions("b"), 2)
+
+	// keep-latest-N drops the oldest versions of a only
+	items, err := r.PlanRetention(ctx, time.Now())
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "a", items[0].Collection)
+	require.Equal(t, RetentionSuperseded, items[0].Reason)
+	require.True(t, versions("a")[0].Equal(*items[0].SupersededAt))
+
+	// TTL expires the live document of a and all its versions, b has no TTL
+	items, err = r.PlanRetention(ctx, time.Now().Add(48*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	reasons := make(map[string]int)
+	for _, item := range items {
+		require.Equal(t, "a", item.Collection)
+		reasons[item.Reason]++
+	}
+	require.Equal(t, map[string]int{RetentionExpired: 1, RetentionSuperseded: 2}, reasons)
+
+	// purging a leaves the same document of b alone
+	require.NoError(t, r.ApplyRetention(ctx, items))
+	documents, err := r.ListDocuments(ctx, &ListDocumentsOptions{})
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+	require.Equal(t, "b", documents[0].Collection)
+	require.Empty(t, versions("a"))
+	require.Len(t, versions("b"), 2)
+
+	items, err = r.PlanRetention(ctx, time.Now().Add(48*time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, items)
+}
@@ -0,0 +1,525 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SearchMode string
+
+const (
+	SearchModeDense   SearchMode = "dense"
+	SearchModeKeyword SearchMode = "keyword"
+	SearchModeHybrid  SearchMode = "hybrid"
+)
+
+const rrfK = 60
+
+// collapseOversample is how many chunks per requested result are retrieved when
+// collapsing, so that enough distinct documents remain.
+const collapseOversample = 5
+
+const CollapseDocument = "document"
+
+func ParseSearchMode(s string) (SearchMode, error) {
+	switch m := SearchMode(s); m {
+	case "":
+		return SearchModeDense, nil
+	case SearchModeDense, SearchModeKeyword, SearchModeHybrid:
+		return m, nil
+	default:
+		return "", errors.Newf("unknown search mode: '%s'", s)
+	}
+}
+
+type SearchOptions struct {
+	Query  string
+	Limit  int
+	Mode   SearchMode
+	Boosts []BoostRule
+
+	// Collection scopes the search, empty means DefaultCollection.
+	Collection string
+	// Filter restricts the search to chunks with matching metadata before ranking.
+	Filter *Filter
+
+	// Rerank retrieves Candidates chunks first and lets the reranker pick the top Limit.
+	Rerank     bool
+	Candidates int
+
+	// Collapse set to CollapseDocument returns only the best chunk of each document.
+	Collapse string
+
+	// Fusion weighs the result lists of hybrid search, zero uses the defaults.
+	Fusion Fusion
+
+	// Expand retrieves with queries written by the assistant as well, ExpandHyDE
+	// or ExpandMulti, and fuses the results. Expansions is how many it writes,
+	// zero uses the default of the strategy.
+	Expand     string
+	Expansions int
+
+	// MinScore drops results with a lower Score, so fewer than Limit chunks are
+	// returned when the rest are not relevant. Zero keeps all results.
+	MinScore float64
+
+	// EfSearch sets hnsw.ef_search for the dense query, trading latency for
+	// recall of an hnsw index. Zero keeps the database setting.
+	EfSearch int
+
+	// Neighbors widens every result to the chunks around it in its document,
+	// Neighbors before and after, or with ParentSection to the section it is
+	// in. Overlapping results are merged, see ChunkSpan.
+	Neighbors     int
+	ParentSection bool
+
+	// MMR picks the results among the Candidates by maximal marginal relevance,
+	// Lambda weighing relevance against redundancy with the results picked
+	// before: 1 ranks by relevance alone, 0 by diversity alone.
+	MMR    bool
+	Lambda float64
+
+	// Compress replaces the text of the results with the sentences the
+	// assistant finds relevant to the query and drops results without any.
+	Compress bool
+
+	// RecencyHalfLife ranks newer documents higher, halving the score of a
+	// result for every half-life its document is older, see DocumentChunk.DocumentTime.
+	// Zero ranks by relevance alone.
+	RecencyHalfLife time.Duration
+
+	// Graph adds after the top Limit candidates the chunks mentioning their
+	// entities or entities related to those in the knowledge graph, see
+	// ExtractGraph, so answers can draw on documents that don't match the query.
+	Graph bool
+
+	// Summaries searches the section and document summaries written by
+	// Summarize along with the chunks, following every matching summary with
+	// its children most similar to the query, so broad questions find the
+	// chunks a summary covers.
+	Summaries bool
+
+	Hooks SearchHooks
+}
+
+func (o *SearchOptions) collection() string {
+	if o.Collection == "" {
+		return DefaultCollection
+	}
+	return o.Collection
+}
+
+func (r *RAG) Search(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	start := time.Now()
+	chunks, err := r.cachedSearch(ctx, opts)
+	r.Metrics.observeSearch(opts, start, err)
+	return chunks, err
+}
+
+func (r *RAG) search(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	if opts.Hooks != nil {
+		o := *opts
+		err := opts.Hooks.PreQuery(ctx, &o)
+		if err != nil {
+			return nil, err
+		}
+		opts = &o
+	}
+
+	collapse := opts.Collapse == CollapseDocument
+	retrieval := *opts
+	if (opts.Rerank || opts.MMR) && retrieval.Candidates > retrieval.Limit {
+		retrieval.Limit = retrieval.Candidates
+	}
+	if collapse && opts.Limit*collapseOversample > retrieval.Limit {
+		retrieval.Limit = opts.Limit * collapseOversample
+	}
+	if opts.RecencyHalfLife > 0 && opts.Limit*recencyOversample > retrieval.Limit {
+		retrieval.Limit = opts.Limit * recencyOversample
+	}
+	var chunks []DocumentChunk
+	var err error
+	if opts.Expand != "" {
+		chunks, err = r.retrieveExpanded(ctx, &retrieval)
+	} else {
+		chunks, err = r.retrieve(ctx, &retrieval)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Hooks != nil {
+		chunks, err = opts.Hooks.PostCandidates(ctx, opts, chunks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Graph && len(chunks) > 0 {
+		seeds := min(opts.Limit, len(chunks))
+		expanded, err := r.expandGraph(ctx, opts, chunks[:seeds])
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to expand results over the graph")
+		}
+		chunks = append(expanded, chunks[seeds:]...)
+	}
+
+	if opts.Rerank && len(chunks) > 0 {
+		topN := opts.Limit
+		if collapse || opts.MMR || opts.RecencyHalfLife > 0 {
+			topN = len(chunks)
+		}
+		chunks, err = r.Rerank(ctx, opts.Query, chunks, topN)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MinScore != 0 {
+		chunks = filterMinScore(chunks, opts.MinScore)
+	}
+	if opts.RecencyHalfLife > 0 {
+		decayByRecency(chunks, opts.RecencyHalfLife, time.Now())
+	}
+	if opts.MMR && len(chunks) > 1 {
+		chunks, err = r.diversify(ctx, opts.Query, chunks, opts.Lambda)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to diversify results")
+		}
+	}
+	if collapse {
+		chunks = collapseByDocument(chunks)
+	}
+	if len(chunks) > opts.Limit {
+		chunks = chunks[:opts.Limit]
+	}
+	if opts.Summaries {
+		chunks, err = r.expandSummaries(ctx, opts.Query, chunks)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to expand summaries")
+		}
+	}
+	err = attachDuplicates(r.DB.WithContext(ctx), chunks)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list duplicates")
+	}
+	if opts.Neighbors > 0 || opts.ParentSection {
+		chunks, err = widenResults(r.DB.WithContext(ctx), chunks, opts.Neighbors, opts.ParentSection)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to widen results")
+		}
+	}
+	if opts.Compress && len(chunks) > 0 {
+		chunks, err = r.compress(ctx, opts.Query, chunks)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to compress results")
+		}
+	}
+
+	if opts.Hooks != nil {
+		chunks, err = opts.Hooks.PostRerank(ctx, opts, chunks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+func ParseCollapse(s string) (string, error) {
+	switch s {
+	case "", CollapseDocument:
+		return s, nil
+	default:
+		return "", errors.Newf("unknown collapse: '%s'", s)
+	}
+}
+
+// collapseByDocument keeps the first chunk of every document, counting the others.
+func collapseByDocument(chunks []DocumentChunk) []DocumentChunk {
+	first := make(map[string]int)
+	collapsed := make([]DocumentChunk, 0, len(chunks))
+	for _, c := range chunks {
+		if i, ok := first[c.Document]; ok {
+			collapsed[i].Collapsed++
+			continue
+		}
+		first[c.Document] = len(collapsed)
+		collapsed = append(collapsed, c)
+	}
+	return collapsed
+}
+
+// filterMinScore keeps the chunks scoring at least min.
+func filterMinScore(chunks []DocumentChunk, min float64) []DocumentChunk {
+	kept := make([]DocumentChunk, 0, len(chunks))
+	for _, c := range chunks {
+		if c.Score >= min {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+func (r *RAG) retrieve(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	switch opts.Mode {
+	case "", SearchModeDense:
+		return r.queryDense(ctx, opts)
+	case SearchModeKeyword:
+		return r.queryKeyword(ctx, opts)
+	case SearchModeHybrid:
+		dense, err := r.queryDense(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		keyword, err := r.queryKeyword(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		fusion := opts.Fusion
+		if fusion.K == 0 {
+			fusion = DefaultConfig().Fusion
+		}
+		chunks := fuseRRF(fusion, dense, keyword)
+		if len(chunks) > opts.Limit {
+			chunks = chunks[:opts.Limit]
+		}
+		return chunks, nil
+	default:
+		return nil, errors.Newf("unknown search mode: '%s'", opts.Mode)
+	}
+}
+
+func (r *RAG) embedQuery(ctx context.Context, query string) (pgvector.Vector, error) {
+	if r.Cache == nil {
+		return r.embedQueryUncached(ctx, query)
+	}
+	key := r.cacheQuery(query)
+	embedding, ok := r.Cache.embedding(ctx, key)
+	r.Metrics.observeCache("embedding", ok)
+	if ok {
+		return pgvector.NewVector(embedding), nil
+	}
+	v, err := r.embedQueryUncached(ctx, query)
+	if err != nil {
+		return v, err
+	}
+	r.Cache.putEmbedding(key, v.Slice())
+	return v, nil
+}
+
+func (r *RAG) embedQueryUncached(ctx context.Context, query string) (pgvector.Vector, error) {
+	if qe, ok := r.Embedder.(QueryEmbedder); ok {
+		start := time.Now()
+		embedding, err := qe.EmbedQuery(ctx, query)
+		r.Metrics.observeEmbedding(start, err)
+		if err != nil {
+			return pgvector.Vector{}, err
+		}
+		if len(embedding) == 0 || len(embedding) > maxQuantizedDims {
+			return pgvector.Vector{}, errors.Newf("query embedding has %d dimensions, expected at most %d", len(embedding),
+				maxQuantizedDims)
+		}
+		return pgvector.NewVector(padEmbedding(embedding)), nil
+	}
+
+	embeddings, err := r.embed(ctx, []string{query})
+	if err != nil {
+		return pgvector.Vector{}, err
+	}
+	return pgvector.NewVector(padEmbedding(embeddings[0])), nil
+}
+
+func (r *RAG) QueryDocumentChunksByKeyword(ctx context.Context, query string, limit int) ([]DocumentChunk, error) {
+	return r.queryKeyword(ctx, &SearchOptions{Query: query, Limit: limit})
+}
+
+func (r *RAG) queryDense(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	active, err := r.ActiveEmbeddingModel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	space, err := r.embeddingSpace(ctx, active)
+	if err != nil {
+		return nil, err
+	}
+	queryEmbedding, err := r.embedQuery(ctx, opts.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	distance, err := r.collectionDistance(ctx, opts.collection())
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := backendOf(r.DB).queryDense(r.DB.WithContext(ctx), queryEmbedding, space, distance, opts)
+	r.Metrics.addChunksScanned(SearchModeDense, len(chunks))
+	return chunks, err
+}
+
+// joinSpace joins the embeddings of a model as space_embedding. Only the
+// embedding and chunk_id are selected, so filters on chunk columns stay unambiguous.
+func joinSpace(db *gorm.DB, space string) *gorm.DB {
+	return db.Joins("JOIN (SELECT chunk_id, embedding AS space_embedding FROM chunk_embeddings WHERE model = ?) e "+
+		"ON e.chunk_id = document_chunks.id", space)
+}
+
+func (postgresBackend) queryDense(db *gorm.DB, queryEmbedding pgvector.Vector, space string, distance string, opts *SearchOptions) ([]DocumentChunk, error) {
+	boost, boostVars := boostExpr(opts.Boosts)
+	column := "embedding"
+	if space != "" {
+		column = "space_embedding"
+	}
+	// without boosts the plain distance is ordered by, which an ANN index can serve
+	order := column + " " + distanceOperator(distance) + " ?"
+	orderVars := append([]interface{}{queryEmbedding}, boostVars...)
+	if len(opts.Boosts) > 0 && distance == DistanceInnerProduct {
+		// negative inner products are multiplied, see boostDistance
+		order = "CASE WHEN " + order + " < 0 THEN (" + order + ") * (" + boost + ") ELSE (" + order + ") / (" + boost + ") END"
+		orderVars = append(append([]interface{}{queryEmbedding, queryEmbedding}, boostVars...), orderVars...)
+	} else if len(opts.Boosts) > 0 {
+		order = "(" + order + ") / (" + boost + ")"
+	}
+	var matches []scoredChunk
+	find := func(db *gorm.DB) error {
+		q := db.Model(&DocumentChunk{})
+		if space != "" {
+			q = joinSpace(q, space)
+		}
+		return opts.Filter.apply(q.Select("document_chunks.*, "+relevanceSQL(distance, column)+" AS relevance", queryEmbedding).
+			Where("collection = ? AND "+column+" IS NOT NULL", opts.collection()).Where(searchable("document_chunks", opts))).
+			Clauses(clause.OrderBy{
+				Expression: clause.Expr{
+					SQL:  order,
+					Vars: orderVars,
+				}},
+			).Limit(opts.Limit).Find(&matches).Error
+	}
+
+	var err error
+	switch {
+	case len(queryEmbedding.Slice()) > dims:
+		// models beyond the halfvec column only have int8 embeddings
+	case opts.EfSearch > 0:
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec(fmt.Sprintf("SET LOCAL hnsw.ef_search = %d", opts.EfSearch)).Error
+			if err != nil {
+				return err
+			}
+			return find(tx)
+		})
+	default:
+		err = find(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	chunks := scoredChunks(matches)
+	if space != "" {
+		return chunks, nil
+	}
+
+	// pgvector has no int8 type: chunks without their original embedding are
+	// found by the HNSW index of their binary quantization, then ranked by
+	// their int8 embeddings
+	ok, err := hasQuantizedOnly(db, opts.collection())
+	if err != nil || !ok {
+		return chunks, err
+	}
+	candidates := opts.Filter.apply(db.Model(&DocumentChunk{}).
+		Where("collection = ? AND embedding IS NULL", opts.collection()).Where(searchable("document_chunks", opts))).
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:  fmt.Sprintf("embedding_bits <~> ?::bit(%d)", maxQuantizedDims),
+			Vars: []interface{}{binaryQuantize(queryEmbedding.Slice())},
+		}}).Limit(opts.Limit * rescoreOversample)
+	quantized, err := scanQuantized(db, candidates, queryEmbedding.Slice(), distance, opts)
+	if err != nil || len(quantized) == 0 {
+		return chunks, err
+	}
+	return mergeQuantized(db, chunks, quantized, queryEmbedding.Slice(), distance, opts)
+}
+
+func (r *RAG) queryKeyword(ctx context.Context, opts *SearchOptions) ([]DocumentChunk, error) {
+	analyzer, err := r.collectionAnalyzer(ctx, opts.collection())
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := backendOf(r.DB).queryKeyword(r.DB.WithContext(ctx), analyzer, opts)
+	r.Metrics.addChunksScanned(SearchModeKeyword, len(chunks))
+	return chunks, err
+}
+
+// The analyzer is bound as a constant rather than read from every row, so the
+// query is the same for all chunks and idx_document_chunks_tsv can serve it.
+func (postgresBackend) queryKeyword(db *gorm.DB, analyzer string, opts *SearchOptions) ([]DocumentChunk, error) {
+	boost, boostVars := boostExpr(opts.Boosts)
+	var matches []scoredChunk
+	err := opts.Filter.apply(db.Model(&DocumentChunk{}).
+		Select("*, ts_rank_cd(tsv, websearch_to_tsquery(?::regconfig, ?)) AS relevance", analyzer, opts.Query).
+		Where("collection = ? AND tsv @@ websearch_to_tsquery(?::regconfig, ?)", opts.collection(), analyzer, opts.Query).
+		Where(searchable("document_chunks", opts))).
+		Clauses(clause.OrderBy{
+			Expression: clause.Expr{
+				SQL:  "ts_rank_cd(tsv, websearch_to_tsquery(?::regconfig, ?)) * (" + boost + ") DESC",
+				Vars: append([]interface{}{analyzer, opts.Query}, boostVars...),
+			}},
+		).Limit(opts.Limit).Find(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+	return scoredChunks(matches), nil
+}
+
+// scoredChunk scans a chunk with its score computed by the query.
+type scoredChunk struct {
+	DocumentChunk
+	Relevance float64
+}
+
+func scoredChunks(matches []scoredChunk) []DocumentChunk {
+	chunks := make([]DocumentChunk, len(matches))
+	for i, m := range matches {
+		chunks[i] = m.DocumentChunk
+		chunks[i].Score = m.Relevance
+	}
+	return chunks
+}
+
+// fuseRRF merges dense and keyword results with weighted reciprocal rank fusion.
+func fuseRRF(f Fusion, dense []DocumentChunk, keyword []DocumentChunk) []DocumentChunk {
+	return fuseLists(f.K, []float64{f.DenseWeight, f.KeywordWeight}, dense, keyword)
+}
+
+// fuseLists merges ranked lists with reciprocal rank fusion, weighing list i by weights[i].
+func fuseLists(k int, weights []float64, lists ...[]DocumentChunk) []DocumentChunk {
+	scores := make(map[string]float64)
+	chunks := make(map[string]DocumentChunk)
+	order := make([]string, 0)
+	for i, list := range lists {
+		for rank, c := range list {
+			if _, ok := chunks[c.ID]; !ok {
+				chunks[c.ID] = c
+				order = append(order, c.ID)
+			}
+			scores[c.ID] += weights[i] / float64(k+rank+1)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+
+	fused := make([]DocumentChunk, len(order))
+	for i, id := range order {
+		fused[i] = chunks[id]
+		fused[i].Score = scores[id]
+	}
+	return fused
+}
@@ -0,0 +1,54 @@
+package rag
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuseRRF(t *testing.T) {
+	dense := []DocumentChunk{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	keyword := []DocumentChunk{{ID: "c"}, {ID: "d"}, {ID: "a"}}
+
+	fused := fuseRRF(DefaultConfig().Fusion, dense, keyword)
+	ids := make([]string, len(fused))
+	for i, c := range fused {
+		ids[i] = c.ID
+	}
+	require.Equal(t, []string{"a", "c", "b", "d"}, ids)
+}
+
+func TestFuseRRFWeights(t *testing.T) {
+	dense := []DocumentChunk{{ID: "a"}, {ID: "b"}}
+	keyword := []DocumentChunk{{ID: "b"}, {ID: "c"}}
+
+	fused := fuseRRF(Fusion{K: 60, DenseWeight: 1, KeywordWeight: 0}, dense, keyword)
+	require.Equal(t, "a", fused[0].ID)
+	fused = fuseRRF(Fusion{K: 60, DenseWeight: 0, KeywordWeight: 1}, dense, keyword)
+	require.Equal(t, "b", fused[0].ID)
+}
+
+func TestParseBoostRule(t *testing.T) {
+	b, err := ParseBoostRule("path=**/archive/**:0.5")
+	require.NoError(t, err)
+	require.Equal(t, BoostRule{Field: BoostFieldPath, Value: "**/archive/**", Factor: 0.5}, b)
+
+	_, err = ParseBoostRule("tag=official")
+	require.Error(t, err)
+
+	require.Regexp(t, globToRegexp(b.Value), "docs/archive/2019/report.md")
+	require.NotRegexp(t, globToRegexp(b.Value), "docs/current/report.md")
+}
+
+func TestCollapseByDocument(t *testing.T) {
+	chunks := collapseByDocument([]DocumentChunk{
+		{ID: "a1", Document: "a"},
+		{ID: "b1", Document: "b"},
+		{ID: "a2", Document: "a"},
+		{ID: "a3", Document: "a"},
+	})
+	require.Len(t, chunks, 2)
+	require.Equal(t, "a1", chunks[0].ID)
+	require.Equal(t, 2, chunks[0].Collapsed)
+	require.Equal(t, 0, chunks[1].Collapsed)
+}
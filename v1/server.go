@@ -2,47 +2,576 @@ package rag
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
 )
 
+const Version = "0.1.0"
+
+const (
+	// HeaderConfigVersion tags responses with the configuration version used.
+	HeaderConfigVersion = "X-Rag-Config-Version"
+	// HeaderSession keeps a client on the same canary arm across requests.
+	HeaderSession = "X-Rag-Session"
+	// HeaderRequestID identifies a request logged while a canary runs, for feedback.
+	HeaderRequestID = "X-Rag-Request-Id"
+	// HeaderContextTokens is the tokens of the chunks injected into a chat completion.
+	HeaderContextTokens = "X-Rag-Context-Tokens"
+)
+
+type ServerOptions struct {
+	Hooks    *HTTPHooks
+	Ingestor *Ingestor
+	// Replicator marks the server as a read-only standby following a primary.
+	Replicator *Replicator
+	// Collection is served by the routes not scoped to a collection, empty means DefaultCollection.
+	Collection string
+	// Health decides which components /health/deep and /readyz require, nil
+	// uses DefaultHealthOptions.
+	Health *HealthOptions
+	// Metrics counts HTTP requests and is served on /metrics, nil disables both.
+	// Set it as RAG.Metrics as well to instrument the retrieval pipeline.
+	Metrics *Metrics
+	// Auth requires an API key on every HTTP and gRPC request, nil serves everyone.
+	Auth *Authenticator
+	// TLS serves HTTPS and gRPC over TLS, nil serves plain text. Set
+	// GetCertificate to rotate certificates without restarting, see CertReloader.
+	TLS *tls.Config
+}
+
 type Server struct {
-	e *echo.Echo
-	r *RAG
+	e    *echo.Echo
+	grpc *grpc.Server
+	// r is swapped by Reload, requests hold it once and keep using their RAG.
+	r    atomic.Pointer[servedRAG]
+	opts ServerOptions
+
+	draining      atomic.Bool
+	streams       sync.WaitGroup
+	shutdownHooks []func(ctx context.Context) error
+
+	startedAt time.Time
+	ready     readyCache
 }
 
-func NewServer(r *RAG) *Server {
-	s := &Server{r: r}
+func NewServer(r *RAG, opts *ServerOptions) *Server {
+	s := &Server{opts: *opts, startedAt: time.Now()}
+	s.r.Store(&servedRAG{RAG: r})
+	if s.opts.Ingestor == nil {
+		s.opts.Ingestor = NewIngestor()
+	}
+	if s.opts.Collection == "" {
+		s.opts.Collection = DefaultCollection
+	}
+	if s.opts.Health == nil {
+		s.opts.Health = DefaultHealthOptions()
+	}
+	s.grpc = s.newGRPCServer()
 	e := echo.New()
 	s.e = e
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		var hookErr *HookError
+		if errors.As(err, &hookErr) {
+			err = echo.NewHTTPError(hookErr.StatusCode, hookErr.Error())
+		}
+		e.DefaultHTTPErrorHandler(err, c)
+	}
 
+	if s.opts.Metrics != nil {
+		e.Use(s.opts.Metrics.middleware)
+		e.GET("/metrics", echo.WrapHandler(s.opts.Metrics.Handler()))
+	}
+	e.Use(s.drainMiddleware)
+	e.Use(s.ragMiddleware)
+	if s.opts.Auth != nil {
+		e.Use(publicProbes(publicUI(s.opts.Auth.middleware)))
+	}
 	e.GET("/", s.homeHandler)
-	e.POST("/v1/search", s.searchHandler)
+	s.registerUI(e)
+	e.GET("/healthz", s.livenessHandler)
+	e.GET("/readyz", s.readinessHandler)
+	e.GET("/health/deep", s.deepHealthHandler)
+	e.GET("/v1/diagnostics", s.diagnosticsHandler)
+	e.GET("/v1/collections", s.collectionsHandler)
+	e.POST("/v1/feedback", s.feedbackHandler)
+	e.GET("/v1/jobs/:id", s.jobHandler)
+	for _, g := range []*echo.Group{
+		e.Group("/v1"),
+		e.Group("/v1/collections/:collection", s.collectionMiddleware),
+	} {
+		g.POST("/search", s.searchHandler, s.canaryMiddleware)
+		g.POST("/upload", s.uploadHandler, s.primaryOnly)
+		g.POST("/documents", s.documentsHandler, s.primaryOnly)
+		g.GET("/documents", s.listDocumentsHandler)
+		g.GET("/stats", s.statsHandler)
+		g.GET("/chunks/:id/context", s.chunkContextHandler)
+		g.POST("/chat", s.chatHandler, s.canaryMiddleware)
+		g.POST("/chat/completions", s.chatCompletionsHandler, s.canaryMiddleware)
+	}
 	return s
 }
 
+// collection returns the collection a request is scoped to.
+func (s *Server) collection(c echo.Context) string {
+	if name := c.Param("collection"); name != "" {
+		return name
+	}
+	return s.opts.Collection
+}
+
+func (s *Server) collectionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := ValidateCollectionName(c.Param("collection")); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return next(c)
+	}
+}
+
+// configure binds the current configuration version to the request, so a
+// rollback takes effect on the next request. While a canary runs, a share of
+// requests gets the canary's version instead and every request is logged.
+func (s *Server) configure(c echo.Context) (*RAG, error) {
+	r, m, err := configureRequest(c.Request().Context(), s.ragOf(c), c.Request().Header.Get(HeaderSession), c.Path())
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		c.Set(canaryMetricKey, m)
+		c.Response().Header().Set(HeaderRequestID, strconv.FormatUint(m.ID, 10))
+	}
+	c.Response().Header().Set(HeaderConfigVersion, strconv.FormatInt(r.config().Version, 10))
+	return r, nil
+}
+
+// configureRequest binds the current configuration version to a request to
+// endpoint, or the canary's for the share of sessions on the canary arm.
+// While a canary runs the request is logged as the returned metric, which
+// finishCanaryMetric completes.
+func configureRequest(ctx context.Context, r *RAG, session string, endpoint string) (*RAG, *CanaryMetric, error) {
+	cfg, err := r.CurrentConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	canary, err := r.ActiveCanary(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if canary == nil {
+		return r.WithConfig(cfg), nil, nil
+	}
+	arm := canaryArm(session, canary.Percent)
+	if arm == ArmCanary {
+		cfg, err = r.GetConfigVersion(ctx, canary.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	m := &CanaryMetric{Canary: canary.Version, Arm: arm, ConfigVersion: cfg.Version, Endpoint: endpoint}
+	err = r.RecordCanaryMetric(ctx, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.WithConfig(cfg), m, nil
+}
+
+func (s *Server) collectionsHandler(c echo.Context) error {
+	collections, err := s.ragOf(c).ListCollections(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"count":       len(collections),
+		"collections": collections,
+	})
+}
+
+// Start serves HTTP on bind, or HTTPS with ServerOptions.TLS.
 func (s *Server) Start(bind string) error {
-	return s.e.Start(bind)
+	if s.opts.TLS == nil {
+		return s.e.Start(bind)
+	}
+	server := s.e.TLSServer
+	server.Addr = bind
+	server.TLSConfig = s.opts.TLS
+	return s.e.StartServer(server)
+}
+
+func (s *Server) rag() *RAG {
+	return s.r.Load().RAG
+}
+
+// servedRAG counts the requests using a RAG, so the model clients of a RAG
+// replaced by Reload are closed only once no request uses them anymore.
+type servedRAG struct {
+	*RAG
+
+	mu       sync.Mutex
+	inflight int
+	// retired is closed once retire was called and no request is in flight.
+	retired chan struct{}
+}
+
+// acquire counts a request in, it fails once the RAG was retired.
+func (g *servedRAG) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired != nil {
+		return false
+	}
+	g.inflight++
+	return true
+}
+
+func (g *servedRAG) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight--
+	if g.retired != nil && g.inflight == 0 {
+		close(g.retired)
+	}
 }
 
+func (g *servedRAG) retire() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retired = make(chan struct{})
+	if g.inflight == 0 {
+		close(g.retired)
+	}
+	return g.retired
+}
+
+// holdRAG returns the current RAG and releases it with the returned func.
+// Reload stores the next RAG before retiring the previous one, so a request
+// failing to acquire a retired RAG gets the next one.
+func (s *Server) holdRAG() (*RAG, func()) {
+	for {
+		g := s.r.Load()
+		if g.acquire() {
+			return g.RAG, g.release
+		}
+	}
+}
+
+const ragKey = "rag"
+
+func (s *Server) ragMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r, release := s.holdRAG()
+		defer release()
+		c.Set(ragKey, r)
+		return next(c)
+	}
+}
+
+// ragOf returns the RAG held by a request for its whole lifetime, streams included.
+func (s *Server) ragOf(c echo.Context) *RAG {
+	if r, ok := c.Get(ragKey).(*RAG); ok {
+		return r
+	}
+	return s.rag()
+}
+
+// Reload serves new requests with r, e.g. with the model clients of a reloaded
+// configuration. In-flight requests finish with the RAG they started with, the
+// returned channel is closed once they all did, then the previous model
+// clients can be closed.
+func (s *Server) Reload(r *RAG) <-chan struct{} {
+	previous := s.r.Swap(&servedRAG{RAG: r})
+	return previous.retire()
+}
+
+// OnShutdown registers a hook run while draining, e.g. to checkpoint background work.
+func (s *Server) OnShutdown(fn func(ctx context.Context) error) {
+	s.shutdownHooks = append(s.shutdownHooks, fn)
+}
+
+// trackStream marks a long-lived response as in flight until the returned func is called.
+func (s *Server) trackStream() func() {
+	s.streams.Add(1)
+	return s.streams.Done
+}
+
+func (s *Server) drainMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.draining.Load() {
+			c.Response().Header().Set(echo.HeaderConnection, "close")
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "server is shutting down")
+		}
+		return next(c)
+	}
+}
+
+// Shutdown stops accepting requests and waits for in-flight requests and streams
+// to finish until ctx expires, after which remaining connections are closed.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.e.Shutdown(ctx)
+	s.draining.Store(true)
+	err := s.e.Shutdown(ctx)
+	s.stopGRPC(ctx)
+
+	streamsDone := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(streamsDone)
+	}()
+	select {
+	case <-streamsDone:
+	case <-ctx.Done():
+		err = errors.CombineErrors(err, ctx.Err())
+	}
+
+	for _, hook := range s.shutdownHooks {
+		if hookErr := hook(ctx); hookErr != nil {
+			log.Error().Err(hookErr).Msg("Shutdown hook failed")
+			err = errors.CombineErrors(err, hookErr)
+		}
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Drain timeout exceeded, closing remaining connections")
+		return errors.CombineErrors(err, s.e.Close())
+	}
+	return nil
 }
 
 type SearchParam struct {
-	Query string `json:"query" validate:"required"`
-	Limit int
+	Query  string      `json:"query" validate:"required"`
+	Mode   string      `json:"mode"`
+	Boosts []BoostRule `json:"boosts"`
+	Limit  int
+
+	Rerank     *bool  `json:"rerank"`
+	Candidates int    `json:"candidates"`
+	Collapse   string `json:"collapse"`
+	// Filter is a metadata filter expression, see ParseFilter.
+	Filter string `json:"filter"`
+	// Expand is hyde or multi to retrieve with queries written by the assistant as well.
+	Expand     string `json:"expand"`
+	Expansions int    `json:"expansions"`
+	// MinScore drops results scoring lower, see DocumentChunk.Score.
+	MinScore float64 `json:"min_score"`
+	// EfSearch sets hnsw.ef_search for the query, zero keeps the database setting.
+	EfSearch int `json:"ef_search"`
+	// Neighbors widens results to the chunks around them, ParentSection to their section.
+	Neighbors     int  `json:"neighbors"`
+	ParentSection bool `json:"parent_section"`
+	// MMR diversifies the results, Lambda defaults to DefaultMMRLambda.
+	MMR    bool     `json:"mmr"`
+	Lambda *float64 `json:"lambda"`
+	// Compress keeps only the sentences of the results relevant to the query.
+	Compress bool `json:"compress"`
+	// RecencyHalfLife ranks newer documents higher, see ParseHalfLife.
+	RecencyHalfLife string `json:"recency_half_life"`
+	// Graph adds the chunks related to the results in the knowledge graph.
+	Graph bool `json:"graph"`
+	// Summaries searches the section and document summaries as well.
+	Summaries bool `json:"summaries"`
 }
 
-func (p *SearchParam) WithDefaults(limitStr string) {
+// maxSearchLimit caps the results a client may ask a search for.
+const maxSearchLimit = 100
+
+func (p *SearchParam) WithDefaults(limitStr string, cfg *Config) {
 	limit, err := strconv.Atoi(limitStr)
 	if limit <= 0 || err != nil {
-		p.Limit = 10
+		p.Limit = cfg.Limit
 	} else {
 		p.Limit = limit
 	}
+	p.Limit = min(p.Limit, maxSearchLimit)
+}
+
+// searchOptions builds the options of a search over HTTP: the query
+// parameters fill in what the body leaves out, then buildSearchOptions
+// applies the defaults and checks shared with gRPC.
+func (s *Server) searchOptions(c echo.Context, r *RAG, p *SearchParam) (*SearchOptions, error) {
+	p.WithDefaults(c.QueryParam("limit"), &r.config().Config)
+	err := p.fromQuery(c)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := s.buildSearchOptions(r, s.collection(c), p, c.Request().Header)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return opts, nil
+}
+
+// fromQuery sets the parameters the body left out from the query parameters.
+func (p *SearchParam) fromQuery(c echo.Context) error {
+	var err error
+	parseBool := func(name string, v *bool) {
+		if q := c.QueryParam(name); err == nil && !*v && q != "" {
+			*v, err = strconv.ParseBool(q)
+		}
+	}
+	parseFloat := func(name string, v *float64) {
+		if q := c.QueryParam(name); err == nil && *v == 0 && q != "" {
+			*v, err = strconv.ParseFloat(q, 64)
+		}
+	}
+	fill := func(name string, v *string) {
+		if *v == "" {
+			*v = c.QueryParam(name)
+		}
+	}
+
+	fill("mode", &p.Mode)
+	fill("collapse", &p.Collapse)
+	fill("filter", &p.Filter)
+	fill("expand", &p.Expand)
+	fill("recency_half_life", &p.RecencyHalfLife)
+	if q := c.QueryParam("rerank"); p.Rerank == nil && q != "" {
+		rerank, err := strconv.ParseBool(q)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		p.Rerank = &rerank
+	}
+	if p.Candidates <= 0 {
+		p.Candidates, _ = strconv.Atoi(c.QueryParam("candidates"))
+	}
+	parseFloat("min_score", &p.MinScore)
+	if q := c.QueryParam("ef_search"); err == nil && p.EfSearch == 0 && q != "" {
+		p.EfSearch, err = strconv.Atoi(q)
+	}
+	parseBool("parent_section", &p.ParentSection)
+	parseBool("mmr", &p.MMR)
+	if q := c.QueryParam("lambda"); err == nil && p.Lambda == nil && q != "" {
+		var lambda float64
+		lambda, err = strconv.ParseFloat(q, 64)
+		p.Lambda = &lambda
+	}
+	parseBool("compress", &p.Compress)
+	parseBool("graph", &p.Graph)
+	parseBool("summaries", &p.Summaries)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if p.Neighbors == 0 {
+		p.Neighbors, err = queryParamInt(c, "neighbors", 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildSearchOptions builds the options of a search in collection with the
+// defaults of r's configuration, for HTTP and gRPC alike. header is passed
+// to the search hooks. Its errors are the client's.
+func (s *Server) buildSearchOptions(r *RAG, collection string, p *SearchParam, header http.Header) (*SearchOptions, error) {
+	cfg := &r.config().Config
+	limit := p.Limit
+	if limit <= 0 {
+		limit = cfg.Limit
+	}
+	limit = min(limit, maxSearchLimit)
+	mode := cfg.Mode
+	var err error
+	if p.Mode != "" {
+		mode, err = ParseSearchMode(p.Mode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range p.Boosts {
+		if err = b.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	rerank := r.Reranker != nil
+	if p.Rerank != nil {
+		rerank = *p.Rerank
+	}
+	candidates := p.Candidates
+	if candidates <= 0 {
+		candidates = limit * cfg.CandidatesPerResult
+	}
+	candidates = min(candidates, maxSearchLimit*cfg.CandidatesPerResult)
+	collapse, err := ParseCollapse(p.Collapse)
+	if err != nil {
+		return nil, err
+	}
+	var filter *Filter
+	if p.Filter != "" {
+		filter, err = ParseFilter(p.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	expand, err := ParseExpand(p.Expand)
+	if err == nil {
+		err = validateExpansion(expand, mode)
+	}
+	if err == nil && expand != "" && r.AssistantClient == nil {
+		err = errors.New("query expansion requires the assistant")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.EfSearch < 0 {
+		return nil, errors.New("ef_search must not be negative")
+	}
+	if p.Neighbors < 0 {
+		return nil, errors.New("neighbors must not be negative")
+	}
+	lambda := DefaultMMRLambda
+	if p.Lambda != nil {
+		lambda = *p.Lambda
+	}
+	if err = ValidateMMRLambda(lambda); err != nil {
+		return nil, err
+	}
+	if p.Compress && r.AssistantClient == nil {
+		return nil, errors.New("contextual compression requires the assistant")
+	}
+	halfLife, err := ParseHalfLife(p.RecencyHalfLife)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &SearchOptions{
+		Query:         p.Query,
+		Limit:         limit,
+		Mode:          mode,
+		Boosts:        p.Boosts,
+		Rerank:        rerank,
+		Candidates:    candidates,
+		Collapse:      collapse,
+		Collection:    collection,
+		Filter:        filter,
+		Fusion:        cfg.Fusion,
+		Expand:        expand,
+		Expansions:    min(p.Expansions, maxExpansions),
+		MinScore:      p.MinScore,
+		EfSearch:      p.EfSearch,
+		Neighbors:     min(p.Neighbors, maxNeighbors),
+		ParentSection: p.ParentSection,
+		MMR:           p.MMR,
+		Lambda:        lambda,
+		Compress:      p.Compress,
+
+		RecencyHalfLife: halfLife,
+		Graph:           p.Graph,
+		Summaries:       p.Summaries,
+	}
+	if s.opts.Hooks != nil {
+		opts.Hooks = s.opts.Hooks.ForRequest(header)
+	}
+	return opts, nil
 }
 
 func (s *Server) searchHandler(c echo.Context) error {
@@ -51,17 +580,22 @@ func (s *Server) searchHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	p.WithDefaults(c.QueryParam("limit"))
-
-	chunks, err := s.r.QueryDocumentChunks(context.TODO(), p.Query, p.Limit)
+	r, err := s.configure(c)
+	if err != nil {
+		return err
+	}
+	opts, err := s.searchOptions(c, r, &p)
 	if err != nil {
 		return err
 	}
 
-	chunks, err = s.r.Rerank(p.Query, chunks, p.Limit)
+	chunks, err := r.Search(c.Request().Context(), opts)
 	if err != nil {
 		return err
 	}
+	if m := canaryMetric(c); m != nil {
+		m.Results = len(chunks)
+	}
 
 	return c.JSON(http.StatusOK, echo.Map{
 		"count":  len(chunks),
@@ -69,10 +603,24 @@ func (s *Server) searchHandler(c echo.Context) error {
 	})
 }
 
+// primaryOnly rejects writes on a standby, they must go to the primary.
+func (s *Server) primaryOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.opts.Replicator != nil {
+			return echo.NewHTTPError(http.StatusForbidden, "server is a read-only standby")
+		}
+		return next(c)
+	}
+}
+
 func (s *Server) homeHandler(c echo.Context) error {
-	return c.JSON(http.StatusOK, echo.Map{
+	m := echo.Map{
 		"name":    "SlimRAG Server",
-		"version": "0.1.0",
+		"version": Version,
 		"URL":     "https://github.com/SlimRAG/SlimRAG",
-	})
+	}
+	if s.opts.Replicator != nil {
+		m["replication"] = s.opts.Replicator.Status()
+	}
+	return c.JSON(http.StatusOK, m)
 }
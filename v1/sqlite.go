@@ -0,0 +1,308 @@
+package rag
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	sqlitedriver "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	sqliteScheme     = "sqlite://"
+	sqliteDialect    = "sqlite"
+	sqliteTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+)
+
+func init() {
+	schema.RegisterSerializer("aggtime", aggregateTime{})
+	// filters match globs with REGEXP, which SQLite leaves to the application
+	sqlitedriver.MustRegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+}
+
+var sqliteRegexps sync.Map
+
+func sqliteRegexp(_ *sqlitedriver.FunctionContext, args []driver.Value) (driver.Value, error) {
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("regexp pattern must be text")
+	}
+	re, ok := sqliteRegexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		re, _ = sqliteRegexps.LoadOrStore(pattern, compiled)
+	}
+	switch s := args[1].(type) {
+	case string:
+		return re.(*regexp.Regexp).MatchString(s), nil
+	case []byte:
+		return re.(*regexp.Regexp).Match(s), nil
+	default:
+		return false, nil
+	}
+}
+
+// aggregateTime scans timestamps computed by aggregates such as
+// MAX(updated_at), which SQLite returns as text rather than time.
+type aggregateTime struct{}
+
+func (aggregateTime) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var t time.Time
+	var err error
+	switch v := dbValue.(type) {
+	case nil:
+	case time.Time:
+		t = v
+	case string:
+		t, err = time.Parse(sqliteTimeFormat, v)
+	case []byte:
+		t, err = time.Parse(sqliteTimeFormat, string(v))
+	default:
+		return errors.Newf("unsupported timestamp %T", dbValue)
+	}
+	if err != nil {
+		return err
+	}
+	return field.Set(ctx, dst, t)
+}
+
+func (aggregateTime) Value(_ context.Context, _ *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	return fieldValue, nil
+}
+
+// openSQLite opens a database file from a sqlite:// DSN. WAL and a busy
+// timeout let compute write from several goroutines while streaming rows.
+func openSQLite(path string) gorm.Dialector {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return sqlite.Open(path + sep + "_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_time_format=sqlite")
+}
+
+// sqliteBackend serves local and offline use. Dense search is a brute-force
+// scan in Go and keyword search uses an FTS5 index kept in sync by triggers.
+type sqliteBackend struct{}
+
+func (sqliteBackend) lockSchema(tx *gorm.DB) error {
+	// SQLite serializes writers itself: of two transactions racing to migrate,
+	// the one writing second fails with SQLITE_BUSY and migrateStep retries it
+	return tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version
+  (version integer PRIMARY KEY, name text NOT NULL, applied_at datetime NOT NULL)`).Error
+}
+
+// isSQLiteBusy reports whether err is SQLITE_BUSY, returned without waiting
+// when a transaction that has read tries to write after another one wrote.
+func isSQLiteBusy(err error) bool {
+	var e *sqlitedriver.Error
+	return errors.As(err, &e) && e.Code()&0xff == 5 // SQLITE_BUSY and its extended codes
+}
+
+func (sqliteBackend) dropSchema(tx *gorm.DB) error {
+	err := tx.Exec("DROP TABLE IF EXISTS document_chunks_fts").Error
+	if err != nil {
+		return err
+	}
+	// the fts triggers are dropped with document_chunks
+	return tx.Migrator().DropTable(baselineModels...)
+}
+
+func (sqliteBackend) migrate(db *gorm.DB) error {
+	err := migrateModels(db)
+	if err != nil {
+		return errors.Wrap(err, "Failed to migrate document chunks")
+	}
+
+	for _, stmt := range []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS document_chunks_fts USING fts5(text, content='document_chunks', content_rowid='rowid')`,
+		`CREATE TRIGGER IF NOT EXISTS document_chunks_fts_insert AFTER INSERT ON document_chunks BEGIN
+  INSERT INTO document_chunks_fts (rowid, text) VALUES (new.rowid, new.text);
+END`,
+		`CREATE TRIGGER IF NOT EXISTS document_chunks_fts_delete AFTER DELETE ON document_chunks BEGIN
+  INSERT INTO document_chunks_fts (document_chunks_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+END`,
+		`CREATE TRIGGER IF NOT EXISTS document_chunks_fts_update AFTER UPDATE OF text ON document_chunks BEGIN
+  INSERT INTO document_chunks_fts (document_chunks_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+  INSERT INTO document_chunks_fts (rowid, text) VALUES (new.rowid, new.text);
+END`,
+	} {
+		err = db.Exec(stmt).Error
+		if err != nil {
+			return errors.Wrap(err, "Failed to create full-text search index")
+		}
+	}
+	return nil
+}
+
+func (sqliteBackend) validateTextSearchConfig(_ *gorm.DB, name string) error {
+	if name != defaultTextSearchConfig {
+		return errors.Newf("text search configuration '%s' is not supported on sqlite", name)
+	}
+	return nil
+}
+
+func (sqliteBackend) storageSize(db *gorm.DB) (int64, error) {
+	var size int64
+	err := db.Raw("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size).Error
+	return size, err
+}
+
+type scoredID struct {
+	ID string
+	// Score orders the results, lower is better.
+	Score float64
+	// Relevance is reported as DocumentChunk.Score, higher is better.
+	Relevance float64
+}
+
+// fetchOrdered loads the chunks with the given IDs, in the order given.
+func fetchOrdered(db *gorm.DB, ranked []scoredID) ([]DocumentChunk, error) {
+	ids := make([]string, len(ranked))
+	for i, s := range ranked {
+		ids[i] = s.ID
+	}
+	var found []DocumentChunk
+	err := db.Where("id IN ?", ids).Find(&found).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]DocumentChunk, len(found))
+	for _, c := range found {
+		byID[c.ID] = c
+	}
+	chunks := make([]DocumentChunk, 0, len(ranked))
+	for _, s := range ranked {
+		if c, ok := byID[s.ID]; ok {
+			c.Score = s.Relevance
+			chunks = append(chunks, c)
+		}
+	}
+	return chunks, nil
+}
+
+func (sqliteBackend) queryDense(db *gorm.DB, queryEmbedding pgvector.Vector, space string, distance string, opts *SearchOptions) ([]DocumentChunk, error) {
+	chunks := db.Model(&DocumentChunk{}).Where("collection = ?", opts.collection()).Where(searchable("document_chunks", opts))
+	var quantized []scoredID
+	if space == "" {
+		var err error
+		quantized, err = scanQuantized(db, opts.Filter.apply(chunks.Session(&gorm.Session{})),
+			queryEmbedding.Slice(), distance, opts)
+		if err != nil {
+			return nil, err
+		}
+		// chunks with quantized embeddings are ranked by scanQuantized
+		chunks = chunks.Select("id", "raw_document", "embedding", "tags", "updated_at").
+			Where("embedding IS NOT NULL AND embedding_int8 IS NULL")
+	} else {
+		chunks = joinSpace(chunks, space).Select("id, raw_document, space_embedding AS embedding, tags, updated_at")
+	}
+	rows, err := opts.Filter.apply(chunks).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	q := queryEmbedding.Slice()
+	boost := newBoostMatcher(opts.Boosts)
+	ranked := quantized
+	for rows.Next() {
+		var c DocumentChunk
+		err = db.ScanRows(rows, &c)
+		if err != nil {
+			return nil, err
+		}
+		d, relevance := vectorDistance(distance, q, c.Embedding.Slice())
+		ranked = append(ranked, scoredID{
+			ID:        c.ID,
+			Score:     boostDistance(d, boost.factor(&c)),
+			Relevance: relevance,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	if len(ranked) > opts.Limit {
+		ranked = ranked[:opts.Limit]
+	}
+	return fetchOrdered(db, ranked)
+}
+
+// ftsQuery quotes every term so user input can't be parsed as FTS5 syntax;
+// adjacent terms are implicitly ANDed like websearch_to_tsquery.
+func ftsQuery(query string) string {
+	terms := strings.Fields(query)
+	for i, t := range terms {
+		terms[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+func (sqliteBackend) queryKeyword(db *gorm.DB, _ string, opts *SearchOptions) ([]DocumentChunk, error) {
+	match := ftsQuery(opts.Query)
+	if match == "" {
+		return nil, nil
+	}
+
+	// bm25 is negative, lower is better, so boosts multiply it
+	limit := opts.Limit
+	if len(opts.Boosts) > 0 {
+		limit *= collapseOversample
+	}
+	var matches []struct {
+		DocumentChunk
+		Rank float64
+	}
+	where := "document_chunks_fts MATCH ? AND c.collection = ? AND " + searchable("c", opts)
+	vars := []any{match, opts.collection()}
+	if opts.Filter != nil {
+		sql, filterVars := opts.Filter.where(sqliteDialect)
+		where += " AND " + sql
+		vars = append(vars, filterVars...)
+	}
+	err := db.Raw(`SELECT c.id, c.raw_document, c.tags, c.updated_at, bm25(document_chunks_fts) AS rank
+FROM document_chunks_fts JOIN document_chunks c ON c.rowid = document_chunks_fts.rowid
+WHERE `+where+` ORDER BY rank LIMIT ?`, append(vars, limit)...).Scan(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+
+	boost := newBoostMatcher(opts.Boosts)
+	ranked := make([]scoredID, len(matches))
+	for i, m := range matches {
+		ranked[i] = scoredID{ID: m.ID, Score: m.Rank * boost.factor(&m.DocumentChunk), Relevance: -m.Rank}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	if len(ranked) > opts.Limit {
+		ranked = ranked[:opts.Limit]
+	}
+	return fetchOrdered(db, ranked)
+}
+
+func (sqliteBackend) invalidChunks(db *gorm.DB, fn func(chunk *DocumentChunk) error) error {
+	rows, err := db.Model(&DocumentChunk{}).Where(invalidChunksSQL + " OR embedding IS NOT NULL").Rows()
+	if err != nil {
+		return err
+	}
+	// the zero vector has no distance operator here, its norm is checked in Go
+	return scanChunks(db, rows, func(chunk *DocumentChunk) error {
+		if chunk.Embedding != nil && chunk.Text != "" && l2Norm(chunk.Embedding.Slice()) != 0 {
+			return nil
+		}
+		return fn(chunk)
+	})
+}
@@ -0,0 +1,236 @@
+package rag
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/cespare/xxhash"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// wordEmbedder embeds texts as bags of words, so texts sharing words are close.
+type wordEmbedder struct{}
+
+func (wordEmbedder) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i] = make([]float32, dims)
+		for _, w := range strings.Fields(strings.ToLower(text)) {
+			embeddings[i][xxhash.Sum64String(w)%dims]++
+		}
+	}
+	return embeddings, nil
+}
+
+func TestBackendSearch(t *testing.T) {
+	forEachBackend(t, testBackendSearch)
+}
+
+func testBackendSearch(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Tags: []string{"food"}, Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+		{Text: "cherries are small"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, Concurrency: 2, BatchSize: 2})
+
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 2, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "cherries", Limit: 2, Mode: SearchModeKeyword})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "cherries are small", chunks[0].Text)
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: `red "apples`, Limit: 3, Mode: SearchModeHybrid})
+	require.NoError(t, err)
+	require.Equal(t, "apples are red", chunks[0].Text)
+
+	// replacing a chunk keeps the keyword index in sync
+	d.Chunks = d.Chunks[:2]
+	d.Chunks[1] = &DocumentChunk{Text: "bananas are ripe"}
+	upsertDocument(t, r, d)
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "yellow", Limit: 3, Mode: SearchModeKeyword})
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+
+	cc, err := r.GetChunkContext(ctx, chunks0ID(t, r), 1, 1)
+	require.NoError(t, err)
+	require.Len(t, cc.After, 1)
+	require.EqualValues(t, 2, cc.Document.Chunks)
+
+	documents, err := r.ListDocuments(ctx, &ListDocumentsOptions{})
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+	require.False(t, documents[0].UpdatedAt.IsZero())
+
+	// filters apply before ranking, on both search paths
+	report := &Document{FileName: "reports/2024/q1.md", Tags: []string{"finance"}, Chunks: []*DocumentChunk{
+		{Text: "apples sold well", Section: "Revenue", Page: 3},
+	}}
+	upsertDocument(t, r, report)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, BatchSize: 2})
+	filter, err := ParseFilter(`tag=finance AND path~"reports/2024/*" AND page>=3 AND created>1h`)
+	require.NoError(t, err)
+	for _, mode := range []SearchMode{SearchModeDense, SearchModeKeyword} {
+		chunks, err = r.Search(ctx, &SearchOptions{Query: "apples", Limit: 3, Mode: mode, Filter: filter})
+		require.NoError(t, err)
+		require.Len(t, chunks, 1, mode)
+		require.Equal(t, "Revenue", chunks[0].Section)
+	}
+	require.NoError(t, r.DB.Where("document = ?", report.Document).Delete(&DocumentChunk{}).Error)
+
+	// the same document in another collection never shows up in the default one
+	_, err = r.EnsureCollection(ctx, "notes", "")
+	require.NoError(t, err)
+	other := &Document{FileName: "fruits.md", Collection: "notes", Chunks: []*DocumentChunk{
+		{Text: "apples are green"},
+	}}
+	upsertDocument(t, r, other)
+
+	// keyword search analyzes queries like the collection's chunks, which
+	// follow the collection's analyzer when it changes
+	_, err = r.EnsureCollection(ctx, "notes", "english")
+	require.NoError(t, err)
+	analyzer, err := r.collectionAnalyzer(ctx, "notes")
+	require.NoError(t, err)
+	require.Equal(t, "english", analyzer)
+	var configs []string
+	require.NoError(t, db.Model(&DocumentChunk{}).Where("collection = ?", "notes").Pluck("text_search_config", &configs).Error)
+	require.Equal(t, []string{"english"}, configs)
+	analyzer, err = r.collectionAnalyzer(ctx, "missing")
+	require.NoError(t, err)
+	require.Equal(t, defaultTextSearchConfig, analyzer)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, BatchSize: 2})
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "green", Limit: 3, Mode: SearchModeKeyword})
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "apples", Collection: "notes", Limit: 3, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "apples are green", chunks[0].Text)
+
+	documents, err = r.ListDocuments(ctx, &ListDocumentsOptions{Collection: DefaultCollection})
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+	collections, err := r.ListCollections(ctx)
+	require.NoError(t, err)
+	require.Len(t, collections, 2)
+}
+
+func chunks0ID(t *testing.T, r *RAG) string {
+	var id string
+	require.NoError(t, r.DB.Model(&DocumentChunk{}).Where("chunk_index = 0").Pluck("id", &id).Error)
+	return id
+}
+
+func TestSearchScores(t *testing.T) {
+	forEachBackend(t, testSearchScores)
+}
+
+func testSearchScores(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "apples are red"},
+		{Text: "bananas are yellow"},
+		{Text: "yellow lemons"},
+	}}
+	upsertDocument(t, r, d)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, BatchSize: 3})
+
+	// dense scores are cosine similarities
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 3, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	require.InDelta(t, 2/math.Sqrt(6), chunks[0].Score, 1e-3)
+	require.InDelta(t, 0.5, chunks[1].Score, 1e-3)
+	require.Zero(t, chunks[2].Score)
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "yellow bananas", Limit: 3, Mode: SearchModeDense, MinScore: 0.6})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "bananas are yellow", chunks[0].Text)
+
+	for _, mode := range []SearchMode{SearchModeKeyword, SearchModeHybrid} {
+		chunks, err = r.Search(ctx, &SearchOptions{Query: "yellow", Limit: 3, Mode: mode})
+		require.NoError(t, err)
+		require.Positive(t, chunks[0].Score, mode)
+		for i := 1; i < len(chunks); i++ {
+			require.LessOrEqual(t, chunks[i].Score, chunks[i-1].Score, mode)
+		}
+	}
+
+	// boosts reorder both search paths
+	upsertDocument(t, r, &Document{FileName: "citrus.md", Tags: []string{"citrus"}, Chunks: []*DocumentChunk{
+		{Text: "yellow lemons are sour"},
+	}})
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true})
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "yellow", Limit: 3, Mode: SearchModeDense})
+	require.NoError(t, err)
+	require.Equal(t, "yellow lemons", chunks[0].Text)
+	for _, mode := range []SearchMode{SearchModeDense, SearchModeKeyword} {
+		chunks, err = r.Search(ctx, &SearchOptions{Query: "yellow", Limit: 3, Mode: mode,
+			Boosts: []BoostRule{{Field: BoostFieldTag, Value: "citrus", Factor: 10}}})
+		require.NoError(t, err)
+		require.Equal(t, "yellow lemons are sour", chunks[0].Text, mode)
+		chunks, err = r.Search(ctx, &SearchOptions{Query: "yellow", Limit: 3, Mode: mode,
+			Boosts: []BoostRule{{Field: BoostFieldPath, Value: "fruits.*", Factor: 10}}})
+		require.NoError(t, err)
+		require.Equal(t, "fruits", chunks[0].Document, mode)
+	}
+}
+
+func TestWidenResults(t *testing.T) {
+	forEachBackend(t, testWidenResults)
+}
+
+func testWidenResults(t *testing.T, db *gorm.DB) {
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{
+		{Text: "fruits", Section: "intro"},
+		{Text: "apples are red", Section: "red"},
+		{Text: "cherries are red", Section: "red"},
+		{Text: "strawberries", Section: "red"},
+		{Text: "interlude", Section: "intro"},
+		{Text: "bananas", Section: "yellow"},
+		{Text: "lemons are yellow", Section: "yellow"},
+		{Text: "pears", Section: "yellow"},
+		{Text: "the end", Section: "outro"},
+	}}
+	upsertDocument(t, r, d)
+
+	// adjacent hits merge into the best ranked one
+	chunks, err := r.Search(ctx, &SearchOptions{Query: "red", Limit: 3, Mode: SearchModeKeyword, Neighbors: 1})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, 0, chunks[0].Span.From)
+	require.Equal(t, 3, chunks[0].Span.To)
+	require.Len(t, chunks[0].Span.IDs, 4)
+	require.Equal(t, "fruits\n\napples are red\n\ncherries are red\n\nstrawberries", chunks[0].Text)
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "are", Limit: 3, Mode: SearchModeKeyword, Neighbors: 1})
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	spans := [][2]int{{chunks[0].Span.From, chunks[0].Span.To}, {chunks[1].Span.From, chunks[1].Span.To}}
+	require.ElementsMatch(t, [][2]int{{0, 3}, {5, 7}}, spans)
+
+	chunks, err = r.Search(ctx, &SearchOptions{Query: "lemons", Limit: 3, Mode: SearchModeKeyword, ParentSection: true})
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	require.Equal(t, "bananas\n\nlemons are yellow\n\npears", chunks[0].Text)
+	require.Equal(t, d.Chunks[6].ID, chunks[0].ID)
+}
@@ -0,0 +1,188 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// maxListDocuments caps the documents listed by one request to
+// GET /v1/documents, RemoteClient.ListDocuments pages through more.
+const maxListDocuments = 1000
+
+// IndexStats summarizes the contents of the index.
+type IndexStats struct {
+	Collections int64 `json:"collections"`
+	Documents   int64 `json:"documents"`
+	Chunks      int64 `json:"chunks"`
+	// Embedded is the number of chunks with an embedding, Pending those
+	// compute has yet to embed.
+	Embedded int64 `json:"embedded"`
+	Pending  int64 `json:"pending"`
+	// Quantized is the number of chunks with a quantized embedding, and
+	// QuantizedOnly those whose original was dropped.
+	Quantized     int64 `json:"quantized"`
+	QuantizedOnly int64 `json:"quantized_only"`
+	// Summaries is the number of the chunks that are section or document
+	// summaries, see Summarize.
+	Summaries int64 `json:"summaries"`
+	// Entities and Relations are the size of the knowledge graph, see ExtractGraph.
+	Entities  int64 `json:"entities"`
+	Relations int64 `json:"relations"`
+	// StorageBytes is the size of the whole database on disk, tables and
+	// indexes included, regardless of the collection.
+	StorageBytes int64        `json:"storage_bytes"`
+	Models       []ModelStats `gorm:"-" json:"models"`
+}
+
+// ModelStats is the number of vectors stored for an embedding model.
+type ModelStats struct {
+	// Model is empty for embeddings of unnamed models.
+	Model string `json:"model"`
+	// Active models' vectors are the chunk embeddings, the others' are kept
+	// side by side in chunk_embeddings.
+	Active  bool  `json:"active"`
+	Vectors int64 `json:"vectors"`
+}
+
+// Stats summarizes the index, restricted to one collection unless it is empty.
+func (r *RAG) Stats(ctx context.Context, collection string) (*IndexStats, error) {
+	db := r.DB.WithContext(ctx)
+	chunks := db.Model(&DocumentChunk{})
+	if collection != "" {
+		chunks = chunks.Where("collection = ?", collection)
+	}
+
+	stats := &IndexStats{}
+	err := chunks.Session(&gorm.Session{}).
+		Select("COUNT(DISTINCT collection) AS collections, COUNT(*) AS chunks, " + countEmbeddedSQL + " AS embedded, " +
+			"COUNT(embedding_int8) AS quantized, COUNT(CASE WHEN embedding IS NULL THEN embedding_int8 END) AS quantized_only, " +
+			"COUNT(CASE WHEN level > 0 THEN 1 END) AS summaries").
+		Scan(stats).Error
+	if err != nil {
+		return nil, err
+	}
+	stats.Pending = stats.Chunks - stats.Embedded
+	err = db.Table("(?) AS d", chunks.Session(&gorm.Session{}).Distinct("collection", "document")).
+		Count(&stats.Documents).Error
+	if err != nil {
+		return nil, err
+	}
+	entities := db.Model(&Entity{})
+	if collection != "" {
+		entities = entities.Where("collection = ?", collection)
+	}
+	err = entities.Session(&gorm.Session{}).Count(&stats.Entities).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(&EntityRelation{}).Where("source_id IN (?)", entities.Session(&gorm.Session{}).Select("id")).
+		Count(&stats.Relations).Error
+	if err != nil {
+		return nil, err
+	}
+	stats.StorageBytes, err = backendOf(r.DB).storageSize(db)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Models = make([]ModelStats, 0)
+	err = chunks.Session(&gorm.Session{}).
+		Select("embedding_model AS model, TRUE AS active, COUNT(*) AS vectors").
+		Where(embeddedSQL).
+		Group("embedding_model").
+		Order("embedding_model").
+		Scan(&stats.Models).Error
+	if err != nil {
+		return nil, err
+	}
+	var secondary []ModelStats
+	q := db.Model(&ChunkEmbedding{}).
+		Select("model, FALSE AS active, COUNT(*) AS vectors").
+		Group("model").
+		Order("model")
+	if collection != "" {
+		q = q.Where("chunk_id IN (?)", db.Model(&DocumentChunk{}).Select("id").Where("collection = ?", collection))
+	}
+	err = q.Scan(&secondary).Error
+	if err != nil {
+		return nil, err
+	}
+	stats.Models = append(stats.Models, secondary...)
+	return stats, nil
+}
+
+// listDocumentsHandler lists the documents of the collection in the path, or
+// of all collections under /v1 unless the collection query parameter names one.
+func (s *Server) listDocumentsHandler(c echo.Context) error {
+	limit, err := queryParamInt(c, "limit", 100)
+	if err != nil {
+		return err
+	}
+	if limit == 0 || limit > maxListDocuments {
+		limit = maxListDocuments
+	}
+	offset, err := queryParamInt(c, "offset", 0)
+	if err != nil {
+		return err
+	}
+	collection, err := queryCollection(c)
+	if err != nil {
+		return err
+	}
+
+	documents, err := s.ragOf(c).ListDocuments(c.Request().Context(), &ListDocumentsOptions{
+		Collection: collection,
+		Pattern:    c.QueryParam("pattern"),
+		Limit:      limit,
+		Offset:     offset,
+	})
+	if err != nil {
+		return err
+	}
+	if documents == nil {
+		documents = make([]DocumentInfo, 0)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"count":     len(documents),
+		"documents": documents,
+	})
+}
+
+// statsHandler summarizes the collection in the path, or all collections
+// under /v1 unless the collection query parameter names one.
+func (s *Server) statsHandler(c echo.Context) error {
+	collection, err := queryCollection(c)
+	if err != nil {
+		return err
+	}
+	stats, err := s.ragOf(c).Stats(c.Request().Context(), collection)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// queryCollection returns the collection in the path, else the one in the
+// collection query parameter, empty for all collections.
+func queryCollection(c echo.Context) (string, error) {
+	if name := c.Param("collection"); name != "" {
+		return name, nil
+	}
+	name := c.QueryParam("collection")
+	if name == "" {
+		return "", nil
+	}
+	if err := ValidateCollectionName(name); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return name, nil
+}
+
+func (postgresBackend) storageSize(db *gorm.DB) (int64, error) {
+	var size int64
+	err := db.Raw("SELECT pg_database_size(current_database())").Scan(&size).Error
+	return size, err
+}
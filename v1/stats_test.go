@@ -0,0 +1,50 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestRAG(db)
+	ctx := context.Background()
+
+	for _, d := range []*Document{
+		{FileName: "fruits.md", Chunks: []*DocumentChunk{{Text: "apples are red"}, {Text: "bananas are yellow"}}},
+		{FileName: "notes/veggies.md", Chunks: []*DocumentChunk{{Text: "carrots are orange"}}},
+	} {
+		upsertDocument(t, r, d)
+	}
+	embedChunks(t, r, &ComputeOptions{Documents: []string{"fruits"}, BatchSize: 2})
+
+	documents, err := r.ListDocuments(ctx, &ListDocumentsOptions{})
+	require.NoError(t, err)
+	require.Len(t, documents, 2)
+	require.Equal(t, "fruits.md", documents[0].RawDocument)
+	require.EqualValues(t, 2, documents[0].Chunks)
+	require.EqualValues(t, 2, documents[0].Embedded)
+	require.EqualValues(t, 0, documents[1].Embedded)
+
+	documents, err = r.ListDocuments(ctx, &ListDocumentsOptions{Pattern: "notes/*", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+	require.Equal(t, "notes/veggies.md", documents[0].RawDocument)
+
+	stats, err := r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, stats.Collections)
+	require.EqualValues(t, 2, stats.Documents)
+	require.EqualValues(t, 3, stats.Chunks)
+	require.EqualValues(t, 2, stats.Embedded)
+	require.EqualValues(t, 1, stats.Pending)
+	require.Positive(t, stats.StorageBytes)
+	require.Equal(t, []ModelStats{{Model: "", Active: true, Vectors: 2}}, stats.Models)
+
+	stats, err = r.Stats(ctx, "notes")
+	require.NoError(t, err)
+	require.Zero(t, stats.Chunks)
+	require.Empty(t, stats.Models)
+}
@@ -0,0 +1,288 @@
+package rag
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/schollz/progressbar/v3"
+	"github.com/sourcegraph/conc/pool"
+	"gorm.io/gorm"
+)
+
+// Levels of chunks: the chunks documents are split into, and the summaries
+// of their sections and of whole documents written by Summarize.
+const (
+	LevelChunk    = 0
+	LevelSection  = 1
+	LevelDocument = 2
+)
+
+const sectionSummaryPrompt = "请用一段话概括下面文档章节的内容，保留关键的名称、数字和结论。只输出概括，不要解释。" +
+	"\n文档：%s\n章节：%s\n内容：\n%s"
+
+const documentSummaryPrompt = "请用一段话概括下面这篇文档的内容，保留关键的名称、数字和结论。只输出概括，不要解释。" +
+	"\n文档：%s\n内容：\n%s"
+
+// summaryInputTokens bounds the text a summary is written from, the rest of
+// a long section or document is cut.
+const summaryInputTokens = 6000
+
+// summaryChildren is how many children follow a summary in search results.
+const summaryChildren = 3
+
+// summaryID derives the ID of the summary of a document, or of the section
+// starting at a chunk index, so summarizing again replaces it.
+func summaryID(collection string, document string, level int, index int) string {
+	return hashString(fmt.Sprintf("summary\x00%s\x00%s\x00%d\x00%d", collection, document, level, index))
+}
+
+// leafChunks matches the chunks of table documents were split into.
+func leafChunks(table string) string {
+	return table + ".level = 0"
+}
+
+// searchable matches the chunks of table a search ranks: those not collapsed
+// into a duplicate, leaf chunks only unless opts.Summaries.
+func searchable(table string, opts *SearchOptions) string {
+	if opts.Summaries {
+		return notDuplicate(table)
+	}
+	return notDuplicate(table) + " AND " + leafChunks(table)
+}
+
+type SummarizeOptions struct {
+	// Collection restricts summarizing to one collection, empty summarizes all.
+	Collection string
+	// Force summarizes the documents summarized before again.
+	Force       bool
+	Concurrency int
+	// Progress is called with the number of documents summarized, instead of
+	// showing a progress bar.
+	Progress func(n int)
+}
+
+type summarizedDocument struct {
+	Collection string
+	Document   string
+}
+
+// Summarize writes with the assistant a summary of every section of two or
+// more chunks and of every document of two or more chunks, from the section
+// summaries and the chunks outside of them. Summaries are stored as chunks of
+// their level, embedded by ComputeEmbeddings and searched with
+// SearchOptions.Summaries. Re-ingesting a document drops its summaries.
+func (r *RAG) Summarize(ctx context.Context, opts *SummarizeOptions) error {
+	if r.AssistantClient == nil {
+		return errors.New("summarizing requires the assistant")
+	}
+	tokenizer, err := NewTokenizer(r.AssistantModel)
+	if err != nil {
+		return err
+	}
+
+	db := r.DB.WithContext(ctx)
+	q := db.Model(&DocumentChunk{}).Select("collection", "document").Where(leafChunks("document_chunks"))
+	if opts.Collection != "" {
+		q = q.Where("collection = ?", opts.Collection)
+	}
+	if !opts.Force {
+		q = q.Where("NOT EXISTS (SELECT 1 FROM document_chunks s WHERE s.collection = document_chunks.collection " +
+			"AND s.document = document_chunks.document AND s.level > 0)")
+	}
+	var documents []summarizedDocument
+	err = q.Group("collection, document").Having("COUNT(*) > 1").Order("collection, document").
+		Find(&documents).Error
+	if err != nil {
+		return err
+	}
+
+	var bar *progressbar.ProgressBar
+	if opts.Progress == nil {
+		bar = progressbar.Default(int64(len(documents)))
+		bar.Describe("Summarizing documents")
+		defer func() { _ = bar.Finish() }()
+	}
+
+	var failed atomic.Int64
+	p := pool.New().WithMaxGoroutines(max(opts.Concurrency, 1))
+	for _, d := range documents {
+		p.Go(func() {
+			if bar != nil {
+				defer func() { _ = bar.Add(1) }()
+			}
+			err := r.summarizeDocument(ctx, tokenizer, d.Collection, d.Document)
+			if err != nil {
+				failed.Add(1)
+				log.Error().Err(err).Str("collection", d.Collection).Str("document", d.Document).
+					Msg("Summarizing document")
+				return
+			}
+			if opts.Progress != nil {
+				opts.Progress(1)
+			}
+		})
+	}
+	p.Wait()
+	if f := failed.Load(); f > 0 {
+		return errors.Newf("failed to summarize %d documents", f)
+	}
+	return nil
+}
+
+// summarizeDocument replaces the summaries of a document.
+func (r *RAG) summarizeDocument(ctx context.Context, tokenizer *Tokenizer, collection string, document string) error {
+	var chunks []DocumentChunk
+	err := r.DB.WithContext(ctx).Omit("embedding", "embedding_int8").
+		Where("collection = ? AND document = ?", collection, document).Where(leafChunks("document_chunks")).
+		Order("chunk_index").Find(&chunks).Error
+	if err != nil {
+		return err
+	}
+	if len(chunks) < 2 {
+		return nil
+	}
+
+	summary := func(level int, first *DocumentChunk, section string, text string) DocumentChunk {
+		return DocumentChunk{
+			ID:               summaryID(collection, document, level, first.Index),
+			Collection:       collection,
+			Document:         document,
+			RawDocument:      first.RawDocument,
+			Text:             text,
+			Index:            first.Index,
+			Tags:             first.Tags,
+			TextSearchConfig: first.TextSearchConfig,
+			SourcePath:       first.SourcePath,
+			Page:             first.Page,
+			Section:          section,
+			DocumentTime:     first.DocumentTime,
+			Level:            level,
+		}
+	}
+
+	summaries := make([]DocumentChunk, 0)
+	parts := make([]string, 0)
+	for start := 0; start < len(chunks); {
+		end := start + 1
+		section := chunks[start].Section
+		for end < len(chunks) && section != "" && chunks[end].Section == section {
+			end++
+		}
+		run := chunks[start:end]
+		if len(run) < 2 {
+			parts = append(parts, run[0].Text)
+			start = end
+			continue
+		}
+		texts := make([]string, len(run))
+		for i, c := range run {
+			texts[i] = c.Text
+		}
+		text, err := r.complete(ctx, "section summary", fmt.Sprintf(sectionSummaryPrompt, document, section,
+			tokenizer.Truncate(strings.Join(texts, "\n\n"), summaryInputTokens)))
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, summary(LevelSection, &run[0], section, text))
+		parts = append(parts, section+"："+text)
+		start = end
+	}
+	// a section summary of the whole document is its summary
+	if len(summaries) == 1 && len(parts) == 1 {
+		summaries[0].Level = LevelDocument
+		summaries[0].ID = summaryID(collection, document, LevelDocument, chunks[0].Index)
+	} else {
+		text, err := r.complete(ctx, "document summary", fmt.Sprintf(documentSummaryPrompt, document,
+			tokenizer.Truncate(strings.Join(parts, "\n\n"), summaryInputTokens)))
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, summary(LevelDocument, &chunks[0], "", text))
+	}
+
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		_, err := deleteChunks(tx, "collection = ? AND document = ? AND level > 0", collection, document)
+		if err != nil {
+			return err
+		}
+		return tx.Create(&summaries).Error
+	})
+}
+
+// expandSummaries follows every summary among chunks with its children most
+// similar to the query, at most summaryChildren, which take its score: the
+// chunks of its section, or of its document. Children already among the
+// results are left where they are.
+func (r *RAG) expandSummaries(ctx context.Context, query string, chunks []DocumentChunk) ([]DocumentChunk, error) {
+	if !slices.ContainsFunc(chunks, func(c DocumentChunk) bool { return c.Level > LevelChunk }) {
+		return chunks, nil
+	}
+	db := r.DB.WithContext(ctx)
+	seen := make(map[string]bool, len(chunks))
+	for _, c := range chunks {
+		seen[c.ID] = true
+	}
+
+	var queryEmbedding []float32
+	space := ""
+	if r.Embedder != nil {
+		active, err := r.ActiveEmbeddingModel(ctx)
+		if err != nil {
+			return nil, err
+		}
+		space, err = r.embeddingSpace(ctx, active)
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.embedQuery(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		queryEmbedding = v.Slice()
+	}
+
+	expanded := make([]DocumentChunk, 0, len(chunks))
+	for _, s := range chunks {
+		expanded = append(expanded, s)
+		if s.Level == LevelChunk {
+			continue
+		}
+		q := db.Omit("embedding", "embedding_int8").
+			Where("collection = ? AND document = ?", s.Collection, s.Document).
+			Where(leafChunks("document_chunks")).Where(notDuplicate("document_chunks"))
+		if s.Level == LevelSection {
+			q = q.Where("section = ?", s.Section)
+		}
+		var children []DocumentChunk
+		err := q.Order("chunk_index").Find(&children).Error
+		if err != nil {
+			return nil, err
+		}
+		children = slices.DeleteFunc(children, func(c DocumentChunk) bool { return seen[c.ID] })
+		if queryEmbedding != nil {
+			embeddings, err := r.candidateEmbeddings(ctx, children, space)
+			if err != nil {
+				return nil, err
+			}
+			similarity := make(map[string]float64, len(children))
+			for _, c := range children {
+				similarity[c.ID] = cosineSimilarity(queryEmbedding, embeddings[c.ID])
+			}
+			slices.SortStableFunc(children, func(a, b DocumentChunk) int {
+				return cmp.Compare(similarity[b.ID], similarity[a.ID])
+			})
+		}
+		for _, c := range children[:min(len(children), summaryChildren)] {
+			c.Score = s.Score
+			seen[c.ID] = true
+			expanded = append(expanded, c)
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,90 @@
+package rag
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db, Embedder: wordEmbedder{}, AssistantClient: graphAssistant(t, map[string]string{
+		"章节：Fruit": "orchard harvest overview",
+		"这篇文档":     "gardening handbook overview",
+	}), AssistantModel: "gpt-4o"}
+	ctx := context.Background()
+
+	garden := func() *Document {
+		d := &Document{FileName: "garden.md", Chunks: []*DocumentChunk{
+			{Text: "apples are red", Section: "Fruit"},
+			{Text: "bananas are yellow", Section: "Fruit"},
+			{Text: "oaks grow slowly", Section: "Trees"},
+		}}
+		d.Fix()
+		return d
+	}
+	require.NoError(t, r.UpsertDocumentChunks(garden()))
+	single := &Document{FileName: "single.md", Chunks: []*DocumentChunk{{Text: "a lonely chunk"}}}
+	upsertDocument(t, r, single)
+
+	summarized := 0
+	require.NoError(t, r.Summarize(ctx, &SummarizeOptions{Concurrency: 2, Progress: func(n int) { summarized += n }}))
+	require.Equal(t, 1, summarized)
+	embedChunks(t, r, &ComputeOptions{OnlyEmpty: true, BatchSize: 4})
+	stats, err := r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.Summaries)
+	require.Equal(t, int64(6), stats.Chunks)
+	require.Equal(t, int64(2), stats.Documents)
+
+	// summaries are searched only when asked for
+	opts := &SearchOptions{Query: "orchard", Mode: SearchModeKeyword, Limit: 5}
+	chunks, err := r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+
+	opts.Summaries = true
+	chunks, err = r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	require.Equal(t, LevelSection, chunks[0].Level)
+	require.Equal(t, "Fruit", chunks[0].Section)
+	require.Equal(t, "apples are red", chunks[1].Text)
+	require.Equal(t, "bananas are yellow", chunks[2].Text)
+	require.Equal(t, chunks[0].Score, chunks[2].Score)
+
+	// children follow the document summary most similar to the query first
+	opts.Query = "gardening handbook oaks"
+	opts.Mode = SearchModeDense
+	opts.Limit = 1
+	chunks, err = r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, chunks, 4)
+	require.Equal(t, LevelDocument, chunks[0].Level)
+	require.Equal(t, "oaks grow slowly", chunks[1].Text)
+
+	// widening leaves summaries as they are
+	opts.Neighbors = 1
+	chunks, err = r.Search(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, "gardening handbook overview", chunks[0].Text)
+	require.Nil(t, chunks[0].Span)
+
+	summarized = 0
+	require.NoError(t, r.Summarize(ctx, &SummarizeOptions{Progress: func(n int) { summarized += n }}))
+	require.Zero(t, summarized)
+	require.NoError(t, r.Summarize(ctx, &SummarizeOptions{Force: true, Progress: func(n int) { summarized += n }}))
+	require.Equal(t, 1, summarized)
+	stats, err = r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.Summaries)
+
+	// re-ingesting a document drops its summaries
+	require.NoError(t, r.UpsertDocumentChunks(garden()))
+	stats, err = r.Stats(ctx, "")
+	require.NoError(t, err)
+	require.Zero(t, stats.Summaries)
+
+	require.ErrorContains(t, (&RAG{DB: db}).Summarize(ctx, &SummarizeOptions{}), "requires the assistant")
+}
@@ -0,0 +1,122 @@
+package rag
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeCert(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "first")
+	certs, err := NewCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	require.NoError(t, err)
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", certs.TLSConfig())
+	require.NoError(t, err)
+	defer func() { _ = lis.Close() }()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	served := func() string {
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	require.Equal(t, "first", served())
+
+	writeCert(t, dir, "second")
+	require.NoError(t, certs.Reload())
+	require.Equal(t, "second", served())
+
+	// a broken pair keeps the previous certificate
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), []byte("broken"), 0o600))
+	require.Error(t, certs.Reload())
+	require.Equal(t, "second", served())
+
+	_, err = NewCertReloader(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "tls.key"))
+	require.Error(t, err)
+}
+
+func TestServerReload(t *testing.T) {
+	db := newTestDB(t)
+	d := &Document{FileName: "fruits.md", Chunks: []*DocumentChunk{{Text: "Apples are red."}}}
+	d.Fix()
+	r := newTestRAG(db)
+	require.NoError(t, r.UpsertDocumentChunks(d))
+	s := NewServer(r, &ServerOptions{})
+
+	search := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/search",
+			strings.NewReader(`{"query":"apples","mode":"keyword","compress":true}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusBadRequest, search().Code)
+
+	// a request in flight keeps the previous RAG until it is done
+	held, release := s.holdRAG()
+	next := *r
+	next.AssistantClient = fakeAssistant(t, "Apples are red.")
+	retired := s.Reload(&next)
+	rec := search()
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Body.String(), "Apples are red.")
+	require.Same(t, r, held)
+	select {
+	case <-retired:
+		t.Fatal("retired with a request in flight")
+	default:
+	}
+	release()
+	<-retired
+	// the RAG passed to NewServer is left as it was
+	require.Nil(t, r.AssistantClient)
+
+	// nothing in flight retires at once
+	<-s.Reload(r)
+}
@@ -0,0 +1,155 @@
+package rag
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// DefaultEncoding counts the tokens of models tiktoken doesn't know, which
+// is close enough for the budgets it enforces.
+const DefaultEncoding = "cl100k_base"
+
+// tokensPerMessage is the overhead of every chat message, its role and
+// separators, and tokensPerReply primes the reply.
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// minTruncatedTokens is the least a chunk is truncated to for the context
+// to fit, below which it is dropped instead.
+const minTruncatedTokens = 32
+
+func init() {
+	// the BPE files are compiled in, instead of downloaded on first use
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// Tokenizer counts tokens as OpenAI models do with tiktoken.
+type Tokenizer struct {
+	encoding string
+	tt       *tiktoken.Tiktoken
+}
+
+var tokenizers sync.Map
+
+// NewTokenizer returns the tokenizer of a model or of an encoding such as
+// cl100k_base, DefaultEncoding for empty or unknown models.
+func NewTokenizer(modelOrEncoding string) (*Tokenizer, error) {
+	encoding := DefaultEncoding
+	if modelOrEncoding != "" {
+		switch modelOrEncoding {
+		case tiktoken.MODEL_O200K_BASE, tiktoken.MODEL_CL100K_BASE, tiktoken.MODEL_P50K_BASE,
+			tiktoken.MODEL_P50K_EDIT, tiktoken.MODEL_R50K_BASE:
+			encoding = modelOrEncoding
+		default:
+			if name, ok := encodingOfModel(modelOrEncoding); ok {
+				encoding = name
+			}
+		}
+	}
+	if t, ok := tokenizers.Load(encoding); ok {
+		return t.(*Tokenizer), nil
+	}
+	tt, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to load encoding %s", encoding)
+	}
+	t, _ := tokenizers.LoadOrStore(encoding, &Tokenizer{encoding: encoding, tt: tt})
+	return t.(*Tokenizer), nil
+}
+
+// encodingOfModel looks a model up like tiktoken.EncodingForModel, without
+// building the encoding it names.
+func encodingOfModel(model string) (string, bool) {
+	if name, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return name, true
+	}
+	longest := ""
+	for prefix := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return "", false
+	}
+	return tiktoken.MODEL_PREFIX_TO_ENCODING[longest], true
+}
+
+func (t *Tokenizer) Encoding() string {
+	return t.encoding
+}
+
+// Count returns the number of tokens of text. Special tokens in it are
+// counted as text, since documents are never meant to contain them.
+func (t *Tokenizer) Count(text string) int {
+	return len(t.tt.EncodeOrdinary(text))
+}
+
+// Truncate returns the longest prefix of text of at most n tokens.
+func (t *Tokenizer) Truncate(text string, n int) string {
+	tokens := t.tt.EncodeOrdinary(text)
+	if len(tokens) <= n {
+		return text
+	}
+	return t.tt.Decode(tokens[:max(n, 0)])
+}
+
+// Split cuts text into pieces of at most n tokens.
+func (t *Tokenizer) Split(text string, n int) []string {
+	tokens := t.tt.EncodeOrdinary(text)
+	pieces := make([]string, 0, len(tokens)/n+1)
+	for len(tokens) > n {
+		pieces = append(pieces, t.tt.Decode(tokens[:n]))
+		tokens = tokens[n:]
+	}
+	if len(tokens) > 0 {
+		pieces = append(pieces, t.tt.Decode(tokens))
+	}
+	return pieces
+}
+
+// countMessages returns the prompt tokens of chat messages.
+func (t *Tokenizer) countMessages(messages ...string) int {
+	n := tokensPerReply
+	for _, m := range messages {
+		n += tokensPerMessage + t.Count(m)
+	}
+	return n
+}
+
+// TokenUsage is the tokens an answer took. Context is the part of the prompt
+// taken by the retrieved chunks.
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	ContextTokens    int `json:"context_tokens"`
+}
+
+// fitContext returns the chunks, in order, whose context fits in budget
+// tokens, truncating the first one that doesn't fit when enough of it does.
+func (t *Tokenizer) fitContext(budget int, chunks []DocumentChunk) []DocumentChunk {
+	fitted := make([]DocumentChunk, 0, len(chunks))
+	for i, c := range chunks {
+		n := t.Count(contextEntry(i, &c))
+		if n <= budget {
+			fitted = append(fitted, c)
+			budget -= n
+			continue
+		}
+		// the text is what is cut, the source header stays whole
+		overhead := n - t.Count(c.Text)
+		if budget-overhead >= minTruncatedTokens {
+			c.Text = t.Truncate(c.Text, budget-overhead)
+			fitted = append(fitted, c)
+		}
+		break
+	}
+	return fitted
+}
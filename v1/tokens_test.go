@@ -0,0 +1,87 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenizer(t *testing.T) {
+	for model, encoding := range map[string]string{
+		"":                       DefaultEncoding,
+		"gpt-4o-mini":            "o200k_base",
+		"gpt-4":                  "cl100k_base",
+		"text-embedding-3-small": "cl100k_base",
+		"p50k_base":              "p50k_base",
+		"qwen3-32b":              DefaultEncoding,
+	} {
+		tokenizer, err := NewTokenizer(model)
+		require.NoError(t, err, model)
+		require.Equal(t, encoding, tokenizer.Encoding(), model)
+	}
+
+	tokenizer, err := NewTokenizer("")
+	require.NoError(t, err)
+	require.Equal(t, 2, tokenizer.Count("hello world"))
+	require.Equal(t, 0, tokenizer.Count(""))
+	require.Equal(t, "hello", tokenizer.Truncate("hello world", 1))
+	require.Equal(t, "hello world", tokenizer.Truncate("hello world", 5))
+	require.Equal(t, []string{"one two", " three four", " five"}, tokenizer.Split("one two three four five", 2))
+}
+
+func TestParagraphChunkerTokens(t *testing.T) {
+	tokenizer, err := NewTokenizer("")
+	require.NoError(t, err)
+	c := &ParagraphChunker{MaxRunes: 1000, MaxTokens: 6, Tokenizer: tokenizer}
+
+	text := "one two\n\nthree four\n\nfive six seven eight nine ten eleven"
+	chunks := c.Chunk(text)
+	require.Equal(t, []string{"one two\n\nthree four", "five six seven eight nine ten", "eleven"}, chunks)
+	for _, chunk := range chunks {
+		require.LessOrEqual(t, tokenizer.Count(chunk), 6)
+	}
+
+	// without a tokenizer only runes are limited
+	c.Tokenizer = nil
+	require.Len(t, c.Chunk(text), 1)
+}
+
+func TestAskContextTokens(t *testing.T) {
+	tokenizer, err := NewTokenizer("")
+	require.NoError(t, err)
+	chunks := []DocumentChunk{
+		{ID: "a", RawDocument: "a.md", Text: "apples are red"},
+		{ID: "b", RawDocument: "b.md", Text: strings.Repeat("bananas are yellow ", 50)},
+		{ID: "c", RawDocument: "c.md", Text: "cherries are dark"},
+	}
+
+	cfg := DefaultConfig()
+	r := (&RAG{AssistantClient: fakeAssistant(t, "apples [1] and bananas [2]")}).
+		WithConfig(&ConfigVersion{Config: cfg})
+	answer, err := r.Ask(context.Background(), "fruits?", chunks)
+	require.NoError(t, err)
+	require.Len(t, answer.Chunks, 3)
+	require.Len(t, answer.Citations, 2)
+	require.Equal(t, tokenizer.Count(buildContext(chunks)), answer.Usage.ContextTokens)
+	require.Equal(t, tokenizer.Count(answer.Text), answer.Usage.CompletionTokens)
+	require.Equal(t, answer.Usage.PromptTokens+answer.Usage.CompletionTokens, answer.Usage.TotalTokens)
+
+	// the second chunk is truncated to the budget and the third dropped
+	question := tokenizer.countMessages(cfg.SystemPrompt, buildPrompt(cfg.AnswerPrompt, "fruits?", nil))
+	cfg.ContextTokens = question + tokenizer.Count(contextEntry(0, &chunks[0])) + 60
+	r = r.WithConfig(&ConfigVersion{Config: cfg})
+	answer, err = r.Ask(context.Background(), "fruits?", chunks)
+	require.NoError(t, err)
+	require.Len(t, answer.Chunks, 2)
+	require.Equal(t, chunks[0].Text, answer.Chunks[0].Text)
+	require.True(t, strings.HasPrefix(chunks[1].Text, answer.Chunks[1].Text))
+	require.Less(t, len(answer.Chunks[1].Text), len(chunks[1].Text))
+	require.LessOrEqual(t, answer.Usage.PromptTokens, cfg.ContextTokens)
+	require.Equal(t, "c", chunks[2].ID)
+
+	cfg.ContextTokens = 10
+	_, err = r.WithConfig(&ConfigVersion{Config: cfg}).Ask(context.Background(), "fruits?", chunks)
+	require.ErrorContains(t, err, "context tokens")
+}
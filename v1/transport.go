@@ -0,0 +1,277 @@
+package rag
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrCircuitOpen is returned for calls to an upstream whose circuit is open
+// after failing repeatedly, until its cooldown passes.
+var ErrCircuitOpen = errors.New("circuit open")
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+type TransportOptions struct {
+	// Timeout bounds every attempt until the response headers arrive, and
+	// then every wait for more of the body, so streamed completions may take
+	// longer as long as they keep streaming. Zero waits forever.
+	Timeout time.Duration
+	// MaxRetries bounds retries with jittered exponential backoff on network
+	// errors, timeouts, 429 and 5xx responses.
+	MaxRetries int
+	// MaxInflight bounds the calls in flight across every client sharing the
+	// transport, zero doesn't limit them.
+	MaxInflight int
+	// BreakerThreshold consecutive failures of an upstream open its circuit
+	// for BreakerCooldown, zero never opens it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+func DefaultTransportOptions() *TransportOptions {
+	return &TransportOptions{
+		Timeout:          2 * time.Minute,
+		MaxRetries:       2,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// Transport is the http.RoundTripper model clients share, so one slow or
+// failing upstream can neither hang callers nor take all capacity: attempts
+// time out, failures are retried, the circuits of upstreams failing
+// repeatedly open, and calls in flight are limited across clients.
+type Transport struct {
+	base       http.RoundTripper
+	timeout    time.Duration
+	maxRetries int
+	// inflight and breakers are shared by the copies of WithMaxRetries
+	inflight chan struct{}
+	breakers *breakers
+}
+
+func NewTransport(opts *TransportOptions) *Transport {
+	t := &Transport{
+		base:       http.DefaultTransport,
+		timeout:    opts.Timeout,
+		maxRetries: opts.MaxRetries,
+		breakers: &breakers{
+			threshold: opts.BreakerThreshold,
+			cooldown:  opts.BreakerCooldown,
+			upstreams: make(map[string]*breaker),
+		},
+	}
+	if opts.MaxInflight > 0 {
+		t.inflight = make(chan struct{}, opts.MaxInflight)
+	}
+	return t
+}
+
+// WithMaxRetries returns a transport retrying up to n times, sharing the
+// limit of calls in flight and the circuits of t.
+func (t *Transport) WithMaxRetries(n int) *Transport {
+	c := *t
+	c.maxRetries = n
+	return &c
+}
+
+// Client returns an HTTP client using t.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstream := req.URL.Host
+	for attempt := 0; ; attempt++ {
+		rsp, err := t.attempt(req, upstream, attempt)
+		if !t.retryable(req, rsp, err) || attempt >= t.maxRetries {
+			return rsp, err
+		}
+		delay := backoff(attempt, rsp)
+		if rsp != nil {
+			_, _ = io.Copy(io.Discard, rsp.Body)
+			_ = rsp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attempt sends req once, holding a slot of the calls in flight until the
+// response body is closed.
+func (t *Transport) attempt(req *http.Request, upstream string, attempt int) (*http.Response, error) {
+	if err := t.breakers.allow(upstream); err != nil {
+		return nil, err
+	}
+	if t.inflight != nil {
+		select {
+		case t.inflight <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	release := sync.OnceFunc(func() {
+		if t.inflight != nil {
+			<-t.inflight
+		}
+	})
+
+	if attempt > 0 && req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			release()
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timer *time.Timer
+	var timedOut atomic.Bool
+	if t.timeout > 0 {
+		timer = time.AfterFunc(t.timeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+	}
+	done := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel()
+		release()
+	}
+
+	rsp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		if timedOut.Load() {
+			err = errors.Newf("%s: no response after %s", upstream, t.timeout)
+		}
+		done()
+		if req.Context().Err() == nil {
+			t.breakers.record(upstream, false)
+		}
+		return nil, err
+	}
+	t.breakers.record(upstream, rsp.StatusCode < http.StatusInternalServerError)
+	rsp.Body = &watchedBody{ReadCloser: rsp.Body, timer: timer, timeout: t.timeout, done: done}
+	return rsp, nil
+}
+
+// retryable reports whether a failed attempt may succeed if sent again:
+// after network errors and timeouts, and on 429 and 5xx responses, unless
+// the caller gave up or the request body can't be sent again.
+func (t *Transport) retryable(req *http.Request, rsp *http.Response, err error) bool {
+	if req.Context().Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff returns the delay before retry attempt+1: the Retry-After of the
+// response if it has one, else an exponential delay with full jitter.
+func backoff(attempt int, rsp *http.Response) time.Duration {
+	if rsp != nil {
+		if seconds, err := strconv.Atoi(rsp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, retryMaxDelay)
+		}
+	}
+	d := min(retryBaseDelay<<attempt, retryMaxDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+// watchedBody extends the attempt's timeout on every read, and ends the
+// attempt when the body is closed.
+type watchedBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	done    func()
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	if b.timer != nil {
+		b.timer.Reset(b.timeout)
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+// breakers hold the circuit of every upstream.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	upstreams map[string]*breaker
+}
+
+type breaker struct {
+	failures int
+	openedAt time.Time
+}
+
+// allow fails while the circuit of upstream is open. Once the cooldown
+// passed, calls are let through again, and the next failure opens it again.
+func (b *breakers) allow(upstream string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.upstreams[upstream]
+	if s == nil || s.failures < b.threshold {
+		return nil
+	}
+	if wait := b.cooldown - time.Since(s.openedAt); wait > 0 {
+		return errors.Wrapf(ErrCircuitOpen, "%s failed %d times, retry in %s", upstream, s.failures,
+			wait.Round(time.Second))
+	}
+	return nil
+}
+
+func (b *breakers) record(upstream string, ok bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.upstreams[upstream]
+	if s == nil {
+		s = &breaker{}
+		b.upstreams[upstream] = s
+	}
+	if ok {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures >= b.threshold {
+		s.openedAt = time.Now()
+	}
+}
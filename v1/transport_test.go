@@ -0,0 +1,143 @@
+package rag
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportRetries(t *testing.T) {
+	var calls atomic.Int32
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := NewTransport(&TransportOptions{MaxRetries: 2}).Client()
+	rsp, err := client.Post(ts.URL, "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(rsp.Body)
+	require.NoError(t, rsp.Body.Close())
+	require.Equal(t, "ok", string(body))
+	require.Equal(t, int32(3), calls.Load())
+	// the body is sent again on every attempt
+	require.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+
+	calls.Store(0)
+	rsp, err = NewTransport(&TransportOptions{MaxRetries: 2}).WithMaxRetries(1).Client().Get(ts.URL)
+	require.NoError(t, err)
+	require.NoError(t, rsp.Body.Close())
+	require.Equal(t, http.StatusServiceUnavailable, rsp.StatusCode)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestTransportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// every part arrives within the timeout, the whole takes longer
+			for range 4 {
+				_, _ = w.Write([]byte("part "))
+				w.(http.Flusher).Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := NewTransport(&TransportOptions{Timeout: 100 * time.Millisecond}).Client()
+	_, err := client.Get(ts.URL)
+	require.ErrorContains(t, err, "no response after 100ms")
+
+	rsp, err := client.Get(ts.URL + "/stream")
+	require.NoError(t, err)
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.NoError(t, rsp.Body.Close())
+	require.Equal(t, strings.Repeat("part ", 4), string(body))
+}
+
+func TestTransportCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	transport := NewTransport(&TransportOptions{BreakerThreshold: 2, BreakerCooldown: time.Hour})
+	for range 2 {
+		rsp, err := transport.Client().Get(ts.URL)
+		require.NoError(t, err)
+		require.NoError(t, rsp.Body.Close())
+	}
+	// copies share the circuits
+	_, err := transport.WithMaxRetries(3).Client().Get(ts.URL)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestTransportMaxInflight(t *testing.T) {
+	var inflight, peak atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	transport := NewTransport(&TransportOptions{MaxInflight: 2})
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := transport.Client().Get(ts.URL)
+			require.NoError(t, err)
+			require.NoError(t, rsp.Body.Close())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), peak.Load())
+
+	// waiting for a slot gives up with the caller
+	transport = NewTransport(&TransportOptions{MaxInflight: 1})
+	transport.inflight <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	_, err = transport.Client().Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
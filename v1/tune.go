@@ -0,0 +1,330 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/pgvector/pgvector-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	IndexMethodHNSW    = "hnsw"
+	IndexMethodIVFFlat = "ivfflat"
+)
+
+var (
+	defaultEfSearch = []int{40, 80, 160, 320, 640}
+	defaultProbes   = []int{1, 5, 10, 20, 50, 100}
+)
+
+// IndexTuneSample records the recall and latency measured for one search
+// parameter value, so that runs can be compared as the corpus grows.
+type IndexTuneSample struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	Index     string    `gorm:"not null" json:"index"`
+	Method    string    `gorm:"not null" json:"method"`
+	Chunks    int64     `gorm:"not null" json:"chunks"`
+	Param     string    `gorm:"not null" json:"param"`
+	Value     int       `gorm:"not null" json:"value"`
+	K         int       `gorm:"not null" json:"k"`
+	Queries   int       `gorm:"not null" json:"queries"`
+	Recall    float64   `gorm:"not null" json:"recall"`
+	P50Ms     float64   `gorm:"column:p50_ms;not null" json:"p50_ms"`
+	P95Ms     float64   `gorm:"column:p95_ms;not null" json:"p95_ms"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+type VectorIndex struct {
+	Name       string `json:"name"`
+	Method     string `json:"method"`
+	Bytes      int64  `json:"bytes"`
+	Definition string `json:"definition"`
+	// Valid is false for an index whose concurrent build failed, it is not used by searches.
+	Valid bool `json:"valid"`
+}
+
+type IndexTuneOptions struct {
+	Queries      int
+	K            int
+	TargetRecall float64
+	// Values overrides the ef_search (hnsw) or probes (ivfflat) values to try.
+	Values []int
+}
+
+type IndexTuneReport struct {
+	Index   *VectorIndex      `json:"index"`
+	Chunks  int64             `json:"chunks"`
+	Samples []IndexTuneSample `json:"samples"`
+
+	Param       string `json:"param"`
+	Current     string `json:"current"`
+	Recommended int    `json:"recommended"`
+
+	CurrentMaintenanceWorkMem     string `json:"current_maintenance_work_mem"`
+	RecommendedMaintenanceWorkMem string `json:"recommended_maintenance_work_mem"`
+
+	Notes []string `json:"notes,omitempty"`
+}
+
+// vectorIndex finds the ANN index of a collection, or with an empty
+// collection the shared one on the embedding column, nil if there is none.
+func (r *RAG) vectorIndex(ctx context.Context, collection string) (*VectorIndex, error) {
+	var indexes []struct {
+		Name  string
+		Def   string
+		Bytes int64
+		Valid bool
+	}
+	err := r.DB.WithContext(ctx).Raw(`SELECT i.indexname AS name, i.indexdef AS def,
+  pg_relation_size(quote_ident(i.indexname)::regclass) AS bytes, x.indisvalid AS valid
+FROM pg_indexes i JOIN pg_index x ON x.indexrelid = quote_ident(i.indexname)::regclass
+WHERE i.tablename = 'document_chunks'`).Scan(&indexes).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range indexes {
+		def := strings.ToLower(idx.Def)
+		if !strings.Contains(def, "(embedding") {
+			continue
+		}
+		// the indexes of collections are partial
+		if collection == "" && strings.Contains(def, " where ") ||
+			collection != "" && idx.Name != vectorIndexNameOf(collection) {
+			continue
+		}
+		for _, method := range []string{IndexMethodHNSW, IndexMethodIVFFlat} {
+			if strings.Contains(def, "using "+method) {
+				return &VectorIndex{Name: idx.Name, Method: method, Bytes: idx.Bytes, Definition: idx.Def, Valid: idx.Valid}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// estimateMaintenanceWorkMem sizes maintenance_work_mem so that an index over
+// chunks vectors can be built in memory: half-precision vectors plus graph
+// links, with headroom for growth.
+func estimateMaintenanceWorkMem(chunks int64) int64 {
+	const perVector = dims*2 + 16*2*8 + 64
+	mb := int64(math.Ceil(float64(chunks) * perVector * 1.5 / (1 << 20)))
+	if mb < 64 {
+		mb = 64
+	}
+	// round up to a power of two so recommendations don't churn on every run
+	p := int64(64)
+	for p < mb {
+		p *= 2
+	}
+	return p
+}
+
+func formatMB(mb int64) string {
+	if mb >= 1024 && mb%1024 == 0 {
+		return fmt.Sprintf("%dGB", mb/1024)
+	}
+	return fmt.Sprintf("%dMB", mb)
+}
+
+func (r *RAG) currentSetting(ctx context.Context, name string) (string, error) {
+	var value *string
+	err := r.DB.WithContext(ctx).Raw("SELECT current_setting(?, true)", name).Scan(&value).Error
+	if err != nil || value == nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// nearestIDs returns the k nearest chunk ids to v, after running setup
+// statements local to the query's transaction.
+func (r *RAG) nearestIDs(ctx context.Context, v pgvector.HalfVector, exclude string, k int, setup ...string) ([]string, time.Duration, error) {
+	var ids []string
+	var elapsed time.Duration
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range setup {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		start := time.Now()
+		err := tx.Model(&DocumentChunk{}).
+			Where("embedding IS NOT NULL AND id <> ?", exclude).
+			Clauses(clause.OrderBy{Expression: clause.Expr{SQL: "embedding <-> ?", Vars: []interface{}{v}}}).
+			Limit(k).
+			Pluck("id", &ids).Error
+		elapsed = time.Since(start)
+		return err
+	})
+	return ids, elapsed, err
+}
+
+// TuneIndex measures recall against exact search and query latency for a
+// range of ef_search (hnsw) or probes (ivfflat) values, records the samples
+// and recommends the cheapest value that reaches the target recall.
+func (r *RAG) TuneIndex(ctx context.Context, opts *IndexTuneOptions) (*IndexTuneReport, error) {
+	report := &IndexTuneReport{}
+	err := r.DB.WithContext(ctx).Model(&DocumentChunk{}).Where("embedding IS NOT NULL").Count(&report.Chunks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	report.CurrentMaintenanceWorkMem, err = r.currentSetting(ctx, "maintenance_work_mem")
+	if err != nil {
+		return nil, err
+	}
+	report.RecommendedMaintenanceWorkMem = formatMB(estimateMaintenanceWorkMem(report.Chunks))
+
+	report.Index, err = r.vectorIndex(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find vector index")
+	}
+	if report.Index == nil {
+		report.Notes = append(report.Notes, "no hnsw or ivfflat index on embedding, queries use an exact scan")
+		return report, nil
+	}
+
+	values := opts.Values
+	switch report.Index.Method {
+	case IndexMethodHNSW:
+		report.Param = "hnsw.ef_search"
+		if len(values) == 0 {
+			values = defaultEfSearch
+		}
+		if slices.Min(values) < opts.K {
+			report.Notes = append(report.Notes, "ef_search values below k return fewer than k results")
+		}
+	case IndexMethodIVFFlat:
+		report.Param = "ivfflat.probes"
+		if len(values) == 0 {
+			values = defaultProbes
+		}
+		report.Notes = append(report.Notes,
+			fmt.Sprintf("ivfflat recall degrades as the corpus grows, consider rebuilding with lists=%d",
+				recommendedLists(report.Chunks)))
+	}
+	report.Current, err = r.currentSetting(ctx, report.Param)
+	if err != nil {
+		return nil, err
+	}
+
+	var queries []struct {
+		ID        string
+		Embedding pgvector.HalfVector
+	}
+	err = r.DB.WithContext(ctx).Model(&DocumentChunk{}).
+		Select("id, embedding").
+		Where("embedding IS NOT NULL").
+		Order("random()").
+		Limit(opts.Queries).
+		Find(&queries).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return report, nil
+	}
+
+	exact := make([]map[string]struct{}, len(queries))
+	for i, q := range queries {
+		ids, _, err := r.nearestIDs(ctx, q.Embedding, q.ID, opts.K,
+			"SET LOCAL enable_indexscan = off", "SET LOCAL enable_bitmapscan = off")
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to run exact search")
+		}
+		exact[i] = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			exact[i][id] = struct{}{}
+		}
+	}
+
+	for _, value := range values {
+		var found, expected int
+		latencies := make([]float64, 0, len(queries))
+		for i, q := range queries {
+			ids, elapsed, err := r.nearestIDs(ctx, q.Embedding, q.ID, opts.K,
+				fmt.Sprintf("SET LOCAL %s = %d", report.Param, value))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to run search with %s=%d", report.Param, value)
+			}
+			latencies = append(latencies, float64(elapsed.Microseconds())/1000)
+			expected += len(exact[i])
+			for _, id := range ids {
+				if _, ok := exact[i][id]; ok {
+					found++
+				}
+			}
+		}
+
+		latency := newDistribution(latencies)
+		sample := IndexTuneSample{
+			Index:   report.Index.Name,
+			Method:  report.Index.Method,
+			Chunks:  report.Chunks,
+			Param:   report.Param,
+			Value:   value,
+			K:       opts.K,
+			Queries: len(queries),
+			Recall:  1,
+			P50Ms:   latency.P50,
+			P95Ms:   latency.P95,
+		}
+		if expected > 0 {
+			sample.Recall = float64(found) / float64(expected)
+		}
+		report.Samples = append(report.Samples, sample)
+	}
+
+	err = r.DB.WithContext(ctx).Create(&report.Samples).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to record tune samples")
+	}
+
+	report.Recommended = report.Samples[len(report.Samples)-1].Value
+	for _, s := range report.Samples {
+		if s.Recall >= opts.TargetRecall {
+			report.Recommended = s.Value
+			break
+		}
+	}
+	if report.Samples[len(report.Samples)-1].Recall < opts.TargetRecall {
+		report.Notes = append(report.Notes, "target recall not reached with any value tried, try larger values")
+	}
+	return report, nil
+}
+
+// ApplyIndexTuning persists the recommended settings as database defaults,
+// taking effect for new connections.
+func (r *RAG) ApplyIndexTuning(ctx context.Context, report *IndexTuneReport) error {
+	var database string
+	err := r.DB.WithContext(ctx).Raw("SELECT current_database()").Scan(&database).Error
+	if err != nil {
+		return err
+	}
+	database = `"` + strings.ReplaceAll(database, `"`, `""`) + `"`
+
+	stmts := []string{
+		fmt.Sprintf("ALTER DATABASE %s SET maintenance_work_mem = '%s'", database, report.RecommendedMaintenanceWorkMem),
+	}
+	if report.Param != "" {
+		stmts = append(stmts, fmt.Sprintf("ALTER DATABASE %s SET %s = %d", database, report.Param, report.Recommended))
+	}
+	for _, stmt := range stmts {
+		if err := r.DB.WithContext(ctx).Exec(stmt).Error; err != nil {
+			return errors.Wrapf(err, "Failed to apply %q", stmt)
+		}
+	}
+	return nil
+}
+
+// IndexTuneHistory returns the most recent tune samples, newest first.
+func (r *RAG) IndexTuneHistory(ctx context.Context, limit int) ([]IndexTuneSample, error) {
+	var samples []IndexTuneSample
+	err := r.DB.WithContext(ctx).Order("created_at DESC, value").Limit(limit).Find(&samples).Error
+	return samples, err
+}
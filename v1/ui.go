@@ -0,0 +1,41 @@
+package rag
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+const uiPath = "/ui"
+
+// registerUI serves the single-page UI, which searches and chats through the
+// HTTP API with the API key entered on the page.
+func (s *Server) registerUI(e *echo.Echo) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	e.GET(uiPath, func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, uiPath+"/")
+	})
+	e.StaticFS(uiPath+"/", files)
+}
+
+// publicUI lets browsers load the UI without an API key, which they cannot
+// send when navigating, while the API calls it makes stay authenticated.
+func publicUI(m echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := m(next)
+		return func(c echo.Context) error {
+			if p := c.Path(); p == uiPath || p == uiPath+"/*" {
+				return next(c)
+			}
+			return h(c)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package rag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUI(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	s := NewServer(r, &ServerOptions{Auth: NewAuthenticator(r)})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/ui")
+	require.Equal(t, http.StatusMovedPermanently, rec.Code)
+	require.Equal(t, "/ui/", rec.Header().Get("Location"))
+
+	// the page loads without an API key, the API it calls does not
+	rec = get("/ui/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	require.Contains(t, rec.Body.String(), "/chat")
+	require.Equal(t, http.StatusOK, get("/ui/index.html").Code)
+	require.Equal(t, http.StatusNotFound, get("/ui/missing.js").Code)
+	require.Equal(t, http.StatusUnauthorized, get("/v1/collections").Code)
+}
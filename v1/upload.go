@@ -0,0 +1,65 @@
+package rag
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/labstack/echo/v4"
+)
+
+const maxUploadSize = 256 << 20
+
+func (s *Server) uploadHandler(c echo.Context) error {
+	// limit the body before the multipart form is parsed, which buffers it
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxUploadSize)
+	fh, err := c.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		return echo.NewHTTPError(http.StatusBadRequest, "file is required")
+	}
+	if err != nil {
+		return ingestBodyError(err)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	document, report, err := s.opts.Ingestor.Load(c.Request().Context(), fh.Filename, data)
+	if errors.Is(err, ErrUnsupportedContentType) {
+		return c.JSON(http.StatusUnsupportedMediaType, echo.Map{"error": err.Error(), "report": report})
+	}
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, echo.Map{"error": err.Error(), "report": report})
+	}
+
+	collection, err := s.ragOf(c).EnsureCollection(c.Request().Context(), s.collection(c), "")
+	if err != nil {
+		return err
+	}
+	document.Collection = collection.Name
+	document.TextSearchConfig = collection.TextSearchConfig
+	if tags := c.FormValue("tags"); tags != "" {
+		document.Tags = strings.Split(tags, ",")
+	}
+	if v := c.FormValue("timestamp"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "timestamp must be a RFC 3339 time")
+		}
+		document.Timestamp = &t
+	}
+	document.Fix()
+	err = s.ragOf(c).UpsertDocumentChunks(document)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, report)
+}
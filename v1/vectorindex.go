@@ -0,0 +1,280 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/cockroachdb/errors"
+	"gorm.io/gorm"
+)
+
+const vectorIndexName = "idx_document_chunks_embedding"
+
+// pgvector's defaults, see https://github.com/pgvector/pgvector#index-options
+const (
+	DefaultHNSWM              = 16
+	DefaultHNSWEfConstruction = 64
+)
+
+var ErrVectorIndexUnsupported = errors.New("vector indexes require PostgreSQL, SQLite always searches by exact scan")
+
+type VectorIndexOptions struct {
+	// Collection builds a partial index on the chunks of the collection with
+	// its distance metric. Empty builds the shared L2 index on all chunks,
+	// which serves the collections using l2.
+	Collection string
+	// Method is IndexMethodHNSW or IndexMethodIVFFlat.
+	Method string
+	// M and EfConstruction tune hnsw, zero uses pgvector's defaults.
+	M              int
+	EfConstruction int
+	// Lists tunes ivfflat, zero derives it from the number of embedded chunks.
+	Lists int
+	// MaintenanceWorkMem is used for the build, e.g. 2GB, empty keeps the server setting.
+	MaintenanceWorkMem string
+}
+
+func ParseIndexMethod(s string) (string, error) {
+	switch s {
+	case IndexMethodHNSW, IndexMethodIVFFlat:
+		return s, nil
+	default:
+		return "", errors.Newf("unknown index method: '%s', expected hnsw or ivfflat", s)
+	}
+}
+
+// recommendedLists follows pgvector's advice of rows / 1000 up to 1M rows and sqrt(rows) above.
+func recommendedLists(chunks int64) int {
+	lists := chunks / 1000
+	if chunks > 1_000_000 {
+		lists = int64(math.Sqrt(float64(chunks)))
+	}
+	return int(max(lists, 1))
+}
+
+// vectorIndexNameOf names the index of a collection, within the 63 bytes of
+// a Postgres identifier.
+func vectorIndexNameOf(collection string) string {
+	if collection == "" {
+		return vectorIndexName
+	}
+	name := vectorIndexName + "_" + collection
+	if len(name) > 63 {
+		name = vectorIndexName + "_" + hashString(collection)
+	}
+	return name
+}
+
+// vectorIndexDDL returns the statement building the index for opts ordering
+// by distance, whose zero values are filled with defaults for chunks
+// embedded chunks.
+func vectorIndexDDL(opts *VectorIndexOptions, chunks int64, distance string) (string, error) {
+	method, err := ParseIndexMethod(opts.Method)
+	if err != nil {
+		return "", err
+	}
+	var with string
+	switch method {
+	case IndexMethodHNSW:
+		if opts.Lists != 0 {
+			return "", errors.New("lists only applies to ivfflat")
+		}
+		m, ef := opts.M, opts.EfConstruction
+		if m == 0 {
+			m = DefaultHNSWM
+		}
+		if ef == 0 {
+			ef = max(DefaultHNSWEfConstruction, 2*m)
+		}
+		if m < 2 || m > 100 {
+			return "", errors.Newf("m must be between 2 and 100, got %d", m)
+		}
+		if ef < 2*m || ef > 1000 {
+			return "", errors.Newf("ef_construction must be between 2*m and 1000, got %d", ef)
+		}
+		with = fmt.Sprintf("m = %d, ef_construction = %d", m, ef)
+	case IndexMethodIVFFlat:
+		if opts.M != 0 || opts.EfConstruction != 0 {
+			return "", errors.New("m and ef_construction only apply to hnsw")
+		}
+		lists := opts.Lists
+		if lists == 0 {
+			lists = recommendedLists(chunks)
+		}
+		if lists < 1 || lists > 32768 {
+			return "", errors.Newf("lists must be between 1 and 32768, got %d", lists)
+		}
+		with = fmt.Sprintf("lists = %d", lists)
+	}
+	if opts.Collection == "" {
+		// the shared index serves tune and the collections ordering by <->
+		return fmt.Sprintf("CREATE INDEX CONCURRENTLY %s ON document_chunks USING %s (embedding halfvec_l2_ops) WITH (%s)",
+			vectorIndexName, method, with), nil
+	}
+	err = ValidateCollectionName(opts.Collection)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`CREATE INDEX CONCURRENTLY "%s" ON document_chunks USING %s (embedding %s) WITH (%s) `+
+		`WHERE collection = '%s'`, vectorIndexNameOf(opts.Collection), method, distanceOpclass(distance), with,
+		opts.Collection), nil
+}
+
+func (r *RAG) requireVectorIndexes() error {
+	if r.DB.Dialector.Name() == sqliteDialect {
+		return ErrVectorIndexUnsupported
+	}
+	return nil
+}
+
+// CreateVectorIndex builds the ANN index on the chunk embeddings without
+// blocking writes. There is at most one per collection and one shared, drop
+// it first to change its options.
+func (r *RAG) CreateVectorIndex(ctx context.Context, opts *VectorIndexOptions) (*VectorIndex, error) {
+	err := r.requireVectorIndexes()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := r.vectorIndex(ctx, opts.Collection)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find vector index")
+	}
+	if existing != nil {
+		return nil, errors.Newf("vector index %s already exists, drop it first", existing.Name)
+	}
+
+	distance := DistanceL2
+	if opts.Collection != "" {
+		var collections []Collection
+		err = r.DB.WithContext(ctx).Where("name = ?", opts.Collection).Find(&collections).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(collections) == 0 {
+			return nil, errors.Newf("collection '%s' does not exist", opts.Collection)
+		}
+		distance = collections[0].Distance
+	}
+
+	chunks, err := r.embeddedChunks(ctx, opts.Collection)
+	if err != nil {
+		return nil, err
+	}
+	ddl, err := vectorIndexDDL(opts, chunks, distance)
+	if err != nil {
+		return nil, err
+	}
+	name := vectorIndexNameOf(opts.Collection)
+
+	// SET applies to the session, so the build must run on the same connection
+	err = r.DB.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if opts.MaintenanceWorkMem != "" {
+			err := conn.Exec("SELECT set_config('maintenance_work_mem', ?, false)", opts.MaintenanceWorkMem).Error
+			if err != nil {
+				return err
+			}
+			defer func() { _ = conn.Exec("RESET maintenance_work_mem").Error }()
+		}
+		return conn.Exec(ddl).Error
+	})
+	if err != nil {
+		// an interrupted concurrent build leaves an invalid index behind
+		_ = r.DB.Exec(`DROP INDEX CONCURRENTLY IF EXISTS "` + name + `"`).Error
+		return nil, errors.Wrap(err, "Failed to create vector index")
+	}
+	return r.vectorIndex(ctx, opts.Collection)
+}
+
+// embeddedChunks counts the embedded chunks of a collection, of all
+// collections when it is empty.
+func (r *RAG) embeddedChunks(ctx context.Context, collection string) (int64, error) {
+	q := r.DB.WithContext(ctx).Model(&DocumentChunk{}).Where("embedding IS NOT NULL")
+	if collection != "" {
+		q = q.Where("collection = ?", collection)
+	}
+	var chunks int64
+	err := q.Count(&chunks).Error
+	return chunks, err
+}
+
+// DropVectorIndex drops the ANN index of a collection, or the shared one
+// with an empty collection. Searches fall back to exact scans.
+func (r *RAG) DropVectorIndex(ctx context.Context, collection string) (*VectorIndex, error) {
+	err := r.requireVectorIndexes()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.vectorIndex(ctx, collection)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find vector index")
+	}
+	if index == nil {
+		return nil, errors.New("no vector index to drop")
+	}
+	err = r.DB.WithContext(ctx).Exec(`DROP INDEX CONCURRENTLY IF EXISTS "` + index.Name + `"`).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to drop vector index")
+	}
+	return index, nil
+}
+
+type VectorIndexStatus struct {
+	// Index is nil when searches use exact scans.
+	Index *VectorIndex `json:"index"`
+	// Chunks is the number of embedded chunks the index covers.
+	Chunks int64 `json:"chunks"`
+
+	EfSearch           string `json:"ef_search"`
+	Probes             string `json:"probes"`
+	MaintenanceWorkMem string `json:"maintenance_work_mem"`
+
+	// Phase and the tuples counts report a build in progress, empty if none.
+	Phase       string `json:"phase,omitempty"`
+	TuplesDone  int64  `json:"tuples_done,omitempty"`
+	TuplesTotal int64  `json:"tuples_total,omitempty"`
+}
+
+// VectorIndexStatus returns the ANN index of a collection, or the shared one
+// with an empty collection, the search settings and the progress of a build
+// running on any connection.
+func (r *RAG) VectorIndexStatus(ctx context.Context, collection string) (*VectorIndexStatus, error) {
+	err := r.requireVectorIndexes()
+	if err != nil {
+		return nil, err
+	}
+	s := &VectorIndexStatus{}
+	s.Index, err = r.vectorIndex(ctx, collection)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to find vector index")
+	}
+	s.Chunks, err = r.embeddedChunks(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]*string{
+		"hnsw.ef_search":       &s.EfSearch,
+		"ivfflat.probes":       &s.Probes,
+		"maintenance_work_mem": &s.MaintenanceWorkMem,
+	} {
+		*value, err = r.currentSetting(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var progress []struct {
+		Phase       string
+		TuplesDone  int64
+		TuplesTotal int64
+	}
+	err = r.DB.WithContext(ctx).Raw(`SELECT phase, tuples_done, tuples_total FROM pg_stat_progress_create_index
+WHERE relid = 'document_chunks'::regclass`).Scan(&progress).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(progress) > 0 {
+		s.Phase, s.TuplesDone, s.TuplesTotal = progress[0].Phase, progress[0].TuplesDone, progress[0].TuplesTotal
+	}
+	return s, nil
+}
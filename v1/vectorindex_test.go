@@ -0,0 +1,52 @@
+package rag
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVectorIndexDDL(t *testing.T) {
+	ddl, err := vectorIndexDDL(&VectorIndexOptions{Method: IndexMethodHNSW}, 100, DistanceL2)
+	require.NoError(t, err)
+	require.Equal(t, "CREATE INDEX CONCURRENTLY idx_document_chunks_embedding ON document_chunks "+
+		"USING hnsw (embedding halfvec_l2_ops) WITH (m = 16, ef_construction = 64)", ddl)
+
+	ddl, err = vectorIndexDDL(&VectorIndexOptions{Method: IndexMethodHNSW, M: 48}, 100, DistanceL2)
+	require.NoError(t, err)
+	require.Contains(t, ddl, "WITH (m = 48, ef_construction = 96)")
+
+	ddl, err = vectorIndexDDL(&VectorIndexOptions{Method: IndexMethodIVFFlat}, 4_000_000, DistanceL2)
+	require.NoError(t, err)
+	require.Contains(t, ddl, "USING ivfflat (embedding halfvec_l2_ops) WITH (lists = 2000)")
+
+	// collections get a partial index with the opclass of their distance
+	ddl, err = vectorIndexDDL(&VectorIndexOptions{Method: IndexMethodHNSW, Collection: "manuals"}, 100, DistanceInnerProduct)
+	require.NoError(t, err)
+	require.Equal(t, `CREATE INDEX CONCURRENTLY "idx_document_chunks_embedding_manuals" ON document_chunks `+
+		`USING hnsw (embedding halfvec_ip_ops) WITH (m = 16, ef_construction = 64) WHERE collection = 'manuals'`, ddl)
+	require.LessOrEqual(t, len(vectorIndexNameOf(strings.Repeat("a", 60))), 63)
+
+	for _, opts := range []*VectorIndexOptions{
+		{Method: "flat"},
+		{Method: IndexMethodHNSW, M: 1},
+		{Method: IndexMethodHNSW, M: 16, EfConstruction: 16},
+		{Method: IndexMethodHNSW, Lists: 100},
+		{Method: IndexMethodIVFFlat, M: 16},
+		{Method: IndexMethodHNSW, Collection: "it's"},
+	} {
+		_, err = vectorIndexDDL(opts, 100, DistanceL2)
+		require.Error(t, err, "%+v", opts)
+	}
+}
+
+func TestVectorIndexSQLite(t *testing.T) {
+	db := newTestDB(t)
+	r := &RAG{DB: db}
+	_, err := r.CreateVectorIndex(context.Background(), &VectorIndexOptions{Method: IndexMethodHNSW})
+	require.ErrorIs(t, err, ErrVectorIndexUnsupported)
+	_, err = r.VectorIndexStatus(context.Background(), "")
+	require.ErrorIs(t, err, ErrVectorIndexUnsupported)
+}
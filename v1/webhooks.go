@@ -0,0 +1,253 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog/log"
+)
+
+type WebhookEvent string
+
+const (
+	// WebhookDocumentIngested is posted when the chunks of a document are upserted.
+	WebhookDocumentIngested WebhookEvent = "document.ingested"
+	// WebhookEmbeddingsComputed is posted when a batch of chunks is embedded
+	// with the active model, which makes them searchable by dense search.
+	WebhookEmbeddingsComputed WebhookEvent = "embeddings.computed"
+	// WebhookJobFailed is posted when an ingest job finishes with errors.
+	WebhookJobFailed WebhookEvent = "job.failed"
+)
+
+func ParseWebhookEvent(s string) (WebhookEvent, error) {
+	switch event := WebhookEvent(s); event {
+	case WebhookDocumentIngested, WebhookEmbeddingsComputed, WebhookJobFailed:
+		return event, nil
+	default:
+		return "", errors.Newf("unknown webhook event: '%s'", s)
+	}
+}
+
+// WebhookPayload is posted to webhooks as JSON.
+type WebhookPayload struct {
+	Event WebhookEvent `json:"event"`
+	Time  time.Time    `json:"time"`
+	// Documents are the documents ingested or embedded, Chunks the chunks
+	// ingested or embedded of all of them.
+	Documents []WebhookDocument `json:"documents,omitempty"`
+	Chunks    int               `json:"chunks"`
+	// Model is the embedding model of embeddings.computed.
+	Model string `json:"model,omitempty"`
+	// Job is the failed job of job.failed, its errors name the failed documents.
+	Job *IngestJob `json:"job,omitempty"`
+}
+
+type WebhookDocument struct {
+	Collection  string `json:"collection"`
+	Document    string `json:"document"`
+	RawDocument string `json:"raw_document,omitempty"`
+	Chunks      int    `json:"chunks"`
+}
+
+type WebhookOptions struct {
+	URLs []string
+	// Secret signs payloads with HMAC-SHA256 in the X-RAG-Signature header,
+	// see VerifyWebhook. Empty doesn't sign them.
+	Secret string
+	// Events are the events posted, empty posts all of them.
+	Events []string
+	// Timeout bounds every attempt to post a payload, failed attempts are
+	// retried up to MaxRetries times.
+	Timeout    time.Duration
+	MaxRetries int
+}
+
+// Webhooks post events of ingestion and embedding to downstream systems, e.g.
+// to invalidate their caches once new content is searchable. Payloads are
+// posted in the background, so they may arrive out of order; failed posts are
+// logged and don't fail what caused them.
+type Webhooks struct {
+	client *http.Client
+	urls   []string
+	secret []byte
+	events map[WebhookEvent]bool
+	wg     sync.WaitGroup
+}
+
+func NewWebhooks(opts *WebhookOptions) (*Webhooks, error) {
+	if len(opts.URLs) == 0 {
+		return nil, errors.New("webhooks require a URL")
+	}
+	for _, u := range opts.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, errors.Newf("invalid webhook URL: '%s'", u)
+		}
+	}
+	w := &Webhooks{
+		client: NewTransport(&TransportOptions{
+			Timeout:          opts.Timeout,
+			MaxRetries:       opts.MaxRetries,
+			BreakerThreshold: 5,
+			BreakerCooldown:  30 * time.Second,
+		}).Client(),
+		urls:   opts.URLs,
+		events: make(map[WebhookEvent]bool),
+	}
+	if opts.Secret != "" {
+		w.secret = []byte(opts.Secret)
+	}
+	for _, e := range opts.Events {
+		event, err := ParseWebhookEvent(e)
+		if err != nil {
+			return nil, err
+		}
+		w.events[event] = true
+	}
+	return w, nil
+}
+
+// Close waits for the payloads being posted.
+func (w *Webhooks) Close() error {
+	w.wg.Wait()
+	return nil
+}
+
+// WebhookTolerance is how old the X-RAG-Timestamp of a payload may be for
+// VerifyWebhook, it covers the retries of a post.
+const WebhookTolerance = 5 * time.Minute
+
+// WebhookSignature returns the X-RAG-Signature of a payload posted at
+// timestamp, in Unix seconds as in the X-RAG-Timestamp header: "sha256=" and
+// the hex HMAC-SHA256 of the timestamp, a dot and body with secret. Signing
+// the timestamp keeps captured payloads from being replayed later.
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a payload received with header, and
+// that it was posted at most tolerance ago, or WebhookTolerance if zero.
+func VerifyWebhook(secret []byte, header http.Header, body []byte, tolerance time.Duration) error {
+	if tolerance <= 0 {
+		tolerance = WebhookTolerance
+	}
+	timestamp := header.Get("X-RAG-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid webhook timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return errors.Newf("webhook timestamp is %s off", age.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(header.Get("X-RAG-Signature")), []byte(WebhookSignature(secret, timestamp, body))) {
+		return errors.New("invalid webhook signature")
+	}
+	return nil
+}
+
+// notify posts payload to every URL in the background, if its event is
+// posted. Nil webhooks post nothing.
+func (w *Webhooks) notify(payload *WebhookPayload) {
+	if w == nil || (len(w.events) > 0 && !w.events[payload.Event]) {
+		return
+	}
+	payload.Time = time.Now()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Str("event", string(payload.Event)).Msg("Encode webhook payload")
+		return
+	}
+	for _, u := range w.urls {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			err := w.post(u, payload.Event, body)
+			if err != nil {
+				log.Error().Err(err).Str("event", string(payload.Event)).Str("url", u).Msg("Post webhook")
+			}
+		}()
+	}
+}
+
+func (w *Webhooks) post(u string, event WebhookEvent, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-RAG-Event", string(event))
+	if w.secret != nil {
+		// retries send the same timestamp, within WebhookTolerance
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-RAG-Timestamp", timestamp)
+		req.Header.Set("X-RAG-Signature", WebhookSignature(w.secret, timestamp, body))
+	}
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	_ = rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return errors.Newf("webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+func (w *Webhooks) documentIngested(document *Document, chunks int) {
+	w.notify(&WebhookPayload{
+		Event: WebhookDocumentIngested,
+		Documents: []WebhookDocument{{
+			Collection:  document.Collection,
+			Document:    document.Document,
+			RawDocument: document.RawDocument,
+			Chunks:      chunks,
+		}},
+		Chunks: chunks,
+	})
+}
+
+// embeddingsComputed posts the documents of a batch of embedded chunks.
+func (w *Webhooks) embeddingsComputed(model string, chunks []DocumentChunk) {
+	if w == nil {
+		return
+	}
+	type key struct{ collection, document string }
+	index := make(map[key]int)
+	documents := make([]WebhookDocument, 0)
+	for _, c := range chunks {
+		k := key{c.Collection, c.Document}
+		i, ok := index[k]
+		if !ok {
+			i = len(documents)
+			index[k] = i
+			documents = append(documents, WebhookDocument{Collection: c.Collection, Document: c.Document})
+		}
+		documents[i].Chunks++
+	}
+	w.notify(&WebhookPayload{
+		Event:     WebhookEmbeddingsComputed,
+		Documents: documents,
+		Chunks:    len(chunks),
+		Model:     model,
+	})
+}
+
+func (w *Webhooks) jobFailed(job *IngestJob) {
+	w.notify(&WebhookPayload{Event: WebhookJobFailed, Job: job, Chunks: job.Chunks})
+}
@@ -0,0 +1,125 @@
+package rag
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[WebhookEvent][]WebhookPayload)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if VerifyWebhook([]byte("s3cret"), r.Header, body, 0) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload WebhookPayload
+		if json.Unmarshal(body, &payload) != nil || string(payload.Event) != r.Header.Get("X-RAG-Event") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received[payload.Event] = append(received[payload.Event], payload)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	_, err := NewWebhooks(&WebhookOptions{URLs: []string{"ftp://example.com"}})
+	require.ErrorContains(t, err, "invalid webhook URL")
+	_, err = NewWebhooks(&WebhookOptions{URLs: []string{ts.URL}, Events: []string{"document.deleted"}})
+	require.ErrorContains(t, err, "unknown webhook event")
+
+	db := newTestDB(t)
+	webhooks, err := NewWebhooks(&WebhookOptions{URLs: []string{ts.URL}, Secret: "s3cret"})
+	require.NoError(t, err)
+	r := &RAG{DB: db, Embedder: wordEmbedder{}, Webhooks: webhooks}
+	ctx := context.Background()
+
+	for _, name := range []string{"apples.md", "bananas.md"} {
+		d := &Document{FileName: name, Collection: "fruits", Chunks: []*DocumentChunk{
+			{Text: name + " one"}, {Text: name + " two"},
+		}}
+		upsertDocument(t, r, d)
+	}
+	require.NoError(t, r.ComputeEmbeddings(ctx, &ComputeOptions{OnlyEmpty: true, Concurrency: 1, BatchSize: 3,
+		Progress: func(int) {}}))
+
+	job, err := r.SubmitIngestJob(ctx, "fruits", &IngestRequest{Files: []IngestFile{{Name: "image.png", Data: []byte("\x89PNG\r\n\x1a\n")}}})
+	require.NoError(t, err)
+	job, err = r.claimIngestJob(ctx)
+	require.NoError(t, err)
+	r.runIngestJob(ctx, NewIngestor(), job)
+	require.NoError(t, webhooks.Close())
+
+	ingested := received[WebhookDocumentIngested]
+	require.Len(t, ingested, 2)
+	slices.SortFunc(ingested, func(a, b WebhookPayload) int {
+		return cmp.Compare(a.Documents[0].RawDocument, b.Documents[0].RawDocument)
+	})
+	require.Equal(t, []WebhookDocument{{Collection: "fruits", Document: ingested[0].Documents[0].Document,
+		RawDocument: "apples.md", Chunks: 2}}, ingested[0].Documents)
+	require.Equal(t, 2, ingested[0].Chunks)
+	require.False(t, ingested[0].Time.IsZero())
+
+	embedded := 0
+	documents := make(map[string]int)
+	for _, p := range received[WebhookEmbeddingsComputed] {
+		embedded += p.Chunks
+		for _, d := range p.Documents {
+			documents[d.Document] += d.Chunks
+		}
+	}
+	require.Len(t, received[WebhookEmbeddingsComputed], 2)
+	require.Equal(t, 4, embedded)
+	require.Equal(t, map[string]int{ingested[0].Documents[0].Document: 2, ingested[1].Documents[0].Document: 2}, documents)
+
+	failed := received[WebhookJobFailed]
+	require.Len(t, failed, 1)
+	require.Equal(t, job.ID, failed[0].Job.ID)
+	require.Equal(t, JobFailed, failed[0].Job.Status)
+	require.Equal(t, "image.png", failed[0].Job.Errors[0].Document)
+
+	// only the chosen events are posted
+	clear(received)
+	r.Webhooks, err = NewWebhooks(&WebhookOptions{URLs: []string{ts.URL}, Secret: "s3cret",
+		Events: []string{string(WebhookJobFailed)}})
+	require.NoError(t, err)
+	d := &Document{FileName: "cherries.md", Collection: "fruits", Chunks: []*DocumentChunk{{Text: "cherries"}}}
+	upsertDocument(t, r, d)
+	require.NoError(t, r.Webhooks.Close())
+	require.Empty(t, received)
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	secret, body := []byte("s3cret"), []byte(`{"event":"job.failed"}`)
+	signed := func(at time.Time, body []byte) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		header := make(http.Header)
+		header.Set("X-RAG-Timestamp", timestamp)
+		header.Set("X-RAG-Signature", WebhookSignature(secret, timestamp, body))
+		return header
+	}
+	require.NoError(t, VerifyWebhook(secret, signed(time.Now(), body), body, 0))
+	require.ErrorContains(t, VerifyWebhook([]byte("other"), signed(time.Now(), body), body, 0), "invalid webhook signature")
+	require.ErrorContains(t, VerifyWebhook(secret, signed(time.Now(), []byte("{}")), body, 0), "invalid webhook signature")
+
+	// a captured delivery can't be replayed later, nor its timestamp moved
+	stale := signed(time.Now().Add(-10*time.Minute), body)
+	require.ErrorContains(t, VerifyWebhook(secret, stale, body, 0), "timestamp")
+	require.NoError(t, VerifyWebhook(secret, stale, body, time.Hour))
+	stale.Set("X-RAG-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	require.ErrorContains(t, VerifyWebhook(secret, stale, body, 0), "invalid webhook signature")
+	require.ErrorContains(t, VerifyWebhook(secret, http.Header{}, body, 0), "invalid webhook timestamp")
+}